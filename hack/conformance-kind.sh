@@ -0,0 +1,42 @@
+#!/usr/bin/env bash
+# Runs the conformance checks against a server talking to a kind cluster:
+# creates the cluster and a pod, starts the server with the kind kubeconfig
+# and runs the conformance tests against it. KEEP_CLUSTER=1 keeps the cluster.
+set -euo pipefail
+
+cluster=${CLUSTER:-terminal-conformance}
+port=${PORT:-18000}
+workdir=$(mktemp -d)
+kubeconfig="$workdir/kubeconfig"
+
+cleanup() {
+	[ -n "${server_pid:-}" ] && kill "$server_pid" 2>/dev/null || true
+	[ -z "${KEEP_CLUSTER:-}" ] && kind delete cluster --name "$cluster" >/dev/null 2>&1 || true
+	rm -rf "$workdir"
+}
+trap cleanup EXIT
+
+if ! kind get clusters | grep -qx "$cluster"; then
+	kind create cluster --name "$cluster" --wait 120s
+fi
+kind get kubeconfig --name "$cluster" > "$kubeconfig"
+kubectl --kubeconfig "$kubeconfig" run conformance --image=busybox:1.36 --restart=Never \
+	--command -- sleep 3600 2>/dev/null || true
+kubectl --kubeconfig "$kubeconfig" wait --for=condition=Ready pod/conformance --timeout=120s
+
+go build -o "$workdir/terminal-server" .
+go test -c -tags conformance -o "$workdir/conformance.test" ./pkg/terminal/conformance
+"$workdir/terminal-server" -addr "127.0.0.1:$port" -kubeconfig "$kubeconfig" > "$workdir/server.log" 2>&1 &
+server_pid=$!
+for _ in $(seq 50); do
+	curl -fs "http://127.0.0.1:$port/version" >/dev/null && break
+	sleep 0.2
+done
+
+# the server runs with the built-in JWT key, so the checks sign their token
+if ! "$workdir/conformance.test" -test.v -url "http://127.0.0.1:$port" -namespace default -pod conformance \
+	-sign-token conformance "$@"; then
+	echo "--- server log" >&2
+	tail -n 50 "$workdir/server.log" >&2
+	exit 1
+fi
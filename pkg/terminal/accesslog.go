@@ -0,0 +1,147 @@
+package terminal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	accessLogEnabled = Flags.Bool("access-log", true, "write an access log line per request to stdout")
+	accessLogFormat  = Flags.String("access-log-format", "json",
+		`format of the access log: "json" or "combined", the Apache combined log format`)
+	accessLogRedact = Flags.String("access-log-redact", "jwtToken,token,access_token,presigned",
+		"comma separated query parameters whose values are replaced in the access log")
+	accessLogSample = Flags.Float64("access-log-sample", 1,
+		"fraction of successful requests that are logged, failed requests are always logged")
+)
+
+var accessLogger = log.New(os.Stdout, "", 0)
+
+// AccessEntry is one line of the access log
+type AccessEntry struct {
+	Time       time.Time `json:"time"`
+	Method     string    `json:"method"`
+	Route      string    `json:"route"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	Bytes      int       `json:"bytes"`
+	DurationMs float64   `json:"durationMs"`
+	User       string    `json:"user,omitempty"`
+	// Remote is the IP address of the client, or of the proxy in front of
+	// the server unless it is one of -trusted-proxies
+	Remote    string `json:"remote"`
+	Referer   string `json:"referer,omitempty"`
+	UserAgent string `json:"userAgent,omitempty"`
+	proto     string
+}
+
+type accessEntryKey struct{}
+
+// AccessLog is a middleware logging every request once it was served
+// Handlers attach the user with SetAccessUser, the route is attached by RecordRoute
+func AccessLog(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if !*accessLogEnabled {
+		next(w, r)
+		return
+	}
+	entry := &AccessEntry{
+		Time:      time.Now(),
+		Method:    r.Method,
+		Path:      redactedPath(r.URL),
+		Remote:    ClientIP(r),
+		Referer:   r.Referer(),
+		UserAgent: r.UserAgent(),
+		proto:     r.Proto,
+	}
+	next(w, r.WithContext(context.WithValue(r.Context(), accessEntryKey{}, entry)))
+
+	entry.DurationMs = float64(time.Since(entry.Time)) / float64(time.Millisecond)
+	entry.Status = http.StatusOK
+	if rw, ok := w.(interface{ Status() int }); ok && rw.Status() != 0 {
+		entry.Status = rw.Status()
+	}
+	if rw, ok := w.(interface{ Size() int }); ok {
+		entry.Bytes = rw.Size()
+	}
+	if entry.Status < 400 && rand.Float64() >= *accessLogSample {
+		return
+	}
+	if *accessLogFormat == "combined" {
+		accessLogger.Println(entry.combined())
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Println("AccessLog err", err)
+		return
+	}
+	accessLogger.Println(string(data))
+}
+
+// combined formats e in the combined log format, the duration is appended in
+// milliseconds
+func (e *AccessEntry) combined() string {
+	return fmt.Sprintf("%s - %s [%s] %q %d %d %q %q %.3f", e.Remote, orDash(e.User),
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"), e.Method+" "+e.Path+" "+e.proto,
+		e.Status, e.Bytes, orDash(e.Referer), orDash(e.UserAgent), e.DurationMs)
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// ValidateAccessLog checks -access-log-format
+func ValidateAccessLog() error {
+	switch *accessLogFormat {
+	case "json", "combined":
+		return nil
+	}
+	return fmt.Errorf("unknown access log format %q", *accessLogFormat)
+}
+
+// RecordRoute is a router middleware adding the matched route template to the
+// access log entry, so requests can be grouped without their variables
+func RecordRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if entry, ok := r.Context().Value(accessEntryKey{}).(*AccessEntry); ok {
+			if route := mux.CurrentRoute(r); route != nil {
+				entry.Route, _ = route.GetPathTemplate()
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// SetAccessUser records the authenticated user of a request in the access log
+func SetAccessUser(r *http.Request, user string) {
+	if entry, ok := r.Context().Value(accessEntryKey{}).(*AccessEntry); ok {
+		entry.User = user
+	}
+}
+
+// redactedPath returns the path and query of u with the values of sensitive
+// query parameters replaced
+func redactedPath(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.Path
+	}
+	query := u.Query()
+	for _, name := range splitList(*accessLogRedact) {
+		if _, ok := query[name]; ok {
+			query.Set(name, "REDACTED")
+		}
+	}
+	return u.Path + "?" + query.Encode()
+}
@@ -0,0 +1,88 @@
+package terminal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+var (
+	// ErrStandbyInstance is returned for terminals requested from a standby instance
+	ErrStandbyInstance = errors.New("standby instance does not serve terminals")
+	// ErrSessionLimit is returned when a user exceeded the session rate limit or quota
+	ErrSessionLimit = errors.New("too many terminal sessions")
+	// ErrTerminalRequired is returned for access without a terminal to the
+	// namespaces of -approval-namespaces and -mfa-namespaces
+	ErrTerminalRequired = errors.New("the namespace needs an approval or MFA code, open a terminal first")
+)
+
+// admitTerminal runs the checks of the terminal websocket endpoint for the
+// clients of the other protocols, and returns the meta of their session with
+// the container the terminal runs in. Viewers get read-only sessions
+func admitTerminal(ctx context.Context, kube *KubeClient, claims *MyCustomClaims,
+	namespace string, pod string, container string) (SessionMeta, error) {
+
+	if IsStandby() {
+		return SessionMeta{}, ErrStandbyInstance
+	}
+	if !claims.AllowsNamespace(namespace) {
+		return SessionMeta{}, ErrNamespaceForbidden
+	}
+	if !DockerBackend() && !kube.Available() {
+		return SessionMeta{}, ErrClusterUnavailable
+	}
+	if err := AuditAvailable(); err != nil {
+		return SessionMeta{}, err
+	}
+	if !AllowSession(claims.Subject) {
+		return SessionMeta{}, ErrSessionLimit
+	}
+	if SessionQueueFull() {
+		return SessionMeta{}, ErrSessionQueueFull
+	}
+	if IsAutoContainer(container) && !DockerBackend() {
+		var err error
+		if container, err = kube.ResolveContainer(ctx, namespace, pod); err != nil {
+			return SessionMeta{}, err
+		}
+	}
+	return SessionMeta{
+		User:      claims.Subject,
+		Role:      claims.Role,
+		Namespace: namespace,
+		Pod:       pod,
+		Container: container,
+		SafeMode:  IsSafeModeRole(claims.Role),
+		ReadOnly:  claims.Role == RoleViewer,
+		Claims:    claims,
+	}, nil
+}
+
+// admitWithoutTerminal checks access to a pod that doesn't go through a
+// terminal, like SSH exec, uploads, file listings and port-forwards. Nothing
+// shows their approval's progress or prompts for their MFA code, so they are
+// refused where terminals need one
+func admitWithoutTerminal(namespace string) error {
+	if ApprovalRequired(namespace) || MFARequired(namespace) {
+		return ErrTerminalRequired
+	}
+	return nil
+}
+
+// authenticateHeader runs the authenticator chain on credentials that came
+// in another protocol, like gRPC metadata or an SSH password
+func authenticateHeader(ctx context.Context, header http.Header) (*MyCustomClaims, error) {
+	r, err := http.NewRequestWithContext(ctx, "GET", "/", nil)
+	if err != nil {
+		return nil, err
+	}
+	r.Header = header
+	for _, a := range authenticators {
+		claims, err := a.Authenticate(r)
+		if err == ErrNoCredentials {
+			continue
+		}
+		return claims, err
+	}
+	return nil, ErrNoCredentials
+}
@@ -0,0 +1,104 @@
+package terminal
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+)
+
+// Error codes of the API besides the ExecErrorCodes, clients should switch on
+// the code instead of the message
+const (
+	ErrCodeTokenInvalid       = "TOKEN_INVALID"
+	ErrCodeTokenExpired       = "TOKEN_EXPIRED"
+	ErrCodeNamespaceForbidden = "NAMESPACE_FORBIDDEN"
+	ErrCodeClusterUnavailable = "CLUSTER_UNAVAILABLE"
+	ErrCodeStandby            = "STANDBY"
+	ErrCodeSessionLimit       = "SESSION_LIMIT"
+	ErrCodeReasonRequired     = "REASON_REQUIRED"
+	ErrCodeContinueExpired    = "CONTINUE_EXPIRED"
+	ErrCodeAuditUnavailable   = "AUDIT_UNAVAILABLE"
+)
+
+// statusCodes are the codes of errors without a more specific one
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            "INVALID_REQUEST",
+	http.StatusUnauthorized:          "UNAUTHENTICATED",
+	http.StatusForbidden:             "FORBIDDEN",
+	http.StatusNotFound:              "NOT_FOUND",
+	http.StatusMethodNotAllowed:      "METHOD_NOT_ALLOWED",
+	http.StatusConflict:              "CONFLICT",
+	http.StatusRequestEntityTooLarge: "TOO_LARGE",
+	http.StatusUnprocessableEntity:   "UNPROCESSABLE",
+	http.StatusTooManyRequests:       "RATE_LIMITED",
+	http.StatusInternalServerError:   "INTERNAL",
+	http.StatusNotImplemented:        "NOT_IMPLEMENTED",
+	http.StatusBadGateway:            "UPSTREAM_ERROR",
+	http.StatusServiceUnavailable:    "UNAVAILABLE",
+}
+
+// StatusErrorCode returns the error code of an HTTP status
+func StatusErrorCode(status int) string {
+	if code, ok := statusCodes[status]; ok {
+		return code
+	}
+	return "HTTP_" + strconv.Itoa(status)
+}
+
+// APIError is the body of every error response:
+// {"error":{"code":"POD_NOT_FOUND","message":"..."}}
+type APIError struct {
+	Error APIErrorDetail `json:"error"`
+}
+
+// APIErrorDetail describes an error
+type APIErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// WriteError replaces http.Error, the code is derived from status
+func WriteError(w http.ResponseWriter, message string, status int) {
+	WriteErrorCode(w, "", message, status)
+}
+
+// WriteErrorCode answers with the error envelope, an empty code is derived
+// from status
+func WriteErrorCode(w http.ResponseWriter, code string, message string, status int) {
+	if code == "" {
+		code = StatusErrorCode(status)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(APIError{Error: APIErrorDetail{Code: code, Message: message}})
+}
+
+// WriteTerminalError answers a terminal request with an error. Browsers don't
+// show websocket clients the response of a failed upgrade, so a websocket
+// request is upgraded to send the error as error message before it is closed
+func WriteTerminalError(w http.ResponseWriter, r *http.Request, code string, message string, status int) {
+	if _, ok := w.(*authMessageWriter); ok || !websocket.IsWebSocketUpgrade(r) {
+		WriteErrorCode(w, code, message, status)
+		return
+	}
+	conn, err := upgradeWebsocket(w, r)
+	if err != nil {
+		// the upgrader answered the request already
+		return
+	}
+	if code == "" {
+		code = StatusErrorCode(status)
+	}
+	closeWithError(conn, code, message)
+}
+
+// closeWithError sends an error message and closes the websocket
+func closeWithError(conn *websocket.Conn, code string, message string) {
+	conn.WriteJSON(TerminalMessage{Op: "error", Code: code, Data: message})
+	conn.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.ClosePolicyViolation, ""))
+	conn.Close()
+}
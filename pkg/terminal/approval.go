@@ -0,0 +1,335 @@
+package terminal
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	approvalNamespaces = Flags.String("approval-namespaces", "",
+		"comma separated namespaces whose terminals wait for a second person's approval, a trailing * matches a prefix")
+	approvalTimeout = Flags.Duration("approval-timeout", 15*time.Minute,
+		"how long a terminal waits for its approval before it is refused")
+	approvalSlackWebhook = Flags.String("approval-slack-webhook", "",
+		"Slack incoming webhook URL approval requests are posted to with approve and deny buttons")
+	approvalSlackSecret = Flags.String("approval-slack-signing-secret", "",
+		"signing secret of the Slack app whose buttons answer approval requests")
+	approvalSlackUsers = Flags.String("approval-slack-users", "",
+		"comma separated SLACK_USER_ID=user pairs, the terminal users Slack users answer approvals as, others can't answer")
+	approvalApprovers = Flags.String("approval-approvers", "",
+		"comma separated users who may answer approvals, required for Slack, admins answer in the API if empty")
+)
+
+// slackMaxSkew bounds the age of signed Slack requests, older ones may be replays
+const slackMaxSkew = 5 * time.Minute
+
+var (
+	ErrApprovalDenied  = errors.New("the terminal was not approved")
+	ErrApprovalTimeout = errors.New("timed out waiting for an approval of the terminal")
+	// ErrApprovalNotFound is returned for approvals that were answered or gave up
+	ErrApprovalNotFound = errors.New("approval request not found")
+	// ErrSelfApproval is returned when users answer their own approval request
+	ErrSelfApproval = errors.New("terminals must be approved by somebody else")
+	// ErrNotApprover is returned for users beyond -approval-approvers
+	ErrNotApprover        = errors.New("not allowed to answer approval requests")
+	ErrSlackNotConfigured = errors.New("slack approvals are not configured")
+	ErrSlackSignature     = errors.New("invalid slack signature")
+)
+
+// Approval is a terminal waiting for a second person to approve it
+type Approval struct {
+	ID        string            `json:"id"`
+	Session   string            `json:"session"`
+	User      string            `json:"user"`
+	Namespace string            `json:"namespace"`
+	Pod       string            `json:"pod"`
+	Container string            `json:"container"`
+	Reason    string            `json:"reason,omitempty"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	Requested time.Time         `json:"requested"`
+	Expires   time.Time         `json:"expires"`
+
+	answer chan approvalAnswer
+}
+
+type approvalAnswer struct {
+	approved bool
+	approver string
+}
+
+var approvals = struct {
+	lock    sync.Mutex
+	pending map[string]*Approval
+}{pending: make(map[string]*Approval)}
+
+// ApprovalRequired reports whether terminals in namespace need an approval
+func ApprovalRequired(namespace string) bool {
+	return namespaceMatches(splitList(*approvalNamespaces), namespace)
+}
+
+// ListApprovals returns the pending approvals, oldest first, of all replicas
+// with -session-registry redis
+func ListApprovals() []Approval {
+	if registryEnabled() {
+		list, err := registeredApprovals()
+		if err == nil {
+			sort.Slice(list, func(i, j int) bool { return list[i].Requested.Before(list[j].Requested) })
+			return list
+		}
+		log.Println("ListApprovals registry err", err)
+	}
+	approvals.lock.Lock()
+	list := make([]Approval, 0, len(approvals.pending))
+	for _, a := range approvals.pending {
+		list = append(list, *a)
+	}
+	approvals.lock.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Requested.Before(list[j].Requested) })
+	return list
+}
+
+// approverAllowed reports whether user may answer approvals, anybody who
+// reached AnswerApproval may if -approval-approvers is empty
+func approverAllowed(user string) bool {
+	approvers := splitList(*approvalApprovers)
+	if len(approvers) == 0 {
+		return true
+	}
+	for _, approver := range approvers {
+		if approver == user {
+			return true
+		}
+	}
+	return false
+}
+
+// AnswerApproval approves or denies the approval id on behalf of approver,
+// who must not be the user of the terminal
+func AnswerApproval(id string, approver string, approved bool) error {
+	if !approverAllowed(approver) {
+		return ErrNotApprover
+	}
+	if registryEnabled() {
+		return answerRegisteredApproval(id, approver, approved)
+	}
+	return answerLocalApproval(id, approver, approved)
+}
+
+// answerLocalApproval hands the answer to a terminal of this replica
+func answerLocalApproval(id string, approver string, approved bool) error {
+	approvals.lock.Lock()
+	defer approvals.lock.Unlock()
+	a, ok := approvals.pending[id]
+	if !ok {
+		return ErrApprovalNotFound
+	}
+	if a.User == approver {
+		return ErrSelfApproval
+	}
+	delete(approvals.pending, id)
+	// buffered, the terminal reads it unless it gave up in the meantime
+	a.answer <- approvalAnswer{approved, approver}
+	return nil
+}
+
+// awaitApproval holds the terminal of a namespace of -approval-namespaces
+// until somebody else approved it, the user sees the progress in the terminal
+func (t *TerminalSession) awaitApproval() error {
+	if !ApprovalRequired(t.meta.Namespace) {
+		return nil
+	}
+	id, _ := GenTerminalSessionId()
+	a := &Approval{
+		ID:        id,
+		Session:   t.id,
+		User:      t.meta.User,
+		Namespace: t.meta.Namespace,
+		Pod:       t.meta.Pod,
+		Container: t.meta.Container,
+		Reason:    t.meta.Reason,
+		Tags:      t.meta.Tags,
+		Requested: time.Now(),
+		Expires:   time.Now().Add(*approvalTimeout),
+		answer:    make(chan approvalAnswer, 1),
+	}
+	approvals.lock.Lock()
+	approvals.pending[id] = a
+	approvals.lock.Unlock()
+	registerApproval(a)
+	defer func() {
+		approvals.lock.Lock()
+		delete(approvals.pending, id)
+		approvals.lock.Unlock()
+		unregisterApproval(id)
+	}()
+
+	audit(t.auditEvent("approval.request", map[string]string{"approval": id}))
+	t.Toast(fmt.Sprintf("Terminals in %s need an approval, waiting for somebody to approve request %s\r\n",
+		t.meta.Namespace, id))
+	if *approvalSlackWebhook != "" {
+		go func() {
+			if err := notifySlack(a); err != nil {
+				log.Println("awaitApproval slack err", err)
+			}
+		}()
+	}
+
+	timeout := time.NewTimer(*approvalTimeout)
+	defer timeout.Stop()
+	select {
+	case answer := <-a.answer:
+		if !answer.approved {
+			audit(t.auditEvent("approval.deny", map[string]string{"approval": id, "approver": answer.approver}))
+			t.Toast(fmt.Sprintf("Denied by %s\r\n", answer.approver))
+			return ErrApprovalDenied
+		}
+		audit(t.auditEvent("approval.approve", map[string]string{"approval": id, "approver": answer.approver}))
+		t.Toast(fmt.Sprintf("Approved by %s\r\n", answer.approver))
+		return nil
+	case <-timeout.C:
+		audit(t.auditEvent("approval.timeout", map[string]string{"approval": id}))
+		t.Toast("Nobody approved the terminal in time\r\n")
+		return ErrApprovalTimeout
+	case <-t.ctx.Done():
+		return t.ctx.Err()
+	}
+}
+
+// notifySlack posts an approval request with approve and deny buttons
+func notifySlack(a *Approval) error {
+	text := fmt.Sprintf("*%s* asks for a terminal in `%s/%s` (container `%s`)", a.User, a.Namespace, a.Pod,
+		a.Container)
+	if a.Reason != "" {
+		text += "\nReason: " + a.Reason
+	}
+	button := func(label string, action string, style string) map[string]interface{} {
+		return map[string]interface{}{
+			"type":      "button",
+			"text":      map[string]string{"type": "plain_text", "text": label},
+			"action_id": action,
+			"value":     a.ID,
+			"style":     style,
+		}
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"text": text,
+		"blocks": []interface{}{
+			map[string]interface{}{"type": "section", "text": map[string]string{"type": "mrkdwn", "text": text}},
+			map[string]interface{}{"type": "actions", "elements": []interface{}{
+				button("Approve", "approve", "primary"),
+				button("Deny", "deny", "danger"),
+			}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	client, err := EgressClient(30 * time.Second)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(*approvalSlackWebhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("slack webhook: %s", resp.Status)
+	}
+	return nil
+}
+
+// slackInteraction is the part of a Slack block_actions payload approvals use
+type slackInteraction struct {
+	User struct {
+		ID       string `json:"id"`
+		Username string `json:"username"`
+	} `json:"user"`
+	Actions []struct {
+		ActionID string `json:"action_id"`
+		Value    string `json:"value"`
+	} `json:"actions"`
+}
+
+// slackApprover returns the terminal user of a Slack user id, Slack names
+// can be changed by their users so only ids are mapped
+func slackApprover(slackId string) (string, bool) {
+	for _, pair := range splitList(*approvalSlackUsers) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) == 2 && parts[0] == slackId && parts[1] != "" {
+			return parts[1], true
+		}
+	}
+	return "", false
+}
+
+// AnswerSlackApproval handles a click on the buttons of the approval requests
+// posted to Slack and returns the text replacing the request. Requests are
+// authenticated with the signature of the Slack app, the approver is the
+// terminal user -approval-slack-users maps the Slack user to, who must be one
+// of -approval-approvers
+func AnswerSlackApproval(header http.Header, body []byte) (string, error) {
+	if *approvalSlackSecret == "" {
+		return "", ErrSlackNotConfigured
+	}
+	if !validSlackSignature(header, body, time.Now()) {
+		return "", ErrSlackSignature
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidInput, err)
+	}
+	var payload slackInteraction
+	if err := json.Unmarshal([]byte(form.Get("payload")), &payload); err != nil {
+		return "", fmt.Errorf("%w: invalid slack payload", ErrInvalidInput)
+	}
+	approver, ok := slackApprover(payload.User.ID)
+	if !ok || *approvalApprovers == "" {
+		// without an allowlist every member of the channel could approve
+		return ErrNotApprover.Error(), nil
+	}
+	text := ""
+	for _, action := range payload.Actions {
+		err := AnswerApproval(action.Value, approver, action.ActionID == "approve")
+		switch {
+		case err == ErrSelfApproval || err == ErrNotApprover:
+			text = err.Error()
+		case err != nil:
+			text = "This request was answered already or gave up"
+		case action.ActionID == "approve":
+			text = "Approved by " + approver
+		default:
+			text = "Denied by " + approver
+		}
+	}
+	return text, nil
+}
+
+// validSlackSignature checks the X-Slack-Signature of a request body
+func validSlackSignature(header http.Header, body []byte, now time.Time) bool {
+	timestamp := header.Get("X-Slack-Request-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if skew := now.Sub(time.Unix(seconds, 0)); skew > slackMaxSkew || skew < -slackMaxSkew {
+		return false
+	}
+	expected := "v0=" + hex.EncodeToString(hmacSHA256([]byte(*approvalSlackSecret), "v0:"+timestamp+":"+string(body)))
+	return hmac.Equal([]byte(expected), []byte(header.Get("X-Slack-Signature")))
+}
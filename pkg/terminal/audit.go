@@ -0,0 +1,432 @@
+package terminal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"log/syslog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	auditSink = Flags.String("audit-sink", "",
+		`where audit events are delivered: "webhook" or "syslog", auditing is off if empty`)
+	auditWebhookURL = Flags.String("audit-webhook-url", "", "URL audit events are POSTed to with -audit-sink webhook")
+	auditSyslogAddr = Flags.String("audit-syslog-addr", "",
+		"syslog server of -audit-sink syslog as udp://host:514 or tcp://host:514, the local syslog if empty")
+	auditSpoolDir = Flags.String("audit-spool-dir", "/var/lib/terminal/audit",
+		"directory of the spool keeping audit events until the sink accepted them, it must survive restarts")
+	auditFailClosed = Flags.Bool("audit-fail-closed", false,
+		"end sessions whose audit events can't be spooled and refuse terminals while auditing fails")
+	auditMaxBacklog = Flags.Int("audit-max-backlog", 10000,
+		"undelivered audit events above which -audit-fail-closed refuses terminals")
+)
+
+// ErrAuditUnavailable is returned for terminals refused by -audit-fail-closed
+var ErrAuditUnavailable = errors.New("audit events can't be recorded, terminals are refused")
+
+// auditCompactSize is the spool size above which it is truncated once every
+// event was delivered
+const auditCompactSize = 64 << 20
+
+// AuditEvent is a security relevant action in a terminal session
+// Seq numbers the events without gaps, so sinks can tell that none is missing
+type AuditEvent struct {
+	Seq       uint64            `json:"seq"`
+	Time      time.Time         `json:"time"`
+	Type      string            `json:"type"`
+	SessionID string            `json:"sessionId,omitempty"`
+	User      string            `json:"user,omitempty"`
+	Namespace string            `json:"namespace,omitempty"`
+	Pod       string            `json:"pod,omitempty"`
+	Container string            `json:"container,omitempty"`
+	Details   map[string]string `json:"details,omitempty"`
+}
+
+// AuditSink delivers events, an error makes the spool retry the same event
+type AuditSink interface {
+	Deliver(event []byte) error
+}
+
+// auditCursor is how far the spool was delivered, it is saved after every
+// delivered event
+type auditCursor struct {
+	Offset int64  `json:"offset"`
+	Seq    uint64 `json:"seq"`
+}
+
+// auditSpool is a write-ahead log of audit events. Events are appended and
+// synced to disk before Audit returns, and delivered strictly in order by a
+// single goroutine that retries an event until the sink accepts it
+type auditSpool struct {
+	lock    sync.Mutex
+	file    *os.File
+	size    int64
+	seq     uint64
+	backlog int
+	wake    chan struct{}
+	sink    AuditSink
+	// failed is the last error spooling an event, nil once one was spooled
+	failed error
+}
+
+var spool *auditSpool
+
+func (s *auditSpool) spoolPath() string  { return filepath.Join(*auditSpoolDir, "audit.log") }
+func (s *auditSpool) cursorPath() string { return filepath.Join(*auditSpoolDir, "audit.cursor") }
+
+// StartAudit opens the spool and starts delivering the events left from a
+// previous run before the new ones
+func StartAudit() error {
+	if *auditSink == "" {
+		return nil
+	}
+	sink, err := newAuditSink()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(*auditSpoolDir, 0700); err != nil {
+		return err
+	}
+	// other users could read or drop the undelivered events
+	if info, err := os.Stat(*auditSpoolDir); err != nil {
+		return err
+	} else if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("-audit-spool-dir %s must only be accessible to its owner, not %v",
+			*auditSpoolDir, info.Mode().Perm())
+	}
+	s := &auditSpool{sink: sink, wake: make(chan struct{}, 1)}
+	s.file, err = os.OpenFile(s.spoolPath(), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	cursor, err := s.loadCursor()
+	if err != nil {
+		return err
+	}
+	// count what is still to deliver and continue the sequence
+	s.seq = cursor.Seq
+	events, err := s.readFrom(cursor.Offset, -1)
+	if err != nil {
+		return err
+	}
+	for _, e := range events {
+		s.seq = e.seq
+	}
+	if s.size, err = s.terminateTornLine(); err != nil {
+		return err
+	}
+	s.backlog = len(events)
+	auditBacklog.Set(float64(s.backlog))
+	spool = s
+	go s.deliver(cursor)
+	return nil
+}
+
+// terminateTornLine ends a line partly written before a crash, so the next
+// event starts on a line of its own. It returns the size of the spool
+func (s *auditSpool) terminateTornLine() (int64, error) {
+	info, err := s.file.Stat()
+	if err != nil || info.Size() == 0 {
+		return 0, err
+	}
+	last := make([]byte, 1)
+	if _, err := s.file.ReadAt(last, info.Size()-1); err != nil {
+		return 0, err
+	}
+	if last[0] == '\n' {
+		return info.Size(), nil
+	}
+	if _, err := s.file.Write([]byte{'\n'}); err != nil {
+		return 0, err
+	}
+	return info.Size() + 1, nil
+}
+
+func newAuditSink() (AuditSink, error) {
+	switch *auditSink {
+	case "webhook":
+		if *auditWebhookURL == "" {
+			return nil, errors.New("-audit-sink webhook needs -audit-webhook-url")
+		}
+		return &webhookAuditSink{url: *auditWebhookURL}, nil
+	case "syslog":
+		network, addr := "", ""
+		if *auditSyslogAddr != "" {
+			u, err := url.Parse(*auditSyslogAddr)
+			if err != nil {
+				return nil, err
+			}
+			network, addr = u.Scheme, u.Host
+		}
+		return &syslogAuditSink{network: network, addr: addr}, nil
+	}
+	return nil, fmt.Errorf("unknown audit sink %q", *auditSink)
+}
+
+// Audit records an event. It returns once the event is on disk, so it is
+// delivered even if the sink is down or the server restarts
+func Audit(event AuditEvent) error {
+	s := spool
+	if s == nil {
+		notify(event)
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	event.Seq = s.seq + 1
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if _, err := s.file.Write(line); err != nil {
+		s.failed = err
+		return fmt.Errorf("spool audit event: %v", err)
+	}
+	if err := s.file.Sync(); err != nil {
+		s.failed = err
+		return fmt.Errorf("spool audit event: %v", err)
+	}
+	s.failed = nil
+	s.seq = event.Seq
+	notify(event)
+	s.size += int64(len(line))
+	s.backlog++
+	auditBacklog.Set(float64(s.backlog))
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// AuditAvailable returns ErrAuditUnavailable while -audit-fail-closed refuses
+// terminals, because events can't be spooled or the sink fell too far behind
+func AuditAvailable() error {
+	s := spool
+	if !*auditFailClosed || s == nil {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.failed != nil || s.backlog > *auditMaxBacklog {
+		return ErrAuditUnavailable
+	}
+	return nil
+}
+
+// audit records an event and logs failures, for callers that can't act on
+// them. With -audit-fail-closed the session of an event that was lost ends
+func audit(event AuditEvent) {
+	err := Audit(event)
+	if err == nil {
+		return
+	}
+	log.Println("audit err", err)
+	if !*auditFailClosed || event.SessionID == "" {
+		return
+	}
+	// not killLocalSession, its audit event would fail as well
+	if session := getSession(event.SessionID); session != nil {
+		log.Printf("session %s: closed, its audit events can't be recorded", event.SessionID)
+		session.Toast("\r\nsession closed, its audit events can't be recorded\r\n")
+		session.cancel()
+	}
+}
+
+// auditEvent returns an event of the session
+func (t *TerminalSession) auditEvent(kind string, details map[string]string) AuditEvent {
+	return AuditEvent{
+		Type:      kind,
+		SessionID: t.id,
+		User:      t.meta.User,
+		Namespace: t.meta.Namespace,
+		Pod:       t.meta.Pod,
+		Container: t.meta.Container,
+		Details:   details,
+	}
+}
+
+type spooledEvent struct {
+	data []byte
+	seq  uint64
+	end  int64
+}
+
+// readFrom returns up to max spooled events starting at offset, all if max is
+// negative. A partly written last line is left for later
+func (s *auditSpool) readFrom(offset int64, max int) ([]spooledEvent, error) {
+	f, err := os.Open(s.spoolPath())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var events []spooledEvent
+	reader := bufio.NewReader(f)
+	for max < 0 || len(events) < max {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		offset += int64(len(line))
+		var header struct {
+			Seq uint64 `json:"seq"`
+		}
+		if err := json.Unmarshal(line, &header); err != nil {
+			// a torn write from a crash, it was never acknowledged
+			log.Printf("audit spool: skipping corrupt line at %d", offset-int64(len(line)))
+			continue
+		}
+		events = append(events, spooledEvent{data: bytes.TrimSpace(line), seq: header.Seq, end: offset})
+	}
+	return events, nil
+}
+
+// deliver sends the spooled events in order, retrying each until the sink
+// accepts it
+func (s *auditSpool) deliver(cursor auditCursor) {
+	backoff := time.Second
+	for {
+		events, err := s.readFrom(cursor.Offset, 100)
+		if err != nil {
+			log.Println("audit spool read err", err)
+		}
+		if len(events) == 0 {
+			cursor = s.compact(cursor)
+			<-s.wake
+			continue
+		}
+		for _, e := range events {
+			for {
+				err := s.sink.Deliver(e.data)
+				if err == nil {
+					break
+				}
+				log.Printf("audit event %d not delivered, retrying in %v: %v", e.seq, backoff, err)
+				time.Sleep(backoff)
+				if backoff *= 2; backoff > time.Minute {
+					backoff = time.Minute
+				}
+			}
+			backoff = time.Second
+			cursor = auditCursor{Offset: e.end, Seq: e.seq}
+			if err := s.saveCursor(cursor); err != nil {
+				log.Println("audit cursor err", err)
+			}
+			s.lock.Lock()
+			s.backlog--
+			auditBacklog.Set(float64(s.backlog))
+			s.lock.Unlock()
+		}
+	}
+}
+
+// compact empties a large spool once everything in it was delivered
+func (s *auditSpool) compact(cursor auditCursor) auditCursor {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.size < auditCompactSize || cursor.Offset != s.size {
+		return cursor
+	}
+	if err := s.file.Truncate(0); err != nil {
+		log.Println("audit spool compact err", err)
+		return cursor
+	}
+	s.size = 0
+	cursor.Offset = 0
+	if err := s.saveCursor(cursor); err != nil {
+		log.Println("audit cursor err", err)
+	}
+	return cursor
+}
+
+func (s *auditSpool) loadCursor() (auditCursor, error) {
+	var cursor auditCursor
+	data, err := ioutil.ReadFile(s.cursorPath())
+	if os.IsNotExist(err) {
+		return cursor, nil
+	} else if err != nil {
+		return cursor, err
+	}
+	err = json.Unmarshal(data, &cursor)
+	return cursor, err
+}
+
+// saveCursor replaces the cursor atomically, a crash delivers the last event
+// again rather than losing it
+func (s *auditSpool) saveCursor(cursor auditCursor) error {
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return err
+	}
+	tmp := s.cursorPath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.cursorPath())
+}
+
+// webhookAuditSink POSTs every event as JSON
+type webhookAuditSink struct {
+	url string
+}
+
+func (w *webhookAuditSink) Deliver(event []byte) error {
+	client, err := EgressClient(0)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(w.url, "application/json", bytes.NewReader(event))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("audit webhook: %s", resp.Status)
+	}
+	return nil
+}
+
+// syslogAuditSink writes every event as one syslog message
+type syslogAuditSink struct {
+	network string
+	addr    string
+	writer  *syslog.Writer
+}
+
+func (s *syslogAuditSink) Deliver(event []byte) error {
+	if s.writer == nil {
+		writer, err := syslog.Dial(s.network, s.addr, syslog.LOG_INFO|syslog.LOG_AUTH, "k8s-terminal-server")
+		if err != nil {
+			return err
+		}
+		s.writer = writer
+	}
+	if err := s.writer.Info(string(event)); err != nil {
+		// reconnect with the retry
+		s.writer.Close()
+		s.writer = nil
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,268 @@
+package terminal
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	authChain = Flags.String("auth", "jwt",
+		"comma separated authenticators tried in order: jwt, apikey, none (development only)")
+	apiKeysFile = Flags.String("api-keys", "", "file of static API keys for -auth apikey, one \"key user role\" per line")
+)
+
+// WebSocketProtocol is the subprotocol of terminal websockets, clients passing
+// their token as a subprotocol must offer it as well
+const WebSocketProtocol = "terminal.k8s.io"
+
+// bearerProtocolPrefix marks a websocket subprotocol carrying a base64url
+// encoded token, like the Kubernetes API server does
+const bearerProtocolPrefix = "base64url.bearer.authorization.k8s.io."
+
+// ErrNoCredentials is returned when a request carries no credentials an
+// authenticator understands
+var ErrNoCredentials = errors.New("no credentials")
+
+// Authenticator identifies the user of a request
+type Authenticator interface {
+	// Authenticate returns ErrNoCredentials if the request has nothing for
+	// this authenticator, so the next one of the chain is tried
+	Authenticate(r *http.Request) (*MyCustomClaims, error)
+}
+
+// AuthenticatorFunc adapts a func to Authenticator
+type AuthenticatorFunc func(r *http.Request) (*MyCustomClaims, error)
+
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (*MyCustomClaims, error) {
+	return f(r)
+}
+
+var authenticators []Authenticator
+
+type authResultKey struct{}
+
+type authResult struct {
+	claims *MyCustomClaims
+	err    error
+}
+
+// SetupAuth builds the authenticator chain of -auth, it is called on startup
+func SetupAuth() error {
+	authenticators = nil
+	if *presignEnabled {
+		// presigned URLs work with every chain, they were signed for its users
+		authenticators = append(authenticators, AuthenticatorFunc(authenticatePresigned))
+	}
+	for _, name := range splitList(*authChain) {
+		switch name {
+		case "jwt":
+			authenticators = append(authenticators, AuthenticatorFunc(authenticateJwt))
+		case "apikey":
+			keys, err := loadAPIKeys(*apiKeysFile)
+			if err != nil {
+				return err
+			}
+			authenticators = append(authenticators, keys)
+		case "none":
+			log.Println("WARNING: authentication is disabled, every request is an admin")
+			authenticators = append(authenticators, AuthenticatorFunc(authenticateNone))
+		default:
+			return fmt.Errorf("unknown authenticator %q", name)
+		}
+	}
+	if len(splitList(*authChain)) == 0 {
+		return errors.New("no authenticator configured")
+	}
+	return nil
+}
+
+// SetAuthenticators replaces the chain of -auth, for services embedding the
+// package that identify users their own way. The first authenticator finding
+// credentials decides
+func SetAuthenticators(chain ...Authenticator) {
+	authenticators = chain
+}
+
+// publicPaths are served without credentials, Slack approvals and the state
+// of the replicas check a signature and the sync token themselves
+var publicPaths = map[string]bool{
+	"/":                                 true,
+	"/version":                          true,
+	"/metrics":                          true,
+	"/.well-known/terminal-server.json": true,
+	"/ui":                               true,
+	"/api/v1/approvals/slack":           true,
+	"/api/v1/internal/state":            true,
+}
+
+// publicPath reports whether path is served to requests without credentials,
+// like the login and the assets of the web UI
+func publicPath(path string) bool {
+	return publicPaths[path] || strings.HasPrefix(path, "/auth/") || strings.HasPrefix(path, "/ui/")
+}
+
+// Authenticate is a negroni middleware running the authenticator chain, the
+// first authenticator finding credentials decides. Requests it can't identify
+// are rejected unless their path is public, handlers read the outcome with
+// RequestClaims
+func Authenticate(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	result := authResult{err: ErrNoCredentials}
+	for _, a := range authenticators {
+		claims, err := a.Authenticate(r)
+		if err == ErrNoCredentials {
+			continue
+		}
+		result = authResult{claims, err}
+		break
+	}
+	if result.err == ErrNoCredentials && *authMessage && websocket.IsWebSocketUpgrade(r) &&
+		authMessageRoute.MatchString(r.URL.Path) && containsString(splitList(*authChain), "jwt") {
+		aw, claims, err := authenticateMessage(rw, r)
+		if aw == nil {
+			return
+		}
+		rw, result = aw, authResult{claims, err}
+	}
+	if result.err == nil {
+		SetAccessUser(r, result.claims.Subject)
+	} else if result.err != ErrNoCredentials {
+		audit(AuditEvent{
+			Type: "auth.failure",
+			Details: map[string]string{
+				"error":  result.err.Error(),
+				"path":   r.URL.Path,
+				"remote": ClientIP(r),
+			},
+		})
+	}
+	if result.err != nil && !publicPath(r.URL.Path) {
+		message := "token is invalid or expired"
+		if result.err == ErrQueryTokenDisabled {
+			message = result.err.Error()
+		}
+		WriteTerminalError(rw, r, ErrCodeTokenInvalid, message, http.StatusUnauthorized)
+		return
+	}
+	next(rw, r.WithContext(context.WithValue(r.Context(), authResultKey{}, result)))
+}
+
+// WithClaims returns r carrying the user a custom auth middleware identified,
+// see Dependencies.Auth. Handlers read it with RequestClaims, err is reported
+// to them if the request was rejected
+func WithClaims(r *http.Request, claims *MyCustomClaims, err error) *http.Request {
+	if err == nil && claims == nil {
+		err = ErrNoCredentials
+	}
+	if err == nil {
+		SetAccessUser(r, claims.Subject)
+	}
+	return r.WithContext(context.WithValue(r.Context(), authResultKey{}, authResult{claims, err}))
+}
+
+// RequestClaims returns the claims of the user of r
+func RequestClaims(r *http.Request) (*MyCustomClaims, error) {
+	result, ok := r.Context().Value(authResultKey{}).(authResult)
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	return result.claims, result.err
+}
+
+// requestToken returns the JWT of the jwtToken parameter, the Authorization
+// header or a websocket subprotocol
+func requestToken(r *http.Request) string {
+	if token := r.URL.Query().Get("jwtToken"); token != "" {
+		return token
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	for _, protocol := range strings.Split(r.Header.Get("Sec-WebSocket-Protocol"), ",") {
+		protocol = strings.TrimSpace(protocol)
+		if !strings.HasPrefix(protocol, bearerProtocolPrefix) {
+			continue
+		}
+		token, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(protocol, bearerProtocolPrefix))
+		if err == nil {
+			return string(token)
+		}
+	}
+	return ""
+}
+
+func authenticateJwt(r *http.Request) (*MyCustomClaims, error) {
+	if !*allowQueryToken && r.URL.Query().Get("jwtToken") != "" {
+		return nil, ErrQueryTokenDisabled
+	}
+	token := requestToken(r)
+	if token == "" {
+		return nil, ErrNoCredentials
+	}
+	_, span := StartSpan(r.Context(), "jwt.validate")
+	claims, err := ParseJwtToken(token)
+	EndSpan(span, err)
+	return claims, err
+}
+
+func authenticateNone(r *http.Request) (*MyCustomClaims, error) {
+	claims := &MyCustomClaims{Role: RoleAdmin}
+	claims.Subject = "anonymous"
+	return claims, nil
+}
+
+// apiKeys authenticates static keys sent in the X-API-Key header
+type apiKeys map[string]*MyCustomClaims
+
+func loadAPIKeys(path string) (apiKeys, error) {
+	if path == "" {
+		return nil, errors.New("-auth apikey needs -api-keys")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := apiKeys{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("api key line %q needs a key and a user", line)
+		}
+		claims := &MyCustomClaims{}
+		claims.Subject = fields[1]
+		if len(fields) > 2 {
+			claims.Role = fields[2]
+		}
+		keys[fields[0]] = claims
+	}
+	return keys, scanner.Err()
+}
+
+func (k apiKeys) Authenticate(r *http.Request) (*MyCustomClaims, error) {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		return nil, ErrNoCredentials
+	}
+	claims, ok := k[key]
+	if !ok {
+		return nil, errors.New("unknown api key")
+	}
+	// handlers may keep the claims, don't share the stored ones
+	copied := *claims
+	return &copied, nil
+}
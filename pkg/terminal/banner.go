@@ -0,0 +1,164 @@
+package terminal
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+var (
+	bannerConfig = Flags.String("banner-config", "",
+		"JSON file with the banner shown when a session starts, it is reloaded when it changes, so it can be a mounted ConfigMap")
+	clusterName = Flags.String("cluster-name", "", "name of the cluster, shown in the banner as {{.Cluster}}")
+)
+
+// BannerConfig is the content of -banner-config
+type BannerConfig struct {
+	// Banner is a text/template shown at the start of every session
+	Banner string `json:"banner"`
+	// ProductionNamespaces get the production warning, a trailing * matches a prefix
+	ProductionNamespaces []string `json:"productionNamespaces"`
+	// ProductionWarning is a text/template shown in red in production namespaces
+	ProductionWarning string `json:"productionWarning"`
+}
+
+// bannerData is what banner templates can use
+type bannerData struct {
+	User      string
+	Namespace string
+	Pod       string
+	Container string
+	Cluster   string
+}
+
+// banner is the parsed -banner-config
+type banner struct {
+	config   BannerConfig
+	banner   *template.Template
+	warning  *template.Template
+	modified time.Time
+}
+
+var (
+	bannerLock    sync.Mutex
+	currentBanner *banner
+)
+
+// loadBanner returns the banner config, reading it again once the file was
+// modified. A file that fails to parse keeps the last good config
+func loadBanner() *banner {
+	if *bannerConfig == "" {
+		return nil
+	}
+	bannerLock.Lock()
+	defer bannerLock.Unlock()
+	info, err := os.Stat(*bannerConfig)
+	if err != nil {
+		log.Println("loadBanner err", err)
+		return currentBanner
+	}
+	if currentBanner != nil && info.ModTime().Equal(currentBanner.modified) {
+		return currentBanner
+	}
+	b, err := parseBanner(*bannerConfig)
+	if err != nil {
+		log.Println("loadBanner err", err)
+		return currentBanner
+	}
+	b.modified = info.ModTime()
+	currentBanner = b
+	return currentBanner
+}
+
+func parseBanner(file string) (*banner, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	b := &banner{}
+	if err := json.Unmarshal(data, &b.config); err != nil {
+		return nil, err
+	}
+	if b.banner, err = template.New("banner").Parse(b.config.Banner); err != nil {
+		return nil, err
+	}
+	if b.warning, err = template.New("warning").Parse(b.config.ProductionWarning); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// production reports whether namespace gets the production warning
+func (b *banner) production(namespace string) bool {
+	return namespaceMatches(b.config.ProductionNamespaces, namespace)
+}
+
+// namespaceMatches reports whether namespace is one of patterns, a trailing *
+// matches a prefix
+func namespaceMatches(patterns []string, namespace string) bool {
+	for _, pattern := range patterns {
+		if prefix := strings.TrimSuffix(pattern, "*"); prefix != pattern {
+			if strings.HasPrefix(namespace, prefix) {
+				return true
+			}
+		} else if namespace == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// render returns the banner of a session, "" if there is none
+func (b *banner) render(meta SessionMeta) string {
+	data := bannerData{
+		User:      meta.User,
+		Namespace: meta.Namespace,
+		Pod:       meta.Pod,
+		Container: meta.Container,
+		Cluster:   *clusterName,
+	}
+	var text strings.Builder
+	if b.config.Banner != "" {
+		text.WriteString(renderTemplate(b.banner, data))
+	}
+	if b.config.ProductionWarning != "" && b.production(meta.Namespace) {
+		warning := strings.TrimSuffix(renderTemplate(b.warning, data), "\n")
+		text.WriteString("\x1b[1;31m" + warning + "\x1b[0m\n")
+	}
+	if text.Len() == 0 {
+		return ""
+	}
+	// the terminal is in raw mode
+	return strings.Replace(text.String(), "\n", "\r\n", -1)
+}
+
+func renderTemplate(tmpl *template.Template, data bannerData) string {
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		log.Println("banner template err", err)
+		return ""
+	}
+	text := out.String()
+	if !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	return text
+}
+
+// showBanner sends the banner of -banner-config as the first output of the
+// session
+func (t *TerminalSession) showBanner() {
+	b := loadBanner()
+	if b == nil {
+		return
+	}
+	if text := b.render(t.meta); text != "" {
+		t.Toast(text)
+	}
+}
@@ -0,0 +1,65 @@
+package terminal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+)
+
+var bootstrapConfig = Flags.String("bootstrap-config", "",
+	`JSON file mapping namespaces (or "*" for all others) to a script run before the shell starts`)
+
+var (
+	bootstrapOnce    sync.Once
+	bootstrapScripts map[string]string
+)
+
+func loadBootstrapScripts() map[string]string {
+	bootstrapOnce.Do(func() {
+		if *bootstrapConfig == "" {
+			return
+		}
+		data, err := ioutil.ReadFile(*bootstrapConfig)
+		if err != nil {
+			log.Println("loadBootstrapScripts err", err)
+			return
+		}
+		if err := json.Unmarshal(data, &bootstrapScripts); err != nil {
+			log.Println("loadBootstrapScripts err", err)
+		}
+	})
+	return bootstrapScripts
+}
+
+// bootstrapScript returns the script configured for namespace, if any
+func bootstrapScript(namespace string) string {
+	scripts := loadBootstrapScripts()
+	if script, ok := scripts[namespace]; ok {
+		return script
+	}
+	return scripts["*"]
+}
+
+// bootstrapCommand wraps shell so that script runs first in the same process,
+// so working directory and exported variables carry over to the user's shell.
+// A login shell is started with -l
+func bootstrapCommand(shell string, script string, login bool) []string {
+	args := []string{shell}
+	if login {
+		args = append(args, "-l")
+	}
+	if script == "" {
+		return args
+	}
+	return []string{shell, "-c", script + "\nexec " + strings.Join(args, " ")}
+}
+
+// announceBootstrap shows the bootstrap script in the terminal, so it is part
+// of what the user (and anyone watching) sees
+func (t *TerminalSession) announceBootstrap(script string) {
+	log.Printf("session %s: running bootstrap script for namespace %s", t.id, t.meta.Namespace)
+	lines := strings.Split(strings.TrimSpace(script), "\n")
+	t.Toast("[bootstrap] " + strings.Join(lines, "\r\n[bootstrap] ") + "\r\n")
+}
@@ -0,0 +1,131 @@
+package terminal
+
+import (
+	"errors"
+	"sync"
+)
+
+const (
+	overflowDropOldest = "drop-oldest"
+	overflowPause      = "pause"
+
+	// maxFrameSize caps how much buffered output is sent in one websocket frame
+	maxFrameSize = 32 * 1024
+)
+
+var (
+	outputBufferSize = Flags.Int("output-buffer-size", 256*1024,
+		"bytes of terminal output buffered per client")
+	outputOverflow = Flags.String("output-overflow", overflowDropOldest,
+		`what to do when a client can't keep up with the output: "drop-oldest" or "pause" the shell`)
+)
+
+var errBufferClosed = errors.New("output buffer is closed")
+
+// outputBuffer is a bounded ring buffer between the exec stream and a slow client
+// It is filled by the session and drained by the client's writer goroutine
+type outputBuffer struct {
+	lock sync.Mutex
+	cond *sync.Cond
+
+	data   []byte
+	start  int
+	length int
+
+	dropOldest bool
+	closed     bool
+	dropped    uint64
+}
+
+func newOutputBuffer() *outputBuffer {
+	size := *outputBufferSize
+	if size <= 0 {
+		size = maxFrameSize
+	}
+	b := &outputBuffer{
+		data:       make([]byte, size),
+		dropOldest: *outputOverflow != overflowPause,
+	}
+	b.cond = sync.NewCond(&b.lock)
+	return b
+}
+
+// push appends p to the buffer. When it is full the oldest output is discarded,
+// or in pause mode push blocks until the writer made room
+func (b *outputBuffer) push(p []byte) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for len(p) > 0 {
+		if b.closed {
+			return errBufferClosed
+		}
+		free := len(b.data) - b.length
+		if free == 0 {
+			if !b.dropOldest {
+				b.cond.Wait()
+				continue
+			}
+			drop := len(p)
+			if drop > b.length {
+				drop = b.length
+			}
+			b.start = (b.start + drop) % len(b.data)
+			b.length -= drop
+			b.dropped += uint64(drop)
+			outputDroppedBytes.Add(float64(drop))
+			continue
+		}
+		n := len(p)
+		if n > free {
+			n = free
+		}
+		end := (b.start + b.length) % len(b.data)
+		copied := copy(b.data[end:], p[:n])
+		copy(b.data, p[copied:n])
+		b.length += n
+		p = p[n:]
+		b.cond.Broadcast()
+	}
+	return nil
+}
+
+// pop blocks until output is available and returns at most max bytes of it
+// It returns nil once the buffer was closed and drained
+func (b *outputBuffer) pop(max int) []byte {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for b.length == 0 && !b.closed {
+		b.cond.Wait()
+	}
+	if b.length == 0 {
+		return nil
+	}
+	n := b.length
+	if n > max {
+		n = max
+	}
+	out := make([]byte, n)
+	copied := copy(out, b.data[b.start:])
+	copy(out[copied:], b.data)
+	b.start = (b.start + n) % len(b.data)
+	b.length -= n
+	b.cond.Broadcast()
+	return out
+}
+
+// stats returns the buffered bytes, the capacity and the dropped bytes
+func (b *outputBuffer) stats() (int, int, uint64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.length, len(b.data), b.dropped
+}
+
+// close rejects further output, the writer still drains what is buffered
+func (b *outputBuffer) close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.closed = true
+	b.cond.Broadcast()
+}
@@ -0,0 +1,102 @@
+package terminal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var captureEnvironment = Flags.Bool("capture-environment", false,
+	"record the container's environment, image digest and pod spec hash with each session")
+
+// sensitiveEnvName matches variables whose values are masked in the capture
+var sensitiveEnvName = regexp.MustCompile(`(?i)pass|secret|token|key|credential|auth|pwd`)
+
+// EnvironmentCapture records what was running when a session started, so its
+// transcript can be interpreted later
+type EnvironmentCapture struct {
+	Image       string            `json:"image"`
+	ImageDigest string            `json:"imageDigest"`
+	PodSpecHash string            `json:"podSpecHash"`
+	Env         map[string]string `json:"env"`
+	EnvFrom     []string          `json:"envFrom,omitempty"`
+}
+
+// captureContainerEnvironment reads the environment of a container from its
+// pod. Values of sensitive looking variables are masked and values taken from
+// secrets or config maps are only referenced
+func (k *KubeClient) captureContainerEnvironment(ctx context.Context, namespace string, pod string,
+	container string) (*EnvironmentCapture, error) {
+
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+	clientset, err := k.Clientset()
+	if err != nil {
+		return nil, err
+	}
+	ctx, span := startClientSpan(ctx, "get", "pods", namespace)
+	p, err := clientset.CoreV1().Pods(namespace).Get(ctx, pod, metav1.GetOptions{})
+	EndSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	spec, err := json.Marshal(p.Spec)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(spec)
+	capture := &EnvironmentCapture{
+		PodSpecHash: "sha256:" + hex.EncodeToString(sum[:]),
+		Env:         make(map[string]string),
+	}
+
+	for _, status := range p.Status.ContainerStatuses {
+		if status.Name == container {
+			capture.ImageDigest = status.ImageID
+		}
+	}
+	for _, c := range p.Spec.Containers {
+		if c.Name != container {
+			continue
+		}
+		capture.Image = c.Image
+		for _, env := range c.Env {
+			capture.Env[env.Name] = describeEnvValue(env)
+		}
+		for _, src := range c.EnvFrom {
+			if src.ConfigMapRef != nil {
+				capture.EnvFrom = append(capture.EnvFrom, "configmap/"+src.ConfigMapRef.Name)
+			}
+			if src.SecretRef != nil {
+				capture.EnvFrom = append(capture.EnvFrom, "secret/"+src.SecretRef.Name)
+			}
+		}
+	}
+	return capture, nil
+}
+
+func describeEnvValue(env v1.EnvVar) string {
+	if from := env.ValueFrom; from != nil {
+		switch {
+		case from.SecretKeyRef != nil:
+			return fmt.Sprintf("<secret %s/%s>", from.SecretKeyRef.Name, from.SecretKeyRef.Key)
+		case from.ConfigMapKeyRef != nil:
+			return fmt.Sprintf("<configmap %s/%s>", from.ConfigMapKeyRef.Name, from.ConfigMapKeyRef.Key)
+		case from.FieldRef != nil:
+			return fmt.Sprintf("<field %s>", from.FieldRef.FieldPath)
+		case from.ResourceFieldRef != nil:
+			return fmt.Sprintf("<resource %s>", from.ResourceFieldRef.Resource)
+		}
+	}
+	if sensitiveEnvName.MatchString(env.Name) {
+		return "****"
+	}
+	return env.Value
+}
@@ -0,0 +1,289 @@
+package terminal
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/term"
+)
+
+// RunClient runs the connect subcommand, a kubectl exec like terminal against
+// a terminal server:
+//
+//	terminal-server connect --url wss://terminal.example.com --namespace x --pod y
+//
+// It returns the exit status of the remote shell
+func RunClient(args []string) (int, error) {
+	flags := flag.NewFlagSet("connect", flag.ContinueOnError)
+	serverURL := flags.String("url", "", "URL of the terminal server, like wss://terminal.example.com")
+	namespace := flags.String("namespace", "default", "namespace of the pod")
+	pod := flags.String("pod", "", "pod to open the terminal in")
+	container := flags.String("container", "", "container of the pod, the server picks one if empty")
+	token := flags.String("token", os.Getenv("TERMINAL_TOKEN"), "JWT or API key, defaults to $TERMINAL_TOKEN")
+	insecure := flags.Bool("insecure", false, "skip the verification of the server certificate")
+	reason := flags.String("reason", "", "why the terminal is opened, e.g. a ticket, some namespaces require it")
+	tty := flags.Bool("tty", term.IsTerminal(int(os.Stdin.Fd())),
+		"run the shell in a terminal, off if stdin isn't one so data can be piped through the shell")
+	if err := flags.Parse(args); err != nil {
+		return 0, err
+	}
+	if *serverURL == "" || *pod == "" {
+		flags.Usage()
+		return 0, errors.New("--url and --pod are required")
+	}
+	target, err := terminalURL(*serverURL, *namespace, *pod, *container)
+	if err != nil {
+		return 0, err
+	}
+	query := url.Values{}
+	if *reason != "" {
+		query.Set("reason", *reason)
+	}
+	if !*tty {
+		query.Set("tty", "false")
+	}
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	dialer := *websocket.DefaultDialer
+	if *insecure {
+		dialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	header := http.Header{}
+	if *token != "" {
+		header.Set("Authorization", "Bearer "+*token)
+	}
+	conn, resp, err := dialer.Dial(target, header)
+	if err != nil {
+		if resp != nil {
+			body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4<<10))
+			var envelope APIError
+			if json.Unmarshal(body, &envelope) == nil && envelope.Error.Code != "" {
+				return 0, fmt.Errorf("%s: %s", envelope.Error.Code, envelope.Error.Message)
+			}
+			return 0, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+		}
+		return 0, err
+	}
+	defer conn.Close()
+
+	c := &cliClient{conn: conn, in: int(os.Stdin.Fd()), noTTY: !*tty}
+	return c.run()
+}
+
+// terminalURL returns the terminal endpoint of a server given by its base URL,
+// http and https URLs are turned into websocket ones
+func terminalURL(server string, namespace string, pod string, container string) (string, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "http", "ws":
+		u.Scheme = "ws"
+	case "https", "wss":
+		u.Scheme = "wss"
+	default:
+		return "", fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+	path := "/api/v1/terminals/" + url.PathEscape(namespace) + "/" + url.PathEscape(pod)
+	if container != "" {
+		path += "/" + url.PathEscape(container)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	return u.String(), nil
+}
+
+// cliClient connects the local terminal to a session
+type cliClient struct {
+	conn *websocket.Conn
+	in   int
+	// noTTY sessions get stderr and notices in messages and stdin is closed
+	// at its end
+	noTTY bool
+	// streams is set once the server agreed to tag the output with its
+	// stream, see FeatureStreams
+	streams bool
+
+	writeLock sync.Mutex
+	started   bool
+	restore   func()
+	// exitCode is the exit status the server reported for the shell
+	exitCode int
+}
+
+func (c *cliClient) writeMessage(messageType int, data []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.conn.WriteMessage(messageType, data)
+}
+
+func (c *cliClient) writeJSON(msg TerminalMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return c.writeMessage(websocket.TextMessage, data)
+}
+
+// size returns the size of the local terminal, 0 if stdin isn't one
+func (c *cliClient) size() (uint16, uint16) {
+	cols, rows, err := term.GetSize(c.in)
+	if err != nil {
+		return 0, 0
+	}
+	return uint16(rows), uint16(cols)
+}
+
+// run reads the session until it ends and returns the exit status of the
+// shell. Once the handshake is acknowledged stdin is put in raw mode and
+// forwarded with the size changes
+func (c *cliClient) run() (int, error) {
+	defer c.restoreTerminal()
+	for {
+		messageType, data, err := c.conn.ReadMessage()
+		if err != nil {
+			// the server closes the connection once the shell exited
+			if c.started {
+				return c.exitCode, nil
+			}
+			return 0, err
+		}
+		if messageType == websocket.BinaryMessage {
+			if c.streams && len(data) > 0 {
+				if data[0] == streamStderr {
+					os.Stderr.Write(data[1:])
+				} else {
+					os.Stdout.Write(data[1:])
+				}
+				continue
+			}
+			os.Stdout.Write(data)
+			continue
+		}
+		var exit ExitMessage
+		if err := json.Unmarshal(data, &exit); err == nil && exit.Op == "exit" {
+			c.exitCode = exit.Code
+			continue
+		}
+		var msg TerminalMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			os.Stdout.Write(data)
+			continue
+		}
+		switch msg.Op {
+		case "capabilities":
+			if err := c.start(msg); err != nil {
+				return 0, err
+			}
+		case "heartbeat":
+			c.writeJSON(TerminalMessage{Op: "heartbeat", Timestamp: msg.Timestamp})
+		case "stderr", "notice":
+			os.Stderr.WriteString(msg.Data)
+		case "queued":
+			fmt.Fprintf(os.Stderr, "waiting for a free terminal, position %d\r\n", msg.Position)
+		case "error":
+			c.restoreTerminal()
+			if msg.Code != "" {
+				return 0, fmt.Errorf("%s: %s", msg.Code, msg.Data)
+			}
+			return 0, errors.New(msg.Data)
+		}
+	}
+}
+
+// start acknowledges the capabilities of the server and starts forwarding
+// the local terminal
+func (c *cliClient) start(caps TerminalMessage) error {
+	// newer servers list the older versions they still speak
+	supported := caps.Version == ProtocolVersion
+	for _, version := range caps.Versions {
+		supported = supported || version == ProtocolVersion
+	}
+	if !supported {
+		return fmt.Errorf("server speaks protocol version %d, the client %d", caps.Version, ProtocolVersion)
+	}
+	rows, cols := c.size()
+	ack := TerminalMessage{
+		Op:       "ack",
+		Version:  ProtocolVersion,
+		Features: []string{FeatureBinary, FeatureResize, FeatureHeartbeats, FeatureExit},
+		Rows:     rows,
+		Cols:     cols,
+	}
+	if c.noTTY && containsString(caps.Features, FeatureStreams) {
+		ack.Features = append(ack.Features, FeatureStreams)
+		c.streams = true
+	}
+	if err := c.writeJSON(ack); err != nil {
+		return err
+	}
+	c.started = true
+	if term.IsTerminal(c.in) && !c.noTTY {
+		state, err := term.MakeRaw(c.in)
+		if err != nil {
+			return err
+		}
+		c.restore = func() { term.Restore(c.in, state) }
+	}
+	if caps.ReadOnly {
+		fmt.Fprint(os.Stderr, "the session is read-only\r\n")
+		return nil
+	}
+	go c.forwardStdin()
+	if !c.noTTY {
+		go c.forwardResizes(rows, cols)
+	}
+	return nil
+}
+
+func (c *cliClient) forwardStdin() {
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if n > 0 {
+			if c.writeMessage(websocket.BinaryMessage, buf[:n]) != nil {
+				return
+			}
+		}
+		if err != nil {
+			if err == io.EOF && c.noTTY {
+				c.writeJSON(TerminalMessage{Op: "eof"})
+			}
+			return
+		}
+	}
+}
+
+// forwardResizes sends the size of the local terminal whenever it changed
+func (c *cliClient) forwardResizes(rows uint16, cols uint16) {
+	for range terminalResizes() {
+		newRows, newCols := c.size()
+		if newRows == rows && newCols == cols {
+			continue
+		}
+		rows, cols = newRows, newCols
+		if c.writeJSON(TerminalMessage{Op: "resize", Rows: rows, Cols: cols}) != nil {
+			return
+		}
+	}
+}
+
+func (c *cliClient) restoreTerminal() {
+	if c.restore != nil {
+		c.restore()
+		c.restore = nil
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+// +build !windows
+
+package terminal
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// terminalResizes signals when the local terminal may have changed its size
+func terminalResizes() <-chan struct{} {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGWINCH)
+	resizes := make(chan struct{})
+	go func() {
+		for range signals {
+			resizes <- struct{}{}
+		}
+	}()
+	return resizes
+}
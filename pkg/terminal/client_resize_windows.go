@@ -0,0 +1,14 @@
+package terminal
+
+import "time"
+
+// terminalResizes polls the console size, Windows has no SIGWINCH
+func terminalResizes() <-chan struct{} {
+	resizes := make(chan struct{})
+	go func() {
+		for range time.Tick(500 * time.Millisecond) {
+			resizes <- struct{}{}
+		}
+	}()
+	return resizes
+}
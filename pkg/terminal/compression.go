@@ -0,0 +1,29 @@
+package terminal
+
+import (
+	"compress/flate"
+	"log"
+)
+
+var (
+	websocketCompression = Flags.Bool("websocket-compression", true,
+		"compress large websocket frames with permessage-deflate if the client supports it")
+	compressionLevel = Flags.Int("websocket-compression-level", flate.BestSpeed,
+		"deflate level of compressed frames, from 1 (fastest) to 9 (smallest)")
+	compressionThreshold = Flags.Int("websocket-compression-threshold", 512,
+		"smallest frame in bytes that is compressed, keystroke echoes are cheaper to send as is")
+)
+
+// setupCompression applies -websocket-compression-level to a connection that
+// negotiated permessage-deflate
+func setupCompression(conn clientConn) {
+	if err := conn.SetCompressionLevel(*compressionLevel); err != nil {
+		log.Println("setupCompression err", err)
+	}
+}
+
+// compressFrame decides whether the next frame of size bytes is compressed,
+// it is called with the client's writeLock held
+func (c *terminalClient) compressFrame(size int) {
+	c.conn.EnableWriteCompression(*websocketCompression && size >= *compressionThreshold)
+}
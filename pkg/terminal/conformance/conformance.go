@@ -0,0 +1,464 @@
+// Package conformance checks that a terminal server speaks the websocket
+// protocol: authentication, the handshake, stdin and stdout, resizing,
+// reattaching and the end of sessions. The checks run as go test with the
+// conformance build tag, against a server in a real cluster like kind, or
+// against a local server with simulated shells
+package conformance
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	".."
+)
+
+// settle is how long the checks give the server to apply a change, like a
+// resize, which travels apart from the input and is debounced
+const settle = 500 * time.Millisecond
+
+// Target is the server and pod the checks open terminals in
+type Target struct {
+	// URL of the server, like http://localhost:8000
+	URL       string
+	Namespace string
+	Pod       string
+	Container string
+	// Auth carries credentials of a user who may open terminals in the pod,
+	// BadAuth credentials the server rejects
+	Auth    http.Header
+	BadAuth http.Header
+	// Timeout bounds every wait for the server
+	Timeout time.Duration
+	// Insecure skips the verification of the server certificate
+	Insecure bool
+}
+
+// Check is one conformance check
+type Check struct {
+	Name string
+	Run  func(t *Target) error
+}
+
+// Checks are run in this order
+var Checks = []Check{
+	{"auth/missing-credentials", checkMissingCredentials},
+	{"auth/invalid-credentials", checkInvalidCredentials},
+	{"handshake", checkHandshake},
+	{"stdin-stdout", checkStdinStdout},
+	{"resize", checkResize},
+	{"reattach", checkReattach},
+	{"exit-code", checkExitCode},
+	{"close", checkClose},
+}
+
+// wsURL returns the websocket URL of path, which may carry a query
+func (t *Target) wsURL(path string) (string, error) {
+	u, err := url.Parse(t.URL)
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(path)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "http", "ws":
+		u.Scheme = "ws"
+	case "https", "wss":
+		u.Scheme = "wss"
+	default:
+		return "", fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + ref.Path
+	u.RawQuery = ref.RawQuery
+	return u.String(), nil
+}
+
+func (t *Target) terminalPath() string {
+	path := "/api/v1/terminals/" + url.PathEscape(t.Namespace) + "/" + url.PathEscape(t.Pod)
+	if t.Container != "" {
+		path += "/" + url.PathEscape(t.Container)
+	}
+	return path
+}
+
+func (t *Target) dial(path string, header http.Header) (*websocket.Conn, *http.Response, error) {
+	target, err := t.wsURL(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	dialer := *websocket.DefaultDialer
+	dialer.HandshakeTimeout = t.Timeout
+	if t.Insecure {
+		dialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return dialer.Dial(target, header)
+}
+
+// do sends an API request with the credentials of Auth
+func (t *Target) do(method string, path string, out interface{}) error {
+	req, err := http.NewRequest(method, strings.TrimSuffix(t.URL, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	for name, values := range t.Auth {
+		req.Header[name] = values
+	}
+	client := &http.Client{Timeout: t.Timeout}
+	if t.Insecure {
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// session is a terminal opened by a check
+type session struct {
+	t    *Target
+	conn *websocket.Conn
+	id   string
+	caps terminal.TerminalMessage
+	// output is the stdout read so far, consumed by expect
+	output bytes.Buffer
+	exit   *terminal.ExitMessage
+}
+
+// open dials path and acknowledges the capabilities with a 24x80 terminal
+func (t *Target) open(path string) (*session, error) {
+	conn, resp, err := t.dial(path, t.Auth)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("%v: %s", err, resp.Status)
+		}
+		return nil, err
+	}
+	s := &session{t: t, conn: conn}
+	conn.SetReadDeadline(time.Now().Add(t.Timeout))
+	if err := conn.ReadJSON(&s.caps); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("read capabilities: %v", err)
+	}
+	if s.caps.Op == "error" {
+		conn.Close()
+		return nil, fmt.Errorf("server error %s: %s", s.caps.Code, s.caps.Data)
+	} else if s.caps.Op != "capabilities" {
+		conn.Close()
+		return nil, fmt.Errorf("first message is %q, not the capabilities", s.caps.Op)
+	}
+	s.id = s.caps.SessionID
+	ack := terminal.TerminalMessage{
+		Op:       "ack",
+		Version:  terminal.ProtocolVersion,
+		Features: []string{terminal.FeatureBinary, terminal.FeatureResize, terminal.FeatureExit},
+		Rows:     24,
+		Cols:     80,
+	}
+	if err := conn.WriteJSON(ack); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *session) close() {
+	s.conn.Close()
+}
+
+func (s *session) send(input string) error {
+	return s.conn.WriteMessage(websocket.TextMessage, []byte(input))
+}
+
+// read reads one message, the output is appended to s.output
+func (s *session) read() error {
+	messageType, data, err := s.conn.ReadMessage()
+	if err != nil {
+		return err
+	}
+	if messageType == websocket.BinaryMessage {
+		s.output.Write(data)
+		return nil
+	}
+	// the code of exit messages is a number, of errors a string
+	var op struct {
+		Op string `json:"op"`
+	}
+	if err := json.Unmarshal(data, &op); err != nil || op.Op == "" {
+		s.output.Write(data)
+		return nil
+	}
+	switch op.Op {
+	case "exit":
+		var exit terminal.ExitMessage
+		if err := json.Unmarshal(data, &exit); err != nil {
+			return err
+		}
+		s.exit = &exit
+	case "error":
+		var msg terminal.TerminalMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return err
+		}
+		return fmt.Errorf("server error %s: %s", msg.Code, msg.Data)
+	}
+	return nil
+}
+
+// expect reads until the output contains want and consumes it
+func (s *session) expect(want string) error {
+	s.conn.SetReadDeadline(time.Now().Add(s.t.Timeout))
+	for !strings.Contains(s.output.String(), want) {
+		if err := s.read(); err != nil {
+			return fmt.Errorf("waiting for %q, got %q: %v", want, s.output.String(), err)
+		}
+	}
+	s.output.Next(strings.Index(s.output.String(), want) + len(want))
+	return nil
+}
+
+// wait reads until the server closes the connection and returns the exit
+// message it sent before
+func (s *session) wait() (*terminal.ExitMessage, error) {
+	s.conn.SetReadDeadline(time.Now().Add(s.t.Timeout))
+	for {
+		err := s.read()
+		// the server drops the connection after the exit message, gorilla
+		// reports that as an abnormal closure
+		var closeErr *websocket.CloseError
+		if errors.As(err, &closeErr) {
+			return s.exit, nil
+		} else if err != nil {
+			return s.exit, err
+		}
+	}
+}
+
+// expectRefused opens a terminal with header and expects it to be refused
+// with code, in the upgrade response or in an error message on the websocket
+func (t *Target) expectRefused(header http.Header, code string) error {
+	conn, resp, err := t.dial(t.terminalPath(), header)
+	if err != nil {
+		if resp == nil {
+			return err
+		}
+		var envelope terminal.APIError
+		if json.NewDecoder(io.LimitReader(resp.Body, 4<<10)).Decode(&envelope) != nil ||
+			envelope.Error.Code != code {
+			return fmt.Errorf("refused with %s, want error %s", resp.Status, code)
+		}
+		return nil
+	}
+	defer conn.Close()
+	var msg terminal.TerminalMessage
+	conn.SetReadDeadline(time.Now().Add(t.Timeout))
+	if err := conn.ReadJSON(&msg); err != nil {
+		return fmt.Errorf("read error message: %v", err)
+	}
+	if msg.Op != "error" || msg.Code != code {
+		return fmt.Errorf("got %q message with code %q, want error %s", msg.Op, msg.Code, code)
+	}
+	return nil
+}
+
+func checkMissingCredentials(t *Target) error {
+	return t.expectRefused(nil, terminal.ErrCodeTokenInvalid)
+}
+
+func checkInvalidCredentials(t *Target) error {
+	return t.expectRefused(t.BadAuth, terminal.ErrCodeTokenInvalid)
+}
+
+func checkHandshake(t *Target) error {
+	s, err := t.open(t.terminalPath())
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	if s.id == "" {
+		return errors.New("capabilities carry no session id")
+	}
+	supported := s.caps.Version == terminal.ProtocolVersion
+	for _, version := range s.caps.Versions {
+		supported = supported || version == terminal.ProtocolVersion
+	}
+	if !supported {
+		return fmt.Errorf("server speaks versions %v, not %d", s.caps.Versions, terminal.ProtocolVersion)
+	}
+	for _, feature := range []string{terminal.FeatureBinary, terminal.FeatureResize, terminal.FeatureExit} {
+		if !contains(s.caps.Features, feature) {
+			return fmt.Errorf("feature %q is not offered", feature)
+		}
+	}
+	return nil
+}
+
+func checkStdinStdout(t *Target) error {
+	s, err := t.open(t.terminalPath())
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	// the shell computes the marker, so an echo of the input doesn't match
+	if err := s.send("echo conformance-$((40+2))\r"); err != nil {
+		return err
+	}
+	return s.expect("conformance-42")
+}
+
+func checkResize(t *Target) error {
+	s, err := t.open(t.terminalPath())
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	time.Sleep(settle)
+	if err := s.send("stty size\r"); err != nil {
+		return err
+	}
+	if err := s.expect("24 80"); err != nil {
+		return fmt.Errorf("initial size: %v", err)
+	}
+	if err := s.conn.WriteJSON(terminal.TerminalMessage{Op: "resize", Rows: 33, Cols: 101}); err != nil {
+		return err
+	}
+	time.Sleep(settle)
+	if err := s.send("stty size\r"); err != nil {
+		return err
+	}
+	return s.expect("33 101")
+}
+
+func checkReattach(t *Target) error {
+	var group terminal.SessionGroup
+	if err := t.do("POST", "/api/v1/groups", &group); err != nil {
+		return err
+	}
+	defer t.do("DELETE", "/api/v1/groups/"+group.ID, nil)
+
+	s, err := t.open(t.terminalPath() + "?group=" + url.QueryEscape(group.ID))
+	if err != nil {
+		return err
+	}
+	if err := s.send("echo before-$((1+1))\r"); err != nil {
+		s.close()
+		return err
+	}
+	if err := s.expect("before-2"); err != nil {
+		s.close()
+		return err
+	}
+	// a dropped connection keeps grouped sessions running
+	s.close()
+	time.Sleep(settle)
+
+	var listed terminal.SessionGroup
+	if err := t.do("GET", "/api/v1/groups/"+group.ID, &listed); err != nil {
+		return err
+	}
+	found := false
+	for _, info := range listed.Sessions {
+		found = found || info.ID == s.id
+	}
+	if !found {
+		return fmt.Errorf("session %s is not running after the client left", s.id)
+	}
+	joined, err := t.open("/api/v1/sessions/" + url.PathEscape(s.id) + "/join?write=true")
+	if err != nil {
+		return fmt.Errorf("reattach: %v", err)
+	}
+	defer joined.close()
+	if joined.id != s.id {
+		return fmt.Errorf("reattached session %s, want %s", joined.id, s.id)
+	}
+	if err := joined.send("echo after-$((2+2))\r"); err != nil {
+		return err
+	}
+	return joined.expect("after-4")
+}
+
+func checkExitCode(t *Target) error {
+	s, err := t.open(t.terminalPath())
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	if err := s.send("exit 3\r"); err != nil {
+		return err
+	}
+	exit, err := s.wait()
+	if err != nil {
+		return err
+	}
+	if exit == nil {
+		return errors.New("no exit message before the connection was closed")
+	}
+	if exit.Code != 3 {
+		return fmt.Errorf("exit code %d, want 3", exit.Code)
+	}
+	return nil
+}
+
+func checkClose(t *Target) error {
+	s, err := t.open(t.terminalPath())
+	if err != nil {
+		return err
+	}
+	if err := s.send("exit\r"); err != nil {
+		s.close()
+		return err
+	}
+	exit, err := s.wait()
+	s.close()
+	if err != nil {
+		return err
+	}
+	if exit == nil || exit.Code != 0 {
+		return fmt.Errorf("exit message %+v, want code 0", exit)
+	}
+	// the session is gone once its shell ended
+	time.Sleep(settle)
+	conn, resp, err := t.dial("/api/v1/sessions/"+url.PathEscape(s.id)+"/join", t.Auth)
+	if err == nil {
+		defer conn.Close()
+		var msg terminal.TerminalMessage
+		conn.SetReadDeadline(time.Now().Add(t.Timeout))
+		if err := conn.ReadJSON(&msg); err == nil && msg.Op == "capabilities" {
+			return fmt.Errorf("session %s can still be joined after it ended", s.id)
+		}
+		return nil
+	}
+	if resp != nil && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("join of the ended session: %s, want 404", resp.Status)
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
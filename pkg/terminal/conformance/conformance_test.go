@@ -0,0 +1,91 @@
+//go:build conformance
+// +build conformance
+
+package conformance
+
+import (
+	"flag"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	".."
+	"../terminaltest"
+)
+
+// The checks run with the conformance build tag, against a local server
+// with simulated shells unless -url is given:
+//
+//	go test -tags conformance ./pkg/terminal/conformance -args -url http://localhost:8000 -pod web -token $TOKEN
+var (
+	serverURL = flag.String("url", "", "URL of the terminal server, a local server with simulated shells if empty")
+	namespace = flag.String("namespace", "default", "namespace of the pod")
+	pod       = flag.String("pod", "conformance", "pod to open the terminals in, its container needs a POSIX shell")
+	container = flag.String("container", "", "container of the pod, the server picks one if empty")
+	token     = flag.String("token", os.Getenv("TERMINAL_TOKEN"), "JWT or API key of an admin, defaults to $TERMINAL_TOKEN")
+	sign      = flag.String("sign-token", "",
+		"sign a token for this admin with the built-in key instead of -token, for servers with the default -jwt-key-source")
+	insecure    = flag.Bool("insecure", false, "skip the verification of the server certificate")
+	stepTimeout = flag.Duration("step-timeout", 10*time.Second, "how long to wait for the server in every step")
+)
+
+func TestConformance(t *testing.T) {
+	target := &Target{
+		URL:       *serverURL,
+		Namespace: *namespace,
+		Pod:       *pod,
+		Container: *container,
+		Auth:      http.Header{},
+		BadAuth:   http.Header{"Authorization": {"Bearer not-a-token"}},
+		Timeout:   *stepTimeout,
+		Insecure:  *insecure,
+	}
+	if *serverURL == "" {
+		server := localServer(target)
+		defer server.Close()
+	} else {
+		bearer := *token
+		if *sign != "" {
+			signed, err := terminal.SignJwtToken(terminaltest.Claims(*sign, terminal.RoleAdmin))
+			if err != nil {
+				t.Fatal(err)
+			}
+			bearer = signed
+		}
+		if bearer == "" {
+			t.Fatal("-token or -sign-token is required with -url")
+		}
+		target.Auth.Set("Authorization", "Bearer "+bearer)
+	}
+
+	for _, check := range Checks {
+		check := check
+		t.Run(check.Name, func(t *testing.T) {
+			if err := check.Run(target); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// localServer starts a server with simulated shells for target, which
+// answer the commands of the checks like a POSIX shell
+func localServer(target *Target) *terminaltest.Server {
+	server := terminaltest.NewServer(terminaltest.Pod(target.Namespace, target.Pod))
+	server.Executor.Shell = terminaltest.Script{
+		Echo: true,
+		Replies: map[string]string{
+			"echo conformance-$((40+2))": "conformance-42",
+			"echo before-$((1+1))":       "before-2",
+			"echo after-$((2+2))":        "after-4",
+		},
+	}
+	// requests need the user header, so missing credentials are refused
+	server.User = nil
+	server.Users["conformance"] = terminaltest.Claims("conformance", terminal.RoleAdmin)
+	target.URL = server.URL
+	target.Auth.Set(terminaltest.UserHeader, "conformance")
+	target.BadAuth = http.Header{terminaltest.UserHeader: {"nobody"}}
+	return server
+}
@@ -0,0 +1,83 @@
+package terminal
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var allowedOrigins = Flags.String("allowed-origins", "",
+	"comma separated origins of front-ends allowed to open terminals and call the API, like "+
+		"https://console.company.com or https://*.company.com, \"*\" allows every origin, "+
+		"the server's own origin is always allowed")
+
+const (
+	corsAllowHeaders  = "Authorization, Content-Type, X-API-Key, Upload-Offset, Upload-Length, Tus-Resumable, traceparent"
+	corsExposeHeaders = "Location, Retry-After, Upload-Offset, Upload-Length, Tus-Resumable, X-Continue"
+	corsAllowMethods  = "GET, POST, PATCH, HEAD, DELETE, OPTIONS"
+)
+
+// OriginAllowed reports whether a browser page from origin may use the server
+// Requests without an Origin header don't come from a browser page
+func OriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, pattern := range splitList(*allowedOrigins) {
+		if originMatches(pattern, u) {
+			return true
+		}
+	}
+	return false
+}
+
+// originMatches matches an origin against an allowlist entry. Entries without
+// a scheme match both http and https, a leading "*." matches subdomains
+func originMatches(pattern string, origin *url.URL) bool {
+	if pattern == "*" {
+		return true
+	}
+	host := pattern
+	if i := strings.Index(pattern, "://"); i >= 0 {
+		if !strings.EqualFold(pattern[:i], origin.Scheme) {
+			return false
+		}
+		host = pattern[i+3:]
+	}
+	host = strings.TrimSuffix(host, "/")
+	if strings.HasPrefix(host, "*.") {
+		return strings.HasSuffix(strings.ToLower(origin.Host), strings.ToLower(host[1:]))
+	}
+	return strings.EqualFold(host, origin.Host)
+}
+
+// CORS is a negroni middleware answering preflight requests and allowing
+// cross-origin calls from -allowed-origins. Other origins get no CORS headers,
+// so browsers don't expose the responses to their pages
+func CORS(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	origin := r.Header.Get("Origin")
+	if origin == "" || !OriginAllowed(r) {
+		next(rw, r)
+		return
+	}
+	header := rw.Header()
+	header.Add("Vary", "Origin")
+	header.Set("Access-Control-Allow-Origin", origin)
+	header.Set("Access-Control-Expose-Headers", corsExposeHeaders)
+	if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+		header.Set("Access-Control-Allow-Methods", corsAllowMethods)
+		header.Set("Access-Control-Allow-Headers", corsAllowHeaders)
+		header.Set("Access-Control-Max-Age", "600")
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+	next(rw, r)
+}
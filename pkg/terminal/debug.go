@@ -0,0 +1,169 @@
+package terminal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"time"
+)
+
+// debugFrameHistory is the number of frames remembered per client
+const debugFrameHistory = 32
+
+// SessionDebug is the admin view of the internals of a live session, for
+// diagnosing frozen terminals
+type SessionDebug struct {
+	SessionInfo
+	Channels    map[string]ChannelDepth `json:"channels"`
+	Connections []ConnectionDebug       `json:"connections"`
+	Goroutines  []GoroutineGroup        `json:"goroutines"`
+}
+
+// ChannelDepth is the number of queued and the capacity of a channel or buffer
+type ChannelDepth struct {
+	Len int `json:"len"`
+	Cap int `json:"cap"`
+}
+
+// ConnectionDebug describes the websocket of one attached client
+type ConnectionDebug struct {
+	ReadOnly        bool          `json:"readOnly"`
+	ProtocolVersion int           `json:"protocolVersion"`
+	Features        []string      `json:"features"`
+	Output          ChannelDepth  `json:"output"`
+	DroppedBytes    uint64        `json:"droppedBytes"`
+	LatencyMs       float64       `json:"latencyMs"`
+	Frames          []FrameRecord `json:"frames"`
+}
+
+// FrameRecord describes a websocket frame without its content, which may
+// contain keystrokes like passwords
+type FrameRecord struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"`
+	Op        string    `json:"op,omitempty"`
+	Size      int       `json:"size"`
+}
+
+// GoroutineGroup is a set of goroutines of the session blocked in the same stack
+type GoroutineGroup struct {
+	Role  string   `json:"role"`
+	Count int      `json:"count"`
+	Stack []string `json:"stack"`
+}
+
+// frameLog remembers the last frames of a connection
+type frameLog struct {
+	lock   sync.Mutex
+	frames [debugFrameHistory]FrameRecord
+	next   int
+	count  int
+	// counters of the session the connection is attached to, nil before
+	counters *sessionCounters
+}
+
+// countInto counts the frames of the connection in the stats of its session
+func (l *frameLog) countInto(counters *sessionCounters) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.counters = counters
+}
+
+// record remembers a frame, op is empty for terminal data
+func (l *frameLog) record(direction string, op string, size int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.counters != nil {
+		l.counters.countFrame(direction)
+	}
+	l.frames[l.next] = FrameRecord{time.Now(), direction, op, size}
+	l.next = (l.next + 1) % debugFrameHistory
+	if l.count < debugFrameHistory {
+		l.count++
+	}
+}
+
+func (l *frameLog) last() []FrameRecord {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	frames := make([]FrameRecord, 0, l.count)
+	for i := l.count; i > 0; i-- {
+		frames = append(frames, l.frames[(l.next-i+debugFrameHistory)%debugFrameHistory])
+	}
+	return frames
+}
+
+// DebugSession returns the internals of a live session
+func DebugSession(sessionId string) (*SessionDebug, error) {
+	t := getSession(sessionId)
+	if t == nil {
+		return nil, ErrSessionNotFound
+	}
+	debug := &SessionDebug{
+		SessionInfo: t.info(),
+		Channels: map[string]ChannelDepth{
+			"stdin":  {len(t.receiver), cap(t.receiver)},
+			"resize": {len(t.sizeChan), cap(t.sizeChan)},
+		},
+		Goroutines: sessionGoroutines(sessionId),
+	}
+	for _, c := range t.attachedClients() {
+		buffered, size, dropped := c.output.stats()
+		debug.Connections = append(debug.Connections, ConnectionDebug{
+			ReadOnly:        c.readOnly,
+			ProtocolVersion: c.version,
+			Features:        c.featureList(),
+			Output:          ChannelDepth{buffered, size},
+			DroppedBytes:    dropped,
+			LatencyMs:       c.latencyMillis(),
+			Frames:          c.frames.last(),
+		})
+	}
+	return debug, nil
+}
+
+// labelGoroutine tags the calling goroutine, and the ones it starts, with the
+// session so they can be found in the goroutine profile
+func (t *TerminalSession) labelGoroutine(role string) {
+	labels := pprof.Labels("session", t.id, "role", role)
+	pprof.SetGoroutineLabels(pprof.WithLabels(context.Background(), labels))
+}
+
+// sessionGoroutines groups the goroutines labeled with the session by stack
+func sessionGoroutines(sessionId string) []GoroutineGroup {
+	var profile bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&profile, 1); err != nil {
+		return nil
+	}
+
+	groups := []GoroutineGroup{}
+	for _, block := range strings.Split(profile.String(), "\n\n") {
+		var group GoroutineGroup
+		matched := false
+		for i, line := range strings.Split(block, "\n") {
+			switch {
+			case i == 0:
+				fmt.Sscanf(line, "%d @", &group.Count)
+			case strings.HasPrefix(line, "# labels: "):
+				var labels map[string]string
+				json.Unmarshal([]byte(strings.TrimPrefix(line, "# labels: ")), &labels)
+				matched = labels["session"] == sessionId
+				group.Role = labels["role"]
+			case strings.HasPrefix(line, "#\t"):
+				// #	0x4f6c3a	pkg.function+0x5a	/path/file.go:42
+				fields := strings.Split(line, "\t")
+				if len(fields) == 4 {
+					group.Stack = append(group.Stack, fields[2]+" "+fields[3])
+				}
+			}
+		}
+		if matched {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
@@ -0,0 +1,312 @@
+package terminal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var (
+	debugPodsEnabled = Flags.Bool("debug-pods", true,
+		"allow creating debug pods, viewers and safe mode users never may")
+	debugPodTTL = Flags.Duration("debug-pod-ttl", time.Hour,
+		"how long a debug pod may run, it is deleted earlier once its terminal ended")
+	debugImages = Flags.String("debug-images", "busybox:1.36,nicolaka/netshoot:latest",
+		"comma separated images standalone debug pods may run, the first one is the default")
+	debugPodCPU          = Flags.String("debug-pod-cpu", "500m", "CPU limit of standalone debug pods")
+	debugPodMemory       = Flags.String("debug-pod-memory", "256Mi", "memory limit of standalone debug pods")
+	debugPodNodeSelector = Flags.String("debug-pod-node-selector", "",
+		"comma separated key=value node labels standalone debug pods are scheduled on")
+)
+
+const (
+	// debugLabel marks the pods created for debugging
+	debugLabel            = "terminal.k8s.io/debug"
+	debugUserAnnotation   = "terminal.k8s.io/debug-user"
+	debugSourceAnnotation = "terminal.k8s.io/debug-source"
+	// debugPodStartTimeout bounds waiting for a debug pod to run
+	debugPodStartTimeout = 2 * time.Minute
+	// debugPodConnectTimeout is how long a debug pod waits for its terminal
+	debugPodConnectTimeout = 5 * time.Minute
+)
+
+// ErrDebugPodFailed is returned for debug pods that stopped before they ran
+var ErrDebugPodFailed = errors.New("debug pod failed to start")
+
+// DebugPodAllowed reports whether role may create debug pods
+func DebugPodAllowed(role string) bool {
+	return *debugPodsEnabled && role != RoleViewer && !IsSafeModeRole(role)
+}
+
+// DebugPod is a pod created for a terminal, it is deleted when the terminal
+// ends
+type DebugPod struct {
+	Namespace string    `json:"namespace"`
+	Pod       string    `json:"pod"`
+	Container string    `json:"container"`
+	Expires   time.Time `json:"expires"`
+	// Terminal is the path of the terminal websocket of the pod
+	Terminal string `json:"terminal"`
+}
+
+// DebugCronJob creates a pod from the job template of a CronJob whose
+// containers sleep instead of running their command, so the job can be
+// debugged in a terminal. Init containers are dropped, they would run the
+// job's side effects like migrations. The labels of the template are dropped,
+// so Services and controllers selecting the job's pods ignore it
+func (k *KubeClient) DebugCronJob(ctx context.Context, namespace string, cronJob string, user string) (*DebugPod, error) {
+	clientset, err := k.Clientset()
+	if err != nil {
+		return nil, err
+	}
+	getCtx, cancel := requestContext(ctx)
+	defer cancel()
+	getCtx, span := startClientSpan(getCtx, "get", "cronjobs", namespace)
+	cj, err := clientset.BatchV1().CronJobs(namespace).Get(getCtx, cronJob, metav1.GetOptions{})
+	EndSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	spec := *cj.Spec.JobTemplate.Spec.Template.Spec.DeepCopy()
+	spec.InitContainers = nil
+	sleep := []string{"sleep", strconv.Itoa(int(debugPodTTL.Seconds()))}
+	for i := range spec.Containers {
+		c := &spec.Containers[i]
+		c.Command, c.Args = sleep, nil
+		c.LivenessProbe, c.ReadinessProbe, c.StartupProbe, c.Lifecycle = nil, nil, nil, nil
+	}
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: cronJob + "-debug-",
+			Annotations:  map[string]string{debugSourceAnnotation: "cronjob/" + cronJob},
+		},
+		Spec: spec,
+	}
+	return k.createDebugPod(ctx, namespace, pod, user, *debugPodTTL)
+}
+
+// DebugPodRequest asks for a standalone debug pod
+type DebugPodRequest struct {
+	// Image is one of -debug-images, the first one if empty
+	Image string `json:"image"`
+	// TTLMinutes shortens -debug-pod-ttl
+	TTLMinutes int `json:"ttlMinutes"`
+}
+
+// DebugImages returns the images standalone debug pods may run
+func DebugImages() []string {
+	return splitList(*debugImages)
+}
+
+// CreateDebugPod starts a pod of its own in namespace running one of
+// -debug-images, a scratchpad inside the cluster that leaves the workloads
+// alone
+func (k *KubeClient) CreateDebugPod(ctx context.Context, namespace string, req DebugPodRequest, user string) (*DebugPod, error) {
+	images := DebugImages()
+	if req.Image == "" && len(images) > 0 {
+		req.Image = images[0]
+	}
+	if !containsString(images, req.Image) {
+		return nil, fmt.Errorf("%w: image must be one of %s", ErrInvalidInput, strings.Join(images, ", "))
+	}
+	ttl := *debugPodTTL
+	if req.TTLMinutes < 0 || time.Duration(req.TTLMinutes)*time.Minute > ttl {
+		return nil, fmt.Errorf("%w: ttlMinutes must be at most %v", ErrInvalidInput, ttl)
+	} else if req.TTLMinutes > 0 {
+		ttl = time.Duration(req.TTLMinutes) * time.Minute
+	}
+	limits := v1.ResourceList{}
+	for name, value := range map[v1.ResourceName]string{v1.ResourceCPU: *debugPodCPU, v1.ResourceMemory: *debugPodMemory} {
+		if value == "" {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return nil, fmt.Errorf("debug pod %s limit: %v", name, err)
+		}
+		limits[name] = quantity
+	}
+	nodeSelector := map[string]string{}
+	for _, label := range splitList(*debugPodNodeSelector) {
+		parts := strings.SplitN(label, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("debug pod node selector %q is not key=value", label)
+		}
+		nodeSelector[parts[0]] = parts[1]
+	}
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "debug-",
+			Annotations:  map[string]string{debugSourceAnnotation: "image/" + req.Image},
+		},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{{
+				Name:      "debug",
+				Image:     req.Image,
+				Command:   []string{"sleep", strconv.Itoa(int(ttl.Seconds()))},
+				Resources: v1.ResourceRequirements{Limits: limits, Requests: limits},
+			}},
+			NodeSelector:                 nodeSelector,
+			AutomountServiceAccountToken: new(bool),
+		},
+	}
+	return k.createDebugPod(ctx, namespace, pod, user, ttl)
+}
+
+// createDebugPod creates pod for user, waits until it runs and deletes it
+// if no terminal was opened within debugPodConnectTimeout
+func (k *KubeClient) createDebugPod(ctx context.Context, namespace string, pod *v1.Pod, user string,
+	lifetime time.Duration) (*DebugPod, error) {
+
+	clientset, err := k.Clientset()
+	if err != nil {
+		return nil, err
+	}
+	ttl := int64(lifetime.Seconds())
+	grace := int64(1)
+	if pod.Labels == nil {
+		pod.Labels = map[string]string{}
+	}
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	pod.Labels[debugLabel] = "true"
+	pod.Annotations[debugUserAnnotation] = user
+	pod.Spec.RestartPolicy = v1.RestartPolicyNever
+	pod.Spec.ActiveDeadlineSeconds = &ttl
+	// sleep ignores SIGTERM as PID 1
+	pod.Spec.TerminationGracePeriodSeconds = &grace
+
+	createCtx, cancel := requestContext(ctx)
+	createCtx, span := startClientSpan(createCtx, "create", "pods", namespace)
+	created, err := clientset.CoreV1().Pods(namespace).Create(createCtx, pod, metav1.CreateOptions{})
+	EndSpan(span, err)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	audit(AuditEvent{
+		Type:      "debug.create",
+		User:      user,
+		Namespace: namespace,
+		Pod:       created.Name,
+		Details:   map[string]string{"source": created.Annotations[debugSourceAnnotation]},
+	})
+	trackDebugPod(k, namespace, created.Name)
+	if err := k.waitRunning(ctx, namespace, created.Name); err != nil {
+		k.deleteDebugPod(namespace, created.Name)
+		return nil, err
+	}
+	return &DebugPod{
+		Namespace: namespace,
+		Pod:       created.Name,
+		Container: created.Spec.Containers[0].Name,
+		Expires:   created.CreationTimestamp.Add(lifetime),
+		Terminal:  "/api/v1/terminals/" + namespace + "/" + created.Name + "/" + created.Spec.Containers[0].Name,
+	}, nil
+}
+
+// waitRunning polls a pod until it runs
+func (k *KubeClient) waitRunning(ctx context.Context, namespace string, name string) error {
+	clientset, err := k.Clientset()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, debugPodStartTimeout)
+	defer cancel()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		pod, err := clientset.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		switch pod.Status.Phase {
+		case v1.PodRunning:
+			return nil
+		case v1.PodFailed, v1.PodSucceeded:
+			return fmt.Errorf("%w: %s", ErrDebugPodFailed, pod.Status.Reason)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: not running after %v", ErrDebugPodFailed, debugPodStartTimeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+func (k *KubeClient) deleteDebugPod(namespace string, name string) {
+	debugPods.lock.Lock()
+	delete(debugPods.pods, namespace+"/"+name)
+	debugPods.lock.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	clientset, err := k.Clientset()
+	if err != nil {
+		log.Println("deleteDebugPod err", err)
+		return
+	}
+	err = clientset.CoreV1().Pods(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil {
+		log.Println("deleteDebugPod err", err)
+		return
+	}
+	log.Printf("deleted debug pod %s/%s", namespace, name)
+}
+
+// trackedDebugPod counts the sessions of a debug pod
+type trackedDebugPod struct {
+	kube     *KubeClient
+	sessions int
+	timer    *time.Timer
+}
+
+var debugPods = struct {
+	lock sync.Mutex
+	pods map[string]*trackedDebugPod
+}{pods: make(map[string]*trackedDebugPod)}
+
+func trackDebugPod(kube *KubeClient, namespace string, name string) {
+	debugPods.lock.Lock()
+	defer debugPods.lock.Unlock()
+	debugPods.pods[namespace+"/"+name] = &trackedDebugPod{
+		kube: kube,
+		timer: time.AfterFunc(debugPodConnectTimeout, func() {
+			log.Printf("debug pod %s/%s was not used", namespace, name)
+			kube.deleteDebugPod(namespace, name)
+		}),
+	}
+}
+
+// claimDebugPod counts a session started in a pod
+func claimDebugPod(namespace string, name string) {
+	debugPods.lock.Lock()
+	defer debugPods.lock.Unlock()
+	if tracked, ok := debugPods.pods[namespace+"/"+name]; ok {
+		tracked.timer.Stop()
+		tracked.sessions++
+	}
+}
+
+// releaseDebugPod deletes a debug pod once its last session ended
+func releaseDebugPod(namespace string, name string) {
+	debugPods.lock.Lock()
+	tracked, ok := debugPods.pods[namespace+"/"+name]
+	if ok {
+		tracked.sessions--
+		ok = tracked.sessions <= 0
+	}
+	debugPods.lock.Unlock()
+	if ok {
+		go tracked.kube.deleteDebugPod(namespace, name)
+	}
+}
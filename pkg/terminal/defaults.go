@@ -0,0 +1,132 @@
+package terminal
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var defaultsConfigMap = Flags.String("defaults-configmap", "terminal-defaults",
+	"ConfigMap of a namespace whose default-container and shell keys apply to pods without annotations, none if empty")
+
+const (
+	defaultContainerAnnotation = "terminal.k8s.io/default-container"
+	// kubectlDefaultContainerAnnotation is honored like kubectl exec does
+	kubectlDefaultContainerAnnotation = "kubectl.kubernetes.io/default-container"
+	shellAnnotation                   = "terminal.k8s.io/shell"
+	// defaultsCacheTTL bounds how long a changed ConfigMap goes unnoticed
+	defaultsCacheTTL = time.Minute
+)
+
+// TerminalDefaults are the container and shell of terminals that don't ask
+// for one, empty fields are picked automatically
+type TerminalDefaults struct {
+	Container string
+	Shell     string
+}
+
+type defaultsKey struct {
+	kube      *KubeClient
+	namespace string
+}
+
+type cachedDefaults struct {
+	defaults TerminalDefaults
+	expires  time.Time
+}
+
+var defaultsCache = struct {
+	lock    sync.Mutex
+	entries map[defaultsKey]cachedDefaults
+}{entries: make(map[defaultsKey]cachedDefaults)}
+
+// getPod fetches a pod from the pod cache or else within the request timeout,
+// the pod must not be modified
+func (k *KubeClient) getPod(ctx context.Context, namespace string, pod string) (*v1.Pod, error) {
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+	if p, ok, err := k.cachedPod(ctx, namespace, pod); ok || err != nil {
+		return p, err
+	}
+	clientset, err := k.Clientset()
+	if err != nil {
+		return nil, err
+	}
+	ctx, span := startClientSpan(ctx, "get", "pods", namespace)
+	p, err := clientset.CoreV1().Pods(namespace).Get(ctx, pod, metav1.GetOptions{})
+	EndSpan(span, err)
+	return p, err
+}
+
+// terminalDefaults returns the defaults of a pod, its annotations win over
+// the -defaults-configmap of its namespace
+func (k *KubeClient) terminalDefaults(ctx context.Context, pod *v1.Pod) TerminalDefaults {
+	defaults := k.namespaceDefaults(ctx, pod.Namespace)
+	if container := pod.Annotations[defaultContainerAnnotation]; container != "" {
+		defaults.Container = container
+	} else if container := pod.Annotations[kubectlDefaultContainerAnnotation]; container != "" {
+		defaults.Container = container
+	}
+	if shell := pod.Annotations[shellAnnotation]; shell != "" {
+		defaults.Shell = shell
+	}
+	return defaults
+}
+
+// namespaceDefaults reads the -defaults-configmap of a namespace, a missing
+// or unreadable ConfigMap has no defaults
+func (k *KubeClient) namespaceDefaults(ctx context.Context, namespace string) TerminalDefaults {
+	if *defaultsConfigMap == "" || k == nil {
+		return TerminalDefaults{}
+	}
+	key := defaultsKey{k, namespace}
+	defaultsCache.lock.Lock()
+	cached, ok := defaultsCache.entries[key]
+	defaultsCache.lock.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.defaults
+	}
+
+	var defaults TerminalDefaults
+	clientset, err := k.Clientset()
+	if err != nil {
+		return defaults
+	}
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+	ctx, span := startClientSpan(ctx, "get", "configmaps", namespace)
+	cm, err := clientset.CoreV1().ConfigMaps(namespace).Get(ctx, *defaultsConfigMap, metav1.GetOptions{})
+	EndSpan(span, err)
+	switch {
+	case err == nil:
+		defaults.Container = strings.TrimSpace(cm.Data["default-container"])
+		defaults.Shell = strings.TrimSpace(cm.Data["shell"])
+	case !apierrors.IsNotFound(err):
+		// cached all the same, so a missing RBAC rule doesn't cost a request
+		// per session
+		log.Println("namespaceDefaults err", err)
+	}
+	defaultsCache.lock.Lock()
+	defaultsCache.entries[key] = cachedDefaults{defaults, time.Now().Add(defaultsCacheTTL)}
+	defaultsCache.lock.Unlock()
+	return defaults
+}
+
+// defaultShells returns the shells to try for a configured shell, sh stays
+// the fallback. Shells are started without a shell around them, so values
+// with arguments are ignored
+func defaultShells(shell string) []string {
+	if shell == "" || len(strings.Fields(shell)) != 1 {
+		return nil
+	}
+	if shell == "sh" || shell == "/bin/sh" {
+		return []string{shell}
+	}
+	return []string{shell, "sh"}
+}
@@ -0,0 +1,105 @@
+package terminal
+
+// Discovery is served at /.well-known/terminal-server.json, so CLI clients,
+// kubectl plugins and other front-ends can configure themselves from the
+// server's hostname
+type Discovery struct {
+	ProtocolVersions []int             `json:"protocolVersions"`
+	Capabilities     Capabilities      `json:"capabilities"`
+	Auth             DiscoveryAuth     `json:"auth"`
+	Features         map[string]bool   `json:"features"`
+	Endpoints        map[string]string `json:"endpoints"`
+}
+
+// DiscoveryAuth tells clients how to authenticate
+type DiscoveryAuth struct {
+	// TokenParameter is the query parameter carrying the JWT, empty if
+	// tokens in URLs are not accepted
+	TokenParameter string `json:"tokenParameter"`
+	// AuthMessage tells whether websockets may authenticate with a first
+	// {"op":"auth"} message
+	AuthMessage bool `json:"authMessage"`
+	// Methods are the enabled authenticators, see -auth
+	Methods []string `json:"methods"`
+	// WebSocketProtocol must be offered by websockets passing the token as
+	// a subprotocol
+	WebSocketProtocol string   `json:"webSocketProtocol"`
+	Roles             []string `json:"roles"`
+}
+
+// GetDiscovery describes the server, endpoints are URL templates below baseURL
+// (http or https) and wsURL (ws or wss)
+func GetDiscovery(baseURL string, wsURL string) Discovery {
+	return Discovery{
+		ProtocolVersions: []int{ProtocolVersion},
+		Capabilities:     serverCapabilities(),
+		Auth: DiscoveryAuth{
+			TokenParameter:    tokenParameter(),
+			AuthMessage:       *authMessage,
+			Methods:           splitList(*authChain),
+			WebSocketProtocol: WebSocketProtocol,
+			Roles:             []string{RoleAdmin, RoleViewer, RoleRestricted},
+		},
+		Features: serverFeatures(),
+		Endpoints: map[string]string{
+			"terminal":        wsURL + "/api/v1/terminals/{namespace}/{pod}/{container}",
+			"terminalByLabel": wsURL + "/api/v1/terminals/{namespace}/by-label/{selector}",
+			"presign":         baseURL + "/api/v1/terminals/presign",
+			"portForward":     wsURL + "/api/v1/portforward/{namespace}/{pod}/{port}",
+			"mux":             wsURL + "/api/v1/mux/{namespace}/{pod}",
+			"joinSession":     wsURL + "/api/v1/sessions/{sessionId}/join",
+			"pairSession":     wsURL + "/api/v1/sessions/{sessionId}/support",
+			"sessionStats":    baseURL + "/api/v1/sessions/{sessionId}/stats",
+			"recordings":      baseURL + "/api/v1/recordings",
+			"playRecording":   wsURL + "/api/v1/recordings/{id}/play",
+			"diffRecordings":  baseURL + "/api/v1/recordings/diff?base={id}&other={id}",
+			"groups":          baseURL + "/api/v1/groups",
+			"namespaces":      baseURL + "/api/v1/namespaces",
+			"workloads":       baseURL + "/api/v1/workloads/{namespace}",
+			"workloadPods":    baseURL + "/api/v1/workloads/{namespace}/{kind}/{name}/pods",
+			"fs":              baseURL + "/api/v1/fs/{namespace}/{pod}/{container}",
+			"debugCronJob":    baseURL + "/api/v1/jobs/{namespace}/{cronjob}/debug",
+			"debugPods":       baseURL + "/api/v1/debug-pods/{namespace}",
+			"watchPods":       baseURL + "/api/v1/watch/pods/{namespace}",
+			"uploads":         baseURL + "/api/v1/uploads",
+			"adminSessions":   baseURL + "/api/v1/admin/sessions",
+			"adminApprovals":  baseURL + "/api/v1/admin/approvals",
+			"version":         baseURL + "/version",
+			"login":           baseURL + "/auth/login",
+			"refreshToken":    baseURL + "/auth/refresh",
+		},
+	}
+}
+
+// serverFeatures tells which optional features are enabled
+func serverFeatures() map[string]bool {
+	return map[string]bool{
+		"sharedSessions":     true,
+		"supportPairing":     true,
+		"sessionGroups":      true,
+		"portForward":        *portForwardEnabled,
+		"mux":                true,
+		"debugPods":          *debugPodsEnabled,
+		"uploads":            true,
+		"encodings":          true,
+		"noTty":              true,
+		"tokenRefresh":       true,
+		"oidcLogin":          OIDCEnabled(),
+		"presign":            *presignEnabled,
+		"heartbeats":         *heartbeatInterval > 0,
+		"safeMode":           *safeModeRoles != "",
+		"captureEnvironment": *captureEnvironment,
+		"namespaceAccessSAR": *namespaceAccess == "sar",
+		"approvals":          *approvalNamespaces != "",
+		"recordings":         RecordingEnabled(),
+		"audit":              *auditSink != "",
+		"notifications":      *notifyWebhook != "",
+	}
+}
+
+func tokenParameter() string {
+	if !*allowQueryToken {
+		return ""
+	}
+	return "jwtToken"
+}
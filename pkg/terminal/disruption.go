@@ -0,0 +1,279 @@
+package terminal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var (
+	disruptionChecks = Flags.Bool("disruption-checks", true,
+		"warn in the terminal if the pod's node is cordoned or draining or the pod is about to be evicted")
+	maxPinDuration = Flags.Duration("max-pin-duration", 0,
+		"longest time the pin query parameter may keep the cluster autoscaler from evicting a pod, 0 disables pinning")
+)
+
+const (
+	// safeToEvictAnnotation makes the cluster autoscaler leave a pod's node alone
+	safeToEvictAnnotation = "cluster-autoscaler.kubernetes.io/safe-to-evict"
+	// pinnedUntilAnnotation records until when a terminal pinned a pod, so a
+	// pin left behind by a restart can be recognized and removed
+	pinnedUntilAnnotation = "terminal.k8s.io/pinned-until"
+	// previousSafeToEvictAnnotation keeps the safe-to-evict value a pod had
+	// before it was pinned, it is put back when the pin ends
+	previousSafeToEvictAnnotation = "terminal.k8s.io/previous-safe-to-evict"
+)
+
+// taints the cluster autoscaler puts on nodes it is about to remove
+const (
+	toBeDeletedTaint       = "ToBeDeletedByClusterAutoscaler"
+	deletionCandidateTaint = "DeletionCandidateOfClusterAutoscaler"
+)
+
+// DisruptionWarnings describes why the shell in a pod may disappear soon: the
+// pod is terminating or targeted for eviction, or its node is cordoned or
+// being scaled down. Checks the server may not run are skipped
+func (k *KubeClient) DisruptionWarnings(ctx context.Context, namespace string, pod string) ([]string, error) {
+	if !*disruptionChecks {
+		return nil, nil
+	}
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+	clientset, err := k.Clientset()
+	if err != nil {
+		return nil, err
+	}
+	spanCtx, span := startClientSpan(ctx, "get", "pods", namespace)
+	p, err := clientset.CoreV1().Pods(namespace).Get(spanCtx, pod, metav1.GetOptions{})
+	EndSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	var warnings []string
+	if p.DeletionTimestamp != nil {
+		warnings = append(warnings, fmt.Sprintf("pod %s is terminating", pod))
+	}
+	for _, c := range p.Status.Conditions {
+		if c.Type == v1.DisruptionTarget && c.Status == v1.ConditionTrue {
+			warnings = append(warnings, fmt.Sprintf("pod %s is about to be evicted: %s", pod, c.Reason))
+		}
+	}
+	if p.Spec.NodeName == "" {
+		return warnings, nil
+	}
+
+	spanCtx, span = startClientSpan(ctx, "get", "nodes", "")
+	node, err := clientset.CoreV1().Nodes().Get(spanCtx, p.Spec.NodeName, metav1.GetOptions{})
+	EndSpan(span, err)
+	if err != nil {
+		// reading nodes needs a cluster role the server may lack
+		log.Println("DisruptionWarnings node err", err)
+		return warnings, nil
+	}
+	draining := false
+	if node.Spec.Unschedulable {
+		warnings = append(warnings, fmt.Sprintf("node %s is cordoned, it may be drained", node.Name))
+		draining = true
+	}
+	for _, taint := range node.Spec.Taints {
+		switch taint.Key {
+		case toBeDeletedTaint:
+			warnings = append(warnings, fmt.Sprintf("node %s is being removed by the cluster autoscaler", node.Name))
+			draining = true
+		case deletionCandidateTaint:
+			warnings = append(warnings, fmt.Sprintf("node %s is a scale-down candidate of the cluster autoscaler", node.Name))
+		}
+	}
+	if draining {
+		if warning := k.budgetWarning(ctx, p); warning != "" {
+			warnings = append(warnings, warning)
+		}
+	}
+	return warnings, nil
+}
+
+// budgetWarning tells whether a PodDisruptionBudget holds off the eviction
+// of a pod on a draining node
+func (k *KubeClient) budgetWarning(ctx context.Context, pod *v1.Pod) string {
+	clientset, err := k.Clientset()
+	if err != nil {
+		return ""
+	}
+	ctx, span := startClientSpan(ctx, "list", "poddisruptionbudgets", pod.Namespace)
+	budgets, err := clientset.PolicyV1().PodDisruptionBudgets(pod.Namespace).List(ctx, metav1.ListOptions{})
+	EndSpan(span, err)
+	if err != nil {
+		log.Println("DisruptionWarnings pdb err", err)
+		return ""
+	}
+	for _, pdb := range budgets.Items {
+		selector, err := metav1.LabelSelectorAsSelector(pdb.Spec.Selector)
+		if err != nil || selector.Empty() || !selector.Matches(labels.Set(pod.Labels)) {
+			continue
+		}
+		if pdb.Status.DisruptionsAllowed == 0 {
+			return fmt.Sprintf("PodDisruptionBudget %s currently blocks the eviction of the pod", pdb.Name)
+		}
+		return fmt.Sprintf("PodDisruptionBudget %s allows %d more disruptions, the pod may be evicted any time",
+			pdb.Name, pdb.Status.DisruptionsAllowed)
+	}
+	return "no PodDisruptionBudget protects the pod, it may be evicted any time"
+}
+
+// PinPod asks the cluster autoscaler not to evict a pod for duration, by
+// setting its safe-to-evict annotation. The previous annotation is put back
+// when the pin expires unless a later pin extended it
+func (k *KubeClient) PinPod(ctx context.Context, namespace string, pod string, duration time.Duration) error {
+	if *maxPinDuration <= 0 {
+		return fmt.Errorf("%w: pinning pods is disabled", ErrInvalidInput)
+	}
+	if duration <= 0 || duration > *maxPinDuration {
+		return fmt.Errorf("%w: pin must last between 1 minute and %v", ErrInvalidInput, *maxPinDuration)
+	}
+	clientset, err := k.Clientset()
+	if err != nil {
+		return err
+	}
+	getCtx, cancel := requestContext(ctx)
+	defer cancel()
+	p, err := clientset.CoreV1().Pods(namespace).Get(getCtx, pod, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	until := time.Now().Add(duration).UTC().Format(time.RFC3339)
+	annotations := map[string]interface{}{
+		safeToEvictAnnotation: "false",
+		pinnedUntilAnnotation: until,
+	}
+	// a pinned pod's safe-to-evict is the pin's, the previous one was saved
+	if _, pinned := p.Annotations[pinnedUntilAnnotation]; !pinned {
+		if previous, ok := p.Annotations[safeToEvictAnnotation]; ok {
+			annotations[previousSafeToEvictAnnotation] = previous
+		}
+	}
+	if err := k.annotatePod(ctx, namespace, pod, annotations); err != nil {
+		return err
+	}
+	time.AfterFunc(duration, func() { k.unpinPod(namespace, pod, until) })
+	return nil
+}
+
+// StartPinSweep unpins the pods whose pins expired while no replica ran, once
+// the cluster is connected, and schedules the unpinning of the others
+func StartPinSweep(kube *KubeClient) {
+	if *maxPinDuration <= 0 {
+		return
+	}
+	go func() {
+		backoff := minConnectBackoff
+		for {
+			err := kube.sweepPins()
+			if err != ErrClusterUnavailable {
+				if err != nil {
+					log.Println("sweep pins err", err)
+				}
+				return
+			}
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxConnectBackoff {
+				backoff = maxConnectBackoff
+			}
+		}
+	}()
+}
+
+// sweepPins goes through the pods of every namespace for pins
+func (k *KubeClient) sweepPins() error {
+	clientset, err := k.Clientset()
+	if err != nil {
+		return err
+	}
+	opts := metav1.ListOptions{Limit: 500}
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		pods, err := clientset.CoreV1().Pods("").List(ctx, opts)
+		cancel()
+		if err != nil {
+			return err
+		}
+		for _, p := range pods.Items {
+			until, ok := p.Annotations[pinnedUntilAnnotation]
+			if !ok {
+				continue
+			}
+			namespace, name := p.Namespace, p.Name
+			expiry, err := time.Parse(time.RFC3339, until)
+			if err != nil || time.Until(expiry) <= 0 {
+				log.Printf("unpinning pod %s/%s, its pin expired at %s", namespace, name, until)
+				k.unpinPod(namespace, name, until)
+				continue
+			}
+			time.AfterFunc(time.Until(expiry), func() { k.unpinPod(namespace, name, until) })
+		}
+		if pods.Continue == "" {
+			return nil
+		}
+		opts.Continue = pods.Continue
+	}
+}
+
+// unpinPod removes a pin that expired at until and puts back the previous
+// safe-to-evict annotation
+func (k *KubeClient) unpinPod(namespace string, pod string, until string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	clientset, err := k.Clientset()
+	if err != nil {
+		log.Println("unpinPod err", err)
+		return
+	}
+	p, err := clientset.CoreV1().Pods(namespace).Get(ctx, pod, metav1.GetOptions{})
+	if err != nil {
+		// a pod that is gone needs no unpinning
+		return
+	}
+	if p.Annotations[pinnedUntilAnnotation] != until {
+		return
+	}
+	annotations := map[string]interface{}{
+		safeToEvictAnnotation:         nil,
+		pinnedUntilAnnotation:         nil,
+		previousSafeToEvictAnnotation: nil,
+	}
+	if previous, ok := p.Annotations[previousSafeToEvictAnnotation]; ok {
+		annotations[safeToEvictAnnotation] = previous
+	}
+	if err := k.annotatePod(ctx, namespace, pod, annotations); err != nil {
+		log.Println("unpinPod err", err)
+	}
+}
+
+// annotatePod merges annotations into a pod, nil values remove them
+func (k *KubeClient) annotatePod(ctx context.Context, namespace string, pod string,
+	annotations map[string]interface{}) error {
+
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+	clientset, err := k.Clientset()
+	if err != nil {
+		return err
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": annotations},
+	})
+	if err != nil {
+		return err
+	}
+	ctx, span := startClientSpan(ctx, "patch", "pods", namespace)
+	_, err = clientset.CoreV1().Pods(namespace).Patch(ctx, pod, types.MergePatchType, patch, metav1.PatchOptions{})
+	EndSpan(span, err)
+	return err
+}
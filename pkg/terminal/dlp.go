@@ -0,0 +1,181 @@
+package terminal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+)
+
+var dlpConfigFile = Flags.String("dlp-config", "",
+	"JSON file with the patterns masked in recordings and audited commands and the commands that need a confirmation")
+
+// StreamFilter is a stage of the DLP filter chain. Filters see output and
+// typed command lines before they are recorded or audited, never what
+// reaches the shell or the clients. Chunks of output are filtered one by one,
+// so a secret split across two of them is missed
+type StreamFilter interface {
+	// Mask returns p with the secrets it found replaced, p must not be modified
+	Mask(p []byte) []byte
+}
+
+// MaskRule replaces matches of Pattern, a regular expression, with Replace,
+// which may refer to groups like ${1}. It defaults to ****
+type MaskRule struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+	Replace string `json:"replace,omitempty"`
+}
+
+// DLPConfig is the content of -dlp-config
+type DLPConfig struct {
+	// Mask defaults to AWS access keys and passwords passed with -p or --password
+	Mask []MaskRule `json:"mask"`
+	// Confirm lists regular expressions of typed command lines that only run
+	// after the user pressed Enter a second time
+	Confirm []string `json:"confirm"`
+	// AuditCommands audits every typed command line, masked
+	AuditCommands bool `json:"auditCommands"`
+}
+
+var defaultMaskRules = []MaskRule{
+	{Name: "aws-access-key", Pattern: `\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`},
+	{Name: "password-flag", Pattern: `((?:^|\s)(?:-p|--password[= ]))\S+`, Replace: "${1}****"},
+}
+
+var (
+	streamFilters  []StreamFilter
+	confirmPattern []*regexp.Regexp
+	auditCommands  bool
+)
+
+// RegisterStreamFilter appends a filter to the chain, before sessions start
+func RegisterStreamFilter(filter StreamFilter) {
+	streamFilters = append(streamFilters, filter)
+}
+
+// patternFilter masks the matches of a MaskRule
+type patternFilter struct {
+	pattern *regexp.Regexp
+	replace []byte
+}
+
+func (f *patternFilter) Mask(p []byte) []byte {
+	if !f.pattern.Match(p) {
+		return p
+	}
+	return f.pattern.ReplaceAll(p, f.replace)
+}
+
+// LoadDLPConfig reads -dlp-config, it is called on startup so a broken
+// config stops the server instead of leaking what it should mask
+func LoadDLPConfig() error {
+	if *dlpConfigFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(*dlpConfigFile)
+	if err != nil {
+		return err
+	}
+	var config DLPConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return err
+	}
+	if config.Mask == nil {
+		config.Mask = defaultMaskRules
+	}
+	for _, rule := range config.Mask {
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return fmt.Errorf("mask %s: %v", rule.Name, err)
+		}
+		if rule.Replace == "" {
+			rule.Replace = "****"
+		}
+		RegisterStreamFilter(&patternFilter{pattern: pattern, replace: []byte(rule.Replace)})
+	}
+	if confirmPattern, err = compilePatterns(config.Confirm); err != nil {
+		return err
+	}
+	auditCommands = config.AuditCommands
+	return nil
+}
+
+// maskStream runs p through the filter chain
+func maskStream(p []byte) []byte {
+	for _, filter := range streamFilters {
+		p = filter.Mask(p)
+	}
+	return p
+}
+
+// dangerousCommand returns the confirm pattern line matches, "" if none does
+func dangerousCommand(line string) string {
+	for _, re := range confirmPattern {
+		if re.MatchString(line) {
+			return re.String()
+		}
+	}
+	return ""
+}
+
+// guardInput follows the command lines typed into the shell, audits them with
+// auditCommands and holds back the newline of dangerous ones until the user
+// confirms them. It returns the part of p that reaches the shell. Like
+// inspectInput this sees keystrokes, so completion, history and line editing
+// with the cursor keys get past it
+func (t *TerminalSession) guardInput(p []byte) []byte {
+	if len(confirmPattern) == 0 && !auditCommands {
+		return p
+	}
+	t.dlpLock.Lock()
+	defer t.dlpLock.Unlock()
+	if t.dlpPending != "" {
+		line := t.dlpPending
+		t.dlpPending = ""
+		if len(p) > 0 && (p[0] == '\r' || p[0] == '\n') {
+			audit(t.auditEvent("dlp.confirmed", map[string]string{"command": string(maskStream([]byte(line)))}))
+			t.auditCommand(line)
+			return p[:1]
+		}
+		t.Toast("\r\ncommand cancelled\r\n")
+		// ^U clears the line the shell still holds
+		return []byte{0x15}
+	}
+	for i, b := range p {
+		switch b {
+		case '\r', '\n':
+			line := string(t.dlpLine)
+			t.dlpLine = nil
+			if pattern := dangerousCommand(line); pattern != "" {
+				t.dlpPending = line
+				audit(t.auditEvent("dlp.held", map[string]string{
+					"command": string(maskStream([]byte(line))),
+					"pattern": pattern,
+				}))
+				t.Toast("\r\nthis command needs a confirmation, press Enter to run it or any other key to cancel\r\n")
+				// the rest of a paste is dropped
+				return p[:i]
+			}
+			t.auditCommand(line)
+		case '\b', 0x7f:
+			if len(t.dlpLine) > 0 {
+				t.dlpLine = t.dlpLine[:len(t.dlpLine)-1]
+			}
+		case 0x03, 0x15:
+			// ^C and ^U discard the line
+			t.dlpLine = nil
+		default:
+			if (b >= 0x20 || b == '\t') && len(t.dlpLine) < maxInspectedLine {
+				t.dlpLine = append(t.dlpLine, b)
+			}
+		}
+	}
+	return p
+}
+
+func (t *TerminalSession) auditCommand(line string) {
+	if auditCommands && line != "" {
+		audit(t.auditEvent("session.command", map[string]string{"command": string(maskStream([]byte(line)))}))
+	}
+}
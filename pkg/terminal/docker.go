@@ -0,0 +1,389 @@
+package terminal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+
+	"k8s.io/client-go/util/exec"
+)
+
+var (
+	execBackendName = Flags.String("exec-backend", "kubernetes",
+		`where terminals run: "kubernetes", or "docker" for local containers without a cluster`)
+	dockerHost = Flags.String("docker-host", dockerHostDefault(),
+		"Docker Engine API of -exec-backend docker as unix:///path or tcp://host:port")
+)
+
+// composeProjectLabel names the docker-compose project of a container, it
+// stands in for the namespace of terminal URLs
+const composeProjectLabel = "com.docker.compose.project"
+
+// dockerNamespace is the namespace of containers outside of compose projects
+const dockerNamespace = "default"
+
+func dockerHostDefault() string {
+	if host := os.Getenv("DOCKER_HOST"); host != "" {
+		return host
+	}
+	return "unix:///var/run/docker.sock"
+}
+
+// Executor runs the commands of sessions, uploads and previews
+type Executor interface {
+	// ExecPod runs cmd with a TTY, or without one writing stderr apart if
+	// stderr isn't nil
+	ExecPod(ctx context.Context, container string, pod string, namespace string, cmd []string,
+		ptyHandler PtyHandler, stderr io.Writer) error
+	ExecCommand(ctx context.Context, container string, pod string, namespace string, cmd []string,
+		stdin io.Reader, stdout io.Writer, stderr io.Writer) error
+}
+
+var docker *dockerClient
+
+// SetupExecBackend connects to the backend of -exec-backend, it is called on startup
+func SetupExecBackend() error {
+	switch *execBackendName {
+	case "kubernetes":
+		return nil
+	case "docker":
+		d, err := newDockerClient(*dockerHost)
+		if err != nil {
+			return err
+		}
+		if err := d.do(context.Background(), "GET", "/_ping", nil, nil); err != nil {
+			return fmt.Errorf("docker %s: %v", *dockerHost, err)
+		}
+		docker = d
+		return nil
+	}
+	return fmt.Errorf("unknown exec backend %q", *execBackendName)
+}
+
+// DockerBackend reports whether terminals run in local docker containers
+// instead of Kubernetes pods. The pod of a terminal URL is then the container
+// name or id, the namespace its compose project or "default", and the
+// container is ignored
+func DockerBackend() bool {
+	return docker != nil
+}
+
+// executor replaces the backends of -exec-backend, see SetExecutor
+var executor Executor
+
+// SetExecutor runs the commands of all sessions, uploads and previews with e
+// instead of the backend of -exec-backend, for services embedding the package
+// that bring their own transport. Call it before the first session starts
+func SetExecutor(e Executor) {
+	executor = e
+}
+
+// execBackendOf returns the backend commands run with
+func execBackendOf(kube *KubeClient) Executor {
+	if executor != nil {
+		return executor
+	}
+	if docker != nil {
+		return docker
+	}
+	return kube
+}
+
+// dockerClient speaks the Docker Engine API, which Podman serves as well
+type dockerClient struct {
+	network string
+	addr    string
+	client  *http.Client
+}
+
+func newDockerClient(host string) (*dockerClient, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+	d := &dockerClient{}
+	switch u.Scheme {
+	case "unix":
+		d.network, d.addr = "unix", u.Path
+	case "tcp":
+		d.network, d.addr = "tcp", u.Host
+	default:
+		return nil, fmt.Errorf("unsupported docker host %q", host)
+	}
+	d.client = &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return d.dial(ctx)
+		},
+	}}
+	return d, nil
+}
+
+func (d *dockerClient) dial(ctx context.Context) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, d.network, d.addr)
+}
+
+func (d *dockerClient) newRequest(ctx context.Context, method string, path string, body interface{}) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "http://docker"+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+// do calls the API and decodes the response into out if it isn't nil
+func (d *dockerClient) do(ctx context.Context, method string, path string, body interface{}, out interface{}) error {
+	req, err := d.newRequest(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return dockerError(resp)
+	}
+	if out == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// dockerError returns the message of an error response, like "No such
+// container: web" or "Container web is not running"
+func dockerError(resp *http.Response) error {
+	var body struct {
+		Message string `json:"message"`
+	}
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(data, &body) != nil || body.Message == "" {
+		body.Message = resp.Status
+	}
+	return errors.New("docker: " + body.Message)
+}
+
+// resolveContainer returns the id of a running container of namespace
+func (d *dockerClient) resolveContainer(ctx context.Context, namespace string, name string) (string, error) {
+	var container struct {
+		ID    string `json:"Id"`
+		State struct {
+			Running bool `json:"Running"`
+		} `json:"State"`
+		Config struct {
+			Labels map[string]string `json:"Labels"`
+		} `json:"Config"`
+	}
+	if err := d.do(ctx, "GET", "/containers/"+url.PathEscape(name)+"/json", nil, &container); err != nil {
+		return "", err
+	}
+	project := container.Config.Labels[composeProjectLabel]
+	if project == "" {
+		project = dockerNamespace
+	}
+	if project != namespace {
+		return "", fmt.Errorf("docker: No such container: %s in %s", name, namespace)
+	}
+	if !container.State.Running {
+		return "", fmt.Errorf("docker: Container %s is not running", name)
+	}
+	return container.ID, nil
+}
+
+// startExec creates an exec instance and attaches to it. The returned reader
+// carries the output, the connection takes the input
+func (d *dockerClient) startExec(ctx context.Context, namespace string, name string, cmd []string,
+	tty bool, stdin bool) (string, net.Conn, *bufio.Reader, error) {
+
+	id, err := d.resolveContainer(ctx, namespace, name)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	var created struct {
+		ID string `json:"Id"`
+	}
+	err = d.do(ctx, "POST", "/containers/"+id+"/exec", map[string]interface{}{
+		"AttachStdin":  stdin,
+		"AttachStdout": true,
+		"AttachStderr": true,
+		"Tty":          tty,
+		"Cmd":          cmd,
+	}, &created)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	// the start request is hijacked for the raw stream, like docker exec does
+	req, err := d.newRequest(ctx, "POST", "/exec/"+created.ID+"/start", map[string]interface{}{
+		"Detach": false,
+		"Tty":    tty,
+	})
+	if err != nil {
+		return "", nil, nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tcp")
+	conn, err := d.dial(ctx)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return "", nil, nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return "", nil, nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols && resp.StatusCode != http.StatusOK {
+		err := dockerError(resp)
+		conn.Close()
+		return "", nil, nil, err
+	}
+	return created.ID, conn, reader, nil
+}
+
+// exitError returns the exit status of a finished exec instance like the
+// Kubernetes executor does, nil for status 0
+func (d *dockerClient) exitError(ctx context.Context, execId string) error {
+	var inspect struct {
+		ExitCode int `json:"ExitCode"`
+	}
+	if err := d.do(ctx, "GET", "/exec/"+execId+"/json", nil, &inspect); err != nil {
+		return err
+	}
+	if inspect.ExitCode == 0 {
+		return nil
+	}
+	return exec.CodeExitError{
+		Err:  fmt.Errorf("command terminated with exit code %d", inspect.ExitCode),
+		Code: inspect.ExitCode,
+	}
+}
+
+// closeOnDone closes conn once ctx is done, the returned func stops waiting
+func closeOnDone(ctx context.Context, conn net.Conn) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// closeWrite ends the input of an exec instance
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
+
+func (d *dockerClient) ExecPod(ctx context.Context, container string, pod string, namespace string, cmd []string,
+	ptyHandler PtyHandler, stderr io.Writer) error {
+
+	if stderr != nil {
+		return d.ExecCommand(ctx, container, pod, namespace, cmd, ptyHandler, ptyHandler, stderr)
+	}
+	execId, conn, output, err := d.startExec(ctx, namespace, pod, cmd, true, true)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer closeOnDone(ctx, conn)()
+
+	go func() {
+		for size := ptyHandler.Next(); size != nil; size = ptyHandler.Next() {
+			query := "?h=" + strconv.Itoa(int(size.Height)) + "&w=" + strconv.Itoa(int(size.Width))
+			if err := d.do(ctx, "POST", "/exec/"+execId+"/resize"+query, nil, nil); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		io.Copy(conn, ptyHandler)
+		closeWrite(conn)
+	}()
+	io.Copy(ptyHandler, output)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return d.exitError(ctx, execId)
+}
+
+func (d *dockerClient) ExecCommand(ctx context.Context, container string, pod string, namespace string,
+	cmd []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+
+	execId, conn, output, err := d.startExec(ctx, namespace, pod, cmd, false, stdin != nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer closeOnDone(ctx, conn)()
+
+	if stdin != nil {
+		go func() {
+			io.Copy(conn, stdin)
+			closeWrite(conn)
+		}()
+	}
+	if err := demuxDockerStream(output, stdout, stderr); err != nil && ctx.Err() == nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return d.exitError(ctx, execId)
+}
+
+// demuxDockerStream splits the output of an exec without TTY, every frame has
+// an 8 byte header of the stream (1 stdout, 2 stderr) and the payload size
+func demuxDockerStream(r io.Reader, stdout io.Writer, stderr io.Writer) error {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		w := stdout
+		if header[0] == 2 {
+			w = stderr
+		}
+		if w == nil {
+			w = ioutil.Discard
+		}
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.CopyN(w, r, size); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package terminal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+var (
+	egressProxy = Flags.String("egress-proxy", "",
+		"proxy URL for calls to external services (webhooks, identity providers, blob storage), "+
+			"HTTPS_PROXY and HTTP_PROXY are used if empty")
+	egressNoProxy = Flags.String("egress-no-proxy", "",
+		"comma separated hosts, domains and CIDRs reached without -egress-proxy, NO_PROXY if empty")
+	egressCABundle = Flags.String("egress-ca-bundle", "",
+		"PEM file of CA certificates trusted for external services in addition to the system ones")
+)
+
+// egressTimeout bounds calls to external services that don't set their own
+const egressTimeout = 30 * time.Second
+
+var (
+	egressOnce      sync.Once
+	egressTransport *http.Transport
+	egressErr       error
+)
+
+// EgressClient returns an HTTP client for server-initiated calls to external
+// services. It is configured separately from the Kubernetes client, as egress
+// to the internet often takes another path than traffic inside the cluster
+func EgressClient(timeout time.Duration) (*http.Client, error) {
+	egressOnce.Do(func() {
+		egressTransport, egressErr = newEgressTransport()
+	})
+	if egressErr != nil {
+		return nil, egressErr
+	}
+	if timeout <= 0 {
+		timeout = egressTimeout
+	}
+	return &http.Client{Transport: egressTransport, Timeout: timeout}, nil
+}
+
+func newEgressTransport() (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	proxyConfig := httpproxy.FromEnvironment()
+	if *egressProxy != "" {
+		proxyConfig.HTTPProxy = *egressProxy
+		proxyConfig.HTTPSProxy = *egressProxy
+	}
+	if *egressNoProxy != "" {
+		proxyConfig.NoProxy = *egressNoProxy
+	}
+	proxyFunc := proxyConfig.ProxyFunc()
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		return proxyFunc(req.URL)
+	}
+
+	if *egressCABundle != "" {
+		pem, err := ioutil.ReadFile(*egressCABundle)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("egress CA bundle contains no certificates")
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return transport, nil
+}
@@ -0,0 +1,80 @@
+package terminal
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/transform"
+)
+
+// ErrUnknownEncoding is returned for encodings that can't be transcoded
+var ErrUnknownEncoding = errors.New("unknown terminal encoding")
+
+// LookupEncoding returns the encoding of a session's encoding parameter, like
+// gbk, gb18030, big5, shift_jis, euc-jp or euc-kr. It returns nil for UTF-8,
+// which needs no transcoding
+func LookupEncoding(name string) (encoding.Encoding, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" || name == "utf-8" || name == "utf8" {
+		return nil, nil
+	}
+	enc, err := htmlindex.Get(name)
+	if err != nil {
+		return nil, ErrUnknownEncoding
+	}
+	if enc == encoding.Nop {
+		return nil, nil
+	}
+	return enc, nil
+}
+
+// transcoder converts a stream chunk by chunk. Incomplete multi-byte
+// sequences at the end of a chunk are kept for the next one, as output is
+// split at arbitrary bytes
+type transcoder struct {
+	lock    sync.Mutex
+	t       transform.Transformer
+	pending []byte
+}
+
+func newTranscoder(t transform.Transformer) *transcoder {
+	return &transcoder{t: t}
+}
+
+// newSessionTranscoders returns the transcoders of a session's output to UTF-8
+// and of its input back to enc, nil for UTF-8 sessions
+func newSessionTranscoders(name string) (*transcoder, *transcoder) {
+	enc, err := LookupEncoding(name)
+	if err != nil || enc == nil {
+		return nil, nil
+	}
+	// characters the legacy encoding lacks are typed as a replacement
+	// instead of failing the stream
+	return newTranscoder(enc.NewDecoder()), newTranscoder(encoding.ReplaceUnsupported(enc.NewEncoder()))
+}
+
+func (c *transcoder) convert(p []byte) []byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	src := append(c.pending, p...)
+	out := make([]byte, 0, len(src)*2)
+	dst := make([]byte, len(src)*3+utf8Slack)
+	for {
+		nDst, nSrc, err := c.t.Transform(dst, src, false)
+		out = append(out, dst[:nDst]...)
+		src = src[nSrc:]
+		if err != transform.ErrShortDst || nDst == 0 && nSrc == 0 {
+			// ErrShortSrc leaves an incomplete sequence for the next chunk
+			break
+		}
+	}
+	c.pending = append([]byte(nil), src...)
+	return out
+}
+
+// utf8Slack makes room for a few replacement characters in tiny chunks
+const utf8Slack = 16
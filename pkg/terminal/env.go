@@ -0,0 +1,115 @@
+package terminal
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	allowedEnv = Flags.String("allowed-env", "TERM,COLORTERM,LANG,LC_*,TZ,HISTFILE,TRACE_ID",
+		"names of environment variables terminal requests may set, a trailing * matches a prefix, empty allows none")
+	wrapShell = Flags.Bool("wrap-shell", false,
+		"start shells with -wrap-shell-env as login shells, so colors, line editing and UTF-8 work in minimal images")
+	wrapShellEnv = Flags.String("wrap-shell-env", "TERM=xterm-256color,LANG=C.UTF-8",
+		"comma separated NAME=value pairs set for shells with -wrap-shell, the env of a request wins")
+	wrapShellLogin = Flags.Bool("wrap-shell-login", true, "start shells with -wrap-shell as login shells (-l)")
+)
+
+// maxEnvValue bounds the length of a variable set by a client
+const maxEnvValue = 4096
+
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// EnvAllowed reports whether clients may set the variable name, see -allowed-env
+func EnvAllowed(name string) bool {
+	if !envNamePattern.MatchString(name) {
+		return false
+	}
+	for _, allowed := range splitList(*allowedEnv) {
+		if prefix := strings.TrimSuffix(allowed, "*"); prefix != allowed {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseSessionEnv validates the NAME=value pairs a terminal request asks to
+// export into the shell
+func ParseSessionEnv(pairs []string) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	env := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%w: env must be NAME=value", ErrInvalidInput)
+		}
+		name, value := parts[0], parts[1]
+		if !EnvAllowed(name) {
+			return nil, fmt.Errorf("%w: env %s is not allowed", ErrInvalidInput, name)
+		}
+		if len(value) > maxEnvValue || strings.ContainsRune(value, 0) {
+			return nil, fmt.Errorf("%w: invalid value of env %s", ErrInvalidInput, name)
+		}
+		env[name] = value
+	}
+	return env, nil
+}
+
+// envCommand runs cmd through env(1), so the variables are exported into the
+// shell and everything it starts
+func envCommand(env map[string]string, cmd []string) []string {
+	if len(env) == 0 {
+		return cmd
+	}
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	wrapped := []string{"env"}
+	for _, name := range names {
+		wrapped = append(wrapped, name+"="+env[name])
+	}
+	return append(wrapped, cmd...)
+}
+
+// shellEnv returns the variables of a session's shell, -wrap-shell-env
+// under the env of the request
+func (t *TerminalSession) shellEnv() map[string]string {
+	if !t.wrapped() {
+		return t.meta.Env
+	}
+	env := make(map[string]string)
+	for _, pair := range splitList(*wrapShellEnv) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || !envNamePattern.MatchString(parts[0]) {
+			log.Printf("ignoring -wrap-shell-env %q", pair)
+			continue
+		}
+		env[parts[0]] = parts[1]
+	}
+	for name, value := range t.meta.Env {
+		env[name] = value
+	}
+	return env
+}
+
+// loginShell reports whether the shell is started with -l
+func (t *TerminalSession) loginShell() bool {
+	return t.wrapped() && *wrapShellLogin && !t.meta.SafeMode
+}
+
+// wrapped reports whether -wrap-shell applies, not to sessions without a TTY
+// whose output must stay plain, nor to Windows containers without env(1)
+func (t *TerminalSession) wrapped() bool {
+	return *wrapShell && !t.meta.NoTTY && !t.windows()
+}
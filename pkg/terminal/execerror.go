@@ -0,0 +1,150 @@
+package terminal
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/util/exec"
+)
+
+// ExecErrorCode classifies why a terminal could not be started
+type ExecErrorCode string
+
+const (
+	ExecErrPodNotFound       ExecErrorCode = "POD_NOT_FOUND"
+	ExecErrContainerNotFound ExecErrorCode = "CONTAINER_NOT_FOUND"
+	ExecErrPodNotRunning     ExecErrorCode = "POD_NOT_RUNNING"
+	ExecErrNoShell           ExecErrorCode = "NO_SHELL"
+	ExecErrForbidden         ExecErrorCode = "RBAC_DENIED"
+	ExecErrTimeout           ExecErrorCode = "NETWORK_TIMEOUT"
+	ExecErrPolicyDenied      ExecErrorCode = "POLICY_DENIED"
+	ExecErrQueueFull         ExecErrorCode = "QUEUE_FULL"
+	ExecErrQueueTimeout      ExecErrorCode = "QUEUE_TIMEOUT"
+	ExecErrApprovalDenied    ExecErrorCode = "APPROVAL_DENIED"
+	ExecErrApprovalTimeout   ExecErrorCode = "APPROVAL_TIMEOUT"
+	ExecErrMFAFailed         ExecErrorCode = "MFA_FAILED"
+	ExecErrPromptUnsupported ExecErrorCode = "PROMPT_UNSUPPORTED"
+	ExecErrUnknown           ExecErrorCode = "UNKNOWN"
+)
+
+// classifyExecError maps an error of ExecPod to an error code
+func classifyExecError(err error) ExecErrorCode {
+	if errors.Is(err, ErrCommandDenied) {
+		return ExecErrPolicyDenied
+	}
+	if err == ErrNoShell {
+		return ExecErrNoShell
+	}
+	if err == ErrSessionQueueFull {
+		return ExecErrQueueFull
+	}
+	if err == ErrSessionQueueTimeout {
+		return ExecErrQueueTimeout
+	}
+	if err == ErrApprovalDenied {
+		return ExecErrApprovalDenied
+	}
+	if err == ErrApprovalTimeout {
+		return ExecErrApprovalTimeout
+	}
+	if err == ErrMFAFailed || err == ErrPromptTimeout {
+		return ExecErrMFAFailed
+	}
+	if err == ErrPromptUnsupported {
+		return ExecErrPromptUnsupported
+	}
+	if apierrors.IsForbidden(err) || apierrors.IsUnauthorized(err) {
+		return ExecErrForbidden
+	}
+	if apierrors.IsNotFound(err) {
+		return ExecErrPodNotFound
+	}
+	if exitErr, ok := err.(exec.CodeExitError); ok {
+		// 126: not executable, 127: not found
+		if exitErr.Code == 126 || exitErr.Code == 127 {
+			return ExecErrNoShell
+		}
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return ExecErrTimeout
+	}
+
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(msg, "executable file not found"),
+		strings.Contains(msg, "no such file or directory"),
+		// Windows containers
+		strings.Contains(msg, "the system cannot find the file specified"):
+		return ExecErrNoShell
+	case strings.Contains(msg, "no such container"):
+		return ExecErrPodNotFound
+	case strings.Contains(msg, "container not found"),
+		strings.Contains(msg, "is not valid for pod"):
+		return ExecErrContainerNotFound
+	case strings.Contains(msg, "does not have a host assigned"),
+		strings.Contains(msg, "completed pod"),
+		strings.Contains(msg, "not running"),
+		strings.Contains(msg, "pod does not exist"):
+		return ExecErrPodNotRunning
+	case strings.Contains(msg, "timeout"),
+		strings.Contains(msg, "timed out"),
+		strings.Contains(msg, "connection refused"),
+		strings.Contains(msg, "connection reset"):
+		return ExecErrTimeout
+	}
+	return ExecErrUnknown
+}
+
+// isShellExit reports whether err only carries the exit status of a shell
+// that ran, which is how every session with a non-zero last command ends
+func isShellExit(err error) bool {
+	exitErr, ok := err.(exec.CodeExitError)
+	return ok && classifyExecError(exitErr) != ExecErrNoShell
+}
+
+// sendExecError reports a classified exec failure to every attached client
+func (t *TerminalSession) sendExecError(code ExecErrorCode, err error) {
+	execErrors.Add(1, string(code))
+	msg := TerminalMessage{Op: "error", Code: string(code), Data: err.Error()}
+	for _, c := range t.attachedClients() {
+		c.writeJSON(msg)
+	}
+}
+
+// ExitMessage is the last message of a session whose shell exited, sent once
+// the pending output was flushed
+type ExitMessage struct {
+	Op   string `json:"op"`
+	Code int    `json:"code"`
+	// Duration is how long the session ran, in seconds
+	Duration float64 `json:"duration"`
+}
+
+// exitCode returns the exit status of a shell that ended with err
+func exitCode(err error) int {
+	if exitErr, ok := err.(exec.CodeExitError); ok {
+		return exitErr.Code
+	}
+	return 0
+}
+
+// setExit stores the exit status of the shell, the writers send it to the
+// clients after their last output
+func (t *TerminalSession) setExit(code int) {
+	t.clientsLock.Lock()
+	defer t.clientsLock.Unlock()
+	t.exit = &ExitMessage{
+		Op:       "exit",
+		Code:     code,
+		Duration: time.Since(t.meta.Started).Seconds(),
+	}
+}
+
+func (t *TerminalSession) exitMessage() *ExitMessage {
+	t.clientsLock.Lock()
+	defer t.clientsLock.Unlock()
+	return t.exit
+}
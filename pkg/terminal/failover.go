@@ -0,0 +1,112 @@
+package terminal
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+var (
+	failoverAttempts = Flags.Int("failover-attempts", 3,
+		"how often the shell of a terminal opened by label moves to another pod when its pod died, 0 disables it")
+	failoverTimeout = Flags.Duration("failover-timeout", time.Minute,
+		"how long a failover waits for a Ready pod matching the label selector")
+)
+
+// failoverPollInterval is how often a failover looks for a Ready pod
+const failoverPollInterval = 2 * time.Second
+
+// podFailure returns why the shell's pod or container went away since
+// started, or "" if it still runs or that can't be told
+func (k *KubeClient) podFailure(t *TerminalSession, pod string, started time.Time) string {
+	p, err := k.getPod(t.ctx, t.meta.Namespace, pod)
+	if apierrors.IsNotFound(err) {
+		return "deleted"
+	} else if err != nil {
+		log.Printf("session %s: failover pod check err %v", t.id, err)
+		return ""
+	}
+	switch {
+	case p.DeletionTimestamp != nil:
+		return "terminating"
+	case p.Status.Phase == v1.PodFailed && p.Status.Reason != "":
+		// e.g. Evicted
+		return p.Status.Reason
+	case p.Status.Phase == v1.PodFailed || p.Status.Phase == v1.PodSucceeded:
+		return string(p.Status.Phase)
+	}
+	for _, status := range p.Status.ContainerStatuses {
+		if status.Name != t.meta.Container {
+			continue
+		}
+		if terminated := status.State.Terminated; terminated != nil {
+			return orDefault(terminated.Reason, "terminated")
+		}
+		// restarted under the shell, e.g. OOMKilled
+		if last := status.LastTerminationState.Terminated; last != nil && last.FinishedAt.After(started) {
+			return orDefault(last.Reason, "restarted")
+		}
+	}
+	return ""
+}
+
+// failover finds a Ready pod for the shell of a session opened by label
+// whose pod died, the user is told about the move. It returns false if the
+// pod is fine or no other one became Ready within -failover-timeout
+func (t *TerminalSession) failover(pod string, started time.Time) (string, bool) {
+	if t.meta.Selector == "" || DockerBackend() {
+		return "", false
+	}
+	reason := t.kube.podFailure(t, pod, started)
+	if reason == "" {
+		return "", false
+	}
+	log.Printf("session %s: pod %s went away (%s), failing over", t.id, pod, reason)
+	t.Toast(fmt.Sprintf("\r\nPod %s went away (%s), looking for another pod\r\n", pod, reason))
+
+	deadline := time.Now().Add(*failoverTimeout)
+	for {
+		next, _, err := t.kube.PickPod(t.ctx, t.meta.Namespace, t.meta.Selector, t.meta.Container)
+		if err == nil {
+			audit(t.auditEvent("session.failover", map[string]string{"from": pod, "to": next, "reason": reason}))
+			t.setPod(next)
+			registerSession(t.info())
+			t.Toast(fmt.Sprintf("Moved to pod %s, container %s, in a new shell\r\n", next, t.meta.Container))
+			return next, true
+		}
+		if err != ErrNoHealthyPod || time.Now().After(deadline) {
+			log.Printf("session %s: failover err %v", t.id, err)
+			t.Toast(fmt.Sprintf("No other pod is available: %v\r\n", err))
+			return "", false
+		}
+		select {
+		case <-time.After(failoverPollInterval):
+		case <-t.ctx.Done():
+			return "", false
+		}
+	}
+}
+
+func orDefault(value string, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// setPod moves a session to another pod
+func (t *TerminalSession) setPod(pod string) {
+	t.clientsLock.Lock()
+	defer t.clientsLock.Unlock()
+	t.meta.Pod = pod
+}
+
+// currentPod returns the pod of a session, it changes on failover
+func (t *TerminalSession) currentPod() string {
+	t.clientsLock.Lock()
+	defer t.clientsLock.Unlock()
+	return t.meta.Pod
+}
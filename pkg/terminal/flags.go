@@ -0,0 +1,16 @@
+package terminal
+
+import "flag"
+
+// Flags are the options of the terminal server. They are kept apart from
+// flag.CommandLine, so importing the package registers nothing; a binary
+// adds them to its own flags with AddFlags, services embedding the package
+// set them with Flags.Set or Flags.Parse
+var Flags = flag.NewFlagSet("terminal-server", flag.ContinueOnError)
+
+// AddFlags registers Flags on fs, like flag.CommandLine before flag.Parse
+func AddFlags(fs *flag.FlagSet) {
+	Flags.VisitAll(func(f *flag.Flag) {
+		fs.Var(f.Value, f.Name, f.Usage)
+	})
+}
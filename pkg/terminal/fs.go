@@ -0,0 +1,173 @@
+package terminal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var fsMaxEntries = Flags.Int("fs-max-entries", 1000, "maximum entries of a directory listing")
+
+// fsTimeout bounds listing a directory
+const fsTimeout = 15 * time.Second
+
+// listCommand prints two lines per entry of the directory $0: the stat of the
+// entry and the target of symlinks, empty for other files. stat -c works with
+// coreutils and busybox alike
+const listCommand = `test -e "$0" || { echo "no such file or directory" >&2; exit 1; }
+test -d "$0" || { echo "not a directory" >&2; exit 1; }
+cd -- "$0" || exit 1
+for f in .* *; do
+	case "$f" in .|..) continue;; esac
+	[ -e "$f" ] || [ -L "$f" ] || continue
+	stat -c '%f %s %Y %U %G %n' -- "$f" || continue
+	if [ -L "$f" ]; then readlink -- "$f"; else echo; fi
+done`
+
+// ErrPathNotFound is returned for directories that don't exist in the container
+var ErrPathNotFound = errors.New("no such file or directory")
+
+// FileEntry is a file of a directory listing
+type FileEntry struct {
+	Name string `json:"name"`
+	// Type is file, dir, symlink or other
+	Type     string    `json:"type"`
+	Mode     string    `json:"mode"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	User     string    `json:"user"`
+	Group    string    `json:"group"`
+	// Target is where a symlink points to
+	Target string `json:"target,omitempty"`
+}
+
+// DirectoryListing is the content of a directory of a container
+type DirectoryListing struct {
+	Path      string      `json:"path"`
+	Entries   []FileEntry `json:"entries"`
+	Truncated bool        `json:"truncated,omitempty"`
+}
+
+// ListDirectory lists dir in a container for user, for a file manager next
+// to the terminal
+func ListDirectory(ctx context.Context, kube *KubeClient, user string, namespace string, pod string,
+	container string, dir string) (*DirectoryListing, error) {
+
+	if !path.IsAbs(dir) {
+		return nil, fmt.Errorf("%w: path must be absolute", ErrInvalidInput)
+	}
+	dir = path.Clean(dir)
+	audit(AuditEvent{
+		Type:      "fs.list",
+		User:      user,
+		Namespace: namespace,
+		Pod:       pod,
+		Container: container,
+		Details:   map[string]string{"path": dir},
+	})
+	ctx, cancel := context.WithTimeout(ctx, fsTimeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	err := execBackendOf(kube).ExecCommand(ctx, container, pod, namespace,
+		[]string{"sh", "-c", listCommand, dir}, nil, &stdout, &stderr)
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		switch {
+		case msg == "no such file or directory":
+			return nil, ErrPathNotFound
+		case msg == "not a directory":
+			return nil, fmt.Errorf("%w: %s is not a directory", ErrInvalidInput, dir)
+		case msg != "":
+			return nil, errors.New(msg)
+		}
+		return nil, err
+	}
+	listing := &DirectoryListing{Path: dir, Entries: []FileEntry{}}
+	scanner := bufio.NewScanner(&stdout)
+	for scanner.Scan() {
+		entry, ok := parseStatLine(scanner.Text())
+		if !scanner.Scan() {
+			break
+		}
+		if !ok {
+			continue
+		}
+		if len(listing.Entries) == *fsMaxEntries {
+			listing.Truncated = true
+			break
+		}
+		entry.Target = scanner.Text()
+		listing.Entries = append(listing.Entries, entry)
+	}
+	return listing, nil
+}
+
+// parseStatLine parses "%f %s %Y %U %G %n", the raw mode in hex, the size,
+// the modification time in unix seconds, owner, group and name
+func parseStatLine(line string) (FileEntry, bool) {
+	fields := strings.SplitN(line, " ", 6)
+	if len(fields) != 6 {
+		return FileEntry{}, false
+	}
+	raw, err := strconv.ParseUint(fields[0], 16, 32)
+	if err != nil {
+		return FileEntry{}, false
+	}
+	size, _ := strconv.ParseInt(fields[1], 10, 64)
+	modified, _ := strconv.ParseInt(fields[2], 10, 64)
+	mode := fileMode(uint32(raw))
+	entry := FileEntry{
+		Name:     fields[5],
+		Type:     "other",
+		Mode:     mode.String(),
+		Size:     size,
+		Modified: time.Unix(modified, 0).UTC(),
+		User:     fields[3],
+		Group:    fields[4],
+	}
+	switch {
+	case mode.IsDir():
+		entry.Type = "dir"
+	case mode&os.ModeSymlink != 0:
+		entry.Type = "symlink"
+	case mode.IsRegular():
+		entry.Type = "file"
+	}
+	return entry, true
+}
+
+// fileMode converts a unix st_mode
+func fileMode(raw uint32) os.FileMode {
+	mode := os.FileMode(raw & 0777)
+	switch raw & 0170000 {
+	case 0040000:
+		mode |= os.ModeDir
+	case 0120000:
+		mode |= os.ModeSymlink
+	case 0010000:
+		mode |= os.ModeNamedPipe
+	case 0140000:
+		mode |= os.ModeSocket
+	case 0020000:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case 0060000:
+		mode |= os.ModeDevice
+	}
+	if raw&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if raw&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if raw&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
@@ -0,0 +1,128 @@
+package terminal
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+var groupDetachTimeout = Flags.Duration("group-detach-timeout", 5*time.Minute,
+	"how long the sessions of a group keep running without clients, so the group can be reattached")
+
+// ErrGroupNotFound is returned for groups that don't exist or belong to another user
+var ErrGroupNotFound = errors.New("session group not found")
+
+// SessionGroup is a set of related sessions, like the shell and log panes of
+// an IDE layout, that are closed and reattached together
+type SessionGroup struct {
+	ID       string        `json:"id"`
+	User     string        `json:"user"`
+	Created  time.Time     `json:"created"`
+	Sessions []SessionInfo `json:"sessions"`
+}
+
+var (
+	groupsLock sync.Mutex
+	groups     = make(map[string]*SessionGroup)
+)
+
+// CreateGroup starts an empty group of user, terminals join it with the
+// group query parameter
+func CreateGroup(user string) *SessionGroup {
+	id, _ := GenTerminalSessionId()
+	group := &SessionGroup{ID: id, User: user, Created: time.Now()}
+	groupsLock.Lock()
+	// forget groups that never got a session
+	for otherId, other := range groups {
+		if time.Since(other.Created) > *groupDetachTimeout && len(groupSessions(otherId)) == 0 {
+			delete(groups, otherId)
+		}
+	}
+	groups[id] = group
+	groupsLock.Unlock()
+	return &SessionGroup{ID: id, User: user, Created: group.Created, Sessions: []SessionInfo{}}
+}
+
+// CheckGroup verifies that user may add sessions to a group
+func CheckGroup(id string, user string) error {
+	groupsLock.Lock()
+	defer groupsLock.Unlock()
+	group, ok := groups[id]
+	if !ok || group.User != user {
+		return ErrGroupNotFound
+	}
+	return nil
+}
+
+// GetGroup returns a group of user with its running sessions, which clients
+// reattach to with the join endpoint
+func GetGroup(id string, user string) (*SessionGroup, error) {
+	if err := CheckGroup(id, user); err != nil {
+		return nil, err
+	}
+	groupsLock.Lock()
+	group := *groups[id]
+	groupsLock.Unlock()
+	group.Sessions = []SessionInfo{}
+	for _, session := range groupSessions(id) {
+		group.Sessions = append(group.Sessions, session.info())
+	}
+	return &group, nil
+}
+
+// CloseGroup ends every session of a group of user and removes the group
+func CloseGroup(id string, user string, reason string) error {
+	if err := CheckGroup(id, user); err != nil {
+		return err
+	}
+	groupsLock.Lock()
+	delete(groups, id)
+	groupsLock.Unlock()
+	for _, session := range groupSessions(id) {
+		KillSession(session.id, reason)
+	}
+	return nil
+}
+
+func groupSessions(id string) []*TerminalSession {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	var sessions []*TerminalSession
+	for _, session := range terminalSessions {
+		if session.meta.Group == id {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions
+}
+
+// leaveGroup removes the group of an ended session once none of its sessions
+// is left
+func leaveGroup(id string) {
+	if id == "" || len(groupSessions(id)) > 0 {
+		return
+	}
+	groupsLock.Lock()
+	delete(groups, id)
+	groupsLock.Unlock()
+}
+
+// keepDetached keeps a grouped session running after its last client left,
+// until a client reattaches or -group-detach-timeout passed. It is called
+// with clientsLock held and returns false for sessions that end right away
+func (t *TerminalSession) keepDetached() bool {
+	if t.meta.Group == "" || *groupDetachTimeout <= 0 {
+		return false
+	}
+	log.Printf("session %s: kept for %v to reattach group %s", t.id, *groupDetachTimeout, t.meta.Group)
+	t.detachedTimer = time.AfterFunc(*groupDetachTimeout, func() {
+		t.clientsLock.Lock()
+		defer t.clientsLock.Unlock()
+		if len(t.clients) == 0 && !t.closed {
+			log.Printf("session %s: nobody reattached", t.id)
+			t.cancel()
+		}
+	})
+	return true
+}
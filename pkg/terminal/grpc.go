@@ -0,0 +1,210 @@
+package terminal
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative terminal.proto
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var grpcListenAddr = Flags.String("grpc-listen", "",
+	"address of the gRPC TerminalService like :9000, it is off if empty")
+
+// StartGRPC serves TerminalService on -grpc-listen, with the TLS config of the
+// HTTP server if it has one. The returned func stops it
+func StartGRPC(kube *KubeClient, tlsConfig *tls.Config) (func(), error) {
+	if *grpcListenAddr == "" {
+		return func() {}, nil
+	}
+	listener, err := net.Listen("tcp", *grpcListenAddr)
+	if err != nil {
+		return nil, err
+	}
+	var options []grpc.ServerOption
+	if tlsConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	server := grpc.NewServer(options...)
+	RegisterTerminalServiceServer(server, &terminalService{kube: kube})
+	log.Println("Start gRPC server on", *grpcListenAddr)
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			log.Println("gRPC server err", err)
+		}
+	}()
+	return server.Stop, nil
+}
+
+type terminalService struct {
+	UnimplementedTerminalServiceServer
+	kube *KubeClient
+}
+
+// authenticateGRPC runs the authenticator chain on the authorization and
+// x-api-key metadata of a call
+func authenticateGRPC(ctx context.Context) (*MyCustomClaims, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	header := http.Header{}
+	for _, key := range []string{"authorization", "x-api-key"} {
+		for _, value := range md.Get(key) {
+			header.Add(key, value)
+		}
+	}
+	return authenticateHeader(ctx, header)
+}
+
+// Exec opens a terminal like the terminal websocket endpoint and streams it
+// until the session ends
+func (s *terminalService) Exec(stream TerminalService_ExecServer) error {
+	claims, err := authenticateGRPC(stream.Context())
+	if err != nil {
+		return status.Error(codes.Unauthenticated, "token is invalid or expired")
+	}
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	start := first.GetStart()
+	if start == nil || start.Namespace == "" || start.Pod == "" {
+		return status.Error(codes.InvalidArgument, "the first request must start a terminal in a namespace and pod")
+	}
+	if _, err := LookupEncoding(start.Encoding); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	meta, err := admitTerminal(stream.Context(), s.kube, claims, start.Namespace, start.Pod, start.Container)
+	switch {
+	case err == ErrStandbyInstance, err == ErrClusterUnavailable, err == ErrSessionQueueFull,
+		err == ErrAuditUnavailable:
+		return status.Error(codes.Unavailable, err.Error())
+	case err == ErrSessionLimit:
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case err == ErrNamespaceForbidden:
+		return status.Error(codes.PermissionDenied, err.Error())
+	case err != nil:
+		return status.Error(codes.NotFound, err.Error())
+	}
+
+	conn := newGRPCConn(stream, start)
+	meta.Encoding = start.Encoding
+	sessionId, err := startSession(stream.Context(), conn, s.kube, meta)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	log.Printf("start gRPC terminal: %s", sessionId)
+	go ExecTerminal(meta.Container, start.Pod, start.Namespace, sessionId)
+	<-conn.closed
+	return nil
+}
+
+// grpcConn adapts an Exec stream to the session stack, which speaks the
+// websocket protocol: stdout is sent as binary frames, control messages as
+// JSON text frames. The capabilities handshake is answered from the start
+// request
+type grpcConn struct {
+	stream TerminalService_ExecServer
+	start  *ExecStart
+	acked  bool
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newGRPCConn(stream TerminalService_ExecServer, start *ExecStart) *grpcConn {
+	return &grpcConn{stream: stream, start: start, closed: make(chan struct{})}
+}
+
+func (g *grpcConn) send(resp *ExecResponse) error {
+	select {
+	case <-g.closed:
+		return errors.New("gRPC stream was closed")
+	default:
+	}
+	return g.stream.Send(resp)
+}
+
+func (g *grpcConn) WriteMessage(messageType int, data []byte) error {
+	if messageType == websocket.TextMessage {
+		var msg TerminalMessage
+		if err := json.Unmarshal(data, &msg); err == nil {
+			return g.WriteJSON(msg)
+		}
+	}
+	return g.send(&ExecResponse{Msg: &ExecResponse_Stdout{Stdout: data}})
+}
+
+// WriteJSON forwards the control messages gRPC clients understand and drops
+// the others, like heartbeats
+func (g *grpcConn) WriteJSON(v interface{}) error {
+	msg, ok := v.(TerminalMessage)
+	if !ok {
+		return nil
+	}
+	switch msg.Op {
+	case "capabilities":
+		return g.send(&ExecResponse{Msg: &ExecResponse_SessionId{SessionId: msg.SessionID}})
+	case "error":
+		return g.send(&ExecResponse{Msg: &ExecResponse_Error{Error: &ExecError{Code: msg.Code, Message: msg.Data}}})
+	}
+	return nil
+}
+
+// ReadMessage returns stdin as binary and resizes as JSON text frames
+func (g *grpcConn) ReadMessage() (int, []byte, error) {
+	for {
+		req, err := g.stream.Recv()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch msg := req.Msg.(type) {
+		case *ExecRequest_Stdin:
+			return websocket.BinaryMessage, msg.Stdin, nil
+		case *ExecRequest_Resize:
+			data, err := json.Marshal(TerminalMessage{
+				Op:   "resize",
+				Rows: uint16(msg.Resize.GetRows()),
+				Cols: uint16(msg.Resize.GetCols()),
+			})
+			return websocket.TextMessage, data, err
+		}
+	}
+}
+
+// ReadJSON returns the ack of the handshake, gRPC clients send no other JSON
+func (g *grpcConn) ReadJSON(v interface{}) error {
+	ack, ok := v.(*TerminalMessage)
+	if !ok || g.acked {
+		return errors.New("unexpected JSON read on a gRPC stream")
+	}
+	g.acked = true
+	*ack = TerminalMessage{
+		Op:      "ack",
+		Version: ProtocolVersion,
+		Rows:    uint16(g.start.GetSize().GetRows()),
+		Cols:    uint16(g.start.GetSize().GetCols()),
+	}
+	return nil
+}
+
+func (g *grpcConn) SetReadDeadline(t time.Time) error   { return nil }
+func (g *grpcConn) SetCompressionLevel(level int) error { return nil }
+func (g *grpcConn) EnableWriteCompression(enable bool)  {}
+
+// Close ends the Exec call once the session is done with the stream
+func (g *grpcConn) Close() error {
+	g.closeOnce.Do(func() { close(g.closed) })
+	return nil
+}
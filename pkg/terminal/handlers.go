@@ -0,0 +1,1422 @@
+package terminal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// api holds the dependencies of the handlers
+type api struct {
+	cfg  Config
+	kube *KubeClient
+}
+
+// clusterUnavailable answers 503 if err reports that the Kubernetes API can't be reached yet
+func clusterUnavailable(w http.ResponseWriter, err error) bool {
+	if err != ErrClusterUnavailable {
+		return false
+	}
+	w.Header().Set("Retry-After", "5")
+	WriteErrorCode(w, ErrCodeClusterUnavailable, err.Error(), http.StatusServiceUnavailable)
+	return true
+}
+
+// parseToken returns the claims the authenticator chain found for the request
+func parseToken(r *http.Request) (*MyCustomClaims, error) {
+	return RequestClaims(r)
+}
+
+func HomeHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "Hello! This is terminal server.")
+}
+
+// authorizeNamespace checks that the user of r may see the pods of namespace
+func authorizeNamespace(w http.ResponseWriter, r *http.Request, namespace string) bool {
+	claims, err := parseToken(r)
+	if err != nil {
+		WriteErrorCode(w, ErrCodeTokenInvalid, "token is invalid or expired", http.StatusUnauthorized)
+		return false
+	}
+	if !claims.AllowsNamespace(namespace) {
+		WriteErrorCode(w, ErrCodeNamespaceForbidden, ErrNamespaceForbidden.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (a *api) GetPodHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	label := vars["label"]
+	namespace := vars["namespace"]
+	if !authorizeNamespace(w, r, namespace) {
+		return
+	}
+	q := r.URL.Query()
+	opts := PodListOptions{Continue: q.Get("continue"), FieldSelector: q.Get("fieldSelector"), Sort: q.Get("sort")}
+	if limit := q.Get("limit"); limit != "" {
+		var err error
+		if opts.Limit, err = strconv.ParseInt(limit, 10, 64); err != nil {
+			WriteError(w, "limit must be a number", http.StatusBadRequest)
+			return
+		}
+	}
+	pods, next, err := a.kube.GetPodListByLable(r.Context(), namespace, label, opts)
+	if clusterUnavailable(w, err) {
+		return
+	} else if errors.Is(err, ErrInvalidInput) || apierrors.IsBadRequest(err) {
+		WriteError(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if apierrors.IsResourceExpired(err) {
+		WriteErrorCode(w, ErrCodeContinueExpired, "the continue token expired, list again from the start",
+			http.StatusGone)
+		return
+	} else if apierrors.IsForbidden(err) {
+		WriteError(w, "access to the pods is forbidden", http.StatusForbidden)
+		return
+	} else if apierrors.IsNotFound(err) {
+		WriteError(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("GetPodHandler err", err)
+		WriteError(w, "failed to list pods", http.StatusInternalServerError)
+		return
+	}
+
+	if next != "" {
+		w.Header().Set("X-Continue", next)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(pods)
+}
+
+// DiscoveryHandler describes the endpoints, protocol and features of the server
+func (a *api) DiscoveryHandler(w http.ResponseWriter, r *http.Request) {
+	scheme, wsScheme := "http", "ws"
+	if RequestScheme(r) == "https" {
+		scheme, wsScheme = "https", "wss"
+	}
+	discovery := GetDiscovery(scheme+"://"+r.Host+a.cfg.PathPrefix, wsScheme+"://"+r.Host+a.cfg.PathPrefix)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(discovery)
+}
+
+// VersionHandler reports the build, protocol versions and features of the server
+func (a *api) VersionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GetVersion(a.cfg.Version, a.cfg.Commit, a.cfg.BuildDate))
+}
+
+// UIConfigHandler serves the runtime configuration of the web UI
+func (a *api) UIConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if err := renderUIConfig(w, GetUIConfig(a.cfg.PathPrefix, a.cfg.Version)); err != nil {
+		log.Println("UIConfigHandler err", err)
+	}
+}
+
+// oidcStateCookie keeps state and nonce of a login until the provider redirects back
+const oidcStateCookie = "terminal_oidc_state"
+
+// OIDCLoginHandler sends the browser to the login page of the OIDC provider
+func (a *api) OIDCLoginHandler(w http.ResponseWriter, r *http.Request) {
+	loginURL, state, nonce, err := OIDCLoginURL(r.Context())
+	if err == ErrOIDCDisabled {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Println("OIDCLoginHandler err", err)
+		WriteError(w, "identity provider is unavailable", http.StatusBadGateway)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state + "." + nonce,
+		Path:     a.cfg.PathPrefix + "/auth/",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   RequestScheme(r) == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, loginURL, http.StatusFound)
+}
+
+// OIDCCallbackHandler completes a login and hands the server's token to the
+// front-end
+func (a *api) OIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if reason := query.Get("error"); reason != "" {
+		WriteError(w, "login failed: "+reason, http.StatusUnauthorized)
+		return
+	}
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		WriteError(w, "login expired, please try again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: a.cfg.PathPrefix + "/auth/", MaxAge: -1})
+	state, nonce := cookie.Value, ""
+	if i := strings.LastIndex(state, "."); i >= 0 {
+		state, nonce = state[:i], state[i+1:]
+	}
+	if state == "" || query.Get("state") != state {
+		WriteError(w, "login state does not match", http.StatusBadRequest)
+		return
+	}
+
+	tokens, err := OIDCCallback(r.Context(), query.Get("code"), nonce)
+	if err == ErrOIDCDisabled {
+		http.NotFound(w, r)
+		return
+	} else if err == ErrNoNamespaces {
+		WriteError(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
+		log.Println("OIDCCallbackHandler err", err)
+		WriteError(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+	writeTokens(w, r, tokens)
+}
+
+// OIDCRefreshHandler issues a new token for {"refreshToken":"..."}
+func OIDCRefreshHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		WriteError(w, "refreshToken is required", http.StatusBadRequest)
+		return
+	}
+	tokens, err := RefreshSessionToken(r.Context(), req.RefreshToken)
+	if errors.Is(err, ErrInvalidRefreshToken) || err == ErrNoNamespaces {
+		WriteError(w, err.Error(), http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		log.Println("OIDCRefreshHandler err", err)
+		WriteError(w, "identity provider is unavailable", http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// writeTokens redirects to the front-end with the tokens in the fragment,
+// which browsers don't send to servers, or returns them as JSON
+func writeTokens(w http.ResponseWriter, r *http.Request, tokens *TokenResponse) {
+	if postLogin := OIDCPostLoginURL(); postLogin != "" {
+		fragment := url.Values{}
+		fragment.Set("token", tokens.Token)
+		fragment.Set("expiresIn", strconv.FormatInt(tokens.ExpiresIn, 10))
+		if tokens.RefreshToken != "" {
+			fragment.Set("refreshToken", tokens.RefreshToken)
+		}
+		http.Redirect(w, r, postLogin+"#"+fragment.Encode(), http.StatusFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// NamespacesHandler lists the namespaces the user of the token may access
+func (a *api) NamespacesHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := parseToken(r)
+	if err != nil {
+		WriteErrorCode(w, ErrCodeTokenInvalid, "token is invalid or expired", http.StatusUnauthorized)
+		return
+	}
+	namespaces, err := a.kube.ListNamespaces(r.Context(), claims)
+	if clusterUnavailable(w, err) {
+		return
+	} else if err != nil {
+		log.Println("NamespacesHandler err", err)
+		WriteError(w, "failed to list namespaces", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(namespaces)
+}
+
+func (a *api) WorkloadsHandler(w http.ResponseWriter, r *http.Request) {
+	namespace := mux.Vars(r)["namespace"]
+	if !authorizeNamespace(w, r, namespace) {
+		return
+	}
+	workloads, err := a.kube.ListWorkloads(r.Context(), namespace)
+	if clusterUnavailable(w, err) {
+		return
+	} else if err != nil {
+		log.Println("WorkloadsHandler err", err)
+		WriteError(w, "failed to list workloads", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(workloads)
+}
+
+// WorkloadPodsHandler lists the pods of a deployment, statefulset, daemonset or job
+func (a *api) WorkloadPodsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !authorizeNamespace(w, r, vars["namespace"]) {
+		return
+	}
+	pods, err := a.kube.GetWorkloadPods(r.Context(), vars["namespace"], vars["kind"], vars["name"])
+	if clusterUnavailable(w, err) {
+		return
+	} else if err == ErrUnknownWorkloadKind {
+		WriteError(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if apierrors.IsNotFound(err) {
+		WriteError(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("WorkloadPodsHandler err", err)
+		WriteError(w, "failed to list workload pods", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pods)
+}
+
+// FSHandler lists a directory of a container for the file manager panel
+func (a *api) FSHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+	claims, err := parseToken(r)
+	if err != nil {
+		WriteErrorCode(w, ErrCodeTokenInvalid, "token is invalid or expired", http.StatusUnauthorized)
+		return
+	}
+	// listing files bypasses what safe mode shells restrict
+	if claims.Role == RoleViewer || IsSafeModeRole(claims.Role) {
+		WriteError(w, "role may not browse files", http.StatusForbidden)
+		return
+	}
+	if !claims.AllowsNamespace(namespace) {
+		WriteErrorCode(w, ErrCodeNamespaceForbidden, "namespace is not allowed", http.StatusForbidden)
+		return
+	}
+	if err := admitWithoutTerminal(namespace); err != nil {
+		WriteError(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	dir := r.URL.Query().Get("path")
+	if dir == "" {
+		dir = "/"
+	}
+	listing, err := ListDirectory(r.Context(), a.kube, claims.Subject, namespace, vars["pod"], vars["container"], dir)
+	if clusterUnavailable(w, err) {
+		return
+	} else if errors.Is(err, ErrInvalidInput) {
+		WriteError(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err == ErrPathNotFound || apierrors.IsNotFound(err) {
+		WriteError(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("FSHandler err", err)
+		WriteError(w, "failed to list directory", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(listing)
+}
+
+// WatchPodsHandler pushes pod changes to the browser as server-sent events
+func (a *api) WatchPodsHandler(w http.ResponseWriter, r *http.Request) {
+	namespace := mux.Vars(r)["namespace"]
+	label := r.URL.Query().Get("label")
+	if !authorizeNamespace(w, r, namespace) {
+		return
+	}
+	if !a.kube.Available() {
+		clusterUnavailable(w, ErrClusterUnavailable)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		WriteError(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	events := make(chan PodEvent)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- a.kube.WatchPods(r.Context(), namespace, label, events)
+	}()
+
+	for {
+		select {
+		case ev := <-events:
+			data, _ := json.Marshal(ev)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+			flusher.Flush()
+		case err := <-errc:
+			if err != nil {
+				log.Println("WatchPodsHandler err", err)
+				fmt.Fprintf(w, "event: error\ndata: %q\n\n", err.Error())
+				flusher.Flush()
+			}
+			return
+		}
+	}
+}
+
+func (a *api) TerminalHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	pod := vars["pod"]
+	container := vars["container"]
+	namespace := vars["namespace"]
+	log.Printf("TerminalHandler namespace=%s, pod=%s, container=%s", namespace, pod, container)
+
+	claims, ok := a.authorizeTerminal(w, r, namespace)
+	if !ok {
+		return
+	}
+	notice := ""
+	if IsAutoContainer(container) && !DockerBackend() {
+		var err error
+		container, err = a.kube.ResolveContainer(r.Context(), namespace, pod)
+		if clusterUnavailable(w, err) {
+			return
+		} else if apierrors.IsNotFound(err) {
+			WriteTerminalError(w, r, string(ExecErrPodNotFound), err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Println("TerminalHandler err", err)
+			WriteTerminalError(w, r, "", "failed to select a container", http.StatusInternalServerError)
+			return
+		}
+		notice = fmt.Sprintf("Using container %s\r\n", container)
+	}
+	a.openTerminal(w, r, claims, namespace, pod, container, "", notice)
+}
+
+// TerminalByLabelHandler opens a shell in a Running and Ready pod matching the
+// label selector, in the container given by the container query parameter or
+// the first non-sidecar one
+func (a *api) TerminalByLabelHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+	selector := vars["selector"]
+	log.Printf("TerminalByLabelHandler namespace=%s, selector=%s", namespace, selector)
+
+	claims, ok := a.authorizeTerminal(w, r, namespace)
+	if !ok {
+		return
+	}
+	pod, container, err := a.kube.PickPod(r.Context(), namespace, selector, r.URL.Query().Get("container"))
+	if clusterUnavailable(w, err) {
+		return
+	} else if errors.Is(err, ErrInvalidInput) {
+		WriteTerminalError(w, r, "", err.Error(), http.StatusBadRequest)
+		return
+	} else if err == ErrNoHealthyPod {
+		WriteTerminalError(w, r, string(ExecErrPodNotFound), err.Error(), http.StatusNotFound)
+		return
+	} else if err == ErrContainerNotFound {
+		WriteTerminalError(w, r, string(ExecErrContainerNotFound), err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("TerminalByLabelHandler err", err)
+		WriteTerminalError(w, r, "", "failed to select a pod", http.StatusInternalServerError)
+		return
+	}
+	notice := fmt.Sprintf("Connected to pod %s, container %s\r\n", pod, container)
+	a.openTerminal(w, r, claims, namespace, pod, container, selector, notice)
+}
+
+// PresignHandler returns a short-lived URL opening a terminal once without a
+// token, for front-ends that don't hand their token to the browser's websocket
+func (a *api) PresignHandler(w http.ResponseWriter, r *http.Request) {
+	if !*presignEnabled {
+		WriteError(w, "presigned URLs are disabled", http.StatusNotFound)
+		return
+	}
+	claims, err := parseToken(r)
+	if err != nil {
+		WriteErrorCode(w, ErrCodeTokenInvalid, "token is invalid or expired", http.StatusUnauthorized)
+		return
+	}
+	var req PresignRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+		WriteError(w, "invalid presign request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Pod == "" || strings.ContainsAny(req.Pod+req.Container, "/?#") {
+		WriteError(w, "pod and container must be names", http.StatusBadRequest)
+		return
+	}
+	if _, ok := req.Params[PresignParameter]; ok {
+		WriteError(w, "params must not contain "+PresignParameter, http.StatusBadRequest)
+		return
+	}
+	if err := validatePodQuery(req.Namespace, ""); err != nil {
+		WriteError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !claims.AllowsNamespace(req.Namespace) {
+		WriteErrorCode(w, ErrCodeNamespaceForbidden, "namespace is not allowed", http.StatusForbidden)
+		return
+	}
+	path := "/api/v1/terminals/" + req.Namespace + "/" + req.Pod
+	if req.Container != "" {
+		path += "/" + req.Container
+	}
+	query := url.Values{}
+	for name, value := range req.Params {
+		query.Set(name, value)
+	}
+	signed, expires, err := Presign(claims, path, query)
+	if err != nil {
+		log.Println("PresignHandler err", err)
+		WriteError(w, "failed to presign the URL", http.StatusInternalServerError)
+		return
+	}
+	query.Set(PresignParameter, signed)
+	scheme := "ws"
+	if RequestScheme(r) == "https" {
+		scheme = "wss"
+	}
+	u := url.URL{Scheme: scheme, Host: r.Host, Path: a.cfg.PathPrefix + path, RawQuery: query.Encode()}
+	log.Printf("PresignHandler namespace=%s, pod=%s, user=%s", req.Namespace, req.Pod, claims.Subject)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PresignedURL{URL: u.String(), ExpiresAt: expires})
+}
+
+// authorizeTerminal checks that a terminal may be opened in namespace for the
+// request's token
+func (a *api) authorizeTerminal(w http.ResponseWriter, r *http.Request, namespace string) (*MyCustomClaims, bool) {
+	if IsStandby() {
+		WriteTerminalError(w, r, ErrCodeStandby, "standby instance does not serve terminals",
+			http.StatusServiceUnavailable)
+		return nil, false
+	}
+	if !DockerBackend() && !a.kube.Available() {
+		w.Header().Set("Retry-After", "5")
+		WriteTerminalError(w, r, ErrCodeClusterUnavailable, ErrClusterUnavailable.Error(),
+			http.StatusServiceUnavailable)
+		return nil, false
+	}
+	if err := AuditAvailable(); err != nil {
+		WriteTerminalError(w, r, ErrCodeAuditUnavailable, err.Error(), http.StatusServiceUnavailable)
+		return nil, false
+	}
+	claims, err := parseToken(r)
+	if err != nil {
+		log.Println("token is invaild or expired")
+		WriteTerminalError(w, r, ErrCodeTokenInvalid, "token is invalid or expired",
+			http.StatusUnauthorized)
+		return nil, false
+	}
+	if !claims.AllowsNamespace(namespace) {
+		WriteTerminalError(w, r, ErrCodeNamespaceForbidden, ErrNamespaceForbidden.Error(), http.StatusForbidden)
+		return nil, false
+	}
+	if !AllowSession(claims.Subject) {
+		WriteTerminalError(w, r, ErrCodeSessionLimit, "too many terminal sessions",
+			http.StatusTooManyRequests)
+		return nil, false
+	}
+	if SessionQueueFull() {
+		w.Header().Set("Retry-After", "30")
+		WriteTerminalError(w, r, string(ExecErrQueueFull), "all terminal slots are taken",
+			http.StatusServiceUnavailable)
+		return nil, false
+	}
+	return claims, true
+}
+
+// openTerminal upgrades the request and starts the shell, notice is shown to
+// the user before the shell's output. The shell of a terminal opened by label
+// selector fails over to another pod
+func (a *api) openTerminal(w http.ResponseWriter, r *http.Request, claims *MyCustomClaims,
+	namespace string, pod string, container string, selector string, notice string) {
+
+	encoding := r.URL.Query().Get("encoding")
+	if _, err := LookupEncoding(encoding); err != nil {
+		WriteTerminalError(w, r, "", err.Error(), http.StatusBadRequest)
+		return
+	}
+	pin := 0
+	if value := r.URL.Query().Get("pin"); value != "" {
+		var err error
+		if pin, err = strconv.Atoi(value); err != nil {
+			WriteTerminalError(w, r, "", "pin must be a number of minutes", http.StatusBadRequest)
+			return
+		}
+	}
+	// viewers only ever watch their terminals
+	readOnly := r.URL.Query().Get("readonly") == "true" || claims.Role == RoleViewer
+	env, err := ParseSessionEnv(r.URL.Query()["env"])
+	if err != nil {
+		WriteTerminalError(w, r, "", err.Error(), http.StatusBadRequest)
+		return
+	}
+	tty, err := ParseTTY(r.URL.Query().Get("tty"))
+	if err != nil {
+		WriteTerminalError(w, r, "", err.Error(), http.StatusBadRequest)
+		return
+	}
+	reason, tags, err := ParseSessionPurpose(r.URL.Query(), namespace)
+	if err == ErrReasonRequired {
+		WriteTerminalError(w, r, ErrCodeReasonRequired, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		WriteTerminalError(w, r, "", err.Error(), http.StatusBadRequest)
+		return
+	}
+	group := r.URL.Query().Get("group")
+	if group != "" {
+		if err := CheckGroup(group, claims.Subject); err != nil {
+			WriteTerminalError(w, r, "", err.Error(), http.StatusNotFound)
+			return
+		}
+	}
+	var warnings []string
+	if !DockerBackend() {
+		var err error
+		if warnings, err = a.kube.DisruptionWarnings(r.Context(), namespace, pod); err != nil {
+			log.Println("openTerminal disruption check err", err)
+		}
+	}
+	sessionId, err := CreateSession(w, r, a.kube, SessionMeta{
+		User:      claims.Subject,
+		Role:      claims.Role,
+		Namespace: namespace,
+		Pod:       pod,
+		Container: container,
+		SafeMode:  IsSafeModeRole(claims.Role),
+		ReadOnly:  readOnly,
+		Encoding:  encoding,
+		Group:     group,
+		Selector:  selector,
+		NoTTY:     !tty,
+		Env:       env,
+		Reason:    reason,
+		Tags:      tags,
+		Claims:    claims,
+		Remote:    ClientIP(r),
+	})
+	log.Printf("start terminal: %s\n", sessionId)
+	if err != nil {
+		return
+	}
+	for _, warning := range warnings {
+		notice += "Warning: " + warning + "\r\n"
+	}
+	if pin > 0 && !DockerBackend() {
+		if err := a.kube.PinPod(r.Context(), namespace, pod, time.Duration(pin)*time.Minute); err != nil {
+			log.Println("openTerminal pin err", err)
+			notice += fmt.Sprintf("Pod could not be pinned: %v\r\n", err)
+		} else {
+			notice += fmt.Sprintf("Pod pinned against cluster autoscaler eviction for %d minutes\r\n", pin)
+		}
+	}
+	if notice != "" {
+		ToastSession(sessionId, notice)
+	}
+	go ExecTerminal(container, pod, namespace, sessionId)
+}
+
+// PortForwardHandler forwards a port of a pod through a websocket, so the web
+// UI can reach admin interfaces listening in the pod
+func (a *api) PortForwardHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+	pod := vars["pod"]
+	claims, err := parseToken(r)
+	if err != nil {
+		WriteErrorCode(w, ErrCodeTokenInvalid, "token is invalid or expired", http.StatusUnauthorized)
+		return
+	}
+	if IsStandby() {
+		WriteErrorCode(w, ErrCodeStandby, "standby instance does not serve terminals",
+			http.StatusServiceUnavailable)
+		return
+	}
+	if DockerBackend() {
+		WriteError(w, "port-forward needs the kubernetes backend", http.StatusNotImplemented)
+		return
+	}
+	if !PortForwardAllowed(claims.Role) {
+		WriteError(w, "role may not forward ports", http.StatusForbidden)
+		return
+	}
+	if !claims.AllowsNamespace(namespace) {
+		WriteErrorCode(w, ErrCodeNamespaceForbidden, "namespace is not allowed", http.StatusForbidden)
+		return
+	}
+	if err := admitWithoutTerminal(namespace); err != nil {
+		WriteError(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	port, err := strconv.Atoi(vars["port"])
+	if err != nil || port < 1 || port > 65535 {
+		WriteError(w, "port must be a number from 1 to 65535", http.StatusBadRequest)
+		return
+	}
+	log.Printf("PortForwardHandler namespace=%s, pod=%s, port=%d, user=%s", namespace, pod, port, claims.Subject)
+
+	if err := a.kube.PortForward(w, r, namespace, pod, port, claims); err != nil {
+		log.Println("PortForwardHandler err", err)
+	}
+}
+
+// MuxHandler runs terminals in several containers of a pod over one websocket
+func (a *api) MuxHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+	pod := vars["pod"]
+	claims, err := parseToken(r)
+	if err != nil {
+		WriteErrorCode(w, ErrCodeTokenInvalid, "token is invalid or expired", http.StatusUnauthorized)
+		return
+	}
+	if IsStandby() {
+		WriteErrorCode(w, ErrCodeStandby, "standby instance does not serve terminals",
+			http.StatusServiceUnavailable)
+		return
+	}
+	if !claims.AllowsNamespace(namespace) {
+		WriteErrorCode(w, ErrCodeNamespaceForbidden, "namespace is not allowed", http.StatusForbidden)
+		return
+	}
+	log.Printf("MuxHandler namespace=%s, pod=%s, user=%s", namespace, pod, claims.Subject)
+
+	if err := MuxTerminals(w, r, a.kube, claims, namespace, pod); err != nil {
+		log.Println("MuxHandler err", err)
+	}
+}
+
+// DebugCronJobHandler creates a pod from the template of a CronJob whose
+// containers sleep, for a terminal to debug the job in
+func (a *api) DebugCronJobHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+	claims, ok := authorizeDebugPod(w, r, namespace)
+	if !ok {
+		return
+	}
+	log.Printf("DebugCronJobHandler namespace=%s, cronjob=%s, user=%s", namespace, vars["cronjob"], claims.Subject)
+	pod, err := a.kube.DebugCronJob(r.Context(), namespace, vars["cronjob"], claims.Subject)
+	a.writeDebugPod(w, pod, err)
+}
+
+// CreateDebugPodHandler starts a standalone debug pod, the body may pick the
+// image and a shorter TTL
+func (a *api) CreateDebugPodHandler(w http.ResponseWriter, r *http.Request) {
+	namespace := mux.Vars(r)["namespace"]
+	claims, ok := authorizeDebugPod(w, r, namespace)
+	if !ok {
+		return
+	}
+	var req DebugPodRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		WriteError(w, "invalid debug pod: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("CreateDebugPodHandler namespace=%s, image=%s, user=%s", namespace, req.Image, claims.Subject)
+	pod, err := a.kube.CreateDebugPod(r.Context(), namespace, req, claims.Subject)
+	a.writeDebugPod(w, pod, err)
+}
+
+// authorizeDebugPod checks that the request's token may create debug pods in namespace
+func authorizeDebugPod(w http.ResponseWriter, r *http.Request, namespace string) (*MyCustomClaims, bool) {
+	claims, err := parseToken(r)
+	if err != nil {
+		WriteErrorCode(w, ErrCodeTokenInvalid, "token is invalid or expired", http.StatusUnauthorized)
+		return nil, false
+	}
+	if IsStandby() {
+		WriteErrorCode(w, ErrCodeStandby, "standby instance does not serve terminals",
+			http.StatusServiceUnavailable)
+		return nil, false
+	}
+	if DockerBackend() {
+		WriteError(w, "debug pods need the kubernetes backend", http.StatusNotImplemented)
+		return nil, false
+	}
+	if !DebugPodAllowed(claims.Role) {
+		WriteError(w, "role may not create debug pods", http.StatusForbidden)
+		return nil, false
+	}
+	if !claims.AllowsNamespace(namespace) {
+		WriteErrorCode(w, ErrCodeNamespaceForbidden, "namespace is not allowed", http.StatusForbidden)
+		return nil, false
+	}
+	return claims, true
+}
+
+func (a *api) writeDebugPod(w http.ResponseWriter, pod *DebugPod, err error) {
+	if clusterUnavailable(w, err) {
+		return
+	} else if errors.Is(err, ErrInvalidInput) {
+		WriteError(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if apierrors.IsNotFound(err) {
+		WriteError(w, err.Error(), http.StatusNotFound)
+		return
+	} else if apierrors.IsForbidden(err) {
+		WriteError(w, err.Error(), http.StatusForbidden)
+		return
+	} else if errors.Is(err, ErrDebugPodFailed) {
+		WriteError(w, err.Error(), http.StatusBadGateway)
+		return
+	} else if err != nil {
+		log.Println("debug pod err", err)
+		WriteError(w, "failed to create the debug pod", http.StatusInternalServerError)
+		return
+	}
+	pod.Terminal = a.cfg.PathPrefix + pod.Terminal
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(pod)
+}
+
+// JoinSessionHandler attaches another client to a running terminal session
+// Clients join read-only unless they ask for write=true and are not viewers
+func JoinSessionHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	sessionId := vars["sessionId"]
+	claims, err := parseToken(r)
+	if err != nil {
+		log.Println("token is invaild or expired")
+		WriteErrorCode(w, ErrCodeTokenInvalid, "token is invalid or expired", http.StatusUnauthorized)
+		return
+	}
+	if IsStandby() {
+		WriteErrorCode(w, ErrCodeStandby, "standby instance does not serve terminals",
+			http.StatusServiceUnavailable)
+		return
+	}
+	readOnly, err := JoinAccess(sessionId, claims, r.URL.Query().Get("write") == "true")
+	if err == ErrSessionNotFound {
+		WriteError(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err == ErrNamespaceForbidden {
+		WriteErrorCode(w, ErrCodeNamespaceForbidden, err.Error(), http.StatusForbidden)
+		return
+	}
+	log.Printf("JoinSessionHandler session=%s, user=%s, readOnly=%v", sessionId, claims.Subject, readOnly)
+
+	err = JoinSession(w, r, sessionId, readOnly)
+	if err == ErrSessionNotFound {
+		WriteError(w, err.Error(), http.StatusNotFound)
+	} else if err != nil {
+		log.Println("JoinSessionHandler err", err)
+	}
+}
+
+// SessionStatsHandler reports the traffic and the state of the shell of a
+// session to its owner and to admins
+func SessionStatsHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := parseToken(r)
+	if err != nil {
+		WriteErrorCode(w, ErrCodeTokenInvalid, "token is invalid or expired", http.StatusUnauthorized)
+		return
+	}
+	stats, err := Sessions.Stats(mux.Vars(r)["sessionId"])
+	if err == ErrSessionNotFound {
+		WriteError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if stats.User != claims.Subject && claims.Role != RoleAdmin {
+		// other users' sessions are not found rather than forbidden
+		WriteError(w, ErrSessionNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// PairSessionHandler lets a support engineer ask the owner of a session for
+// write access for minutes, granted in the owner's terminal
+func PairSessionHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	sessionId := vars["sessionId"]
+	claims, err := parseToken(r)
+	if err != nil {
+		WriteErrorCode(w, ErrCodeTokenInvalid, "token is invalid or expired", http.StatusUnauthorized)
+		return
+	}
+	if IsStandby() {
+		WriteErrorCode(w, ErrCodeStandby, "standby instance does not serve terminals",
+			http.StatusServiceUnavailable)
+		return
+	}
+	if claims.Role == RoleViewer || IsSafeModeRole(claims.Role) {
+		WriteError(w, "role may not write to other sessions", http.StatusForbidden)
+		return
+	}
+	if _, err := JoinAccess(sessionId, claims, false); err == ErrSessionNotFound {
+		WriteError(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err == ErrNamespaceForbidden {
+		WriteErrorCode(w, ErrCodeNamespaceForbidden, err.Error(), http.StatusForbidden)
+		return
+	}
+	minutes, err := strconv.Atoi(r.URL.Query().Get("minutes"))
+	if err != nil {
+		WriteError(w, "minutes is required", http.StatusBadRequest)
+		return
+	}
+	log.Printf("PairSessionHandler session=%s, user=%s, minutes=%d", sessionId, claims.Subject, minutes)
+
+	err = PairSession(w, r, sessionId, claims.Subject, time.Duration(minutes)*time.Minute)
+	if err == ErrSessionNotFound {
+		WriteError(w, err.Error(), http.StatusNotFound)
+	} else if errors.Is(err, ErrInvalidInput) {
+		WriteError(w, err.Error(), http.StatusBadRequest)
+	} else if err != nil {
+		log.Println("PairSessionHandler err", err)
+	}
+}
+
+// CreateGroupHandler starts a session group, terminals opened with its id in
+// the group query parameter are closed and reattached together
+func CreateGroupHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := parseToken(r)
+	if err != nil {
+		WriteErrorCode(w, ErrCodeTokenInvalid, "token is invalid or expired", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CreateGroup(claims.Subject))
+}
+
+// GroupHandler lists the running sessions of a group to reattach them
+func GroupHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := parseToken(r)
+	if err != nil {
+		WriteErrorCode(w, ErrCodeTokenInvalid, "token is invalid or expired", http.StatusUnauthorized)
+		return
+	}
+	group, err := GetGroup(mux.Vars(r)["groupId"], claims.Subject)
+	if err == ErrGroupNotFound {
+		WriteError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(group)
+}
+
+// DeleteGroupHandler ends every session of a group
+func DeleteGroupHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := parseToken(r)
+	if err != nil {
+		WriteErrorCode(w, ErrCodeTokenInvalid, "token is invalid or expired", http.StatusUnauthorized)
+		return
+	}
+	err = CloseGroup(mux.Vars(r)["groupId"], claims.Subject, "The session group was closed")
+	if err == ErrGroupNotFound {
+		WriteError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RecordingsHandler searches recorded sessions by user, namespace and start
+// time, users other than admins only find their own
+func RecordingsHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := parseToken(r)
+	if err != nil {
+		WriteErrorCode(w, ErrCodeTokenInvalid, "token is invalid or expired", http.StatusUnauthorized)
+		return
+	}
+	q := r.URL.Query()
+	query := RecordingQuery{User: q.Get("user"), Namespace: q.Get("namespace"), Deleted: q.Get("deleted") == "true"}
+	if claims.Role != RoleAdmin {
+		if query.Deleted {
+			WriteError(w, "admin role required", http.StatusForbidden)
+			return
+		}
+		query.User = claims.Subject
+	}
+	if since := q.Get("since"); since != "" {
+		if query.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			WriteError(w, "since must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+	}
+	if limit := q.Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil {
+			WriteError(w, "limit must be a number", http.StatusBadRequest)
+			return
+		}
+	}
+	recordings, err := SearchRecordings(query)
+	if err != nil {
+		log.Println("RecordingsHandler err", err)
+		WriteError(w, "failed to search recordings", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(recordings)
+}
+
+// RecordingHandler serves the asciicast file of a recording
+func RecordingHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := parseToken(r)
+	if err != nil {
+		WriteErrorCode(w, ErrCodeTokenInvalid, "token is invalid or expired", http.StatusUnauthorized)
+		return
+	}
+	info, err := GetRecording(mux.Vars(r)["id"])
+	if err == ErrRecordingNotFound || (err == nil && claims.Role != RoleAdmin && info.User != claims.Subject) {
+		WriteError(w, ErrRecordingNotFound.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("RecordingHandler err", err)
+		WriteError(w, "failed to read recording", http.StatusInternalServerError)
+		return
+	}
+	recording, err := OpenRecording(r.Context(), info.ID)
+	if err == ErrRecordingNotFound {
+		WriteError(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("RecordingHandler err", err)
+		WriteError(w, "failed to read recording", http.StatusInternalServerError)
+		return
+	}
+	defer recording.Close()
+	w.Header().Set("Content-Type", "application/x-asciicast")
+	// local recordings support range requests
+	if file, ok := recording.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, info.ID+".cast", info.Ended, file)
+		return
+	}
+	io.Copy(w, recording)
+}
+
+// RecordingDiffHandler aligns the commands of the recordings base and other
+// of the query and compares their output. ignore is a regular expression of
+// the volatile parts of the output
+func RecordingDiffHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := parseToken(r)
+	if err != nil {
+		WriteErrorCode(w, ErrCodeTokenInvalid, "token is invalid or expired", http.StatusUnauthorized)
+		return
+	}
+	q := r.URL.Query()
+	var opts DiffOptions
+	if ignore := q.Get("ignore"); ignore != "" {
+		if opts.Ignore, err = regexp.Compile(ignore); err != nil {
+			WriteError(w, "ignore must be a regular expression", http.StatusBadRequest)
+			return
+		}
+	}
+	var recordings [2]*RecordingInfo
+	for i, param := range []string{"base", "other"} {
+		id := q.Get(param)
+		if id == "" {
+			WriteError(w, param+" is required", http.StatusBadRequest)
+			return
+		}
+		info, err := GetRecording(id)
+		if err == ErrRecordingNotFound || (err == nil && claims.Role != RoleAdmin && info.User != claims.Subject) {
+			WriteError(w, ErrRecordingNotFound.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Println("RecordingDiffHandler err", err)
+			WriteError(w, "failed to read recording", http.StatusInternalServerError)
+			return
+		}
+		recordings[i] = info
+	}
+	diff, err := DiffRecordings(r.Context(), recordings[0], recordings[1], opts)
+	if err == ErrRecordingNotFound {
+		WriteError(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("RecordingDiffHandler err", err)
+		WriteError(w, "failed to diff the recordings", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(diff)
+}
+
+// DeleteRecordingHandler deletes a recording, admins restore it within
+// -recording-restore-window
+func DeleteRecordingHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAdmin(w, r) {
+		return
+	}
+	claims, _ := parseToken(r)
+	err := DeleteRecording(mux.Vars(r)["id"], claims.Subject)
+	writeRecordingChange(w, err, "DeleteRecordingHandler")
+}
+
+// RestoreRecordingHandler restores a deleted recording that wasn't purged yet
+func RestoreRecordingHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAdmin(w, r) {
+		return
+	}
+	claims, _ := parseToken(r)
+	err := RestoreRecording(mux.Vars(r)["id"], claims.Subject)
+	writeRecordingChange(w, err, "RestoreRecordingHandler")
+}
+
+func writeRecordingChange(w http.ResponseWriter, err error, handler string) {
+	if err == ErrRecordingNotFound {
+		WriteError(w, err.Error(), http.StatusNotFound)
+	} else if errors.Is(err, ErrInvalidInput) {
+		WriteError(w, err.Error(), http.StatusConflict)
+	} else if err != nil {
+		log.Println(handler+" err", err)
+		WriteError(w, "failed to change the recording", http.StatusInternalServerError)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// PlayRecordingHandler replays a recording over a websocket with its timing,
+// at the speed and with the pauses capped to the idleLimit of the query
+func PlayRecordingHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := parseToken(r)
+	if err != nil {
+		WriteTerminalError(w, r, ErrCodeTokenInvalid, "token is invalid or expired", http.StatusUnauthorized)
+		return
+	}
+	p := &replayer{speed: 1}
+	q := r.URL.Query()
+	if speed := q.Get("speed"); speed != "" {
+		if p.speed, err = parseReplaySpeed(speed); err != nil {
+			WriteTerminalError(w, r, "", err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if idleLimit := q.Get("idleLimit"); idleLimit != "" {
+		if p.idleLimit, err = replayIdleLimit(idleLimit); err != nil {
+			WriteTerminalError(w, r, "", err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	info, err := GetRecording(mux.Vars(r)["id"])
+	if err == ErrRecordingNotFound || (err == nil && claims.Role != RoleAdmin && info.User != claims.Subject) {
+		WriteTerminalError(w, r, "", ErrRecordingNotFound.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("PlayRecordingHandler err", err)
+		WriteTerminalError(w, r, "", "failed to read recording", http.StatusInternalServerError)
+		return
+	}
+	recording, err := OpenRecording(r.Context(), info.ID)
+	if err == ErrRecordingNotFound {
+		WriteTerminalError(w, r, "", err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("PlayRecordingHandler err", err)
+		WriteTerminalError(w, r, "", "failed to read recording", http.StatusInternalServerError)
+		return
+	}
+	defer recording.Close()
+	if p.conn, err = upgradeWebsocket(w, r); err != nil {
+		log.Println("PlayRecordingHandler err", err)
+		return
+	}
+	defer p.conn.Close()
+	log.Printf("PlayRecordingHandler recording=%s, user=%s", info.ID, claims.Subject)
+	if err := p.play(recording); err != nil {
+		log.Println("PlayRecordingHandler err", err)
+	}
+}
+
+// checkAdmin verifies the request carries a valid token with the admin role
+func checkAdmin(w http.ResponseWriter, r *http.Request) bool {
+	claims, err := parseToken(r)
+	if err != nil {
+		WriteErrorCode(w, ErrCodeTokenInvalid, "token is invalid or expired", http.StatusUnauthorized)
+		return false
+	}
+	if claims.Role != RoleAdmin {
+		WriteError(w, "admin role required", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func AdminSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAdmin(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Sessions.List())
+}
+
+// AdminKillSessionHandler ends a running session
+func AdminKillSessionHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAdmin(w, r) {
+		return
+	}
+	err := Sessions.Kill(mux.Vars(r)["sessionId"], "The session was terminated by an administrator")
+	if err == ErrSessionNotFound {
+		WriteError(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("AdminKillSessionHandler err", err)
+		WriteError(w, "failed to end the session", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AdminApprovalsHandler lists the terminals waiting for an approval
+func AdminApprovalsHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAdmin(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ListApprovals())
+}
+
+// AdminAnswerApprovalHandler approves or denies a terminal waiting for an
+// approval, admins can't answer their own requests
+func AdminAnswerApprovalHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAdmin(w, r) {
+		return
+	}
+	claims, _ := parseToken(r)
+	vars := mux.Vars(r)
+	err := AnswerApproval(vars["id"], claims.Subject, vars["answer"] == "approve")
+	if err == ErrApprovalNotFound {
+		WriteError(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err == ErrSelfApproval || err == ErrNotApprover {
+		WriteError(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
+		log.Println("AdminAnswerApprovalHandler err", err)
+		WriteError(w, "failed to answer the approval", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SlackApprovalHandler receives the buttons of approval requests posted to Slack
+func SlackApprovalHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		WriteError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	text, err := AnswerSlackApproval(r.Header, body)
+	if err == ErrSlackNotConfigured {
+		WriteError(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err == ErrSlackSignature {
+		WriteError(w, err.Error(), http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		WriteError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// replaces the message with the buttons
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"replace_original": true, "text": text})
+}
+
+// AdminSessionDebugHandler shows buffer depths, recent frames and goroutines of
+// a live session, for diagnosing frozen terminals
+func AdminSessionDebugHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAdmin(w, r) {
+		return
+	}
+	debug, err := DebugSession(mux.Vars(r)["sessionId"])
+	if err == ErrSessionNotFound {
+		WriteError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(debug)
+}
+
+// AdminHeatmapHandler reports terminal usage per namespace in hourly or daily buckets
+func AdminHeatmapHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAdmin(w, r) {
+		return
+	}
+	query := r.URL.Query()
+	daily := false
+	switch query.Get("granularity") {
+	case "", "hour":
+	case "day":
+		daily = true
+	default:
+		WriteError(w, "granularity must be hour or day", http.StatusBadRequest)
+		return
+	}
+	since := time.Now().Add(-7 * 24 * time.Hour)
+	if s := query.Get("since"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			WriteError(w, "since must be an RFC3339 time", http.StatusBadRequest)
+			return
+		}
+		since = t
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GetActivityHeatmap(query.Get("namespace"), since, daily))
+}
+
+func AdminJobsHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAdmin(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ListJobs())
+}
+
+// authorizeUpload checks the token of an upload request, viewers may not upload
+func authorizeUpload(w http.ResponseWriter, r *http.Request) (*MyCustomClaims, bool) {
+	claims, err := parseToken(r)
+	if err != nil {
+		WriteErrorCode(w, ErrCodeTokenInvalid, "token is invalid or expired", http.StatusUnauthorized)
+		return nil, false
+	}
+	if claims.Role == RoleViewer || IsSafeModeRole(claims.Role) {
+		WriteError(w, "role may not upload files", http.StatusForbidden)
+		return nil, false
+	}
+	w.Header().Set("Tus-Resumable", "1.0.0")
+	return claims, true
+}
+
+func writeUpload(w http.ResponseWriter, status int, upload *Upload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Size, 10))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(upload)
+}
+
+// CreateUploadHandler starts a resumable upload of a file into a container
+// The body names the target and announces the size and sha256 of the file
+func (a *api) CreateUploadHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := authorizeUpload(w, r)
+	if !ok {
+		return
+	}
+	var u Upload
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+		WriteError(w, "invalid upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if u.Namespace == "" || u.Pod == "" || u.Container == "" || u.Path == "" {
+		WriteError(w, "namespace, pod, container and path are required", http.StatusBadRequest)
+		return
+	}
+	if !claims.AllowsNamespace(u.Namespace) {
+		WriteErrorCode(w, ErrCodeNamespaceForbidden, "namespace is not allowed", http.StatusForbidden)
+		return
+	}
+	if err := admitWithoutTerminal(u.Namespace); err != nil {
+		WriteError(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	u.User = claims.Subject
+
+	upload, err := CreateUpload(r.Context(), a.kube, u)
+	switch err {
+	case nil:
+	case ErrUploadTooLarge:
+		WriteError(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	case ErrUploadInvalidHash:
+		WriteError(w, err.Error(), http.StatusBadRequest)
+		return
+	case ErrClusterUnavailable:
+		clusterUnavailable(w, err)
+		return
+	default:
+		log.Println("CreateUploadHandler err", err)
+		WriteError(w, "failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", a.cfg.PathPrefix+"/api/v1/uploads/"+upload.ID)
+	writeUpload(w, http.StatusCreated, upload)
+}
+
+// UploadHandler reports the offset of an upload (HEAD, GET) or appends a chunk (PATCH)
+func (a *api) UploadHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := authorizeUpload(w, r)
+	if !ok {
+		return
+	}
+	id := mux.Vars(r)["id"]
+
+	var upload *Upload
+	var err error
+	if r.Method == "PATCH" {
+		offset, perr := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if perr != nil {
+			WriteError(w, "Upload-Offset header is required", http.StatusBadRequest)
+			return
+		}
+		upload, err = AppendUpload(r.Context(), a.kube, id, claims.Subject, offset, r.Body)
+	} else {
+		upload, err = GetUpload(id, claims.Subject)
+	}
+
+	switch err {
+	case nil:
+		writeUpload(w, http.StatusOK, upload)
+	case ErrUploadNotFound:
+		WriteError(w, err.Error(), http.StatusNotFound)
+	case ErrUploadOffset:
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		WriteError(w, err.Error(), http.StatusConflict)
+	case ErrUploadChecksum:
+		w.Header().Set("Upload-Offset", "0")
+		WriteError(w, err.Error(), http.StatusUnprocessableEntity)
+	case ErrClusterUnavailable:
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		clusterUnavailable(w, err)
+	case ErrTerminalRequired:
+		WriteError(w, err.Error(), http.StatusForbidden)
+	default:
+		log.Println("UploadHandler err", err)
+		if upload != nil {
+			w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		}
+		WriteError(w, "upload failed", http.StatusInternalServerError)
+	}
+}
+
+// StateHandler serves the control-plane state to the standby instance
+func StateHandler(w http.ResponseWriter, r *http.Request) {
+	if !CheckSyncToken(r.Header.Get(SyncTokenHeader)) {
+		WriteError(w, "invalid sync token", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GetStateSnapshot())
+}
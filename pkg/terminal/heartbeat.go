@@ -0,0 +1,56 @@
+package terminal
+
+import (
+	"time"
+)
+
+var heartbeatInterval = Flags.Duration("heartbeat-interval", 15*time.Second,
+	"interval of heartbeat messages to clients, 0 disables them")
+
+// sendHeartbeats periodically sends the server time to a client, which echoes it
+// back so the round-trip latency can be measured. The last measured latency is
+// included, so front-ends can display it without trusting their own clock
+func (t *TerminalSession) sendHeartbeats(c *terminalClient) {
+	if *heartbeatInterval <= 0 {
+		return
+	}
+	t.labelGoroutine("sendHeartbeats")
+	ticker := time.NewTicker(*heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-ticker.C:
+			msg := TerminalMessage{
+				Op:        "heartbeat",
+				Timestamp: now.UnixNano() / int64(time.Millisecond),
+				Latency:   c.latencyMillis(),
+			}
+			if err := c.writeJSON(msg); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// recordLatency handles the echo of a heartbeat sent at timestamp (unix ms)
+func (t *TerminalSession) recordLatency(c *terminalClient, timestamp int64) {
+	rtt := time.Since(time.Unix(0, timestamp*int64(time.Millisecond)))
+	if rtt < 0 || rtt > time.Minute {
+		// not an echo of one of our heartbeats
+		return
+	}
+	c.statsLock.Lock()
+	c.latency = rtt
+	c.statsLock.Unlock()
+
+	heartbeatRTT.Observe(rtt.Seconds())
+	sessionLatency.Set(rtt.Seconds(), t.id)
+}
+
+func (c *terminalClient) latencyMillis() float64 {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+	return float64(c.latency) / float64(time.Millisecond)
+}
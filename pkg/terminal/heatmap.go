@@ -0,0 +1,141 @@
+package terminal
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+var heatmapRetention = Flags.Duration("heatmap-retention", 30*24*time.Hour,
+	"how long terminal activity is kept for the heatmap")
+
+// ActivityBucket aggregates the terminal usage of a namespace in one hour or day
+type ActivityBucket struct {
+	Start     time.Time `json:"start"`
+	Namespace string    `json:"namespace"`
+	// Sessions counts the sessions started in the bucket
+	Sessions int `json:"sessions"`
+	// ActiveSeconds sums the session time that fell into the bucket
+	ActiveSeconds float64 `json:"activeSeconds"`
+}
+
+// jobKindRecordActivity aggregates a finished session into the heatmap
+const jobKindRecordActivity = "usage.record"
+
+type activityRecord struct {
+	Namespace string    `json:"namespace"`
+	Started   time.Time `json:"started"`
+	Ended     time.Time `json:"ended"`
+}
+
+func init() {
+	RegisterJobHandler(jobKindRecordActivity, func(payload json.RawMessage) error {
+		var record activityRecord
+		if err := json.Unmarshal(payload, &record); err != nil {
+			return err
+		}
+		recordActivity(record.Namespace, record.Started, record.Ended)
+		return nil
+	})
+}
+
+type bucketKey struct {
+	namespace string
+	start     time.Time
+}
+
+var (
+	activityLock    sync.Mutex
+	activityBuckets = make(map[bucketKey]*ActivityBucket)
+)
+
+func activityBucket(namespace string, start time.Time) *ActivityBucket {
+	key := bucketKey{namespace, start}
+	b, ok := activityBuckets[key]
+	if !ok {
+		b = &ActivityBucket{Start: start, Namespace: namespace}
+		activityBuckets[key] = b
+	}
+	return b
+}
+
+// recordActivity adds a finished session to the hourly buckets, its duration
+// is split over the hours it spanned
+func recordActivity(namespace string, started time.Time, ended time.Time) {
+	activityLock.Lock()
+	defer activityLock.Unlock()
+
+	started = started.UTC()
+	ended = ended.UTC()
+	hour := started.Truncate(time.Hour)
+	activityBucket(namespace, hour).Sessions++
+	for from := started; from.Before(ended); hour = hour.Add(time.Hour) {
+		to := hour.Add(time.Hour)
+		if to.After(ended) {
+			to = ended
+		}
+		activityBucket(namespace, hour).ActiveSeconds += to.Sub(from).Seconds()
+		from = to
+	}
+
+	cutoff := time.Now().Add(-*heatmapRetention)
+	for key := range activityBuckets {
+		if key.start.Before(cutoff) {
+			delete(activityBuckets, key)
+		}
+	}
+}
+
+// GetActivityHeatmap returns the usage buckets since the given time, per hour
+// or per day when daily is set. An empty namespace selects all namespaces
+func GetActivityHeatmap(namespace string, since time.Time, daily bool) []ActivityBucket {
+	activityLock.Lock()
+	defer activityLock.Unlock()
+
+	merged := make(map[bucketKey]*ActivityBucket)
+	for key, b := range activityBuckets {
+		if namespace != "" && key.namespace != namespace {
+			continue
+		}
+		if key.start.Before(since) {
+			continue
+		}
+		start := key.start
+		if daily {
+			start = start.Truncate(24 * time.Hour)
+		}
+		mkey := bucketKey{key.namespace, start}
+		m, ok := merged[mkey]
+		if !ok {
+			m = &ActivityBucket{Start: start, Namespace: key.namespace}
+			merged[mkey] = m
+		}
+		m.Sessions += b.Sessions
+		m.ActiveSeconds += b.ActiveSeconds
+	}
+
+	buckets := make([]ActivityBucket, 0, len(merged))
+	for _, b := range merged {
+		buckets = append(buckets, *b)
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		if !buckets[i].Start.Equal(buckets[j].Start) {
+			return buckets[i].Start.Before(buckets[j].Start)
+		}
+		return buckets[i].Namespace < buckets[j].Namespace
+	})
+	return buckets
+}
+
+// importActivity replaces the activity with the buckets copied from another instance
+func importActivity(buckets []ActivityBucket) {
+	activityLock.Lock()
+	defer activityLock.Unlock()
+
+	activityBuckets = make(map[bucketKey]*ActivityBucket, len(buckets))
+	for i := range buckets {
+		b := buckets[i]
+		activityBuckets[bucketKey{b.Namespace, b.Start}] = &b
+	}
+}
@@ -0,0 +1,89 @@
+package terminal
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+var (
+	idleTimeout = Flags.Duration("idle-timeout", 0,
+		"close sessions without input for this long, 0 keeps them open")
+	idleWarnings = Flags.String("idle-warnings", "60s,30s,10s",
+		"comma separated times before the idle timeout at which the terminal shows a countdown")
+)
+
+// warningTimes parses a list of warning times like -idle-warnings, longest
+// first. Times of limit or longer are dropped unless limit is 0
+func warningTimes(list string, limit time.Duration) []time.Duration {
+	var times []time.Duration
+	for _, s := range splitList(list) {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			log.Printf("ignoring warning time %q", s)
+			continue
+		}
+		if limit <= 0 || d < limit {
+			times = append(times, d)
+		}
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] > times[j] })
+	return times
+}
+
+// touch records input of a client, which resets the idle timeout
+func (t *TerminalSession) touch() {
+	t.idleLock.Lock()
+	t.lastInput = time.Now()
+	t.idleLock.Unlock()
+}
+
+func (t *TerminalSession) lastInputTime() time.Time {
+	t.idleLock.Lock()
+	defer t.idleLock.Unlock()
+	return t.lastInput
+}
+
+// watchIdle ends the session once nobody typed for -idle-timeout. Before it
+// counts down in the terminal at the -idle-warnings, input starts over
+func (t *TerminalSession) watchIdle() {
+	if *idleTimeout <= 0 {
+		return
+	}
+	t.labelGoroutine("watchIdle")
+	t.touch()
+	warnings := warningTimes(*idleWarnings, *idleTimeout)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var since time.Time
+	warned := 0
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		last := t.lastInputTime()
+		if !last.Equal(since) {
+			if warned > 0 {
+				t.Toast("\r\nidle timeout reset\r\n")
+			}
+			since, warned = last, 0
+		}
+		remaining := *idleTimeout - time.Since(last)
+		if remaining <= 0 {
+			killLocalSession(t.id, fmt.Sprintf("session closed after %s without input", *idleTimeout))
+			return
+		}
+		if warned < len(warnings) && remaining <= warnings[warned] {
+			// thresholds passed together, like after a pause of the process,
+			// get one warning
+			for warned < len(warnings) && remaining <= warnings[warned] {
+				warned++
+			}
+			t.Toast(fmt.Sprintf("\r\nsession will close in %s without input, press any key\r\n",
+				remaining.Round(time.Second)))
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package terminal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	jobQueueFile = Flags.String("jobqueue-file", "",
+		"file persisting queued jobs across restarts, jobs are only kept in memory if empty")
+	jobQueueWorkers = Flags.Int("jobqueue-workers", 2, "number of goroutines executing queued jobs")
+)
+
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobFailed  = "failed"
+
+	defaultJobAttempts = 10
+	maxJobBackoff      = 30 * time.Minute
+)
+
+// Job is a unit of asynchronous work, executed at least once
+// A job is only removed from the queue after its handler succeeded, so jobs
+// running when the server stopped are executed again after a restart
+type Job struct {
+	ID          string          `json:"id"`
+	Kind        string          `json:"kind"`
+	Payload     json.RawMessage `json:"payload"`
+	State       string          `json:"state"`
+	RunAt       time.Time       `json:"runAt"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"maxAttempts"`
+	LastError   string          `json:"lastError,omitempty"`
+}
+
+// JobHandler executes the jobs of one kind, returning an error schedules a retry
+type JobHandler func(payload json.RawMessage) error
+
+var jobQueue = struct {
+	lock     sync.Mutex
+	jobs     map[string]*Job
+	handlers map[string]JobHandler
+	wake     chan struct{}
+}{
+	jobs:     make(map[string]*Job),
+	handlers: make(map[string]JobHandler),
+	wake:     make(chan struct{}, 1),
+}
+
+// RegisterJobHandler sets the handler of a job kind, usually from an init function
+func RegisterJobHandler(kind string, handler JobHandler) {
+	jobQueue.lock.Lock()
+	defer jobQueue.lock.Unlock()
+	jobQueue.handlers[kind] = handler
+}
+
+// EnqueueJob queues a job to be executed at runAt (or right away if zero)
+func EnqueueJob(kind string, payload interface{}, runAt time.Time) (string, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	id, err := GenTerminalSessionId()
+	if err != nil {
+		return "", err
+	}
+	if runAt.IsZero() {
+		runAt = time.Now()
+	}
+
+	jobQueue.lock.Lock()
+	jobQueue.jobs[id] = &Job{
+		ID:          id,
+		Kind:        kind,
+		Payload:     data,
+		State:       JobPending,
+		RunAt:       runAt,
+		MaxAttempts: defaultJobAttempts,
+	}
+	updateJobMetricsLocked()
+	err = saveJobsLocked()
+	jobQueue.lock.Unlock()
+
+	select {
+	case jobQueue.wake <- struct{}{}:
+	default:
+	}
+	return id, err
+}
+
+// ListJobs returns the queued and failed jobs for inspection
+func ListJobs() []Job {
+	jobQueue.lock.Lock()
+	defer jobQueue.lock.Unlock()
+	jobs := make([]Job, 0, len(jobQueue.jobs))
+	for _, job := range jobQueue.jobs {
+		jobs = append(jobs, *job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].RunAt.Before(jobs[j].RunAt) })
+	return jobs
+}
+
+// StartJobQueue restores persisted jobs and starts the workers
+func StartJobQueue() {
+	if err := loadJobs(); err != nil {
+		log.Println("StartJobQueue load err", err)
+	}
+	for i := 0; i < *jobQueueWorkers; i++ {
+		go runJobs()
+	}
+}
+
+func runJobs() {
+	for {
+		job, handler := nextDueJob()
+		if job == nil {
+			select {
+			case <-jobQueue.wake:
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		err := runJob(job, handler)
+		finishJob(job, err)
+	}
+}
+
+// runJob executes a job, a panicking handler counts as failed attempt
+func runJob(job *Job, handler JobHandler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+	return handler(job.Payload)
+}
+
+// nextDueJob claims the oldest pending job whose time has come
+func nextDueJob() (*Job, JobHandler) {
+	jobQueue.lock.Lock()
+	defer jobQueue.lock.Unlock()
+
+	now := time.Now()
+	var next *Job
+	for _, job := range jobQueue.jobs {
+		if job.State != JobPending || job.RunAt.After(now) {
+			continue
+		}
+		if _, ok := jobQueue.handlers[job.Kind]; !ok {
+			continue
+		}
+		if next == nil || job.RunAt.Before(next.RunAt) {
+			next = job
+		}
+	}
+	if next == nil {
+		return nil, nil
+	}
+	next.State = JobRunning
+	next.Attempts++
+	updateJobMetricsLocked()
+	return next, jobQueue.handlers[next.Kind]
+}
+
+func finishJob(job *Job, err error) {
+	jobQueue.lock.Lock()
+	defer jobQueue.lock.Unlock()
+
+	if err == nil {
+		delete(jobQueue.jobs, job.ID)
+		jobsProcessed.Add(1, job.Kind, "success")
+	} else {
+		job.LastError = err.Error()
+		if job.Attempts >= job.MaxAttempts {
+			job.State = JobFailed
+			jobsProcessed.Add(1, job.Kind, "failed")
+			log.Printf("job %s (%s) failed permanently: %v", job.ID, job.Kind, err)
+		} else {
+			job.State = JobPending
+			job.RunAt = time.Now().Add(jobBackoff(job.Attempts))
+			jobsProcessed.Add(1, job.Kind, "retry")
+			log.Printf("job %s (%s) failed, retrying at %s: %v", job.ID, job.Kind, job.RunAt, err)
+		}
+	}
+	updateJobMetricsLocked()
+	if err := saveJobsLocked(); err != nil {
+		log.Println("finishJob save err", err)
+	}
+}
+
+func jobBackoff(attempts int) time.Duration {
+	backoff := time.Duration(1<<uint(attempts)) * time.Second
+	if backoff > maxJobBackoff || backoff <= 0 {
+		backoff = maxJobBackoff
+	}
+	return backoff
+}
+
+// updateJobMetricsLocked counts the jobs per state, it must be called with the lock held
+func updateJobMetricsLocked() {
+	counts := map[string]float64{JobPending: 0, JobRunning: 0, JobFailed: 0}
+	for _, job := range jobQueue.jobs {
+		counts[job.State]++
+	}
+	for state, count := range counts {
+		queuedJobs.Set(count, state)
+	}
+}
+
+// saveJobsLocked persists the queue, it must be called with the lock held
+func saveJobsLocked() error {
+	if *jobQueueFile == "" {
+		return nil
+	}
+	jobs := make([]*Job, 0, len(jobQueue.jobs))
+	for _, job := range jobQueue.jobs {
+		jobs = append(jobs, job)
+	}
+	data, err := json.Marshal(jobs)
+	if err != nil {
+		return err
+	}
+	tmp := *jobQueueFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, *jobQueueFile)
+}
+
+func loadJobs() error {
+	if *jobQueueFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(*jobQueueFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var jobs []*Job
+	if err := json.Unmarshal(data, &jobs); err != nil {
+		return err
+	}
+
+	jobQueue.lock.Lock()
+	defer jobQueue.lock.Unlock()
+	for _, job := range jobs {
+		// jobs interrupted by a restart run again
+		if job.State == JobRunning {
+			job.State = JobPending
+		}
+		jobQueue.jobs[job.ID] = job
+	}
+	updateJobMetricsLocked()
+	log.Printf("restored %d queued jobs", len(jobs))
+	return nil
+}
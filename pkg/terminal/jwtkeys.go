@@ -0,0 +1,323 @@
+package terminal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+var (
+	jwtKeySource = Flags.String("jwt-key-source", "static",
+		`where the keys of the server's tokens come from: "static", "secret" or "vault"`)
+	jwtKeyFile = Flags.String("jwt-key-file", "",
+		"file with the key of -jwt-key-source static, the built-in key is for development only")
+	jwtKeySecret = Flags.String("jwt-key-secret", "",
+		"namespace/name of the Secret with the keys for -jwt-key-source secret, every entry is a key")
+	vaultAddr       = Flags.String("vault-addr", os.Getenv("VAULT_ADDR"), "address of Vault, defaults to $VAULT_ADDR")
+	jwtKeyVaultPath = Flags.String("jwt-key-vault-path", "",
+		"API path of the KV secret with the keys for -jwt-key-source vault, like secret/data/terminal/jwt")
+	vaultRole = Flags.String("vault-role", "",
+		"role of the Vault kubernetes auth method to log in with, $VAULT_TOKEN is used if empty")
+	jwtKeyRefresh = Flags.Duration("jwt-key-refresh", time.Minute, "how often the keys are read from Vault")
+)
+
+const (
+	// staticKeyID is the id of the built-in key
+	staticKeyID = "static"
+	// serviceAccountToken authenticates the server at Vault's kubernetes auth
+	serviceAccountToken = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	vaultTimeout        = 10 * time.Second
+	// minJWTKeyLength is the shortest key that is loaded, HS256 keys should
+	// be as long as the hash
+	minJWTKeyLength = 32
+)
+
+// ErrNoJWTKeys is returned while the keys of -jwt-key-source weren't loaded
+var ErrNoJWTKeys = errors.New("no JWT keys are loaded")
+
+// jwtKeySet are the keys tokens are verified with by their id, tokens of the
+// server are signed with the last id in sort order, so the newest key should
+// sort last, like 2024-06 after 2024-01
+type jwtKeySet struct {
+	keys    map[string][]byte
+	signing string
+}
+
+var jwtKeys = struct {
+	lock sync.RWMutex
+	set  *jwtKeySet
+}{set: &jwtKeySet{keys: map[string][]byte{staticKeyID: jwtKey}, signing: staticKeyID}}
+
+func currentJWTKeys() *jwtKeySet {
+	jwtKeys.lock.RLock()
+	defer jwtKeys.lock.RUnlock()
+	return jwtKeys.set
+}
+
+// setJWTKeys replaces the keys, an empty set keeps the old keys. Keys shorter
+// than minJWTKeyLength are skipped
+func setJWTKeys(source string, keys map[string][]byte) {
+	ids := make([]string, 0, len(keys))
+	for id, key := range keys {
+		// like the built-in key, short keys are guessed
+		if len(key) >= minJWTKeyLength {
+			ids = append(ids, id)
+		} else if len(key) > 0 {
+			log.Printf("%s: JWT key %s is shorter than %d bytes, skipping it", source, id, minJWTKeyLength)
+		}
+	}
+	if len(ids) == 0 {
+		log.Printf("%s has no JWT keys, keeping the loaded ones", source)
+		return
+	}
+	sort.Strings(ids)
+	set := &jwtKeySet{keys: make(map[string][]byte, len(ids)), signing: ids[len(ids)-1]}
+	for _, id := range ids {
+		set.keys[id] = keys[id]
+	}
+	jwtKeys.lock.Lock()
+	jwtKeys.set = set
+	jwtKeys.lock.Unlock()
+	log.Printf("loaded %d JWT keys from %s, signing with %s", len(ids), source, set.signing)
+}
+
+// verificationOrder returns the ids of the keys to try, the signing key first
+func (s *jwtKeySet) verificationOrder() []string {
+	ids := []string{s.signing}
+	for id := range s.keys {
+		if id != s.signing {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids[1:])
+	return ids
+}
+
+// StartJWTKeys loads the keys of -jwt-key-source and keeps them up to date in
+// the background, so rotating them needs no restart. Tokens are refused until
+// the first keys were loaded
+func StartJWTKeys(kube *KubeClient) error {
+	switch *jwtKeySource {
+	case "static":
+		if *jwtKeyFile != "" {
+			key, err := ioutil.ReadFile(*jwtKeyFile)
+			if err != nil {
+				return err
+			}
+			if key = bytes.TrimSpace(key); len(key) < minJWTKeyLength {
+				return fmt.Errorf("-jwt-key-file must hold at least %d bytes", minJWTKeyLength)
+			}
+			setJWTKeys(*jwtKeyFile, map[string][]byte{staticKeyID: key})
+			return nil
+		}
+		// anyone reading the source could sign the tokens of logins and
+		// presigned URLs with the built-in key
+		if OIDCEnabled() || *presignEnabled {
+			return errors.New("-oidc-issuer and -presign sign tokens, " +
+				"they need -jwt-key-file or the keys of -jwt-key-source secret or vault")
+		}
+		return nil
+	case "secret":
+		if DockerBackend() {
+			return errors.New("-jwt-key-source secret needs a cluster")
+		}
+		parts := strings.SplitN(*jwtKeySecret, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return errors.New("-jwt-key-secret must be namespace/name")
+		}
+		clearJWTKeys()
+		go watchJWTKeySecret(kube, parts[0], parts[1])
+		return nil
+	case "vault":
+		if *vaultAddr == "" || *jwtKeyVaultPath == "" {
+			return errors.New("-vault-addr and -jwt-key-vault-path are required with -jwt-key-source vault")
+		}
+		clearJWTKeys()
+		go pollVaultJWTKeys()
+		return nil
+	}
+	return fmt.Errorf("unknown JWT key source %q", *jwtKeySource)
+}
+
+func clearJWTKeys() {
+	jwtKeys.lock.Lock()
+	jwtKeys.set = &jwtKeySet{}
+	jwtKeys.lock.Unlock()
+}
+
+// watchJWTKeySecret follows the Secret with an informer once the cluster is
+// available
+func watchJWTKeySecret(kube *KubeClient, namespace string, name string) {
+	backoff := minConnectBackoff
+	for {
+		clientset, err := kube.Clientset()
+		if err == nil {
+			factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0,
+				informers.WithNamespace(namespace),
+				informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+					options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+				}))
+			informer := factory.Core().V1().Secrets().Informer()
+			load := func(obj interface{}) {
+				if secret, ok := obj.(*v1.Secret); ok {
+					setJWTKeys("secret "+namespace+"/"+name, secret.Data)
+				}
+			}
+			informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+				AddFunc:    load,
+				UpdateFunc: func(old interface{}, obj interface{}) { load(obj) },
+				DeleteFunc: func(obj interface{}) {
+					log.Printf("JWT key secret %s/%s was deleted, keeping the loaded keys", namespace, name)
+				},
+			})
+			// runs as long as the server
+			factory.Start(make(chan struct{}))
+			return
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxConnectBackoff {
+			backoff = maxConnectBackoff
+		}
+	}
+}
+
+// pollVaultJWTKeys reads the keys from Vault every -jwt-key-refresh
+func pollVaultJWTKeys() {
+	vault := &vaultClient{}
+	for {
+		keys, err := vault.readKeys(*jwtKeyVaultPath)
+		if err != nil {
+			log.Println("pollVaultJWTKeys err", err)
+		} else {
+			setJWTKeys("vault "+*jwtKeyVaultPath, keys)
+		}
+		time.Sleep(*jwtKeyRefresh)
+	}
+}
+
+// vaultClient reads secrets over the HTTP API of Vault, logged in with the
+// service account of the server if -vault-role is set
+type vaultClient struct {
+	token   string
+	expires time.Time
+}
+
+// readKeys reads the fields of a KV secret, of version 1 or 2
+func (v *vaultClient) readKeys(path string) (map[string][]byte, error) {
+	var body struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := v.do("GET", path, nil, &body); err != nil {
+		return nil, err
+	}
+	fields := body.Data
+	// KV version 2 nests the fields in data.data
+	if nested, ok := body.Data["data"]; ok {
+		if err := json.Unmarshal(nested, &fields); err != nil {
+			return nil, err
+		}
+	}
+	keys := make(map[string][]byte, len(fields))
+	for id, raw := range fields {
+		var value string
+		if json.Unmarshal(raw, &value) == nil {
+			keys[id] = []byte(value)
+		}
+	}
+	return keys, nil
+}
+
+func (v *vaultClient) do(method string, path string, in interface{}, out interface{}) error {
+	token, err := v.login()
+	if err != nil {
+		return err
+	}
+	err = vaultRequest(method, path, token, in, out)
+	if errors.Is(err, errVaultForbidden) && *vaultRole != "" {
+		// the token may have been revoked, log in again next time
+		v.token = ""
+	}
+	return err
+}
+
+// login returns the token to use, $VAULT_TOKEN without -vault-role
+func (v *vaultClient) login() (string, error) {
+	if *vaultRole == "" {
+		return os.Getenv("VAULT_TOKEN"), nil
+	}
+	if v.token != "" && time.Now().Before(v.expires) {
+		return v.token, nil
+	}
+	jwt, err := ioutil.ReadFile(serviceAccountToken)
+	if err != nil {
+		return "", err
+	}
+	var body struct {
+		Auth struct {
+			ClientToken   string `json:"client_token"`
+			LeaseDuration int    `json:"lease_duration"`
+		} `json:"auth"`
+	}
+	in := map[string]string{"role": *vaultRole, "jwt": strings.TrimSpace(string(jwt))}
+	if err := vaultRequest("POST", "auth/kubernetes/login", "", in, &body); err != nil {
+		return "", fmt.Errorf("vault login: %w", err)
+	}
+	v.token = body.Auth.ClientToken
+	// logged in again well before the token expires
+	v.expires = time.Now().Add(time.Duration(body.Auth.LeaseDuration) * time.Second * 2 / 3)
+	return v.token, nil
+}
+
+var errVaultForbidden = errors.New("vault: permission denied")
+
+func vaultRequest(method string, path string, token string, in interface{}, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(*vaultAddr, "/")+"/v1/"+strings.TrimPrefix(path, "/"), body)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	client, err := EgressClient(vaultTimeout)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusForbidden:
+		io.Copy(ioutil.Discard, resp.Body)
+		return errVaultForbidden
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		io.Copy(ioutil.Discard, resp.Body)
+		return fmt.Errorf("vault %s %s: %s", method, path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
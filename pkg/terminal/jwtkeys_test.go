@@ -0,0 +1,38 @@
+package terminal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSigningNeedsARealKey(t *testing.T) {
+	defer Flags.Set("presign", "false")
+	defer Flags.Set("jwt-key-file", "")
+	Flags.Set("presign", "true")
+	if err := StartJWTKeys(nil); err == nil {
+		t.Error("-presign started with the built-in key")
+	}
+
+	dir, err := ioutil.TempDir("", "jwtkeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "key")
+	ioutil.WriteFile(file, []byte("test\n"), 0600)
+	Flags.Set("jwt-key-file", file)
+	if err := StartJWTKeys(nil); err == nil {
+		t.Error("-presign started with a short -jwt-key-file")
+	}
+}
+
+func TestShortKeysAreSkipped(t *testing.T) {
+	loaded := currentJWTKeys()
+	defer func() { jwtKeys.set = loaded }()
+	setJWTKeys("test", map[string][]byte{"2024-01": make([]byte, minJWTKeyLength), "2024-06": []byte("test")})
+	if keys := currentJWTKeys(); keys.signing != "2024-01" || len(keys.keys) != 1 {
+		t.Errorf("loaded %d keys signing with %s, want only 2024-01", len(keys.keys), keys.signing)
+	}
+}
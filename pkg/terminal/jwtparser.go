@@ -0,0 +1,101 @@
+package terminal
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+const (
+	// RoleViewer marks users that may only watch terminals, never type into them
+	RoleViewer = "viewer"
+	// RoleAdmin grants access to the admin API
+	RoleAdmin = "admin"
+	// RoleRestricted marks low-trust users whose terminals run in safe mode
+	RoleRestricted = "restricted"
+)
+
+// jwtKey signs and verifies the server's tokens
+var jwtKey = []byte("test")
+
+type MyCustomClaims struct {
+	Role string `json:"role,omitempty"`
+	// Namespaces the user may access, "*" or no claim at all means every namespace
+	Namespaces []string `json:"namespaces,omitempty"`
+	jwt.StandardClaims
+}
+
+// ParseJwtToken validates the token and returns its claims
+// Tokens without an expiry are rejected
+func ParseJwtToken(tokenString string) (*MyCustomClaims, error) {
+	token, err := parseWithJWTKeys(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims, ok := token.Claims.(*MyCustomClaims); ok && token.Valid {
+		now := time.Now().Unix()
+		if claims.StandardClaims.VerifyExpiresAt(now, true) {
+			return claims, nil
+		}
+		return nil, errors.New("token has no expiry or is expired")
+	}
+	return nil, errors.New("token is invalid")
+}
+
+// parseWithJWTKeys verifies a token with the key of its kid header, tokens
+// without one are tried with every key so they stay valid across a rotation
+func parseWithJWTKeys(tokenString string) (*jwt.Token, error) {
+	keys := currentJWTKeys()
+	if len(keys.keys) == 0 {
+		return nil, ErrNoJWTKeys
+	}
+	var token *jwt.Token
+	var err error
+	for _, id := range keys.verificationOrder() {
+		key := keys.keys[id]
+		token, err = jwt.ParseWithClaims(tokenString, &MyCustomClaims{},
+			func(token *jwt.Token) (interface{}, error) {
+				if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+					return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+				}
+				if kid, ok := token.Header["kid"].(string); ok && kid != "" {
+					if key, ok := keys.keys[kid]; ok {
+						return key, nil
+					}
+					return nil, fmt.Errorf("unknown key id %q", kid)
+				}
+				return key, nil
+			})
+		if token == nil || token.Header["kid"] != nil || !signatureInvalid(err) {
+			return token, err
+		}
+	}
+	return token, err
+}
+
+func signatureInvalid(err error) bool {
+	validation, ok := err.(*jwt.ValidationError)
+	return ok && validation.Errors&jwt.ValidationErrorSignatureInvalid != 0
+}
+
+// SignJwtToken issues a token of the server for claims
+func SignJwtToken(claims *MyCustomClaims) (string, error) {
+	keys := currentJWTKeys()
+	if len(keys.keys) == 0 {
+		return "", ErrNoJWTKeys
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = keys.signing
+	return token.SignedString(keys.keys[keys.signing])
+}
+
+func IsVaildJwtToken(tokenString string) bool {
+	if _, err := ParseJwtToken(tokenString); err != nil {
+		fmt.Println(err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,191 @@
+package terminal
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	minConnectBackoff = time.Second
+	maxConnectBackoff = time.Minute
+
+	// connectProbeTimeout bounds the request checking that the API server answers
+	connectProbeTimeout = 10 * time.Second
+	// minReconnectInterval limits how often rejected credentials trigger a reload
+	minReconnectInterval = time.Minute
+)
+
+var (
+	kubeQPS = Flags.Float64("kube-qps", 50,
+		"queries per second to the Kubernetes API, the client-go default of 5 throttles busy servers")
+	kubeBurst   = Flags.Int("kube-burst", 100, "burst of queries to the Kubernetes API above -kube-qps")
+	kubeTimeout = Flags.Duration("kube-timeout", 30*time.Second,
+		"deadline of Kubernetes API requests and of establishing exec streams, 0 for none")
+)
+
+// ErrClusterUnavailable is returned while no connection to the Kubernetes API
+// could be established yet
+var ErrClusterUnavailable = errors.New("kubernetes API is not available")
+
+// KubeClient owns the rest.Config and Clientset of one cluster
+// Token files, like projected service account tokens, are re-read by client-go
+// when they rotate. Other credentials are reloaded from the kubeconfig once the
+// API server rejects them as unauthorized
+type KubeClient struct {
+	kubeconfig string
+
+	lock          sync.RWMutex
+	config        *rest.Config
+	clientset     kubernetes.Interface
+	lastConnected time.Time
+	reconnecting  bool
+	// static clients were given their clientset and never reload it
+	static bool
+}
+
+// NewKubeClient returns a client of the cluster in kubeconfig, or of the
+// cluster the server runs in if kubeconfig is empty. Call Start to connect
+func NewKubeClient(kubeconfig string) *KubeClient {
+	return &KubeClient{kubeconfig: kubeconfig}
+}
+
+// NewKubeClientFor returns a client using clientset, like the fake clientset
+// of k8s.io/client-go/kubernetes/fake in tests. config is needed by exec and
+// port-forward streams only and may be nil when an Executor is set. The
+// client is connected already, Start isn't needed
+func NewKubeClientFor(clientset kubernetes.Interface, config *rest.Config) *KubeClient {
+	return &KubeClient{config: config, clientset: clientset, lastConnected: time.Now(), static: true}
+}
+
+// Start connects to the Kubernetes API in the background, retrying with
+// exponential backoff, so an API server outage at startup heals by itself.
+// Until connected, cluster calls fail with ErrClusterUnavailable
+func (k *KubeClient) Start() {
+	go func() {
+		backoff := minConnectBackoff
+		for {
+			err := k.Connect(context.Background())
+			if err == nil {
+				log.Println("connected to the kubernetes API")
+				return
+			}
+			log.Printf("connect to kubernetes API failed, retrying in %s: %v", backoff, err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxConnectBackoff {
+				backoff = maxConnectBackoff
+			}
+		}
+	}()
+}
+
+// Available reports whether the connection to the Kubernetes API was established
+func (k *KubeClient) Available() bool {
+	_, err := k.Clientset()
+	return err == nil
+}
+
+// Config returns the rest.Config of the cluster
+func (k *KubeClient) Config() (*rest.Config, error) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	if k.config == nil {
+		return nil, ErrClusterUnavailable
+	}
+	return k.config, nil
+}
+
+// Clientset returns the clientset of the cluster
+func (k *KubeClient) Clientset() (kubernetes.Interface, error) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	if k.clientset == nil {
+		return nil, ErrClusterUnavailable
+	}
+	return k.clientset, nil
+}
+
+// Connect makes one attempt to connect to the Kubernetes API, the check that
+// the API server answers is bound to ctx. Start retries it in the background
+func (k *KubeClient) Connect(ctx context.Context) error {
+	// use the current context in kubeconfig
+	config, err := clientcmd.BuildConfigFromFlags("", k.kubeconfig)
+	if err != nil {
+		return err
+	}
+	config.QPS = float32(*kubeQPS)
+	config.Burst = *kubeBurst
+	// rest.Config.Timeout would also cut watches and exec streams, requests
+	// get deadlines from requestContext instead
+	config.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+		return &reconnectTransport{kube: k, next: rt}
+	})
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+
+	probeCtx, cancel := context.WithTimeout(ctx, connectProbeTimeout)
+	defer cancel()
+	if err := clientset.Discovery().RESTClient().Get().AbsPath("/version").Do(probeCtx).Error(); err != nil {
+		return err
+	}
+
+	k.lock.Lock()
+	k.config = config
+	k.clientset = clientset
+	k.lastConnected = time.Now()
+	k.lock.Unlock()
+	return nil
+}
+
+// reconnect reloads the credentials after the API server rejected them, the
+// current clientset is kept if that fails
+func (k *KubeClient) reconnect() {
+	k.lock.Lock()
+	if k.static || k.reconnecting || time.Since(k.lastConnected) < minReconnectInterval {
+		k.lock.Unlock()
+		return
+	}
+	k.reconnecting = true
+	k.lock.Unlock()
+
+	log.Println("kubernetes API rejected the credentials, reloading them")
+	if err := k.Connect(context.Background()); err != nil {
+		log.Println("KubeClient reconnect err", err)
+	}
+	k.lock.Lock()
+	k.reconnecting = false
+	k.lastConnected = time.Now()
+	k.lock.Unlock()
+}
+
+// reconnectTransport triggers a reload of the credentials on 401 responses
+type reconnectTransport struct {
+	kube *KubeClient
+	next http.RoundTripper
+}
+
+func (t *reconnectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		go t.kube.reconnect()
+	}
+	return resp, err
+}
+
+// requestContext bounds API requests by -kube-timeout, so a slow API server
+// doesn't hang the handlers waiting for it
+func requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if *kubeTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, *kubeTimeout)
+}
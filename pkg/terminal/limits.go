@@ -0,0 +1,63 @@
+package terminal
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/time/rate"
+)
+
+var (
+	maxMessageSize = Flags.Int64("max-message-size", 64<<10,
+		"bytes of the largest websocket message a client may send, larger ones close the connection")
+	inputRateLimit = Flags.Int("input-rate-limit", 1<<20,
+		"bytes per second of stdin a session accepts, 0 for no limit")
+	inputBurst = Flags.Int("input-burst", 256<<10,
+		"bytes of stdin a session accepts at once before -input-rate-limit applies")
+)
+
+// maxTerminalSize bounds the rows and columns of a terminal, larger sizes
+// only make programs in the container allocate huge screens
+const maxTerminalSize = 1000
+
+// upgradeWebsocket upgrades a request with the read limit of -max-message-size,
+// a client sending a larger frame is disconnected before it is buffered
+func upgradeWebsocket(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, err
+	}
+	if *maxMessageSize > 0 {
+		conn.SetReadLimit(*maxMessageSize)
+	}
+	return conn, nil
+}
+
+// newInputLimiter returns the token bucket of a session's stdin, nil if
+// input is not limited
+func newInputLimiter() *rate.Limiter {
+	if *inputRateLimit <= 0 {
+		return nil
+	}
+	burst := *inputBurst
+	if burst < 1 {
+		burst = *inputRateLimit
+	}
+	return rate.NewLimiter(rate.Limit(*inputRateLimit), burst)
+}
+
+// limitInput blocks until the session may take n bytes of stdin. Not reading
+// from the client pushes back on it through TCP instead of queueing its input
+func (t *TerminalSession) limitInput(n int) error {
+	if t.inputLimiter == nil {
+		return nil
+	}
+	started := time.Now()
+	defer func() {
+		if waited := time.Since(started); waited > time.Millisecond {
+			inputThrottled.Add(waited.Seconds())
+		}
+	}()
+	return waitLimiter(t, t.inputLimiter, n)
+}
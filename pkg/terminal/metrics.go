@@ -0,0 +1,210 @@
+package terminal
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var metricsBackendNames = Flags.String("metrics-backends", "prometheus",
+	"comma separated metrics backends: prometheus (served on /metrics), statsd, otlp")
+
+type metricKind int
+
+const (
+	counterMetric metricKind = iota
+	gaugeMetric
+	histogramMetric
+)
+
+// Metric is a measurement of the server, it is recorded by every backend
+// enabled with -metrics-backends
+type Metric struct {
+	Name    string
+	Help    string
+	Labels  []string
+	Buckets []float64
+	kind    metricKind
+}
+
+// MetricsBackend exports measurements, label values are in the order of the
+// metric's Labels
+type MetricsBackend interface {
+	Register(m *Metric) error
+	Add(m *Metric, value float64, labels []string)
+	Set(m *Metric, value float64, labels []string)
+	Observe(m *Metric, value float64, labels []string)
+	// Delete forgets a labelled series, like the gauge of an ended session
+	Delete(m *Metric, labels []string)
+}
+
+var (
+	metrics        []*Metric
+	metricsBackend []MetricsBackend
+)
+
+func newMetric(kind metricKind, name string, help string, buckets []float64, labels []string) *Metric {
+	m := &Metric{Name: name, Help: help, Labels: labels, Buckets: buckets, kind: kind}
+	metrics = append(metrics, m)
+	return m
+}
+
+func newCounter(name string, help string, labels ...string) *Metric {
+	return newMetric(counterMetric, name, help, nil, labels)
+}
+
+func newGauge(name string, help string, labels ...string) *Metric {
+	return newMetric(gaugeMetric, name, help, nil, labels)
+}
+
+func newHistogram(name string, help string, buckets []float64, labels ...string) *Metric {
+	return newMetric(histogramMetric, name, help, buckets, labels)
+}
+
+var (
+	outputDroppedBytes = newCounter("terminal_output_dropped_bytes_total",
+		"Bytes of terminal output discarded because a client could not keep up.")
+	outputThrottled = newCounter("terminal_output_throttled_seconds_total",
+		"Time session output was held back by -output-rate-limit.")
+	inputThrottled = newCounter("terminal_input_throttled_seconds_total",
+		"Time session input was held back by -input-rate-limit.")
+	heartbeatRTT = newHistogram("terminal_heartbeat_rtt_seconds",
+		"Round-trip time of heartbeats between server and clients.",
+		[]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5})
+	sessionLatency = newGauge("terminal_session_latency_seconds",
+		"Last heartbeat round-trip time measured per session.", "session")
+	execErrors = newCounter("terminal_exec_errors_total",
+		"Terminals that could not be started, by error code.", "code")
+	queuedJobs = newGauge("terminal_jobs",
+		"Jobs in the embedded job queue, by state.", "state")
+	queuedSessions = newGauge("terminal_sessions_queued",
+		"Terminals waiting for a free session slot.")
+	auditBacklog = newGauge("terminal_audit_backlog_events",
+		"Audit events spooled but not yet accepted by the audit sink.")
+	jobsProcessed = newCounter("terminal_jobs_processed_total",
+		"Job executions, by kind and result (success, retry, failed).", "kind", "result")
+)
+
+// StartMetrics creates the backends of -metrics-backends and registers the
+// metrics with them. Measurements before it are dropped. The returned
+// function flushes the backends that push
+func StartMetrics() (func(), error) {
+	var stops []func()
+	for _, name := range splitList(*metricsBackendNames) {
+		var backend MetricsBackend
+		var stop func()
+		var err error
+		switch name {
+		case "prometheus":
+			backend = newPrometheusBackend()
+		case "statsd":
+			backend, err = newStatsdBackend()
+		case "otlp":
+			backend, stop, err = newOTLPMetricsBackend()
+		default:
+			err = fmt.Errorf("unknown metrics backend %q", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range metrics {
+			if err := backend.Register(m); err != nil {
+				return nil, fmt.Errorf("register %s with %s: %v", m.Name, name, err)
+			}
+		}
+		metricsBackend = append(metricsBackend, backend)
+		if stop != nil {
+			stops = append(stops, stop)
+		}
+	}
+	return func() {
+		for _, stop := range stops {
+			stop()
+		}
+	}, nil
+}
+
+// Add increases a counter
+func (m *Metric) Add(value float64, labels ...string) {
+	for _, b := range metricsBackend {
+		b.Add(m, value, labels)
+	}
+}
+
+// Set sets a gauge
+func (m *Metric) Set(value float64, labels ...string) {
+	for _, b := range metricsBackend {
+		b.Set(m, value, labels)
+	}
+}
+
+// Observe records a value of a histogram
+func (m *Metric) Observe(value float64, labels ...string) {
+	for _, b := range metricsBackend {
+		b.Observe(m, value, labels)
+	}
+}
+
+// Delete forgets the series of the label values
+func (m *Metric) Delete(labels ...string) {
+	for _, b := range metricsBackend {
+		b.Delete(m, labels)
+	}
+}
+
+// prometheusBackend serves the metrics on /metrics
+type prometheusBackend struct {
+	counters   map[*Metric]*prometheus.CounterVec
+	gauges     map[*Metric]*prometheus.GaugeVec
+	histograms map[*Metric]*prometheus.HistogramVec
+}
+
+func newPrometheusBackend() *prometheusBackend {
+	return &prometheusBackend{
+		counters:   map[*Metric]*prometheus.CounterVec{},
+		gauges:     map[*Metric]*prometheus.GaugeVec{},
+		histograms: map[*Metric]*prometheus.HistogramVec{},
+	}
+}
+
+func (p *prometheusBackend) Register(m *Metric) error {
+	switch m.kind {
+	case counterMetric:
+		vec := prometheus.NewCounterVec(prometheus.CounterOpts{Name: m.Name, Help: m.Help}, m.Labels)
+		p.counters[m] = vec
+		return prometheus.Register(vec)
+	case gaugeMetric:
+		vec := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: m.Name, Help: m.Help}, m.Labels)
+		p.gauges[m] = vec
+		return prometheus.Register(vec)
+	default:
+		vec := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: m.Name, Help: m.Help, Buckets: m.Buckets}, m.Labels)
+		p.histograms[m] = vec
+		return prometheus.Register(vec)
+	}
+}
+
+func (p *prometheusBackend) Add(m *Metric, value float64, labels []string) {
+	if vec, ok := p.counters[m]; ok {
+		vec.WithLabelValues(labels...).Add(value)
+	}
+}
+
+func (p *prometheusBackend) Set(m *Metric, value float64, labels []string) {
+	if vec, ok := p.gauges[m]; ok {
+		vec.WithLabelValues(labels...).Set(value)
+	}
+}
+
+func (p *prometheusBackend) Observe(m *Metric, value float64, labels []string) {
+	if vec, ok := p.histograms[m]; ok {
+		vec.WithLabelValues(labels...).Observe(value)
+	}
+}
+
+func (p *prometheusBackend) Delete(m *Metric, labels []string) {
+	if vec, ok := p.gauges[m]; ok {
+		vec.DeleteLabelValues(labels...)
+	}
+}
@@ -0,0 +1,319 @@
+package terminal
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var muxMaxChannels = Flags.Int("mux-max-channels", 8, "terminals one multiplexed websocket may open")
+
+// ErrChannelOverflow ends a channel whose terminal doesn't keep up with its input
+var ErrChannelOverflow = errors.New("the terminal of the channel doesn't keep up with its input")
+
+// muxMessage is the JSON control message of a multiplexed websocket
+type muxMessage struct {
+	Op        string `json:"op"`
+	Channel   uint16 `json:"channel"`
+	Container string `json:"container,omitempty"`
+	Rows      uint16 `json:"rows,omitempty"`
+	Cols      uint16 `json:"cols,omitempty"`
+	Data      string `json:"data,omitempty"`
+}
+
+// MuxTerminals runs terminals in containers of one pod over the websocket of
+// r, so a UI can show the app and its sidecars in tabs with one connection and
+// one authentication. {"op":"open","channel":N,"container":"app","rows":..,
+// "cols":..} starts a terminal, every channel then speaks the terminal
+// protocol: binary frames start with the channel id as 2 byte big endian
+// number, control messages carry a "channel" field. The capabilities message
+// is acknowledged by the open, and {"op":"close","channel":N} ends a channel
+// in both directions. The reason and tags of the request apply to every
+// channel. It blocks until the websocket is closed
+func MuxTerminals(w http.ResponseWriter, r *http.Request, kube *KubeClient, claims *MyCustomClaims,
+	namespace string, pod string) error {
+
+	reason, tags, err := ParseSessionPurpose(r.URL.Query(), namespace)
+	if err != nil {
+		code := ""
+		if err == ErrReasonRequired {
+			code = ErrCodeReasonRequired
+		}
+		WriteTerminalError(w, r, code, err.Error(), http.StatusBadRequest)
+		return err
+	}
+	conn, err := upgrade(w, r)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(detachedTraceContext(r.Context()))
+	defer cancel()
+	m := &terminalMux{
+		ctx:       ctx,
+		conn:      conn,
+		kube:      kube,
+		claims:    claims,
+		namespace: namespace,
+		pod:       pod,
+		reason:    reason,
+		tags:      tags,
+		channels:  make(map[uint16]*muxChannel),
+	}
+	err = m.run()
+	m.closeAll()
+	return err
+}
+
+// terminalMux is a multiplexed websocket
+type terminalMux struct {
+	ctx       context.Context
+	conn      *websocket.Conn
+	writeLock sync.Mutex
+	kube      *KubeClient
+	claims    *MyCustomClaims
+	namespace string
+	pod       string
+	reason    string
+	tags      map[string]string
+
+	lock     sync.Mutex
+	channels map[uint16]*muxChannel
+}
+
+func (m *terminalMux) writeMessage(messageType int, data []byte) error {
+	m.writeLock.Lock()
+	defer m.writeLock.Unlock()
+	return m.conn.WriteMessage(messageType, data)
+}
+
+func (m *terminalMux) sendClose(id uint16, reason string) {
+	data, _ := json.Marshal(muxMessage{Op: "close", Channel: id, Data: reason})
+	m.writeMessage(websocket.TextMessage, data)
+}
+
+// run reads the websocket until it is closed
+func (m *terminalMux) run() error {
+	for {
+		messageType, data, err := m.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				return nil
+			}
+			return err
+		}
+		if messageType == websocket.BinaryMessage {
+			if len(data) >= 2 {
+				m.forward(binary.BigEndian.Uint16(data), websocket.BinaryMessage, data[2:])
+			}
+			continue
+		}
+		var msg muxMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			continue
+		}
+		switch msg.Op {
+		case "open":
+			m.open(msg)
+		case "close":
+			m.lock.Lock()
+			channel := m.channels[msg.Channel]
+			m.lock.Unlock()
+			if channel != nil {
+				m.remove(channel)
+			}
+		default:
+			// the session handles the other control messages
+			m.forward(msg.Channel, websocket.TextMessage, data)
+		}
+	}
+}
+
+// forward passes a frame to the terminal of channel id. It never blocks, a
+// stuck terminal would hold up every channel of the websocket, so a channel
+// whose frames pile up is closed instead; dropping frames would garble its
+// input
+func (m *terminalMux) forward(id uint16, messageType int, data []byte) {
+	m.lock.Lock()
+	channel := m.channels[id]
+	m.lock.Unlock()
+	if channel == nil {
+		return
+	}
+	select {
+	case channel.frames <- muxFrame{messageType, data}:
+	case <-channel.closed:
+	default:
+		log.Printf("mux channel %d: %v", id, ErrChannelOverflow)
+		channel.fail(ErrChannelOverflow.Error())
+	}
+}
+
+// open starts the terminal of a channel
+func (m *terminalMux) open(msg muxMessage) {
+	m.lock.Lock()
+	if _, ok := m.channels[msg.Channel]; ok {
+		m.lock.Unlock()
+		m.sendClose(msg.Channel, "channel is in use")
+		return
+	}
+	if len(m.channels) >= *muxMaxChannels {
+		m.lock.Unlock()
+		m.sendClose(msg.Channel, ErrTooManyChannels.Error())
+		return
+	}
+	channel := &muxChannel{
+		mux:    m,
+		id:     msg.Channel,
+		rows:   msg.Rows,
+		cols:   msg.Cols,
+		frames: make(chan muxFrame, 16),
+		closed: make(chan struct{}),
+	}
+	m.channels[msg.Channel] = channel
+	m.lock.Unlock()
+
+	go func() {
+		meta, err := admitTerminal(m.ctx, m.kube, m.claims, m.namespace, m.pod, msg.Container)
+		if err != nil {
+			channel.fail(err.Error())
+			return
+		}
+		meta.Reason = m.reason
+		meta.Tags = m.tags
+		sessionId, err := startSession(m.ctx, channel, m.kube, meta)
+		if err != nil {
+			channel.fail(err.Error())
+			return
+		}
+		log.Printf("start multiplexed terminal: %s (channel %d)", sessionId, channel.id)
+		ExecTerminal(meta.Container, m.pod, m.namespace, sessionId)
+	}()
+}
+
+// remove closes a channel, which ends its terminal. Its id may be reused
+// right away
+func (m *terminalMux) remove(channel *muxChannel) {
+	m.lock.Lock()
+	if m.channels[channel.id] == channel {
+		delete(m.channels, channel.id)
+	}
+	m.lock.Unlock()
+	channel.closeOnce.Do(func() { close(channel.closed) })
+}
+
+func (m *terminalMux) closeAll() {
+	m.lock.Lock()
+	channels := make([]*muxChannel, 0, len(m.channels))
+	for _, channel := range m.channels {
+		channels = append(channels, channel)
+	}
+	m.lock.Unlock()
+	for _, channel := range channels {
+		m.remove(channel)
+	}
+}
+
+type muxFrame struct {
+	messageType int
+	data        []byte
+}
+
+// muxChannel adapts a channel of a multiplexed websocket to the session
+// stack. The capabilities handshake is answered from the open message
+type muxChannel struct {
+	mux        *terminalMux
+	id         uint16
+	rows       uint16
+	cols       uint16
+	acked      bool
+	frames     chan muxFrame
+	closeOnce  sync.Once
+	closed     chan struct{}
+	notifyOnce sync.Once
+}
+
+// fail closes a channel whose terminal could not be started
+func (c *muxChannel) fail(reason string) {
+	c.mux.remove(c)
+	c.notifyOnce.Do(func() { c.mux.sendClose(c.id, reason) })
+}
+
+func (c *muxChannel) WriteMessage(messageType int, data []byte) error {
+	select {
+	case <-c.closed:
+		return errors.New("channel was closed")
+	default:
+	}
+	if messageType == websocket.TextMessage {
+		return c.mux.writeMessage(messageType, withChannel(c.id, data))
+	}
+	frame := make([]byte, len(data)+2)
+	binary.BigEndian.PutUint16(frame, c.id)
+	copy(frame[2:], data)
+	return c.mux.writeMessage(messageType, frame)
+}
+
+func (c *muxChannel) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.WriteMessage(websocket.TextMessage, data)
+}
+
+// withChannel adds the channel field to a JSON object
+func withChannel(id uint16, data []byte) []byte {
+	if len(data) < 2 || data[0] != '{' {
+		return data
+	}
+	field := `{"channel":` + strconv.Itoa(int(id))
+	if data[1] != '}' {
+		field += ","
+	}
+	return append([]byte(field), data[1:]...)
+}
+
+func (c *muxChannel) ReadMessage() (int, []byte, error) {
+	select {
+	case frame := <-c.frames:
+		return frame.messageType, frame.data, nil
+	case <-c.closed:
+		return 0, nil, errors.New("channel was closed")
+	}
+}
+
+// ReadJSON returns the ack of the handshake with the size of the open message
+func (c *muxChannel) ReadJSON(v interface{}) error {
+	ack, ok := v.(*TerminalMessage)
+	if !ok || c.acked {
+		return errors.New("unexpected JSON read on a multiplexed channel")
+	}
+	c.acked = true
+	*ack = TerminalMessage{Op: "ack", Version: ProtocolVersion, Rows: c.rows, Cols: c.cols}
+	return nil
+}
+
+func (c *muxChannel) SetReadDeadline(t time.Time) error   { return nil }
+func (c *muxChannel) SetCompressionLevel(level int) error { return nil }
+func (c *muxChannel) EnableWriteCompression(enable bool)  {}
+
+// Close is called once the session is done with the channel, the client is
+// told unless it closed the channel itself
+func (c *muxChannel) Close() error {
+	select {
+	case <-c.closed:
+	default:
+		c.notifyOnce.Do(func() { c.mux.sendClose(c.id, "") })
+	}
+	c.mux.remove(c)
+	return nil
+}
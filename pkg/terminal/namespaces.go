@@ -0,0 +1,87 @@
+package terminal
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var namespaceAccess = Flags.String("namespace-access", "claims",
+	`how visible namespaces are decided: "claims" uses the token's namespaces claim, `+
+		`"sar" asks the API server whether the user may exec into pods there`)
+
+// ErrNamespaceForbidden is returned when the token's namespaces claim doesn't
+// grant the namespace of a session
+var ErrNamespaceForbidden = errors.New("namespace is not allowed")
+
+// AllowsNamespace reports whether the token grants access to namespace
+// Tokens without a namespaces claim are not restricted
+func (c *MyCustomClaims) AllowsNamespace(namespace string) bool {
+	if len(c.Namespaces) == 0 {
+		return true
+	}
+	for _, ns := range c.Namespaces {
+		if ns == "*" || ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// ListNamespaces returns the names of the namespaces the user may see
+func (k *KubeClient) ListNamespaces(ctx context.Context, claims *MyCustomClaims) ([]string, error) {
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+	clientset, err := k.Clientset()
+	if err != nil {
+		return nil, err
+	}
+	list, err := clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(list.Items))
+	for _, ns := range list.Items {
+		allowed := claims.AllowsNamespace(ns.Name)
+		if allowed && *namespaceAccess == "sar" {
+			if allowed, err = k.canExecInNamespace(ctx, claims.Subject, ns.Name); err != nil {
+				return nil, err
+			}
+		}
+		if allowed {
+			names = append(names, ns.Name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// canExecInNamespace asks the API server whether user may exec into pods of namespace
+func (k *KubeClient) canExecInNamespace(ctx context.Context, user string, namespace string) (bool, error) {
+	review := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User: user,
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace:   namespace,
+				Verb:        "create",
+				Resource:    "pods",
+				Subresource: "exec",
+			},
+		},
+	}
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+	clientset, err := k.Clientset()
+	if err != nil {
+		return false, err
+	}
+	result, err := clientset.AuthorizationV1().SubjectAccessReviews().Create(ctx, review, metav1.CreateOptions{})
+	if err != nil {
+		return false, err
+	}
+	return result.Status.Allowed, nil
+}
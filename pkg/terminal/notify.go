@@ -0,0 +1,153 @@
+package terminal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var (
+	notifyWebhook = Flags.String("notify-webhook", "", "URL notifications of session events are posted to")
+	notifyFormat  = Flags.String("notify-format", "slack",
+		`payload of -notify-webhook: "slack", "teams" or "generic"`)
+	notifyEvents = Flags.String("notify-events", "session.start,session.end,auth.failure,policy.denied",
+		"comma separated audit event types that are notified")
+	notifyNamespaces = Flags.String("notify-namespaces", "",
+		"comma separated namespaces whose events are notified, a trailing * matches a prefix, all if empty")
+	notifyTemplate = Flags.String("notify-template", "",
+		"file with a text/template of the message, of the whole body with -notify-format generic")
+)
+
+const (
+	// notifyQueueSize bounds the notifications waiting for the webhook, more
+	// are dropped so a slow webhook never holds up sessions
+	notifyQueueSize = 256
+	notifyTimeout   = 10 * time.Second
+)
+
+// defaultNotifyTemplate describes an event in one line
+const defaultNotifyTemplate = `{{with .Cluster}}[{{.}}] {{end}}{{.Type}}: {{or .User "unknown user"}}` +
+	`{{with .Namespace}} in {{.}}{{with $.Pod}}/{{.}}{{end}}{{with $.Container}} ({{.}}){{end}}{{end}}` +
+	`{{range $name, $value := .Details}} {{$name}}={{$value}}{{end}}`
+
+// notification is what notify templates can use, the fields of the event and
+// the name of the cluster
+type notification struct {
+	AuditEvent
+	Cluster string
+}
+
+var notifier struct {
+	events   []string
+	template *template.Template
+	queue    chan notification
+}
+
+// StartNotifications checks the notify flags and starts posting events to
+// -notify-webhook
+func StartNotifications() error {
+	if *notifyWebhook == "" {
+		return nil
+	}
+	switch *notifyFormat {
+	case "slack", "teams", "generic":
+	default:
+		return fmt.Errorf("unknown notify format %q", *notifyFormat)
+	}
+	text := defaultNotifyTemplate
+	if *notifyTemplate != "" {
+		data, err := ioutil.ReadFile(*notifyTemplate)
+		if err != nil {
+			return err
+		}
+		text = string(data)
+	}
+	tmpl, err := template.New("notify").Funcs(template.FuncMap{"json": jsonString}).Parse(text)
+	if err != nil {
+		return err
+	}
+	notifier.events = splitList(*notifyEvents)
+	notifier.template = tmpl
+	notifier.queue = make(chan notification, notifyQueueSize)
+	go deliverNotifications()
+	return nil
+}
+
+// jsonString quotes a value for generic templates writing JSON
+func jsonString(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// notify queues event for the webhook if its type and namespace are notified
+func notify(event AuditEvent) {
+	if notifier.queue == nil || !containsString(notifier.events, event.Type) {
+		return
+	}
+	if event.Namespace != "" && *notifyNamespaces != "" &&
+		!namespaceMatches(splitList(*notifyNamespaces), event.Namespace) {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	select {
+	case notifier.queue <- notification{event, *clusterName}:
+	default:
+		log.Printf("notification of %s dropped, the webhook is too slow", event.Type)
+	}
+}
+
+func deliverNotifications() {
+	for n := range notifier.queue {
+		if err := postNotification(n); err != nil {
+			log.Println("notification err", err)
+		}
+	}
+}
+
+// postNotification sends one notification, it is not retried
+func postNotification(n notification) error {
+	var text bytes.Buffer
+	if err := notifier.template.Execute(&text, n); err != nil {
+		return err
+	}
+	var body []byte
+	switch *notifyFormat {
+	case "generic":
+		body = text.Bytes()
+		if *notifyTemplate == "" {
+			body, _ = json.Marshal(map[string]interface{}{"text": text.String(), "event": n.AuditEvent})
+		}
+	case "teams":
+		// the legacy MessageCard of Office 365 connectors and Workflows webhooks
+		body, _ = json.Marshal(map[string]string{
+			"@type":    "MessageCard",
+			"@context": "https://schema.org/extensions",
+			"summary":  n.Type,
+			"text":     strings.TrimSpace(text.String()),
+		})
+	default:
+		body, _ = json.Marshal(map[string]string{"text": strings.TrimSpace(text.String())})
+	}
+	client, err := EgressClient(notifyTimeout)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(*notifyWebhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("notify webhook: %s", resp.Status)
+	}
+	return nil
+}
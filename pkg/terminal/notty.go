@@ -0,0 +1,104 @@
+package terminal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// ParseTTY reads the tty parameter of a terminal request, "false" runs the
+// shell without a terminal so data can be piped through it, like a SQL file
+// into psql
+func ParseTTY(value string) (bool, error) {
+	switch value {
+	case "", "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	return false, fmt.Errorf("%w: tty must be true or false", ErrInvalidInput)
+}
+
+// stderr returns the writer of the shell's stderr, nil for sessions with a
+// TTY where it is part of the output
+func (t *TerminalSession) stderr() io.Writer {
+	if !t.meta.NoTTY {
+		return nil
+	}
+	return stderrWriter{t}
+}
+
+// closeStdin ends the stdin of a NoTTY session once a client sent
+// {"op":"eof"}, commands reading it to the end can then finish. Sessions with
+// a TTY get ^D instead
+func (t *TerminalSession) closeStdin() {
+	if t.meta.NoTTY {
+		t.eofOnce.Do(func() { close(t.eof) })
+	}
+}
+
+// stderrWriter queues the stderr of a NoTTY session for every client, it is
+// kept apart from the output, see writeStderr
+type stderrWriter struct {
+	t *TerminalSession
+}
+
+func (w stderrWriter) Write(p []byte) (int, error) {
+	t := w.t
+	t.endSetup(nil)
+	if err := t.throttle(len(p)); err != nil {
+		return 0, err
+	}
+	output := p
+	if t.decoder != nil {
+		output = t.decoder.convert(p)
+	}
+	t.recorder.record(output)
+	t.counters.countOutput(len(p))
+	delivered := 0
+	for _, c := range t.attachedClients() {
+		if c.stderr == nil {
+			continue
+		}
+		if err := c.stderr.push(output); err == nil {
+			delivered++
+		}
+	}
+	if delivered == 0 && !t.detached() {
+		return 0, errors.New("no client is attached to the terminal")
+	}
+	return len(p), nil
+}
+
+// writeStderr sends the buffered stderr of a client until the buffer is
+// closed, in frames of stream 2 with FeatureStreams or else in
+// {"op":"stderr","data":"..."} messages
+func (t *TerminalSession) writeStderr(c *terminalClient) {
+	t.labelGoroutine("writeStderr")
+	defer close(c.stderrDone)
+	for {
+		data := c.stderr.pop(maxFrameSize)
+		if data == nil {
+			return
+		}
+		var err error
+		if c.has(FeatureStreams) {
+			err = c.writeMessage(websocket.BinaryMessage, streamFrame(streamStderr, data))
+		} else {
+			err = c.writeJSON(TerminalMessage{
+				Op:   "stderr",
+				Data: string(bytes.ToValidUTF8(data, []byte(string(utf8.RuneError)))),
+			})
+		}
+		if err != nil {
+			log.Printf("session %s: write to client failed: %v", t.id, err)
+			t.detach(c)
+			return
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package terminal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	jwt "github.com/dgrijalva/jwt-go"
+	"golang.org/x/oauth2"
+)
+
+var (
+	oidcIssuer       = Flags.String("oidc-issuer", "", "issuer URL of the OpenID Connect provider users log in with, e.g. https://keycloak/realms/main")
+	oidcClientID     = Flags.String("oidc-client-id", "", "OAuth client id of the server at the OIDC provider")
+	oidcClientSecret = Flags.String("oidc-client-secret", "", "OAuth client secret of the server at the OIDC provider")
+	oidcRedirectURL  = Flags.String("oidc-redirect-url", "", "public URL of /auth/callback registered at the OIDC provider")
+	oidcPostLogin    = Flags.String("oidc-post-login-url", "",
+		"front-end URL users are sent to after login, the tokens are appended as fragment, JSON is returned if empty")
+	oidcUserClaim       = Flags.String("oidc-user-claim", "email", "ID token claim naming the user, sub if missing")
+	oidcRoleClaim       = Flags.String("oidc-role-claim", "role", "ID token claim holding the role")
+	oidcNamespacesClaim = Flags.String("oidc-namespaces-claim", "namespaces", "ID token claim listing the namespaces of the user")
+	sessionTokenTTL     = Flags.Duration("session-token-ttl", 15*time.Minute, "lifetime of tokens issued after an OIDC login")
+	refreshTokenTTL     = Flags.Duration("refresh-token-ttl", 12*time.Hour, "how long tokens issued after an OIDC login can be refreshed")
+)
+
+var (
+	ErrOIDCDisabled        = errors.New("oidc login is not configured")
+	ErrInvalidRefreshToken = errors.New("refresh token is invalid or expired")
+	ErrNoNamespaces        = errors.New("user has no namespaces, \"*\" grants all of them")
+)
+
+// TokenResponse is returned by a login or refresh, Token is a JWT of the
+// server and RefreshToken an opaque handle to get the next one
+type TokenResponse struct {
+	Token        string `json:"token"`
+	ExpiresIn    int64  `json:"expiresIn"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+// oidcRefresh keeps the refresh token of the provider, clients only get an
+// opaque handle to it
+type oidcRefresh struct {
+	token   *oauth2.Token
+	claims  MyCustomClaims
+	expires time.Time
+}
+
+var (
+	oidcLock      sync.Mutex
+	oidcProvider  *oidc.Provider
+	oidcRefreshes = map[string]*oidcRefresh{}
+)
+
+// OIDCEnabled reports whether users can log in with -oidc-issuer
+func OIDCEnabled() bool {
+	return *oidcIssuer != ""
+}
+
+// OIDCPostLoginURL returns where users go after a login, empty to answer JSON
+func OIDCPostLoginURL() string {
+	return *oidcPostLogin
+}
+
+// oidcContext makes the oidc and oauth2 packages use the egress client
+func oidcContext(ctx context.Context) (context.Context, error) {
+	client, err := EgressClient(0)
+	if err != nil {
+		return nil, err
+	}
+	return oidc.ClientContext(ctx, client), nil
+}
+
+// oidcConfig discovers the provider on first use, a failed discovery is
+// retried with the next login
+func oidcConfig(ctx context.Context) (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	if !OIDCEnabled() {
+		return nil, nil, ErrOIDCDisabled
+	}
+	oidcLock.Lock()
+	defer oidcLock.Unlock()
+	if oidcProvider == nil {
+		provider, err := oidc.NewProvider(ctx, *oidcIssuer)
+		if err != nil {
+			return nil, nil, fmt.Errorf("discover oidc provider: %v", err)
+		}
+		oidcProvider = provider
+	}
+	config := &oauth2.Config{
+		ClientID:     *oidcClientID,
+		ClientSecret: *oidcClientSecret,
+		RedirectURL:  *oidcRedirectURL,
+		Endpoint:     oidcProvider.Endpoint(),
+		Scopes:       []string{oidc.ScopeOpenID, oidc.ScopeOfflineAccess, "profile", "email"},
+	}
+	verifier := oidcProvider.Verifier(&oidc.Config{ClientID: *oidcClientID})
+	return config, verifier, nil
+}
+
+// OIDCLoginURL returns the URL of the provider's login page. state and nonce
+// must be kept by the browser, usually in a cookie, for OIDCCallback
+func OIDCLoginURL(ctx context.Context) (loginURL string, state string, nonce string, err error) {
+	ctx, err = oidcContext(ctx)
+	if err != nil {
+		return "", "", "", err
+	}
+	config, _, err := oidcConfig(ctx)
+	if err != nil {
+		return "", "", "", err
+	}
+	if state, err = GenTerminalSessionId(); err != nil {
+		return "", "", "", err
+	}
+	if nonce, err = GenTerminalSessionId(); err != nil {
+		return "", "", "", err
+	}
+	return config.AuthCodeURL(state, oidc.Nonce(nonce)), state, nonce, nil
+}
+
+// OIDCCallback exchanges the code of a login for the user's ID token and
+// issues a token of the server with the user's role and namespaces
+func OIDCCallback(ctx context.Context, code string, nonce string) (*TokenResponse, error) {
+	ctx, err := oidcContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	config, verifier, err := oidcConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	token, err := config.Exchange(ctx, code)
+	if err != nil {
+		return nil, fmt.Errorf("exchange code: %v", err)
+	}
+	claims, err := verifyIDToken(ctx, verifier, token)
+	if err != nil {
+		return nil, err
+	}
+	if claims == nil {
+		return nil, errors.New("provider returned no id_token")
+	}
+	if nonce == "" || claims.nonce != nonce {
+		return nil, errors.New("id_token nonce does not match")
+	}
+	return issueSessionToken(claims.MyCustomClaims, token)
+}
+
+// RefreshSessionToken refreshes the login at the provider, so revoked users
+// lose access, and issues a new token. The refresh token is rotated
+func RefreshSessionToken(ctx context.Context, refreshToken string) (*TokenResponse, error) {
+	oidcLock.Lock()
+	refresh, ok := oidcRefreshes[refreshToken]
+	delete(oidcRefreshes, refreshToken)
+	oidcLock.Unlock()
+	if !ok || time.Now().After(refresh.expires) {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	ctx, err := oidcContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	config, verifier, err := oidcConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	token, err := config.TokenSource(ctx, &oauth2.Token{RefreshToken: refresh.token.RefreshToken}).Token()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRefreshToken, err)
+	}
+	claims := refresh.claims
+	// providers may send a new id_token with updated groups
+	if fresh, err := verifyIDToken(ctx, verifier, token); err != nil {
+		return nil, err
+	} else if fresh != nil {
+		claims = fresh.MyCustomClaims
+	}
+	if token.RefreshToken == "" {
+		token.RefreshToken = refresh.token.RefreshToken
+	}
+	return issueSessionToken(claims, token)
+}
+
+type idTokenClaims struct {
+	MyCustomClaims
+	nonce string
+}
+
+// verifyIDToken maps the id_token of token to claims, nil if it has none
+func verifyIDToken(ctx context.Context, verifier *oidc.IDTokenVerifier, token *oauth2.Token) (*idTokenClaims, error) {
+	raw, ok := token.Extra("id_token").(string)
+	if !ok || raw == "" {
+		return nil, nil
+	}
+	idToken, err := verifier.Verify(ctx, raw)
+	if err != nil {
+		return nil, fmt.Errorf("verify id_token: %v", err)
+	}
+	var values map[string]interface{}
+	if err := idToken.Claims(&values); err != nil {
+		return nil, err
+	}
+
+	claims := &idTokenClaims{nonce: idToken.Nonce}
+	claims.Subject = idToken.Subject
+	if user, ok := values[*oidcUserClaim].(string); ok && user != "" {
+		claims.Subject = user
+	}
+	claims.Role, _ = values[*oidcRoleClaim].(string)
+	switch namespaces := values[*oidcNamespacesClaim].(type) {
+	case string:
+		claims.Namespaces = splitList(namespaces)
+	case []interface{}:
+		for _, ns := range namespaces {
+			if s, ok := ns.(string); ok {
+				claims.Namespaces = append(claims.Namespaces, s)
+			}
+		}
+	}
+	if len(claims.Namespaces) == 0 {
+		// a token without the claim would grant every namespace
+		return nil, ErrNoNamespaces
+	}
+	return claims, nil
+}
+
+// issueSessionToken signs a short-lived token for claims and keeps the
+// provider's token for refreshes
+func issueSessionToken(claims MyCustomClaims, token *oauth2.Token) (*TokenResponse, error) {
+	now := time.Now()
+	claims.StandardClaims = jwt.StandardClaims{
+		Subject:   claims.Subject,
+		Issuer:    "k8s-terminal-server",
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(*sessionTokenTTL).Unix(),
+	}
+	signed, err := SignJwtToken(&claims)
+	if err != nil {
+		return nil, err
+	}
+	response := &TokenResponse{Token: signed, ExpiresIn: int64(sessionTokenTTL.Seconds())}
+	if token.RefreshToken == "" {
+		return response, nil
+	}
+
+	handle, err := GenTerminalSessionId()
+	if err != nil {
+		return nil, err
+	}
+	oidcLock.Lock()
+	defer oidcLock.Unlock()
+	for key, refresh := range oidcRefreshes {
+		if now.After(refresh.expires) {
+			delete(oidcRefreshes, key)
+		}
+	}
+	oidcRefreshes[handle] = &oidcRefresh{token: token, claims: claims, expires: now.Add(*refreshTokenTTL)}
+	response.RefreshToken = handle
+	return response, nil
+}
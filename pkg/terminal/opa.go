@@ -0,0 +1,140 @@
+package terminal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var (
+	opaURL = Flags.String("opa-url", "",
+		"OPA decision URL every terminal is authorized against before exec, e.g. http://localhost:8181/v1/data/terminal/allow")
+	opaTimeout  = Flags.Duration("opa-timeout", 5*time.Second, "timeout of OPA decisions")
+	opaFailOpen = Flags.Bool("opa-fail-open", false, "allow terminals when OPA can't be reached, its denials still hold")
+)
+
+// ExecPolicyInput is the input document of OPA decisions
+type ExecPolicyInput struct {
+	User       string            `json:"user"`
+	Role       string            `json:"role"`
+	Namespaces []string          `json:"namespaces"`
+	Claims     *MyCustomClaims   `json:"claims,omitempty"`
+	Namespace  string            `json:"namespace"`
+	Pod        string            `json:"pod"`
+	Labels     map[string]string `json:"labels"`
+	Container  string            `json:"container"`
+	Image      string            `json:"image"`
+	Command    string            `json:"command"`
+	// Port is the port of port-forwards, their command is "portforward"
+	Port int `json:"port,omitempty"`
+}
+
+// opaDecision is the answer of OPA, the rule may return a bool or an object
+// with allow and a reason shown to the user
+type opaDecision struct {
+	Result json.RawMessage `json:"result"`
+}
+
+type opaResult struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason"`
+}
+
+// execPolicyInput collects what OPA decides on, the pod is read once per session
+func (k *KubeClient) execPolicyInput(ctx context.Context, meta SessionMeta) (*ExecPolicyInput, error) {
+	input := &ExecPolicyInput{
+		User:      meta.User,
+		Role:      meta.Role,
+		Claims:    meta.Claims,
+		Namespace: meta.Namespace,
+		Pod:       meta.Pod,
+		Container: meta.Container,
+	}
+	if meta.Claims != nil {
+		input.Namespaces = meta.Claims.Namespaces
+	}
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+	clientset, err := k.Clientset()
+	if err != nil {
+		return nil, err
+	}
+	ctx, span := startClientSpan(ctx, "get", "pods", meta.Namespace)
+	pod, err := clientset.CoreV1().Pods(meta.Namespace).Get(ctx, meta.Pod, metav1.GetOptions{})
+	EndSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	input.Labels = pod.Labels
+	for _, c := range pod.Spec.Containers {
+		if c.Name == meta.Container {
+			input.Image = c.Image
+		}
+	}
+	return input, nil
+}
+
+// authorizeOPA asks OPA whether the command may run, a denial wraps
+// ErrCommandDenied. Without -opa-url every command is allowed. -opa-fail-open
+// only allows commands OPA couldn't decide on, its denials always hold
+func authorizeOPA(ctx context.Context, input *ExecPolicyInput) error {
+	if *opaURL == "" {
+		return nil
+	}
+	err := queryOPA(ctx, input)
+	if err == nil || errors.Is(err, ErrCommandDenied) || !*opaFailOpen {
+		return err
+	}
+	log.Println("authorizeOPA err, allowing", err)
+	return nil
+}
+
+func queryOPA(ctx context.Context, input *ExecPolicyInput) error {
+	body, err := json.Marshal(map[string]interface{}{"input": input})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, *opaTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, *opaURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client, err := EgressClient(*opaTimeout)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("query opa: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("query opa: %s", resp.Status)
+	}
+
+	var decision opaDecision
+	if err := json.NewDecoder(resp.Body).Decode(&decision); err != nil {
+		return fmt.Errorf("decode opa decision: %v", err)
+	}
+	var result opaResult
+	if err := json.Unmarshal(decision.Result, &result.Allow); err != nil {
+		// an undefined decision has no result and denies as well
+		json.Unmarshal(decision.Result, &result)
+	}
+	if !result.Allow {
+		if result.Reason != "" {
+			return fmt.Errorf("%w: %s", ErrCommandDenied, result.Reason)
+		}
+		return fmt.Errorf("%w: %s", ErrCommandDenied, input.Command)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package terminal
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+)
+
+// otlpMetricsBackend exports measurements to the OTLP collector of
+// -otlp-endpoint, like the spans
+type otlpMetricsBackend struct {
+	meter      metric.Meter
+	counters   map[*Metric]metric.Float64Counter
+	histograms map[*Metric]metric.Float64Histogram
+
+	// gauges are observed, the last value set is reported
+	gaugeLock sync.Mutex
+	gauges    map[*Metric]map[string]otlpGaugeValue
+}
+
+type otlpGaugeValue struct {
+	value float64
+	attrs attribute.Set
+}
+
+func newOTLPMetricsBackend() (*otlpMetricsBackend, func(), error) {
+	options := []otlpmetrichttp.Option{}
+	if *otlpEndpoint != "" {
+		options = append(options, otlpmetrichttp.WithEndpoint(*otlpEndpoint))
+	}
+	if *otlpInsecure {
+		options = append(options, otlpmetrichttp.WithInsecure())
+	}
+	exporter, err := otlpmetrichttp.New(context.Background(), options...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	providerOptions := []sdkmetric.Option{
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter)),
+		sdkmetric.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceName("k8s-terminal-server"))),
+	}
+	for _, m := range metrics {
+		if m.kind == histogramMetric && m.Buckets != nil {
+			providerOptions = append(providerOptions, sdkmetric.WithView(sdkmetric.NewView(
+				sdkmetric.Instrument{Name: m.Name},
+				sdkmetric.Stream{Aggregation: sdkmetric.AggregationExplicitBucketHistogram{Boundaries: m.Buckets}},
+			)))
+		}
+	}
+	provider := sdkmetric.NewMeterProvider(providerOptions...)
+
+	backend := &otlpMetricsBackend{
+		meter:      provider.Meter("k8s-terminal-server"),
+		counters:   map[*Metric]metric.Float64Counter{},
+		histograms: map[*Metric]metric.Float64Histogram{},
+		gauges:     map[*Metric]map[string]otlpGaugeValue{},
+	}
+	return backend, func() { provider.Shutdown(context.Background()) }, nil
+}
+
+func (o *otlpMetricsBackend) Register(m *Metric) error {
+	switch m.kind {
+	case counterMetric:
+		counter, err := o.meter.Float64Counter(m.Name, metric.WithDescription(m.Help))
+		o.counters[m] = counter
+		return err
+	case gaugeMetric:
+		o.gauges[m] = map[string]otlpGaugeValue{}
+		_, err := o.meter.Float64ObservableGauge(m.Name, metric.WithDescription(m.Help),
+			metric.WithFloat64Callback(func(ctx context.Context, observer metric.Float64Observer) error {
+				o.gaugeLock.Lock()
+				defer o.gaugeLock.Unlock()
+				for _, v := range o.gauges[m] {
+					observer.Observe(v.value, metric.WithAttributeSet(v.attrs))
+				}
+				return nil
+			}))
+		return err
+	default:
+		histogram, err := o.meter.Float64Histogram(m.Name, metric.WithDescription(m.Help))
+		o.histograms[m] = histogram
+		return err
+	}
+}
+
+func otlpAttributes(m *Metric, labels []string) attribute.Set {
+	attrs := make([]attribute.KeyValue, 0, len(labels))
+	for i, label := range labels {
+		attrs = append(attrs, attribute.String(m.Labels[i], label))
+	}
+	return attribute.NewSet(attrs...)
+}
+
+func (o *otlpMetricsBackend) Add(m *Metric, value float64, labels []string) {
+	if counter, ok := o.counters[m]; ok {
+		counter.Add(context.Background(), value, metric.WithAttributeSet(otlpAttributes(m, labels)))
+	}
+}
+
+func (o *otlpMetricsBackend) Set(m *Metric, value float64, labels []string) {
+	o.gaugeLock.Lock()
+	defer o.gaugeLock.Unlock()
+	if series, ok := o.gauges[m]; ok {
+		series[strings.Join(labels, "\x00")] = otlpGaugeValue{value, otlpAttributes(m, labels)}
+	}
+}
+
+func (o *otlpMetricsBackend) Observe(m *Metric, value float64, labels []string) {
+	if histogram, ok := o.histograms[m]; ok {
+		histogram.Record(context.Background(), value, metric.WithAttributeSet(otlpAttributes(m, labels)))
+	}
+}
+
+func (o *otlpMetricsBackend) Delete(m *Metric, labels []string) {
+	o.gaugeLock.Lock()
+	defer o.gaugeLock.Unlock()
+	if series, ok := o.gauges[m]; ok {
+		delete(series, strings.Join(labels, "\x00"))
+	}
+}
@@ -0,0 +1,214 @@
+package terminal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	pairMaxDuration = Flags.Duration("pair-max-duration", time.Hour,
+		"longest write access a session owner may grant to a support engineer")
+	pairApprovalTimeout = Flags.Duration("pair-approval-timeout", time.Minute,
+		"how long a support request waits for the session owner to answer")
+)
+
+var (
+	// ErrPairDenied is returned when the owner refused or didn't answer a support request
+	ErrPairDenied = errors.New("the session owner did not grant access")
+	// ErrPairPending is returned while another support request awaits an answer
+	ErrPairPending = errors.New("another support request is waiting for the session owner")
+)
+
+// pairRequest is a support engineer waiting for the owner's approval
+type pairRequest struct {
+	id       string
+	user     string
+	duration time.Duration
+	answer   chan bool
+}
+
+// pairGrant is the write access of a support engineer, revoked when its
+// timer fires
+type pairGrant struct {
+	user   string
+	expiry time.Time
+	timer  *time.Timer
+}
+
+// PairSession attaches a support engineer to a session with write access for
+// duration once the owner approved it in the terminal. It blocks until the
+// access ended
+func PairSession(w http.ResponseWriter, r *http.Request, sessionId string, user string,
+	duration time.Duration) error {
+
+	if duration <= 0 || duration > *pairMaxDuration {
+		return fmt.Errorf("%w: support access must last between 1 minute and %v", ErrInvalidInput, *pairMaxDuration)
+	}
+	session := getSession(sessionId)
+	if session == nil {
+		return ErrSessionNotFound
+	}
+	if session.meta.ReadOnly {
+		return fmt.Errorf("%w: nobody may write to a read-only session", ErrInvalidInput)
+	}
+
+	conn, err := upgrade(w, r)
+	if err != nil {
+		log.Print("upgrade:", err)
+		return err
+	}
+	c := newTerminalClient(conn, false)
+	if claims, err := RequestClaims(r); err == nil {
+		c.setToken(claims)
+	}
+	if _, err := c.handshake(sessionId); err != nil {
+		conn.Close()
+		return err
+	}
+	c.writeMessage(websocket.BinaryMessage, []byte("waiting for the session owner to grant access...\r\n"))
+
+	approved, err := session.requestPair(user, duration)
+	if err != nil || !approved {
+		if err == nil {
+			err = ErrPairDenied
+		}
+		c.sendError(err.Error())
+		conn.Close()
+		return err
+	}
+	if !session.attach(c) {
+		c.sendError("terminal session was closed")
+		conn.Close()
+		return errors.New("terminal session was closed while pairing")
+	}
+	session.grantPair(c, user, duration)
+	log.Printf("support user %s paired with session %s for %v", user, sessionId, duration)
+	session.readFromClient(c)
+	session.revokePair(c, "disconnected")
+	return nil
+}
+
+// requestPair asks the owner to approve a support engineer and waits for the
+// answer. Only one request may be pending at a time
+func (t *TerminalSession) requestPair(user string, duration time.Duration) (bool, error) {
+	id, _ := GenTerminalSessionId()
+	req := &pairRequest{id: id, user: user, duration: duration, answer: make(chan bool, 1)}
+	t.pairLock.Lock()
+	if t.pairPending != nil {
+		t.pairLock.Unlock()
+		return false, ErrPairPending
+	}
+	t.pairPending = req
+	t.pairLock.Unlock()
+	defer func() {
+		t.pairLock.Lock()
+		t.pairPending = nil
+		t.pairLock.Unlock()
+	}()
+
+	audit(t.pairEvent("support.requested", user, duration, nil))
+	minutes := int(duration / time.Minute)
+	t.owner.writeJSON(TerminalMessage{Op: "pair_request", RequestID: id, User: user, Minutes: minutes})
+	prompt := fmt.Sprintf("\r\n%s asks for write access to this terminal for %d minutes, answer in the terminal's UI\r\n",
+		user, minutes)
+	t.owner.writeMessage(websocket.BinaryMessage, []byte(prompt))
+
+	approved := false
+	select {
+	case approved = <-req.answer:
+	case <-time.After(*pairApprovalTimeout):
+	case <-t.ctx.Done():
+	}
+	if !approved {
+		audit(t.pairEvent("support.denied", user, duration, nil))
+		t.owner.writeMessage(websocket.BinaryMessage, []byte("\r\nsupport access denied\r\n"))
+	}
+	return approved, nil
+}
+
+// answerPair settles the pending support request with the owner's pair_answer
+// message. Keystrokes never answer it, anyone who can type into the terminal
+// or make the shell print could fake them
+func (t *TerminalSession) answerPair(c *terminalClient, requestId string, approved bool) bool {
+	if c != t.owner {
+		return false
+	}
+	t.pairLock.Lock()
+	defer t.pairLock.Unlock()
+	req := t.pairPending
+	if req == nil || requestId != req.id {
+		return false
+	}
+	t.pairPending = nil
+	req.answer <- approved
+	return true
+}
+
+// grantPair records the access of a support engineer and revokes it after duration
+func (t *TerminalSession) grantPair(c *terminalClient, user string, duration time.Duration) {
+	grant := &pairGrant{user: user, expiry: time.Now().Add(duration)}
+	grant.timer = time.AfterFunc(duration, func() { t.revokePair(c, "expired") })
+	t.pairLock.Lock()
+	t.pairs[c] = grant
+	t.pairLock.Unlock()
+	audit(t.pairEvent("support.granted", user, duration, map[string]string{
+		"expires": grant.expiry.UTC().Format(time.RFC3339),
+	}))
+	t.Toast(fmt.Sprintf("\r\n%s has write access until %s\r\n", user, grant.expiry.Format("15:04:05")))
+}
+
+// revokePair ends the access of a support engineer and disconnects them
+func (t *TerminalSession) revokePair(c *terminalClient, reason string) {
+	t.pairLock.Lock()
+	grant, ok := t.pairs[c]
+	delete(t.pairs, c)
+	t.pairLock.Unlock()
+	if !ok {
+		return
+	}
+	grant.timer.Stop()
+	audit(t.pairEvent("support.revoked", grant.user, 0, map[string]string{"reason": reason}))
+	if reason != "disconnected" {
+		c.writeMessage(websocket.BinaryMessage, []byte("\r\nsupport access ended\r\n"))
+	}
+	t.detach(c)
+	t.Toast(fmt.Sprintf("\r\nwrite access of %s ended (%s)\r\n", grant.user, reason))
+}
+
+// revokePairs ends the access of every support engineer, the owner asks for it
+// with a pair_revoke message
+func (t *TerminalSession) revokePairs(c *terminalClient) {
+	if c != t.owner {
+		return
+	}
+	t.pairLock.Lock()
+	clients := make([]*terminalClient, 0, len(t.pairs))
+	for pc := range t.pairs {
+		clients = append(clients, pc)
+	}
+	t.pairLock.Unlock()
+	for _, pc := range clients {
+		t.revokePair(pc, "revoked by owner")
+	}
+}
+
+// pairEvent returns an audit event of support access, User stays the owner
+// and supportUser names the engineer
+func (t *TerminalSession) pairEvent(kind string, user string, duration time.Duration,
+	details map[string]string) AuditEvent {
+
+	if details == nil {
+		details = map[string]string{}
+	}
+	details["supportUser"] = user
+	if duration > 0 {
+		details["minutes"] = strconv.Itoa(int(duration / time.Minute))
+	}
+	return t.auditEvent(kind, details)
+}
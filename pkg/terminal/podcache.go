@@ -0,0 +1,239 @@
+package terminal
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+var (
+	podCacheMode = Flags.String("pod-cache", "namespace",
+		`serve pod lookups from informers: "namespace" watches each namespace once it is used, "cluster" all pods, "" asks the API server every time`)
+	podCacheIdle = Flags.Duration("pod-cache-idle", 10*time.Minute,
+		"stop watching a namespace whose pods weren't looked up for this long, with -pod-cache namespace")
+)
+
+// podCacheSyncTimeout bounds how long a lookup waits for the initial list of
+// a namespace, it asks the API server after that
+const podCacheSyncTimeout = 5 * time.Second
+
+// podCache keeps the pods of the namespaces in use in shared informers, so
+// the pod picker and the auto-selection answer from memory instead of
+// listing pods on every request
+type podCache struct {
+	lock      sync.Mutex
+	clientset kubernetes.Interface
+	informers map[string]*podInformer
+	janitor   sync.Once
+}
+
+type podInformer struct {
+	informer cache.SharedIndexInformer
+	lister   listers.PodLister
+	stop     chan struct{}
+	lastUsed time.Time
+	// forbidden is set once RBAC denied listing or watching the pods,
+	// lookups then go to the API server right away
+	forbidden int32
+}
+
+var sharedPods = &podCache{informers: make(map[string]*podInformer)}
+
+// informerFor returns the informer of namespace, started on first use. All
+// informers are restarted once the clientset changed after a reconnect
+func (c *podCache) informerFor(clientset kubernetes.Interface, namespace string) *podInformer {
+	key := namespace
+	if *podCacheMode == "cluster" {
+		key = ""
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.clientset != clientset {
+		for _, i := range c.informers {
+			close(i.stop)
+		}
+		c.informers = make(map[string]*podInformer)
+		c.clientset = clientset
+	}
+	i, ok := c.informers[key]
+	if !ok {
+		options := []informers.SharedInformerOption{}
+		if key != "" {
+			options = append(options, informers.WithNamespace(key))
+		}
+		factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0, options...)
+		podsInformer := factory.Core().V1().Pods()
+		i = &podInformer{informer: podsInformer.Informer(), lister: podsInformer.Lister(), stop: make(chan struct{})}
+		// managed fields are most of a pod's size and never read here
+		i.informer.SetTransform(func(obj interface{}) (interface{}, error) {
+			if p, ok := obj.(*v1.Pod); ok {
+				p.ManagedFields = nil
+			}
+			return obj, nil
+		})
+		informer := i
+		i.informer.SetWatchErrorHandler(func(r *cache.Reflector, err error) {
+			if apierrors.IsForbidden(err) {
+				atomic.StoreInt32(&informer.forbidden, 1)
+			}
+			cache.DefaultWatchErrorHandler(r, err)
+		})
+		go i.informer.Run(i.stop)
+		c.informers[key] = i
+		log.Printf("pod cache: watching pods of namespace %q", key)
+	}
+	i.lastUsed = time.Now()
+	if key != "" {
+		c.janitor.Do(func() { go c.stopIdle() })
+	}
+	return i
+}
+
+// stopIdle stops the informers of namespaces not used for -pod-cache-idle
+func (c *podCache) stopIdle() {
+	for range time.Tick(time.Minute) {
+		c.lock.Lock()
+		for namespace, i := range c.informers {
+			if namespace != "" && time.Since(i.lastUsed) > *podCacheIdle {
+				close(i.stop)
+				delete(c.informers, namespace)
+				log.Printf("pod cache: stopped watching idle namespace %q", namespace)
+			}
+		}
+		c.lock.Unlock()
+	}
+}
+
+// syncedLister returns the lister of namespace once its informer has listed
+// the pods, false if the cache is off or the list took too long
+func (k *KubeClient) syncedLister(ctx context.Context, namespace string) (listers.PodNamespaceLister, bool) {
+	if *podCacheMode == "" {
+		return nil, false
+	}
+	clientset, err := k.Clientset()
+	if err != nil {
+		return nil, false
+	}
+	i := sharedPods.informerFor(clientset, namespace)
+	if atomic.LoadInt32(&i.forbidden) == 1 {
+		return nil, false
+	}
+	if !i.informer.HasSynced() {
+		ctx, cancel := context.WithTimeout(ctx, podCacheSyncTimeout)
+		defer cancel()
+		if !cache.WaitForCacheSync(ctx.Done(), i.informer.HasSynced) {
+			log.Printf("pod cache: namespace %q isn't synced, asking the API server", namespace)
+			return nil, false
+		}
+	}
+	return i.lister.Pods(namespace), true
+}
+
+// cachedPods returns the pods of namespace matching the selectors from the
+// cache, false if the API server has to be asked. The pods are shared with
+// the cache and must not be modified
+func (k *KubeClient) cachedPods(ctx context.Context, namespace string, selector labels.Selector,
+	fieldSelector fields.Selector) ([]*v1.Pod, bool) {
+
+	lister, ok := k.syncedLister(ctx, namespace)
+	if !ok {
+		return nil, false
+	}
+	list, err := lister.List(selector)
+	if err != nil {
+		return nil, false
+	}
+	if fieldSelector == nil || fieldSelector.Empty() {
+		return list, true
+	}
+	matched := list[:0:0]
+	for _, p := range list {
+		if fieldSelector.Matches(podFields(p)) {
+			matched = append(matched, p)
+		}
+	}
+	return matched, true
+}
+
+// cachedPod returns a pod from the cache, with a NotFound error like the API
+// server if the synced cache doesn't have it
+func (k *KubeClient) cachedPod(ctx context.Context, namespace string, name string) (*v1.Pod, bool, error) {
+	lister, ok := k.syncedLister(ctx, namespace)
+	if !ok {
+		return nil, false, nil
+	}
+	p, err := lister.Get(name)
+	if apierrors.IsNotFound(err) {
+		return nil, true, apierrors.NewNotFound(v1.Resource("pods"), name)
+	}
+	return p, err == nil, nil
+}
+
+// podFields are the fields the API server selects pods by
+func podFields(p *v1.Pod) fields.Set {
+	return fields.Set{
+		"metadata.name":            p.Name,
+		"metadata.namespace":       p.Namespace,
+		"spec.nodeName":            p.Spec.NodeName,
+		"spec.restartPolicy":       string(p.Spec.RestartPolicy),
+		"spec.schedulerName":       p.Spec.SchedulerName,
+		"spec.serviceAccountName":  p.Spec.ServiceAccountName,
+		"spec.hostNetwork":         strconv.FormatBool(p.Spec.HostNetwork),
+		"status.phase":             string(p.Status.Phase),
+		"status.podIP":             p.Status.PodIP,
+		"status.nominatedNodeName": p.Status.NominatedNodeName,
+	}
+}
+
+// cachedPodList answers the first page of a pod listing from the cache, if it
+// is the only one. Later pages and listings longer than a page need the
+// continue tokens of the API server
+func (k *KubeClient) cachedPodList(ctx context.Context, namespace string, selector string,
+	opts PodListOptions) ([]PodInfo, bool) {
+
+	if opts.Continue != "" {
+		return nil, false
+	}
+	parsed, err := labels.Parse(selector)
+	if err != nil {
+		return nil, false
+	}
+	fieldSelector, err := fields.ParseSelector(opts.FieldSelector)
+	if err != nil {
+		return nil, false
+	}
+	for _, requirement := range fieldSelector.Requirements() {
+		// the API server rejects fields it doesn't select pods by
+		if _, ok := podFields(&v1.Pod{})[requirement.Field]; !ok {
+			return nil, false
+		}
+	}
+	cached, ok := k.cachedPods(ctx, namespace, parsed, fieldSelector)
+	if !ok || int64(len(cached)) > opts.Limit {
+		return nil, false
+	}
+	if len(cached) == 0 {
+		// unknown namespaces are reported as not found by the API server
+		return nil, false
+	}
+	podInfos := make([]PodInfo, len(cached))
+	for i, p := range cached {
+		podInfos[i] = newPodInfo(p)
+	}
+	// in the order of the API server
+	sortPods(podInfos, "name")
+	sortPods(podInfos, opts.Sort)
+	return podInfos, true
+}
@@ -0,0 +1,221 @@
+package terminal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// maxSelectorLength caps the label and field selectors passed on to the API server
+	maxSelectorLength = 1024
+	// maxPodListLimit caps the pods of one page of a pod listing, listings
+	// without a limit get this many
+	maxPodListLimit = 500
+)
+
+// Orders of a pod listing, see PodListOptions
+var podListSorts = []string{"name", "created", "-created", "restarts"}
+
+var (
+	// ErrNoHealthyPod is returned when no Running and Ready pod matches a selector
+	ErrNoHealthyPod = errors.New("no running and ready pod matches the selector")
+	// ErrContainerNotFound is returned when the selected pod lacks the requested container
+	ErrContainerNotFound = errors.New("pod has no such container")
+	// ErrInvalidInput wraps errors about malformed namespaces and selectors
+	ErrInvalidInput = errors.New("invalid input")
+)
+
+// validatePodQuery checks a namespace and label selector before they are sent
+// to the API server
+func validatePodQuery(namespace string, selector string) error {
+	if errs := validation.IsDNS1123Label(namespace); len(errs) > 0 {
+		return fmt.Errorf("%w: namespace %q: %s", ErrInvalidInput, namespace, strings.Join(errs, ", "))
+	}
+	if len(selector) > maxSelectorLength {
+		return fmt.Errorf("%w: label selector is longer than %d characters", ErrInvalidInput, maxSelectorLength)
+	}
+	if _, err := labels.Parse(selector); err != nil {
+		return fmt.Errorf("%w: label selector: %v", ErrInvalidInput, err)
+	}
+	return nil
+}
+
+// PodListOptions narrow down and page a pod listing like the Kubernetes list
+// API. Continue is the token of the previous page, Sort orders the pods of a
+// page by name, created (oldest first), -created or restarts (most first)
+type PodListOptions struct {
+	Limit         int64
+	Continue      string
+	FieldSelector string
+	Sort          string
+}
+
+// validate checks the options and applies the default limit
+func (o *PodListOptions) validate() error {
+	if o.Limit < 0 || o.Limit > maxPodListLimit {
+		return fmt.Errorf("%w: limit must be between 1 and %d", ErrInvalidInput, maxPodListLimit)
+	}
+	if o.Limit == 0 {
+		o.Limit = maxPodListLimit
+	}
+	if len(o.FieldSelector) > maxSelectorLength {
+		return fmt.Errorf("%w: field selector is longer than %d characters", ErrInvalidInput, maxSelectorLength)
+	}
+	if _, err := fields.ParseSelector(o.FieldSelector); err != nil {
+		return fmt.Errorf("%w: field selector: %v", ErrInvalidInput, err)
+	}
+	if o.Sort != "" && !containsString(podListSorts, o.Sort) {
+		return fmt.Errorf("%w: sort must be one of %s", ErrInvalidInput, strings.Join(podListSorts, ", "))
+	}
+	return nil
+}
+
+// sortPods orders a page of a listing, the API server lists by name
+func sortPods(pods []PodInfo, order string) {
+	switch order {
+	case "created":
+		sort.SliceStable(pods, func(i, j int) bool { return pods[i].Created.Before(pods[j].Created) })
+	case "-created":
+		sort.SliceStable(pods, func(i, j int) bool { return pods[i].Created.After(pods[j].Created) })
+	case "restarts":
+		sort.SliceStable(pods, func(i, j int) bool { return pods[i].Restarts > pods[j].Restarts })
+	case "name":
+		sort.SliceStable(pods, func(i, j int) bool { return pods[i].Name < pods[j].Name })
+	}
+}
+
+// PodInfo is the pod listing entry shown by the pod picker
+type PodInfo struct {
+	Name       string          `json:"name"`
+	Namespace  string          `json:"namespace"`
+	Phase      string          `json:"phase"`
+	Ready      bool            `json:"ready"`
+	Node       string          `json:"node"`
+	Created    time.Time       `json:"created"`
+	Restarts   int32           `json:"restarts"`
+	Containers []ContainerInfo `json:"containers"`
+}
+
+// ContainerInfo describes a container of a listed pod
+type ContainerInfo struct {
+	Name     string `json:"name"`
+	Image    string `json:"image"`
+	Ready    bool   `json:"ready"`
+	Restarts int32  `json:"restarts"`
+	// State is one of running, waiting or terminated, with the reason if any
+	State string `json:"state"`
+}
+
+func newPodInfo(pod *v1.Pod) PodInfo {
+	info := PodInfo{
+		Name:      pod.Name,
+		Namespace: pod.Namespace,
+		Phase:     string(pod.Status.Phase),
+		Ready:     isPodReady(pod),
+		Node:      pod.Spec.NodeName,
+		Created:   pod.CreationTimestamp.Time,
+	}
+
+	statuses := make(map[string]v1.ContainerStatus)
+	for _, status := range pod.Status.ContainerStatuses {
+		statuses[status.Name] = status
+	}
+	for _, container := range pod.Spec.Containers {
+		c := ContainerInfo{Name: container.Name, Image: container.Image}
+		if status, ok := statuses[container.Name]; ok {
+			c.Ready = status.Ready
+			c.Restarts = status.RestartCount
+			c.State = containerState(status.State)
+			info.Restarts += status.RestartCount
+		}
+		info.Containers = append(info.Containers, c)
+	}
+	return info
+}
+
+func containerState(state v1.ContainerState) string {
+	switch {
+	case state.Running != nil:
+		return "running"
+	case state.Waiting != nil:
+		return "waiting: " + state.Waiting.Reason
+	case state.Terminated != nil:
+		return "terminated: " + state.Terminated.Reason
+	}
+	return ""
+}
+
+// listPods returns the pods of namespace matching the label selector from the
+// pod cache or else the API server
+func (k *KubeClient) listPods(ctx context.Context, namespace string, selector string) ([]*v1.Pod, error) {
+	parsed, err := labels.Parse(selector)
+	if err != nil {
+		return nil, fmt.Errorf("%w: label selector: %v", ErrInvalidInput, err)
+	}
+	if cached, ok := k.cachedPods(ctx, namespace, parsed, nil); ok {
+		return cached, nil
+	}
+	clientset, err := k.Clientset()
+	if err != nil {
+		return nil, err
+	}
+	ctx, span := startClientSpan(ctx, "list", "pods", namespace)
+	list, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	EndSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	pods := make([]*v1.Pod, len(list.Items))
+	for i := range list.Items {
+		pods[i] = &list.Items[i]
+	}
+	return pods, nil
+}
+
+// PickPod selects a random Running and Ready pod matching the label selector
+// and returns it with the requested container, or its first non-sidecar container
+func (k *KubeClient) PickPod(ctx context.Context, namespace string, selector string,
+	container string) (string, string, error) {
+
+	if err := validatePodQuery(namespace, selector); err != nil {
+		return "", "", err
+	}
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+	candidates, err := k.listPods(ctx, namespace, selector)
+	if err != nil {
+		return "", "", err
+	}
+
+	var healthy []*v1.Pod
+	for _, pod := range candidates {
+		if pod.Status.Phase == v1.PodRunning && isPodReady(pod) && pod.DeletionTimestamp == nil {
+			healthy = append(healthy, pod)
+		}
+	}
+	if len(healthy) == 0 {
+		return "", "", ErrNoHealthyPod
+	}
+	pod := healthy[rand.Intn(len(healthy))]
+
+	if container == "" {
+		return pod.Name, pickContainer(pod, k.terminalDefaults(ctx, pod).Container), nil
+	}
+	for _, c := range pod.Spec.Containers {
+		if c.Name == container {
+			return pod.Name, container, nil
+		}
+	}
+	return "", "", ErrContainerNotFound
+}
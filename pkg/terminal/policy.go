@@ -0,0 +1,235 @@
+package terminal
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var commandPolicyFile = Flags.String("command-policy", "",
+	"JSON file with rules restricting the commands terminals may run per namespace and role")
+
+// maxInspectedLine caps how much of an input line is kept for inspection
+const maxInspectedLine = 4096
+
+// ErrCommandDenied is returned when the command policy forbids a command
+var ErrCommandDenied = errors.New("command is not allowed by policy")
+
+// ErrShellSyntax is returned for commands run without terminal that use shell
+// syntax where a command policy or OPA checks them
+var ErrShellSyntax = errors.New("shell syntax is not allowed in commands checked by policy")
+
+// shellMetacharacters run further commands or hide words from the policy in
+// a shell, like "true;nsenter", "$(kubectl ...)" or "'nsen'ter"
+const shellMetacharacters = ";&|$`()<>\\'\"\n\r{}*?[]~"
+
+// CommandRule restricts the commands run in sessions of matching namespaces
+// and roles, empty lists match every namespace or role. Patterns are regular
+// expressions matched against command names, anchor them for exact matches
+type CommandRule struct {
+	Namespaces []string `json:"namespaces"`
+	Roles      []string `json:"roles"`
+	// Allow lists the shells (and first commands) that may run, all if empty
+	Allow []string `json:"allow"`
+	// Deny lists commands that must not run, it wins over Allow
+	Deny []string `json:"deny"`
+	// InspectFirstLine also checks the first line typed into the shell, every
+	// word of it against Deny and its first word against Allow
+	InspectFirstLine bool `json:"inspectFirstLine"`
+
+	allow []*regexp.Regexp
+	deny  []*regexp.Regexp
+}
+
+var commandPolicy []*CommandRule
+
+// LoadCommandPolicy reads the rules of -command-policy, it is called on startup
+// so a broken policy stops the server instead of being ignored
+func LoadCommandPolicy() error {
+	if *commandPolicyFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(*commandPolicyFile)
+	if err != nil {
+		return err
+	}
+	var rules []*CommandRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if rule.allow, err = compilePatterns(rule.Allow); err != nil {
+			return err
+		}
+		if rule.deny, err = compilePatterns(rule.Deny); err != nil {
+			return err
+		}
+	}
+	commandPolicy = rules
+	return nil
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// commandRule returns the first rule matching namespace and role, nil if none does
+func commandRule(namespace string, role string) *CommandRule {
+	for _, rule := range commandPolicy {
+		if len(rule.Namespaces) > 0 && !containsString(rule.Namespaces, namespace) {
+			continue
+		}
+		if len(rule.Roles) > 0 && !containsString(rule.Roles, role) {
+			continue
+		}
+		return rule
+	}
+	return nil
+}
+
+// allows reports whether command may run, a nil rule allows everything
+func (r *CommandRule) allows(command string) bool {
+	if r == nil {
+		return true
+	}
+	name := filepath.Base(command)
+	for _, re := range r.deny {
+		if re.MatchString(name) {
+			return false
+		}
+	}
+	if len(r.allow) == 0 {
+		return true
+	}
+	for _, re := range r.allow {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsLine checks a command line typed by the user. Every word is checked
+// against the deny list, so "sudo kubectl" or "env nsenter" are caught too
+func (r *CommandRule) allowsLine(line string) bool {
+	words := strings.Fields(line)
+	if len(words) == 0 {
+		return true
+	}
+	if !r.allows(words[0]) {
+		return false
+	}
+	for _, word := range words[1:] {
+		name := filepath.Base(word)
+		for _, re := range r.deny {
+			if re.MatchString(name) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// states of the escape sequences inspectInput skips
+const (
+	escNone = iota
+	// escStart follows ESC
+	escStart
+	// escCSI is in a control sequence like the arrow keys, ESC [ ... final byte
+	escCSI
+	// escSS3 waits for the key of ESC O, like the keypad sends
+	escSS3
+	// escOSC is in an operating system command, ended by BEL or ESC \
+	escOSC
+)
+
+// nextEscape returns the escape state after b
+func nextEscape(state int, b byte) int {
+	switch state {
+	case escStart:
+		switch b {
+		case '[':
+			return escCSI
+		case 'O':
+			return escSS3
+		case ']':
+			return escOSC
+		}
+	case escCSI:
+		if b < 0x40 || b > 0x7e {
+			return escCSI
+		}
+	case escOSC:
+		if b == 0x1b {
+			return escStart
+		} else if b != 0x07 {
+			return escOSC
+		}
+	}
+	return escNone
+}
+
+// inspectInput collects the lines typed into the shell and checks them once
+// they are complete, before the newline reaches the shell, until the first
+// command. Empty lines don't count, and every line of the frame completing
+// the first command is checked, as it reaches the shell along with it.
+// Escape sequences and control bytes are dropped, ^C and ^U discard the line.
+// It returns false if a line is denied. This is best effort: it sees
+// keystrokes, not what the shell ends up running after completion or history
+// expansion
+func (t *TerminalSession) inspectInput(p []byte) bool {
+	if t.policy == nil || !t.policy.InspectFirstLine {
+		return true
+	}
+	t.policyLock.Lock()
+	defer t.policyLock.Unlock()
+	if t.lineChecked {
+		return true
+	}
+	for _, b := range p {
+		if t.inputEscape != escNone {
+			t.inputEscape = nextEscape(t.inputEscape, b)
+			continue
+		}
+		switch {
+		case b == '\r' || b == '\n':
+			line := strings.TrimSpace(string(t.firstLine))
+			t.firstLine = nil
+			if !t.policy.allowsLine(line) {
+				return false
+			}
+			if line != "" {
+				t.lineChecked = true
+			}
+		case b == 0x1b:
+			t.inputEscape = escStart
+		case b == '\b' || b == 0x7f:
+			if len(t.firstLine) > 0 {
+				t.firstLine = t.firstLine[:len(t.firstLine)-1]
+			}
+		case b == 0x03 || b == 0x15:
+			t.firstLine = nil
+		case b < 0x20 && b != '\t':
+			// other control bytes don't reach the command line
+		default:
+			if len(t.firstLine) < maxInspectedLine {
+				t.firstLine = append(t.firstLine, b)
+			}
+		}
+	}
+	if t.lineChecked {
+		t.firstLine = nil
+	}
+	return true
+}
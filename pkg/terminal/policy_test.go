@@ -0,0 +1,36 @@
+package terminal
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestInspectInput(t *testing.T) {
+	policy := &CommandRule{InspectFirstLine: true, deny: []*regexp.Regexp{regexp.MustCompile(`^nsenter$`)}}
+	for input, allowed := range map[string]bool{
+		"ls -l\r":                 true,
+		"nsenter -t 1\r":          false,
+		"\rnsenter -t 1\r":        false,
+		"ls\rnsenter -t 1\r":      false,
+		"nsen\x1b[Dter -t 1\r":    false,
+		"nsen\x1b]0;x\x07ter\r":   false,
+		"nse\x01nter -t 1\r":      false,
+		"rm\x15nsenter -t 1\r":    false,
+		"nsenter\x03ls\r":         true,
+		"\x1b[200~ls\x1b[201~\r":  true,
+		"ls\r\r":                  true,
+		"echo nsenter\x7f\x7fr\r": true,
+	} {
+		session := &TerminalSession{policy: policy}
+		if got := session.inspectInput([]byte(input)); got != allowed {
+			t.Errorf("inspectInput(%q) = %v, want %v", input, got, allowed)
+		}
+	}
+
+	// only the lines up to the first command are checked
+	session := &TerminalSession{policy: policy}
+	if !session.inspectInput([]byte("\r")) || !session.inspectInput([]byte("ls\r")) ||
+		!session.inspectInput([]byte("nsenter\r")) {
+		t.Error("lines after the first command were checked")
+	}
+}
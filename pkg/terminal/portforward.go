@@ -0,0 +1,321 @@
+package terminal
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+)
+
+var (
+	portForwardEnabled = Flags.Bool("port-forward", true,
+		"allow forwarding pod ports over websockets, viewers and safe mode users never may")
+	portForwardMaxChannels = Flags.Int("port-forward-max-channels", 32,
+		"connections one port-forward websocket may multiplex")
+)
+
+// ErrTooManyChannels is returned for channels beyond -port-forward-max-channels
+var ErrTooManyChannels = errors.New("too many port-forward channels")
+
+// PortForwardAllowed reports whether role may forward pod ports
+func PortForwardAllowed(role string) bool {
+	return *portForwardEnabled && role != RoleViewer && !IsSafeModeRole(role)
+}
+
+// portForwardMessage is the JSON control message of a port-forward websocket
+type portForwardMessage struct {
+	Op      string `json:"op"`
+	Channel uint16 `json:"channel"`
+	Data    string `json:"data,omitempty"`
+}
+
+// PortForward forwards port of a pod through the websocket of r, errors are
+// sent to the client before the upgrade and only returned after it. Every TCP
+// connection is a channel: binary frames start with its id as 2 byte big
+// endian number, the first frame of an unknown id opens a connection, and
+// {"op":"close","channel":N} closes one, in both directions. OPA authorizes
+// the port like a terminal's shell, and the websocket is closed once the
+// token of claims expired
+func (k *KubeClient) PortForward(w http.ResponseWriter, r *http.Request, namespace string, pod string,
+	port int, claims *MyCustomClaims) error {
+
+	user := claims.Subject
+	if *opaURL != "" {
+		input, err := k.execPolicyInput(r.Context(), SessionMeta{
+			User:      user,
+			Role:      claims.Role,
+			Namespace: namespace,
+			Pod:       pod,
+			Claims:    claims,
+		})
+		if err == nil {
+			input.Command = "portforward"
+			input.Port = port
+			err = authorizeOPA(r.Context(), input)
+		}
+		if errors.Is(err, ErrCommandDenied) {
+			WriteErrorCode(w, string(ExecErrPolicyDenied), err.Error(), http.StatusForbidden)
+			return err
+		} else if err != nil {
+			status, message := portForwardError(err)
+			WriteError(w, message, status)
+			return err
+		}
+	}
+	streams, err := k.dialPortForward(r, namespace, pod)
+	if err != nil {
+		status, message := portForwardError(err)
+		WriteError(w, message, status)
+		return err
+	}
+	defer streams.Close()
+	conn, err := upgradeWebsocket(w, r)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	audit(AuditEvent{
+		Type:      "portforward.open",
+		User:      user,
+		Namespace: namespace,
+		Pod:       pod,
+		Details:   map[string]string{"port": strconv.Itoa(port)},
+	})
+	f := &portForwarder{
+		conn:     conn,
+		streams:  streams,
+		port:     strconv.Itoa(port),
+		channels: make(map[uint16]*forwardChannel),
+	}
+	go func() {
+		// the kubelet went away, like when the pod was deleted
+		<-streams.CloseChan()
+		conn.Close()
+	}()
+	if claims.ExpiresAt > 0 {
+		expiry := time.NewTimer(time.Until(time.Unix(claims.ExpiresAt, 0)))
+		defer expiry.Stop()
+		go func() {
+			select {
+			case <-expiry.C:
+			case <-streams.CloseChan():
+				return
+			}
+			audit(AuditEvent{Type: "portforward.token_expired", User: user, Namespace: namespace, Pod: pod})
+			f.writeMessage(websocket.CloseMessage, websocket.FormatCloseMessage(closeTokenExpired, "token expired"))
+			conn.Close()
+		}()
+	}
+	err = f.run()
+	f.closeAll()
+	return err
+}
+
+// dialPortForward opens the SPDY connection of the portforward subresource
+func (k *KubeClient) dialPortForward(r *http.Request, namespace string, pod string) (httpstream.Connection, error) {
+	config, err := k.Config()
+	if err != nil {
+		return nil, err
+	}
+	clientset, err := k.Clientset()
+	if err != nil {
+		return nil, err
+	}
+	config = tracedConfig(r.Context(), config)
+	transport, upgrader, err := spdy.RoundTripperFor(config)
+	if err != nil {
+		return nil, err
+	}
+	req := clientset.CoreV1().RESTClient().Post().Resource("pods").Name(pod).
+		Namespace(namespace).SubResource("portforward")
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, "POST", req.URL())
+	streams, _, err := dialer.Dial(portforward.PortForwardProtocolV1Name)
+	return streams, err
+}
+
+// portForwarder multiplexes the connections of one websocket
+type portForwarder struct {
+	conn      *websocket.Conn
+	writeLock sync.Mutex
+	streams   httpstream.Connection
+	port      string
+
+	lock      sync.Mutex
+	channels  map[uint16]*forwardChannel
+	requestId int
+}
+
+// forwardChannel is a TCP connection to the pod port
+type forwardChannel struct {
+	id     uint16
+	data   httpstream.Stream
+	errors httpstream.Stream
+	closed bool
+}
+
+func (f *portForwarder) writeMessage(messageType int, data []byte) error {
+	f.writeLock.Lock()
+	defer f.writeLock.Unlock()
+	return f.conn.WriteMessage(messageType, data)
+}
+
+// run reads the websocket until it is closed
+func (f *portForwarder) run() error {
+	for {
+		messageType, data, err := f.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				return nil
+			}
+			return err
+		}
+		if messageType == websocket.TextMessage {
+			var msg portForwardMessage
+			if err := json.Unmarshal(data, &msg); err == nil && msg.Op == "close" {
+				f.closeChannel(msg.Channel, "", false)
+			}
+			continue
+		}
+		if len(data) < 2 {
+			continue
+		}
+		id := binary.BigEndian.Uint16(data)
+		channel, err := f.channel(id)
+		if err != nil {
+			f.sendClose(id, err.Error())
+			continue
+		}
+		if _, err := channel.data.Write(data[2:]); err != nil {
+			f.closeChannel(id, err.Error(), true)
+		}
+	}
+}
+
+// channel returns the connection of id, opening it on first use
+func (f *portForwarder) channel(id uint16) (*forwardChannel, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if channel, ok := f.channels[id]; ok {
+		return channel, nil
+	}
+	if len(f.channels) >= *portForwardMaxChannels {
+		return nil, ErrTooManyChannels
+	}
+	// the kubelet tells connections apart by request id, which isn't reused
+	// like channel ids are
+	f.requestId++
+	headers := http.Header{}
+	headers.Set(v1.StreamType, v1.StreamTypeError)
+	headers.Set(v1.PortHeader, f.port)
+	headers.Set(v1.PortForwardRequestIDHeader, strconv.Itoa(f.requestId))
+	errorStream, err := f.streams.CreateStream(headers)
+	if err != nil {
+		return nil, err
+	}
+	// the error stream is only read
+	errorStream.Close()
+	headers.Set(v1.StreamType, v1.StreamTypeData)
+	dataStream, err := f.streams.CreateStream(headers)
+	if err != nil {
+		f.streams.RemoveStreams(errorStream)
+		return nil, err
+	}
+	channel := &forwardChannel{id: id, data: dataStream, errors: errorStream}
+	f.channels[id] = channel
+
+	go func() {
+		message, err := ioutil.ReadAll(errorStream)
+		if err == nil && len(message) > 0 {
+			f.closeChannel(id, strings.TrimSpace(string(message)), true)
+		}
+	}()
+	go f.copyOutput(channel)
+	return channel, nil
+}
+
+// copyOutput sends what the pod writes to a connection until it is closed
+func (f *portForwarder) copyOutput(channel *forwardChannel) {
+	buf := make([]byte, 32<<10)
+	binary.BigEndian.PutUint16(buf, channel.id)
+	for {
+		n, err := channel.data.Read(buf[2:])
+		if n > 0 {
+			if f.writeMessage(websocket.BinaryMessage, buf[:n+2]) != nil {
+				return
+			}
+		}
+		if err != nil {
+			f.closeChannel(channel.id, "", true)
+			return
+		}
+	}
+}
+
+// closeChannel ends a connection, notify tells the client about it
+func (f *portForwarder) closeChannel(id uint16, reason string, notify bool) {
+	f.lock.Lock()
+	channel, ok := f.channels[id]
+	if !ok || channel.closed {
+		f.lock.Unlock()
+		return
+	}
+	channel.closed = true
+	delete(f.channels, id)
+	f.lock.Unlock()
+
+	channel.data.Reset()
+	f.streams.RemoveStreams(channel.data, channel.errors)
+	if notify {
+		f.sendClose(id, reason)
+	}
+}
+
+func (f *portForwarder) sendClose(id uint16, reason string) {
+	if reason != "" {
+		log.Printf("port-forward channel %d: %s", id, reason)
+	}
+	data, _ := json.Marshal(portForwardMessage{Op: "close", Channel: id, Data: reason})
+	f.writeMessage(websocket.TextMessage, data)
+}
+
+func (f *portForwarder) closeAll() {
+	f.lock.Lock()
+	ids := make([]uint16, 0, len(f.channels))
+	for id := range f.channels {
+		ids = append(ids, id)
+	}
+	f.lock.Unlock()
+	for _, id := range ids {
+		f.closeChannel(id, "", false)
+	}
+}
+
+// portForwardError is the HTTP status of an error dialing the pod
+func portForwardError(err error) (int, string) {
+	if err == ErrClusterUnavailable {
+		return http.StatusServiceUnavailable, err.Error()
+	}
+	switch classifyExecError(err) {
+	case ExecErrPodNotFound:
+		return http.StatusNotFound, err.Error()
+	case ExecErrForbidden:
+		return http.StatusForbidden, err.Error()
+	case ExecErrPodNotRunning:
+		return http.StatusConflict, err.Error()
+	}
+	return http.StatusBadGateway, fmt.Sprintf("port-forward failed: %v", err)
+}
@@ -0,0 +1,213 @@
+package terminal
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+var (
+	presignEnabled = Flags.Bool("presign", false,
+		"issue presigned terminal URLs, they are signed with the key of -jwt-key-file or -jwt-key-source")
+	presignTTL = Flags.Duration("presign-ttl", 30*time.Second,
+		"how long a presigned terminal URL may be used, it is valid for one connection")
+)
+
+// PresignParameter is the query parameter carrying a presigned URL's signature
+const PresignParameter = "presigned"
+
+var (
+	// ErrPresignInvalid is returned for presigned URLs that are forged, expired
+	// or opened for another path or query
+	ErrPresignInvalid = errors.New("presigned URL is invalid or expired")
+	// ErrPresignUsed is returned for presigned URLs that were opened already
+	ErrPresignUsed = errors.New("presigned URL was used already")
+)
+
+// PresignRequest is the body of POST /api/v1/terminals/presign, Params are
+// added to the query of the URL, like reason or readonly
+type PresignRequest struct {
+	Namespace string            `json:"namespace"`
+	Pod       string            `json:"pod"`
+	Container string            `json:"container,omitempty"`
+	Params    map[string]string `json:"params,omitempty"`
+}
+
+// PresignedURL is a terminal URL a browser opens without holding a token
+type PresignedURL struct {
+	URL       string `json:"url"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+// presignedTarget is the signed payload of a presigned URL
+type presignedTarget struct {
+	Nonce string `json:"n"`
+	// Key is the id of the JWT key the payload is signed with
+	Key  string `json:"k"`
+	Path string `json:"p"`
+	// Query is the query of the URL without the signature, encoded with its
+	// parameters sorted
+	Query      string   `json:"q,omitempty"`
+	Expires    int64    `json:"e"`
+	User       string   `json:"u"`
+	Role       string   `json:"r,omitempty"`
+	Namespaces []string `json:"ns,omitempty"`
+	// TokenExpires is the expiry of the token the URL was presigned with,
+	// the session ends then like one opened with the token
+	TokenExpires int64 `json:"t,omitempty"`
+}
+
+// Presign returns the signature of a URL opening path, like
+// /api/v1/terminals/default/web/app, with query as the user of claims. It is
+// signed with the JWT signing key and expires after -presign-ttl
+func Presign(claims *MyCustomClaims, path string, query url.Values) (string, int64, error) {
+	keys := currentJWTKeys()
+	if len(keys.keys) == 0 {
+		return "", 0, ErrNoJWTKeys
+	}
+	nonce, err := GenTerminalSessionId()
+	if err != nil {
+		return "", 0, err
+	}
+	target := presignedTarget{
+		Nonce:        nonce,
+		Key:          keys.signing,
+		Path:         path,
+		Query:        query.Encode(),
+		Expires:      time.Now().Add(*presignTTL).Unix(),
+		User:         claims.Subject,
+		Role:         claims.Role,
+		Namespaces:   claims.Namespaces,
+		TokenExpires: claims.ExpiresAt,
+	}
+	payload, err := json.Marshal(target)
+	if err != nil {
+		return "", 0, err
+	}
+	mac := presignMAC(keys.keys[keys.signing], payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac),
+		target.Expires, nil
+}
+
+func presignMAC(key []byte, payload []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte("terminal-presign:"))
+	h.Write(payload)
+	return h.Sum(nil)
+}
+
+// authenticatePresigned accepts the presigned parameter for the path it was
+// signed for, once
+func authenticatePresigned(r *http.Request) (*MyCustomClaims, error) {
+	signed := r.URL.Query().Get(PresignParameter)
+	if signed == "" {
+		return nil, ErrNoCredentials
+	}
+	parts := strings.Split(signed, ".")
+	if len(parts) != 2 {
+		return nil, ErrPresignInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrPresignInvalid
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrPresignInvalid
+	}
+	var target presignedTarget
+	if err := json.Unmarshal(payload, &target); err != nil {
+		return nil, ErrPresignInvalid
+	}
+	key, ok := currentJWTKeys().keys[target.Key]
+	if !ok || !hmac.Equal(mac, presignMAC(key, payload)) {
+		return nil, ErrPresignInvalid
+	}
+	now := time.Now().Unix()
+	if now > target.Expires || target.TokenExpires != 0 && now > target.TokenExpires || target.Path != r.URL.Path {
+		return nil, ErrPresignInvalid
+	}
+	// parameters like readonly or container change what the URL opens
+	query := r.URL.Query()
+	query.Del(PresignParameter)
+	if query.Encode() != target.Query {
+		return nil, ErrPresignInvalid
+	}
+	first, err := claimPresigned(target.Nonce, time.Until(time.Unix(target.Expires+1, 0)))
+	if err != nil {
+		return nil, err
+	} else if !first {
+		return nil, ErrPresignUsed
+	}
+	return &MyCustomClaims{
+		Role:       target.Role,
+		Namespaces: target.Namespaces,
+		StandardClaims: jwt.StandardClaims{
+			Subject:   target.User,
+			ExpiresAt: target.TokenExpires,
+		},
+	}, nil
+}
+
+var presignedUses = struct {
+	sync.Mutex
+	nonces    map[string]time.Time
+	lastSweep time.Time
+}{nonces: make(map[string]time.Time)}
+
+// claimPresigned marks the nonce of a presigned URL used and reports whether
+// it was the first use. With -limiter-backend redis the replicas share the marks
+func claimPresigned(nonce string, ttl time.Duration) (bool, error) {
+	if *limiterBackend == "redis" {
+		return getRedisClient().SetNX("terminal:presign:"+nonce, 1, ttl).Result()
+	}
+	presignedUses.Lock()
+	defer presignedUses.Unlock()
+	now := time.Now()
+	if now.Sub(presignedUses.lastSweep) > time.Minute {
+		for n, expires := range presignedUses.nonces {
+			if now.After(expires) {
+				delete(presignedUses.nonces, n)
+			}
+		}
+		presignedUses.lastSweep = now
+	}
+	if _, used := presignedUses.nonces[nonce]; used {
+		return false, nil
+	}
+	presignedUses.nonces[nonce] = now.Add(ttl)
+	return true, nil
+}
+
+// presignedUsesSnapshot returns the used presigned URLs for the standby,
+// nil if the replicas share them in redis
+func presignedUsesSnapshot() map[string]time.Time {
+	if *limiterBackend == "redis" {
+		return nil
+	}
+	presignedUses.Lock()
+	defer presignedUses.Unlock()
+	uses := make(map[string]time.Time, len(presignedUses.nonces))
+	for nonce, expires := range presignedUses.nonces {
+		uses[nonce] = expires
+	}
+	return uses
+}
+
+// importPresignedUses marks the presigned URLs the active instance saw used
+func importPresignedUses(uses map[string]time.Time) {
+	presignedUses.Lock()
+	defer presignedUses.Unlock()
+	for nonce, expires := range uses {
+		presignedUses.nonces[nonce] = expires
+	}
+}
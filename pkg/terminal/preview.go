@@ -0,0 +1,163 @@
+package terminal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+var previewMaxSize = Flags.Int64("preview-max-size", 256<<10, "maximum bytes of a file returned for preview")
+
+// previewTimeout bounds reading a file for preview
+const previewTimeout = 15 * time.Second
+
+// previewCommand is run to read a file, the first line of its output is the
+// file size, the rest its first bytes
+const previewCommand = `test -f "$0" || { echo "not a regular file" >&2; exit 1; }; wc -c < "$0" && head -c "$1" "$0"`
+
+var (
+	// ErrPreviewDenied is returned to clients that may not read files
+	ErrPreviewDenied = errors.New("file preview is not allowed in this session")
+	// ErrPreviewBusy is returned while another preview of the session runs
+	ErrPreviewBusy = errors.New("a file preview is running already")
+)
+
+// FilePreview answers a preview request of a client, the content is only
+// sent for text files
+type FilePreview struct {
+	Op        string `json:"op"`
+	RequestID string `json:"requestId,omitempty"`
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	Truncated bool   `json:"truncated,omitempty"`
+	Binary    bool   `json:"binary,omitempty"`
+	// Language is a hint for syntax highlighting derived from the file name
+	Language string `json:"language,omitempty"`
+	Content  string `json:"content,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+var previewLanguages = map[string]string{
+	".go": "go", ".py": "python", ".js": "javascript", ".ts": "typescript", ".java": "java",
+	".rb": "ruby", ".rs": "rust", ".c": "c", ".h": "c", ".cpp": "cpp", ".sh": "shell",
+	".yaml": "yaml", ".yml": "yaml", ".json": "json", ".toml": "toml", ".ini": "ini",
+	".conf": "ini", ".xml": "xml", ".html": "html", ".css": "css", ".sql": "sql",
+	".md": "markdown", ".properties": "properties", ".log": "log",
+}
+
+func previewLanguage(name string) string {
+	base := path.Base(name)
+	if base == "Dockerfile" {
+		return "dockerfile"
+	}
+	return previewLanguages[strings.ToLower(path.Ext(base))]
+}
+
+// startPreview runs preview in the background, one at a time per session so
+// clients can't pile up execs in the container
+func (t *TerminalSession) startPreview(c *terminalClient, requestId string, name string) {
+	if !atomic.CompareAndSwapInt32(&t.previewing, 0, 1) {
+		result := FilePreview{Op: "preview", RequestID: requestId, Path: name, Error: ErrPreviewBusy.Error()}
+		if err := c.writeJSON(result); err != nil {
+			log.Println("preview:", err)
+		}
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&t.previewing, 0)
+		t.preview(c, requestId, name)
+	}()
+}
+
+// preview reads the start of a file from the session's container and sends
+// it to the client that asked. It runs beside the shell, so output already
+// in the terminal is not disturbed, and is checked by OPA like the shell,
+// masked and marked in the recording
+func (t *TerminalSession) preview(c *terminalClient, requestId string, name string) {
+	t.labelGoroutine("preview")
+	result := FilePreview{Op: "preview", RequestID: requestId, Path: name}
+	err := t.readPreview(c, &result)
+	if err != ErrPreviewDenied {
+		audit(t.auditEvent("file.preview", map[string]string{"path": name}))
+	}
+	if err == nil {
+		t.recorder.marker(fmt.Sprintf("preview %s (%d bytes)", name, result.Size))
+	}
+	if err != nil {
+		log.Printf("session %s: preview %s err %v", t.id, name, err)
+		result.Error = err.Error()
+	}
+	c.frames.record("out", result.Op, len(result.Content))
+	if err := c.writeJSON(result); err != nil {
+		log.Println("preview:", err)
+	}
+}
+
+func (t *TerminalSession) readPreview(c *terminalClient, result *FilePreview) error {
+	// reading files bypasses what the shell restricts
+	if c.readOnly || t.meta.SafeMode || !t.policy.allows("head") {
+		return ErrPreviewDenied
+	}
+	if result.Path == "" {
+		return fmt.Errorf("%w: path is required", ErrInvalidInput)
+	}
+	if *opaURL != "" {
+		t.clientsLock.Lock()
+		meta := t.meta
+		t.clientsLock.Unlock()
+		input, err := t.kube.execPolicyInput(t.ctx, meta)
+		if err != nil {
+			return err
+		}
+		input.Command = "head"
+		if err := authorizeOPA(t.ctx, input); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(t.ctx, previewTimeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := []string{"sh", "-c", previewCommand, result.Path, strconv.FormatInt(*previewMaxSize, 10)}
+	err := t.exec.ExecCommand(ctx, t.meta.Container, t.currentPod(), t.meta.Namespace, cmd, nil, &stdout, &stderr)
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return errors.New(msg)
+		}
+		return err
+	}
+
+	output := stdout.Bytes()
+	newline := bytes.IndexByte(output, '\n')
+	if newline < 0 {
+		return errors.New("read file size: no output")
+	}
+	result.Size, err = strconv.ParseInt(strings.TrimSpace(string(output[:newline])), 10, 64)
+	if err != nil {
+		return fmt.Errorf("read file size: %v", err)
+	}
+	content := output[newline+1:]
+	result.Truncated = result.Size > int64(len(content))
+	if result.Truncated {
+		// don't cut a multi-byte character in half
+		for i := 0; i < utf8.UTFMax && len(content) > 0 && !utf8.Valid(content); i++ {
+			content = content[:len(content)-1]
+		}
+	}
+	if bytes.IndexByte(content, 0) >= 0 || !utf8.Valid(content) {
+		result.Binary = true
+		return nil
+	}
+	result.Language = previewLanguage(result.Path)
+	// masked like the output of the terminal
+	result.Content = string(maskStream(content))
+	return nil
+}
@@ -0,0 +1,202 @@
+package terminal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+var (
+	promptTimeout = Flags.Duration("prompt-timeout", 2*time.Minute,
+		"how long a masked prompt waits for the session owner to answer")
+	relayPrompts = Flags.Bool("relay-prompts", true,
+		"let programs in the container ask the session owner for a secret in a masked prompt, see the README")
+	mfaNamespaces = Flags.String("mfa-namespaces", "",
+		"comma separated namespaces whose terminals ask for an MFA code before the shell starts, a trailing * matches a prefix")
+	mfaVerifyURL = Flags.String("mfa-verify-url", "",
+		`URL MFA codes are POSTed to as {"user","namespace","code"}, a 2xx answer accepts the code`)
+)
+
+const (
+	// promptSequence starts the OSC sequence a program writes to ask the
+	// owner for a secret, it ends with BEL: ESC ] 7373 ; prompt ; text BEL
+	promptSequence = "\x1b]7373;prompt;"
+	// maxPromptText bounds the text of a prompt asked for by a program
+	maxPromptText = 256
+	// maxMFAAttempts is how often a wrong MFA code may be entered
+	maxMFAAttempts   = 3
+	mfaVerifyTimeout = 10 * time.Second
+)
+
+var (
+	// ErrPromptUnsupported is returned for clients that didn't agree on
+	// FeaturePrompt in the handshake
+	ErrPromptUnsupported = errors.New("the client can't answer masked prompts")
+	ErrPromptTimeout     = errors.New("the masked prompt was not answered in time")
+	ErrMFAFailed         = errors.New("the MFA code was not accepted")
+)
+
+// promptSecret asks the owner of a session for input that must not end up in
+// the terminal, its recording or the logs, like an MFA code or a password.
+// The client shows {"op":"prompt","requestId":"..","data":"text","masked":true}
+// outside the terminal and answers with {"op":"prompt_answer",...}
+func (t *TerminalSession) promptSecret(text string) (string, error) {
+	owner := t.owner
+	if !owner.has(FeaturePrompt) {
+		return "", ErrPromptUnsupported
+	}
+	id, _ := GenTerminalSessionId()
+	answer := make(chan string, 1)
+	t.promptLock.Lock()
+	if t.prompts == nil {
+		t.prompts = make(map[string]chan string)
+	}
+	t.prompts[id] = answer
+	t.promptLock.Unlock()
+	defer func() {
+		t.promptLock.Lock()
+		delete(t.prompts, id)
+		t.promptLock.Unlock()
+	}()
+
+	if err := owner.writeJSON(TerminalMessage{Op: "prompt", RequestID: id, Data: text, Masked: true}); err != nil {
+		return "", err
+	}
+	timeout := time.NewTimer(*promptTimeout)
+	defer timeout.Stop()
+	select {
+	case secret := <-answer:
+		return secret, nil
+	case <-timeout.C:
+		return "", ErrPromptTimeout
+	case <-t.ctx.Done():
+		return "", t.ctx.Err()
+	}
+}
+
+// answerPrompt settles a pending prompt, only the owner may answer
+func (t *TerminalSession) answerPrompt(c *terminalClient, requestId string, secret string) {
+	if c != t.owner {
+		return
+	}
+	t.promptLock.Lock()
+	defer t.promptLock.Unlock()
+	if answer, ok := t.prompts[requestId]; ok {
+		delete(t.prompts, requestId)
+		answer <- secret
+	}
+}
+
+// relayPromptRequests cuts the prompt sequences out of the output, see
+// promptSequence, and relays each to the owner. The answer is typed into the
+// shell, so a wrapper can read a sudo password without it being typed into
+// the terminal. A sequence must be written at once
+func (t *TerminalSession) relayPromptRequests(output []byte) []byte {
+	if !*relayPrompts || t.meta.ReadOnly {
+		return output
+	}
+	for {
+		start := bytes.Index(output, []byte(promptSequence))
+		if start < 0 {
+			return output
+		}
+		end := bytes.IndexByte(output[start:], '\a')
+		if end < 0 {
+			return output
+		}
+		text := string(output[start+len(promptSequence) : start+end])
+		if len(text) > maxPromptText {
+			text = text[:maxPromptText]
+		}
+		// a copy, output may be the buffer of the exec stream
+		output = append(output[:start:start], output[start+end+1:]...)
+		go t.relayPrompt(text)
+	}
+}
+
+func (t *TerminalSession) relayPrompt(text string) {
+	secret, err := t.promptSecret(text)
+	if err != nil {
+		if t.ctx.Err() == nil {
+			t.Toast(fmt.Sprintf("\r\n%v, answer in the terminal\r\n", err))
+		}
+		return
+	}
+	audit(t.auditEvent("prompt.answer", map[string]string{"prompt": text}))
+	enter := "\r"
+	if t.meta.NoTTY && t.windows() {
+		enter = "\r\n"
+	} else if t.meta.NoTTY {
+		enter = "\n"
+	}
+	select {
+	case t.receiver <- []byte(secret + enter):
+	case <-t.ctx.Done():
+	}
+}
+
+// MFARequired reports whether terminals in namespace ask for an MFA code
+func MFARequired(namespace string) bool {
+	return *mfaVerifyURL != "" && namespaceMatches(splitList(*mfaNamespaces), namespace)
+}
+
+// verifyMFA asks the owner of a terminal in a namespace of -mfa-namespaces
+// for an MFA code in a masked prompt and checks it with -mfa-verify-url
+func (t *TerminalSession) verifyMFA() error {
+	if !MFARequired(t.meta.Namespace) {
+		return nil
+	}
+	for attempt := 0; attempt < maxMFAAttempts; attempt++ {
+		code, err := t.promptSecret(fmt.Sprintf("MFA code for terminals in %s", t.meta.Namespace))
+		if err != nil {
+			return err
+		}
+		valid, err := checkMFACode(t.ctx, t.meta.User, t.meta.Namespace, code)
+		if err != nil {
+			return err
+		}
+		if valid {
+			audit(t.auditEvent("mfa.success", nil))
+			return nil
+		}
+		audit(t.auditEvent("mfa.failure", nil))
+		t.Toast("Invalid MFA code\r\n")
+	}
+	return ErrMFAFailed
+}
+
+// checkMFACode asks -mfa-verify-url whether code is valid for user
+func checkMFACode(ctx context.Context, user string, namespace string, code string) (bool, error) {
+	body, err := json.Marshal(map[string]string{"user": user, "namespace": namespace, "code": code})
+	if err != nil {
+		return false, err
+	}
+	client, err := EgressClient(mfaVerifyTimeout)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", *mfaVerifyURL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		return true, nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return false, nil
+	}
+	return false, fmt.Errorf("MFA verification: %s", resp.Status)
+}
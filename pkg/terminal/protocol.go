@@ -0,0 +1,310 @@
+package terminal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// ProtocolVersion is the latest version of the websocket protocol spoken by this server
+// Version 2 sends terminal output in binary frames
+const ProtocolVersion = 2
+
+// MinProtocolVersion is the oldest version clients may still ack. Version 1
+// clients get the output in text frames and only the features they ask for
+const MinProtocolVersion = 1
+
+// Features a client and the server may agree on in the handshake
+const (
+	// FeatureBinary sends the output in binary frames as is, without it the
+	// output arrives in text frames as UTF-8
+	FeatureBinary     = "binary"
+	FeatureResize     = "resize"
+	FeatureHeartbeats = "heartbeats"
+	// FeatureExit sends the exit status of the shell, see ExitMessage
+	FeatureExit    = "exit"
+	FeaturePreview = "preview"
+	// FeatureStreams starts the binary frames of sessions without a TTY with
+	// the stream of the output, see streamFrame. It changes the frames, so
+	// only clients asking for it get it
+	FeatureStreams = "streams"
+	// FeaturePrompt lets the server ask for secrets in masked prompts, see
+	// promptSecret. Clients must answer them, so only clients asking for it
+	// get it
+	FeaturePrompt = "prompt"
+	// FeaturePlatform sends the OS of Windows containers, see detectOS
+	FeaturePlatform = "platform"
+	// FeatureMux is the multiplexed websocket, it is announced but can't be
+	// negotiated on a terminal
+	FeatureMux = "mux"
+)
+
+// Streams of the output of sessions without a TTY, the channel ids of the
+// Kubernetes exec protocol
+const (
+	streamStdout byte = 1
+	streamStderr byte = 2
+)
+
+// handshakeTimeout bounds how long a client may take to acknowledge the capabilities
+const handshakeTimeout = 10 * time.Second
+
+// Capabilities lists the optional protocol features the server supports
+type Capabilities struct {
+	FlowControl  bool `json:"flowControl"`
+	FileTransfer bool `json:"fileTransfer"`
+	Resize       bool `json:"resize"`
+	Recording    bool `json:"recording"`
+	Preview      bool `json:"preview"`
+}
+
+// TerminalMessage is the JSON envelope of the control messages exchanged with the client
+type TerminalMessage struct {
+	Op      string `json:"op"`
+	Version int    `json:"version,omitempty"`
+	// Versions are the protocol versions the server accepts in the ack
+	Versions []int `json:"versions,omitempty"`
+	// Features the server offers in the capabilities, the ones the client
+	// wants in the ack. Without the list a client gets every feature of its
+	// version
+	Features     []string      `json:"features,omitempty"`
+	SessionID    string        `json:"sessionId,omitempty"`
+	ReadOnly     bool          `json:"readOnly,omitempty"`
+	Capabilities *Capabilities `json:"capabilities,omitempty"`
+	Data         string        `json:"data,omitempty"`
+	// Code classifies errors, see ExecErrorCode
+	Code string `json:"code,omitempty"`
+	// Timestamp is the server time of a heartbeat in unix milliseconds
+	Timestamp int64 `json:"timestamp,omitempty"`
+	// Latency is the last measured round-trip time in milliseconds
+	Latency float64 `json:"latency,omitempty"`
+	// Rows and Cols are the terminal size of resize messages and of the ack
+	Rows uint16 `json:"rows,omitempty"`
+	Cols uint16 `json:"cols,omitempty"`
+	// Position is the place of a terminal waiting for a free slot
+	Position int `json:"position,omitempty"`
+	// Path and RequestID of a file preview request, see FilePreview
+	Path      string `json:"path,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+	// Token authenticates a websocket opened without credentials or
+	// replaces the token of a client in a refresh_token message
+	Token string `json:"token,omitempty"`
+	// ExpiresAt is the unix time the refreshed token expires at
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
+	// User and Minutes describe the support access asked for in a pair_request
+	User    string `json:"user,omitempty"`
+	Minutes int    `json:"minutes,omitempty"`
+	// Approved answers a pair_request in a pair_answer
+	Approved bool `json:"approved,omitempty"`
+	// Masked prompts must not echo the answer, see promptSecret
+	Masked bool `json:"masked,omitempty"`
+	// Route sends later requests of the session to its replica, see RouteToReplica
+	Route string `json:"route,omitempty"`
+}
+
+func serverCapabilities() Capabilities {
+	return Capabilities{
+		FlowControl:  false,
+		FileTransfer: true,
+		Resize:       true,
+		Recording:    RecordingEnabled(),
+		Preview:      true,
+	}
+}
+
+// protocolFeatures are the features the server offers
+func protocolFeatures() []string {
+	features := []string{FeatureBinary, FeatureResize, FeatureExit, FeaturePreview, FeatureStreams, FeaturePrompt,
+		FeaturePlatform, FeatureMux}
+	if *heartbeatInterval > 0 {
+		features = append(features, FeatureHeartbeats)
+	}
+	return features
+}
+
+// negotiateFeatures returns the features of a client that acked version with
+// the features it wants, nil if it sent none
+func negotiateFeatures(version int, wanted []string) map[string]bool {
+	explicit := wanted != nil
+	if wanted == nil {
+		if version >= 2 {
+			wanted = protocolFeatures()
+		} else {
+			wanted = []string{FeatureResize}
+		}
+	}
+	features := make(map[string]bool)
+	for _, feature := range wanted {
+		if feature != FeatureMux && containsString(protocolFeatures(), feature) {
+			features[feature] = true
+		}
+	}
+	if !explicit {
+		delete(features, FeatureStreams)
+		delete(features, FeaturePrompt)
+	}
+	// stream ids only make sense in binary frames
+	if !features[FeatureBinary] {
+		delete(features, FeatureStreams)
+	}
+	return features
+}
+
+// handshake sends the server capabilities and waits for the client to acknowledge them
+// The session is refused if the client does not ack a supported protocol version in time
+// The ack may carry the initial terminal size and the features the client wants
+func (c *terminalClient) handshake(sessionId string) (*TerminalMessage, error) {
+	caps := serverCapabilities()
+	msg := TerminalMessage{
+		Op:           "capabilities",
+		Version:      ProtocolVersion,
+		Versions:     supportedVersions(),
+		Features:     protocolFeatures(),
+		SessionID:    sessionId,
+		Route:        routeToken(sessionId),
+		ReadOnly:     c.readOnly,
+		Capabilities: &caps,
+	}
+	if err := c.writeJSON(msg); err != nil {
+		return nil, err
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer c.conn.SetReadDeadline(time.Time{})
+
+	var ack TerminalMessage
+	if err := c.conn.ReadJSON(&ack); err != nil {
+		c.sendError("capabilities were not acknowledged")
+		return nil, fmt.Errorf("read capabilities ack: %v", err)
+	}
+	if ack.Op != "ack" {
+		c.sendError("expected ack of capabilities")
+		return nil, fmt.Errorf("unexpected handshake message %q", ack.Op)
+	}
+	if ack.Version < MinProtocolVersion || ack.Version > ProtocolVersion {
+		c.sendError(fmt.Sprintf("unsupported protocol version %d, server speaks %d to %d",
+			ack.Version, MinProtocolVersion, ProtocolVersion))
+		return nil, fmt.Errorf("client protocol version %d is not supported", ack.Version)
+	}
+	c.version = ack.Version
+	c.features = negotiateFeatures(ack.Version, ack.Features)
+	return &ack, nil
+}
+
+func supportedVersions() []int {
+	versions := make([]int, 0, ProtocolVersion-MinProtocolVersion+1)
+	for v := MinProtocolVersion; v <= ProtocolVersion; v++ {
+		versions = append(versions, v)
+	}
+	return versions
+}
+
+// has reports whether the client agreed on feature in the handshake
+func (c *terminalClient) has(feature string) bool {
+	return c.features[feature]
+}
+
+// featureList returns the negotiated features sorted
+func (c *terminalClient) featureList() []string {
+	features := make([]string, 0, len(c.features))
+	for feature := range c.features {
+		features = append(features, feature)
+	}
+	sort.Strings(features)
+	return features
+}
+
+// outputFrame returns the frame carrying output to c. Clients without binary
+// frames get text frames, a character split across two chunks is held back
+// until it is complete. Only the writer of c may call it
+func (c *terminalClient) outputFrame(data []byte) (int, []byte) {
+	if c.has(FeatureBinary) {
+		return websocket.BinaryMessage, data
+	}
+	if len(c.partial) > 0 {
+		data = append(c.partial, data...)
+		c.partial = nil
+	}
+	// a rune starts in the last 3 bytes at the latest
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax+1; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				c.partial = append([]byte(nil), data[i:]...)
+				data = data[:i]
+			}
+			break
+		}
+	}
+	return websocket.TextMessage, bytes.ToValidUTF8(data, []byte(string(utf8.RuneError)))
+}
+
+// streamFrame returns the binary frame of output of a stream to a client with
+// FeatureStreams, the first byte is the stream
+func streamFrame(stream byte, data []byte) []byte {
+	frame := make([]byte, len(data)+1)
+	frame[0] = stream
+	copy(frame[1:], data)
+	return frame
+}
+
+// noticeFrame returns the frame carrying a notice like a Toast to c
+func (c *terminalClient) noticeFrame(data []byte) (int, []byte) {
+	if c.has(FeatureBinary) {
+		return websocket.BinaryMessage, data
+	}
+	return websocket.TextMessage, bytes.ToValidUTF8(data, []byte(string(utf8.RuneError)))
+}
+
+// sendError reports a protocol error to the client before the session is closed
+func (c *terminalClient) sendError(reason string) {
+	msg := TerminalMessage{Op: "error", Data: reason}
+	if err := c.writeJSON(msg); err != nil {
+		log.Println("sendError:", err)
+	}
+}
+
+// handleControl processes a JSON control message sent by a client
+// It returns false if the message is plain stdin
+func (t *TerminalSession) handleControl(c *terminalClient, message []byte) bool {
+	if len(message) == 0 || message[0] != '{' {
+		return false
+	}
+	var msg TerminalMessage
+	if err := json.Unmarshal(message, &msg); err != nil || msg.Op == "" {
+		return false
+	}
+	c.frames.record("in", msg.Op, len(message))
+	switch msg.Op {
+	case "heartbeat":
+		t.recordLatency(c, msg.Timestamp)
+	case "resize":
+		// read-only clients must not change the size under the writer's feet,
+		// unless they own a read-only session nobody writes to
+		if !c.readOnly || c == t.owner {
+			t.resize(msg.Rows, msg.Cols)
+		}
+	case "preview":
+		t.startPreview(c, msg.RequestID, msg.Path)
+	case "pair_answer":
+		t.answerPair(c, msg.RequestID, msg.Approved)
+	case "pair_revoke":
+		go t.revokePairs(c)
+	case "prompt_answer":
+		t.answerPrompt(c, msg.RequestID, msg.Data)
+	case "refresh_token":
+		t.refreshToken(c, msg.Token)
+	case "eof":
+		if !c.readOnly {
+			t.closeStdin()
+		}
+	default:
+		log.Printf("session %s: ignoring unknown op %q", t.id, msg.Op)
+	}
+	return true
+}
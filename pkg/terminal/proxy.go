@@ -0,0 +1,114 @@
+package terminal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var trustedProxies = Flags.String("trusted-proxies", "",
+	"comma separated CIDRs of reverse proxies, like an ingress controller, whose X-Forwarded-For, "+
+		"X-Forwarded-Proto and X-Forwarded-Host headers are applied")
+
+var trustedNets []*net.IPNet
+
+type forwardedSchemeKey struct{}
+
+// SetupProxies parses -trusted-proxies, it is called on startup
+func SetupProxies() error {
+	trustedNets = nil
+	for _, entry := range splitList(*trustedProxies) {
+		if !strings.Contains(entry, "/") {
+			if strings.Contains(entry, ":") {
+				entry += "/128"
+			} else {
+				entry += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return fmt.Errorf("trusted proxy %q: %v", entry, err)
+		}
+		trustedNets = append(trustedNets, network)
+	}
+	return nil
+}
+
+func trustedProxy(ip net.IP) bool {
+	for _, network := range trustedNets {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Forwarded is a negroni middleware applying the X-Forwarded-* headers of
+// requests from -trusted-proxies: RemoteAddr becomes the address of the
+// client, Host the host it asked for and the scheme is kept for
+// RequestScheme. Headers of other peers are ignored, they could be forged
+func Forwarded(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if len(trustedNets) == 0 || !trustedProxy(net.ParseIP(ClientIP(r))) {
+		next(w, r)
+		return
+	}
+	if client := forwardedFor(r.Header.Values("X-Forwarded-For")); client != "" {
+		r.RemoteAddr = net.JoinHostPort(client, "0")
+	}
+	if host := firstForwarded(r.Header.Get("X-Forwarded-Host")); host != "" {
+		r.Host = host
+	}
+	if proto := strings.ToLower(firstForwarded(r.Header.Get("X-Forwarded-Proto"))); proto == "https" || proto == "http" {
+		r = r.WithContext(context.WithValue(r.Context(), forwardedSchemeKey{}, proto))
+	}
+	next(w, r)
+}
+
+// forwardedFor returns the client of an X-Forwarded-For chain: the last
+// address that isn't a trusted proxy, as the ones before it may be forged
+func forwardedFor(headers []string) string {
+	var chain []string
+	for _, header := range headers {
+		chain = append(chain, splitList(header)...)
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := net.ParseIP(chain[i])
+		if ip == nil {
+			return ""
+		}
+		if !trustedProxy(ip) || i == 0 {
+			return ip.String()
+		}
+	}
+	return ""
+}
+
+// firstForwarded returns the value the first proxy set in a list header
+func firstForwarded(value string) string {
+	if i := strings.Index(value, ","); i >= 0 {
+		value = value[:i]
+	}
+	return strings.TrimSpace(value)
+}
+
+// ClientIP returns the address of the client of r, see Forwarded
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// RequestScheme returns "https" or "http", as the client sees the server
+func RequestScheme(r *http.Request) string {
+	if scheme, ok := r.Context().Value(forwardedSchemeKey{}).(string); ok {
+		return scheme
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
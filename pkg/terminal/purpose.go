@@ -0,0 +1,73 @@
+package terminal
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var reasonNamespaces = Flags.String("require-reason", "",
+	"comma separated namespaces whose terminals need a reason, a trailing * matches a prefix")
+
+const (
+	maxSessionTags = 16
+	maxTagValue    = 256
+	maxReason      = 1024
+)
+
+// tagName is what tags may be called, e.g. ticket or change-request
+var tagName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,62}$`)
+
+// ErrReasonRequired is returned for sessions without a reason in namespaces of
+// -require-reason
+var ErrReasonRequired = errors.New("a reason is required to open a terminal in this namespace")
+
+// ReasonRequired reports whether terminals in namespace need a reason
+func ReasonRequired(namespace string) bool {
+	return namespaceMatches(splitList(*reasonNamespaces), namespace)
+}
+
+// ParseSessionPurpose reads why a terminal is opened from the reason and tag
+// query parameters of a terminal request, tags are given as name=value like
+// tag=ticket=OPS-123
+func ParseSessionPurpose(query url.Values, namespace string) (string, map[string]string, error) {
+	reason := strings.TrimSpace(query.Get("reason"))
+	if len(reason) > maxReason || strings.ContainsRune(reason, 0) {
+		return "", nil, fmt.Errorf("%w: reason must be at most %d characters", ErrInvalidInput, maxReason)
+	}
+	if reason == "" && ReasonRequired(namespace) {
+		return "", nil, ErrReasonRequired
+	}
+	pairs := query["tag"]
+	if len(pairs) == 0 {
+		return reason, nil, nil
+	}
+	if len(pairs) > maxSessionTags {
+		return "", nil, fmt.Errorf("%w: at most %d tags are allowed", ErrInvalidInput, maxSessionTags)
+	}
+	tags := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || !tagName.MatchString(parts[0]) {
+			return "", nil, fmt.Errorf("%w: tag must be name=value", ErrInvalidInput)
+		}
+		if len(parts[1]) > maxTagValue || strings.ContainsRune(parts[1], 0) {
+			return "", nil, fmt.Errorf("%w: invalid value of tag %s", ErrInvalidInput, parts[0])
+		}
+		tags[parts[0]] = parts[1]
+	}
+	return reason, tags, nil
+}
+
+// purposeDetails adds the reason and tags of meta to audit details
+func purposeDetails(meta SessionMeta, details map[string]string) map[string]string {
+	if meta.Reason != "" {
+		details["reason"] = meta.Reason
+	}
+	for name, value := range meta.Tags {
+		details["tag."+name] = value
+	}
+	return details
+}
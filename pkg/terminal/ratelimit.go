@@ -0,0 +1,125 @@
+package terminal
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	limiterBackend = Flags.String("limiter-backend", "memory",
+		`backend counting rate limits and quotas: "memory" or "redis" to share them between replicas`)
+	sessionRateLimit = Flags.Int("session-rate-limit", 0,
+		"terminal sessions a user may open per minute, 0 disables the limit")
+	sessionQuota = Flags.Int("session-quota", 0,
+		"terminal sessions a user may open per day, 0 disables the quota")
+
+	limiterOnce sync.Once
+	limiter     Limiter
+)
+
+// Limiter counts events per key in fixed time windows
+// Rate limits and quotas both use it, only with different windows
+type Limiter interface {
+	// Allow records an event for key and reports whether no more than
+	// limit events happened in the current window
+	Allow(key string, limit int, window time.Duration) (bool, error)
+}
+
+func getLimiter() Limiter {
+	limiterOnce.Do(func() {
+		switch *limiterBackend {
+		case "redis":
+			limiter = &redisLimiter{}
+		default:
+			limiter = newMemoryLimiter()
+		}
+	})
+	return limiter
+}
+
+// AllowSession checks the session rate limit and daily quota of a user
+// Errors of the backend are logged and the session is allowed
+func AllowSession(user string) bool {
+	checks := []struct {
+		name   string
+		limit  int
+		window time.Duration
+	}{
+		{"session-rate", *sessionRateLimit, time.Minute},
+		{"session-quota", *sessionQuota, 24 * time.Hour},
+	}
+	for _, check := range checks {
+		if check.limit <= 0 {
+			continue
+		}
+		ok, err := getLimiter().Allow(check.name+":"+user, check.limit, check.window)
+		if err != nil {
+			log.Printf("AllowSession %s err %v", check.name, err)
+			continue
+		}
+		if !ok {
+			log.Printf("user %s exceeded %s of %d", user, check.name, check.limit)
+			return false
+		}
+	}
+	return true
+}
+
+type limiterWindow struct {
+	start time.Time
+	count int
+}
+
+// memoryLimiter keeps the counters in process, limits apply per replica
+type memoryLimiter struct {
+	lock      sync.Mutex
+	windows   map[string]*limiterWindow
+	lastSweep time.Time
+}
+
+func newMemoryLimiter() *memoryLimiter {
+	return &memoryLimiter{windows: make(map[string]*limiterWindow), lastSweep: time.Now()}
+}
+
+func (l *memoryLimiter) Allow(key string, limit int, window time.Duration) (bool, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	key = fmt.Sprintf("%s:%d", key, window)
+	w, ok := l.windows[key]
+	if !ok || now.Sub(w.start) >= window {
+		w = &limiterWindow{start: now.Truncate(window)}
+		l.windows[key] = w
+	}
+	w.count++
+
+	// forget windows that ended a day ago
+	if now.Sub(l.lastSweep) > time.Hour {
+		for k, old := range l.windows {
+			if now.Sub(old.start) > window+24*time.Hour {
+				delete(l.windows, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	return w.count <= limit, nil
+}
+
+// redisLimiter keeps the counters in redis so all replicas share them
+type redisLimiter struct{}
+
+func (l *redisLimiter) Allow(key string, limit int, window time.Duration) (bool, error) {
+	slot := time.Now().UnixNano() / int64(window)
+	redisKey := fmt.Sprintf("terminal:limit:%s:%d:%d", key, window/time.Second, slot)
+
+	pipe := getRedisClient().TxPipeline()
+	incr := pipe.Incr(redisKey)
+	pipe.Expire(redisKey, window)
+	if _, err := pipe.Exec(); err != nil {
+		return false, err
+	}
+	return incr.Val() <= int64(limit), nil
+}
@@ -0,0 +1,443 @@
+package terminal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	recordingDir = Flags.String("recording-dir", "",
+		"directory session output is recorded to as asciicast files, recording is off if empty")
+	recordingRetention = Flags.Duration("recording-retention", 0,
+		"age after which recordings are deleted, 0 keeps them")
+	recordingMaxBytes = Flags.Int64("recording-max-bytes", 0,
+		"total size of recordings above which the oldest are deleted, 0 for no limit")
+	recordingGCInterval = Flags.Duration("recording-gc-interval", time.Hour,
+		"interval of deleting recordings beyond -recording-retention and -recording-max-bytes")
+	recordingRestoreWindow = Flags.Duration("recording-restore-window", 7*24*time.Hour,
+		"how long recordings deleted through the API can be restored before they are purged")
+)
+
+// ErrRecordingNotFound is returned for recordings that don't exist or were deleted
+var ErrRecordingNotFound = errors.New("recording not found")
+
+var recordingsBucket = []byte("recordings")
+
+// recordingKeyLayout orders index keys by start time
+const recordingKeyLayout = "20060102T150405.000000000Z"
+
+// RecordingInfo is the index entry of a recorded session, Ended is zero while
+// the session runs
+type RecordingInfo struct {
+	ID        string    `json:"id"`
+	User      string    `json:"user"`
+	Role      string    `json:"role,omitempty"`
+	Namespace string    `json:"namespace"`
+	Pod       string    `json:"pod"`
+	Container string    `json:"container"`
+	Started   time.Time `json:"started"`
+	Ended     time.Time `json:"ended,omitempty"`
+	Size      int64     `json:"size"`
+	// Reason and Tags are the purpose of the session
+	Reason string            `json:"reason,omitempty"`
+	Tags   map[string]string `json:"tags,omitempty"`
+	// DeletedAt is set when an admin deleted the recording, it can be
+	// restored until -recording-restore-window passed
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+	DeletedBy string     `json:"deletedBy,omitempty"`
+}
+
+func (info *RecordingInfo) key() []byte {
+	return []byte(info.Started.UTC().Format(recordingKeyLayout) + "/" + info.ID)
+}
+
+// RecordingQuery filters SearchRecordings, empty fields match everything.
+// Deleted recordings are only found with Deleted, which finds nothing else
+type RecordingQuery struct {
+	User      string
+	Namespace string
+	Since     time.Time
+	Limit     int
+	Deleted   bool
+}
+
+var recordingIndex *bolt.DB
+
+// RecordingEnabled reports whether sessions are recorded
+func RecordingEnabled() bool {
+	return *recordingDir != ""
+}
+
+// StartRecordings opens the index of -recording-dir and starts deleting
+// recordings beyond the retention limits
+func StartRecordings() error {
+	if !RecordingEnabled() {
+		return nil
+	}
+	if err := setupRecordingStore(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(*recordingDir, 0700); err != nil {
+		return err
+	}
+	db, err := bolt.Open(filepath.Join(*recordingDir, "index.db"), 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(recordingsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return err
+	}
+	recordingIndex = db
+	// deleted recordings are purged whatever the retention limits
+	go func() {
+		for {
+			collectRecordings()
+			time.Sleep(*recordingGCInterval)
+		}
+	}()
+	return nil
+}
+
+func recordingPath(id string) string {
+	return filepath.Join(*recordingDir, id+".cast")
+}
+
+func putRecording(info *RecordingInfo) error {
+	return recordingIndex.Update(func(tx *bolt.Tx) error {
+		data, err := json.Marshal(info)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(recordingsBucket).Put(info.key(), data)
+	})
+}
+
+// sessionRecorder writes the output of a session in the asciicast v2 format
+type sessionRecorder struct {
+	lock    sync.Mutex
+	file    *os.File
+	writer  *bufio.Writer
+	started time.Time
+	info    RecordingInfo
+}
+
+// newSessionRecorder starts recording a session, it returns nil if recording
+// is off or the recording can't be created
+func newSessionRecorder(id string, meta SessionMeta, rows uint16, cols uint16) *sessionRecorder {
+	if recordingIndex == nil {
+		return nil
+	}
+	file, err := os.OpenFile(recordingPath(id), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		log.Println("newSessionRecorder err", err)
+		return nil
+	}
+	r := &sessionRecorder{
+		file:    file,
+		writer:  bufio.NewWriter(file),
+		started: meta.Started,
+		info: RecordingInfo{
+			ID:        id,
+			User:      meta.User,
+			Role:      meta.Role,
+			Namespace: meta.Namespace,
+			Pod:       meta.Pod,
+			Container: meta.Container,
+			Started:   meta.Started,
+			Reason:    meta.Reason,
+			Tags:      meta.Tags,
+		},
+	}
+	if cols == 0 || rows == 0 {
+		cols, rows = 80, 24
+	}
+	header := map[string]interface{}{
+		"version":   2,
+		"width":     cols,
+		"height":    rows,
+		"timestamp": meta.Started.Unix(),
+		"env":       map[string]string{"TERM": "xterm"},
+	}
+	if meta.Reason != "" {
+		header["title"] = meta.Reason
+	}
+	if len(meta.Tags) > 0 {
+		header["tags"] = meta.Tags
+	}
+	headerLine, _ := json.Marshal(header)
+	r.writeLine(headerLine)
+	if err := putRecording(&r.info); err != nil {
+		log.Println("newSessionRecorder index err", err)
+	}
+	return r
+}
+
+func (r *sessionRecorder) writeLine(line []byte) {
+	r.writer.Write(line)
+	r.writer.WriteByte('\n')
+	r.info.Size += int64(len(line)) + 1
+}
+
+// record appends an output event
+func (r *sessionRecorder) record(p []byte) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.file == nil {
+		return
+	}
+	event, _ := json.Marshal([]interface{}{time.Since(r.started).Seconds(), "o", string(maskStream(p))})
+	r.writeLine(event)
+}
+
+// marker appends a marker event, players list them as chapters
+func (r *sessionRecorder) marker(label string) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.file == nil {
+		return
+	}
+	event, _ := json.Marshal([]interface{}{time.Since(r.started).Seconds(), "m", string(maskStream([]byte(label)))})
+	r.writeLine(event)
+}
+
+// close ends the recording and completes its index entry
+func (r *sessionRecorder) close() {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.file == nil {
+		return
+	}
+	if err := r.writer.Flush(); err != nil {
+		log.Println("recording flush err", err)
+	}
+	r.file.Close()
+	r.file = nil
+	r.info.Ended = time.Now()
+	if err := putRecording(&r.info); err != nil {
+		log.Println("recording index err", err)
+	}
+	storeRecording(r.info.ID)
+}
+
+// SearchRecordings returns the recordings matching query, oldest first
+func SearchRecordings(query RecordingQuery) ([]RecordingInfo, error) {
+	if recordingIndex == nil {
+		return nil, nil
+	}
+	limit := query.Limit
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	recordings := []RecordingInfo{}
+	err := recordingIndex.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(recordingsBucket).Cursor()
+		k, v := cursor.First()
+		if !query.Since.IsZero() {
+			k, v = cursor.Seek([]byte(query.Since.UTC().Format(recordingKeyLayout)))
+		}
+		for ; k != nil && len(recordings) < limit; k, v = cursor.Next() {
+			var info RecordingInfo
+			if err := json.Unmarshal(v, &info); err != nil {
+				return err
+			}
+			if (query.User == "" || info.User == query.User) &&
+				(query.Namespace == "" || info.Namespace == query.Namespace) &&
+				(info.DeletedAt != nil) == query.Deleted {
+				recordings = append(recordings, info)
+			}
+		}
+		return nil
+	})
+	return recordings, err
+}
+
+// GetRecording returns the index entry of a recording, its asciicast file is
+// read with OpenRecording. Deleted recordings are not found
+func GetRecording(id string) (*RecordingInfo, error) {
+	info, err := findRecording(id)
+	if err == nil && info.DeletedAt != nil {
+		return nil, ErrRecordingNotFound
+	}
+	return info, err
+}
+
+// findRecording returns the index entry of a recording, deleted or not
+func findRecording(id string) (*RecordingInfo, error) {
+	if recordingIndex == nil {
+		return nil, ErrRecordingNotFound
+	}
+	var found *RecordingInfo
+	err := recordingIndex.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(recordingsBucket).ForEach(func(k, v []byte) error {
+			var info RecordingInfo
+			if err := json.Unmarshal(v, &info); err != nil {
+				return err
+			}
+			if info.ID == id {
+				found = &info
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, ErrRecordingNotFound
+	}
+	return found, nil
+}
+
+// DeleteRecording hides a recording from searches and downloads. It is only
+// purged once -recording-restore-window passed, so RestoreRecording can undo
+// an accidental deletion
+func DeleteRecording(id string, user string) error {
+	info, err := GetRecording(id)
+	if err != nil {
+		return err
+	}
+	if getSession(id) != nil {
+		return fmt.Errorf("%w: the session is still running", ErrInvalidInput)
+	}
+	now := time.Now()
+	info.DeletedAt, info.DeletedBy = &now, user
+	if err := putRecording(info); err != nil {
+		return err
+	}
+	audit(info.auditEvent("recording.delete", user))
+	return nil
+}
+
+// RestoreRecording undoes DeleteRecording, recordings that were purged are
+// not found
+func RestoreRecording(id string, user string) error {
+	info, err := findRecording(id)
+	if err != nil {
+		return err
+	}
+	if info.DeletedAt == nil {
+		return fmt.Errorf("%w: the recording is not deleted", ErrInvalidInput)
+	}
+	info.DeletedAt, info.DeletedBy = nil, ""
+	if err := putRecording(info); err != nil {
+		return err
+	}
+	audit(info.auditEvent("recording.restore", user))
+	return nil
+}
+
+// auditEvent describes what user did to the recording, the owner of the
+// recorded session is a detail
+func (info *RecordingInfo) auditEvent(kind string, user string) AuditEvent {
+	return AuditEvent{
+		Type:      kind,
+		SessionID: info.ID,
+		User:      user,
+		Namespace: info.Namespace,
+		Pod:       info.Pod,
+		Container: info.Container,
+		Details:   map[string]string{"owner": info.User},
+	}
+}
+
+// collectRecordings purges the recordings deleted longer than
+// -recording-restore-window ago, then deletes the recordings older than
+// -recording-retention and the oldest ones beyond -recording-max-bytes.
+// Recordings of running sessions are kept
+func collectRecordings() {
+	var total int64
+	var candidates []RecordingInfo
+	err := recordingIndex.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(recordingsBucket).ForEach(func(k, v []byte) error {
+			var info RecordingInfo
+			if err := json.Unmarshal(v, &info); err != nil {
+				return err
+			}
+			total += info.Size
+			candidates = append(candidates, info)
+			return nil
+		})
+	})
+	if err != nil {
+		log.Println("collectRecordings err", err)
+		return
+	}
+	deleted := 0
+	purgeBefore := time.Now().Add(-*recordingRestoreWindow)
+	kept := candidates[:0]
+	for _, info := range candidates {
+		if info.DeletedAt == nil || info.DeletedAt.After(purgeBefore) {
+			kept = append(kept, info)
+			continue
+		}
+		if err := deleteRecording(&info); err != nil {
+			log.Println("collectRecordings err", err)
+			kept = append(kept, info)
+			continue
+		}
+		audit(info.auditEvent("recording.purge", ""))
+		total -= info.Size
+		deleted++
+	}
+	candidates = kept
+
+	cutoff := time.Now().Add(-*recordingRetention)
+	// the index is ordered by start time, so the oldest come first
+	for _, info := range candidates {
+		expired := *recordingRetention > 0 && info.Started.Before(cutoff)
+		oversized := *recordingMaxBytes > 0 && total > *recordingMaxBytes
+		if !expired && !oversized {
+			break
+		}
+		if getSession(info.ID) != nil {
+			continue
+		}
+		if err := deleteRecording(&info); err != nil {
+			log.Println("collectRecordings err", err)
+			continue
+		}
+		total -= info.Size
+		deleted++
+	}
+	if deleted > 0 {
+		log.Printf("deleted %d recordings", deleted)
+	}
+}
+
+func deleteRecording(info *RecordingInfo) error {
+	if err := os.Remove(recordingPath(info.ID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), recordingStoreTimeout)
+	defer cancel()
+	if err := recordingStore.Delete(ctx, info.ID); err != nil {
+		return err
+	}
+	return recordingIndex.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(recordingsBucket).Delete(info.key())
+	})
+}
@@ -0,0 +1,286 @@
+package terminal
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+var recordingPrompt = Flags.String("recording-prompt", `^[^\n]{0,120}?[$#%>] `,
+	"regular expression of the shell prompt, lines starting with it are commands when recordings are diffed")
+
+const (
+	// maxDiffRecordingBytes bounds how much of a recording is read for a diff
+	maxDiffRecordingBytes = 32 << 20
+	// maxDiffCommands bounds the commands aligned per recording, the alignment
+	// takes their product in memory
+	maxDiffCommands = 2000
+	// maxDiffOutput bounds the output of a command returned by a diff
+	maxDiffOutput = 4 << 10
+)
+
+// Kinds of the steps of a RecordingDiff
+const (
+	DiffSame    = "same"
+	DiffChanged = "changed"
+	DiffAdded   = "added"
+	DiffRemoved = "removed"
+)
+
+// RecordedCommand is a command found in a recording with the output it printed
+type RecordedCommand struct {
+	Command string `json:"command"`
+	Output  string `json:"output"`
+	// Time is when the command was entered, in seconds of the recording
+	Time float64 `json:"time"`
+	// Truncated is set when the output was cut to 4 KiB
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// DiffStep aligns a command of the base recording with one of the other
+// recording. Removed steps only ran in the base, added ones only in the other
+type DiffStep struct {
+	Kind  string           `json:"kind"`
+	Base  *RecordedCommand `json:"base,omitempty"`
+	Other *RecordedCommand `json:"other,omitempty"`
+}
+
+// RecordingDiff compares the commands of two recordings, like a runbook
+// rehearsed in staging and run in production
+type RecordingDiff struct {
+	Base    RecordingInfo `json:"base"`
+	Other   RecordingInfo `json:"other"`
+	Steps   []DiffStep    `json:"steps"`
+	Same    int           `json:"same"`
+	Changed int           `json:"changed"`
+	Added   int           `json:"added"`
+	Removed int           `json:"removed"`
+	// Truncated is set when a recording had more commands than were compared
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// DiffOptions tune what counts as a difference
+type DiffOptions struct {
+	// Ignore matches volatile parts of the output, like ages or pod name
+	// suffixes, which are masked before outputs are compared
+	Ignore *regexp.Regexp
+}
+
+// DiffRecordings aligns the commands of two recordings by their text and
+// compares the output of the commands both ran
+func DiffRecordings(ctx context.Context, base *RecordingInfo, other *RecordingInfo, opts DiffOptions) (*RecordingDiff, error) {
+	prompt, err := regexp.Compile(*recordingPrompt)
+	if err != nil {
+		return nil, fmt.Errorf("-recording-prompt: %v", err)
+	}
+	diff := &RecordingDiff{Base: *base, Other: *other, Steps: []DiffStep{}}
+	baseCommands, truncated, err := recordedCommands(ctx, base.ID, prompt)
+	if err != nil {
+		return nil, err
+	}
+	diff.Truncated = truncated
+	otherCommands, truncated, err := recordedCommands(ctx, other.ID, prompt)
+	if err != nil {
+		return nil, err
+	}
+	diff.Truncated = diff.Truncated || truncated
+
+	normalize := func(s string) string {
+		if opts.Ignore != nil {
+			s = opts.Ignore.ReplaceAllString(s, "*")
+		}
+		return strings.Join(strings.Fields(s), " ")
+	}
+	for _, step := range alignCommands(baseCommands, otherCommands) {
+		switch {
+		case step.Base == nil:
+			step.Kind = DiffAdded
+			diff.Added++
+		case step.Other == nil:
+			step.Kind = DiffRemoved
+			diff.Removed++
+		case normalize(step.Base.Output) != normalize(step.Other.Output):
+			step.Kind = DiffChanged
+			diff.Changed++
+		default:
+			step.Kind = DiffSame
+			diff.Same++
+		}
+		diff.Steps = append(diff.Steps, step)
+	}
+	return diff, nil
+}
+
+// alignCommands pairs the commands of a and b along their longest common
+// subsequence, commands only one side ran are left unpaired
+func alignCommands(a []RecordedCommand, b []RecordedCommand) []DiffStep {
+	key := func(c RecordedCommand) string { return strings.Join(strings.Fields(c.Command), " ") }
+	// lengths[i][j] is the length of the common subsequence of a[i:] and b[j:]
+	lengths := make([][]int32, len(a)+1)
+	for i := range lengths {
+		lengths[i] = make([]int32, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if key(a[i]) == key(b[j]) {
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			} else if lengths[i+1][j] >= lengths[i][j+1] {
+				lengths[i][j] = lengths[i+1][j]
+			} else {
+				lengths[i][j] = lengths[i][j+1]
+			}
+		}
+	}
+	var steps []DiffStep
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case key(a[i]) == key(b[j]):
+			steps = append(steps, DiffStep{Base: &a[i], Other: &b[j]})
+			i++
+			j++
+		case lengths[i+1][j] >= lengths[i][j+1]:
+			steps = append(steps, DiffStep{Base: &a[i]})
+			i++
+		default:
+			steps = append(steps, DiffStep{Other: &b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		steps = append(steps, DiffStep{Base: &a[i]})
+	}
+	for ; j < len(b); j++ {
+		steps = append(steps, DiffStep{Other: &b[j]})
+	}
+	return steps
+}
+
+// recordedCommands replays the output of a recording into lines and splits
+// them into the commands typed at a prompt and their output. It reports
+// whether the recording had more than maxDiffCommands
+func recordedCommands(ctx context.Context, id string, prompt *regexp.Regexp) ([]RecordedCommand, bool, error) {
+	recording, err := OpenRecording(ctx, id)
+	if err != nil {
+		return nil, false, err
+	}
+	defer recording.Close()
+
+	screen := &lineScreen{}
+	var commands []RecordedCommand
+	var output []string
+	finish := func() {
+		if len(commands) == 0 {
+			return
+		}
+		c := &commands[len(commands)-1]
+		c.Output = strings.Join(output, "\n")
+		if len(c.Output) > maxDiffOutput {
+			cut := maxDiffOutput
+			for cut > 0 && !utf8.RuneStart(c.Output[cut]) {
+				cut--
+			}
+			c.Output, c.Truncated = c.Output[:cut], true
+		}
+		output = nil
+	}
+	var at float64
+	line := func(text string) bool {
+		if loc := prompt.FindStringIndex(text); loc != nil {
+			finish()
+			if len(commands) == maxDiffCommands {
+				return false
+			}
+			commands = append(commands, RecordedCommand{Command: strings.TrimSpace(text[loc[1]:]), Time: at})
+		} else if len(commands) > 0 {
+			output = append(output, text)
+		}
+		return true
+	}
+
+	reader := bufio.NewReader(io.LimitReader(recording, maxDiffRecordingBytes))
+	// the first line is the header
+	if _, err := reader.ReadBytes('\n'); err != nil && err != io.EOF {
+		return nil, false, err
+	}
+	for {
+		event, err := reader.ReadBytes('\n')
+		if len(event) > 0 {
+			if t, kind, data, ok := parseReplayEvent(event); ok && kind == "o" {
+				at = t
+				for _, text := range screen.write(data) {
+					if !line(text) {
+						return commands, true, nil
+					}
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, false, err
+		}
+	}
+	// the last line is the prompt after the last command, or its output
+	if text := screen.current.String(); text != "" && !line(text) {
+		return withoutEmptyPrompts(commands), true, nil
+	}
+	finish()
+	return withoutEmptyPrompts(commands), false, nil
+}
+
+// withoutEmptyPrompts drops the prompts at which nothing was entered
+func withoutEmptyPrompts(commands []RecordedCommand) []RecordedCommand {
+	kept := commands[:0]
+	for _, c := range commands {
+		if c.Command != "" || c.Output != "" {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
+
+// escapeSequence matches the CSI, OSC and two byte escape sequences of the
+// output, which don't add text to a line
+var escapeSequence = regexp.MustCompile("\x1b\\[[0-?]*[ -/]*[@-~]|\x1b\\][^\x07\x1b]*(\x07|\x1b\\\\)?|\x1b[@-_]")
+
+// lineScreen turns terminal output into the lines it shows, well enough for
+// the echo of commands edited with backspace and carriage returns
+type lineScreen struct {
+	current strings.Builder
+	// pendingCR is a carriage return that may start a line break
+	pendingCR bool
+}
+
+// write returns the lines data completed
+func (s *lineScreen) write(data string) []string {
+	data = escapeSequence.ReplaceAllString(data, "")
+	var lines []string
+	for _, r := range data {
+		if s.pendingCR && r != '\n' {
+			// a lone carriage return rewrites the line from its start
+			s.current.Reset()
+		}
+		s.pendingCR = false
+		switch {
+		case r == '\n':
+			lines = append(lines, strings.TrimRight(s.current.String(), " "))
+			s.current.Reset()
+		case r == '\r':
+			s.pendingCR = true
+		case r == '\b':
+			text := []rune(s.current.String())
+			if len(text) > 0 {
+				s.current.Reset()
+				s.current.WriteString(string(text[:len(text)-1]))
+			}
+		case r == '\t' || r >= ' ' && r != 0x7f:
+			s.current.WriteRune(r)
+		}
+	}
+	return lines
+}
@@ -0,0 +1,139 @@
+package terminal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// gcsMetadataToken is where workloads on GKE and GCE get an access token of
+// their service account
+const gcsMetadataToken = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// gcsRecordingStore keeps recordings in a Cloud Storage bucket, it
+// authenticates as the service account of the node or, with workload
+// identity, of the pod
+type gcsRecordingStore struct {
+	client *http.Client
+	tokens oauth2.TokenSource
+}
+
+func newGCSRecordingStore(client *http.Client) *gcsRecordingStore {
+	return &gcsRecordingStore{
+		client: client,
+		tokens: oauth2.ReuseTokenSource(nil, metadataTokenSource{}),
+	}
+}
+
+func (g *gcsRecordingStore) Put(ctx context.Context, id string, r io.Reader, size int64) error {
+	query := url.Values{"uploadType": {"media"}, "name": {recordingObject(id)}}
+	if *recordingKMSKey != "" {
+		query.Set("kmsKeyName", *recordingKMSKey)
+	}
+	u := "https://storage.googleapis.com/upload/storage/v1/b/" + url.PathEscape(*recordingBucket) +
+		"/o?" + query.Encode()
+	resp, err := g.do(ctx, http.MethodPost, u, r, size)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (g *gcsRecordingStore) Get(ctx context.Context, id string) (io.ReadCloser, error) {
+	resp, err := g.do(ctx, http.MethodGet, g.objectURL(id)+"?alt=media", nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (g *gcsRecordingStore) Delete(ctx context.Context, id string) error {
+	resp, err := g.do(ctx, http.MethodDelete, g.objectURL(id), nil, 0)
+	if err == ErrRecordingNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (g *gcsRecordingStore) objectURL(id string) string {
+	return "https://storage.googleapis.com/storage/v1/b/" + url.PathEscape(*recordingBucket) +
+		"/o/" + url.PathEscape(recordingObject(id))
+}
+
+func (g *gcsRecordingStore) do(ctx context.Context, method string, u string, body io.Reader,
+	size int64) (*http.Response, error) {
+
+	token, err := g.tokens.Token()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	token.SetAuthHeader(req)
+	if body != nil {
+		req.ContentLength = size
+		req.Header.Set("Content-Type", "application/x-asciicast")
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrRecordingNotFound
+	}
+	if resp.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		resp.Body.Close()
+		return nil, fmt.Errorf("gcs %s: %s: %s", method, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return resp, nil
+}
+
+// metadataTokenSource gets access tokens from the metadata server
+type metadataTokenSource struct{}
+
+func (metadataTokenSource) Token() (*oauth2.Token, error) {
+	req, err := http.NewRequest(http.MethodGet, gcsMetadataToken, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	// the metadata server is link-local, the egress proxy can't reach it
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("metadata server: %s", resp.Status)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+		TokenType   string `json:"token_type"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, err
+	}
+	return &oauth2.Token{
+		AccessToken: token.AccessToken,
+		TokenType:   token.TokenType,
+		Expiry:      time.Now().Add(time.Duration(token.ExpiresIn) * time.Second),
+	}, nil
+}
@@ -0,0 +1,188 @@
+package terminal
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	recordingS3Endpoint = Flags.String("recording-s3-endpoint", "https://s3.amazonaws.com",
+		"endpoint of the s3 recording store, any S3-compatible service like MinIO works")
+	recordingS3Region = Flags.String("recording-s3-region", "us-east-1", "region of the s3 recording store")
+	recordingSSE      = Flags.String("recording-sse", "",
+		`server-side encryption of the s3 recording store: "AES256" or "aws:kms" with -recording-kms-key`)
+)
+
+// unsignedPayload lets uploads stream instead of hashing the recording first,
+// the connection is protected by TLS
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// s3RecordingStore keeps recordings in an S3 bucket. Credentials come from
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+type s3RecordingStore struct {
+	client    *http.Client
+	endpoint  *url.URL
+	accessKey string
+	secretKey string
+	token     string
+}
+
+func newS3RecordingStore(client *http.Client) (*s3RecordingStore, error) {
+	endpoint, err := url.Parse(*recordingS3Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, errors.New("-recording-s3-endpoint must be a URL")
+	}
+	switch *recordingSSE {
+	case "", "AES256":
+	case "aws:kms":
+		if *recordingKMSKey == "" {
+			return nil, errors.New("-recording-kms-key is required with -recording-sse aws:kms")
+		}
+	default:
+		return nil, fmt.Errorf("unknown server-side encryption %q", *recordingSSE)
+	}
+	s := &s3RecordingStore{
+		client:    client,
+		endpoint:  endpoint,
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:     os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required by the s3 recording store")
+	}
+	return s, nil
+}
+
+func (s *s3RecordingStore) Put(ctx context.Context, id string, r io.Reader, size int64) error {
+	header := http.Header{}
+	header.Set("Content-Type", "application/x-asciicast")
+	if *recordingSSE != "" {
+		header.Set("X-Amz-Server-Side-Encryption", *recordingSSE)
+	}
+	if *recordingSSE == "aws:kms" {
+		header.Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", *recordingKMSKey)
+	}
+	resp, err := s.do(ctx, http.MethodPut, id, header, r, size)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3RecordingStore) Get(ctx context.Context, id string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, id, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3RecordingStore) Delete(ctx context.Context, id string) error {
+	resp, err := s.do(ctx, http.MethodDelete, id, nil, nil, 0)
+	if err == ErrRecordingNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do sends a signed request for the object of recording id, errors of S3 are
+// returned as error
+func (s *s3RecordingStore) do(ctx context.Context, method string, id string, header http.Header,
+	body io.Reader, size int64) (*http.Response, error) {
+
+	u := *s.endpoint
+	// path-style URLs work with every S3-compatible service
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + *recordingBucket + "/" + recordingObject(id)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	s.sign(req, time.Now().UTC())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrRecordingNotFound
+	}
+	if resp.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", method, id, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return resp, nil
+}
+
+// sign adds an AWS signature version 4 to req
+func (s *s3RecordingStore) sign(req *http.Request, now time.Time) {
+	date := now.Format("20060102")
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	if s.token != "" {
+		req.Header.Set("X-Amz-Security-Token", s.token)
+	}
+
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		unsignedPayload,
+	}, "\n")
+
+	scope := date + "/" + *recordingS3Region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" +
+		hex.EncodeToString(hash[:])
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	for _, part := range []string{*recordingS3Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+	// net/http sends req.Host, the header was only needed for the signature
+	req.Header.Del("Host")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
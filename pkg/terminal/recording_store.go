@@ -0,0 +1,155 @@
+package terminal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+var (
+	recordingStoreKind = Flags.String("recording-store", "local",
+		`where finished recordings are kept: "local" in -recording-dir (which can be a PVC), "s3" or "gcs"`)
+	recordingBucket = Flags.String("recording-bucket", "", "bucket of the s3 and gcs recording stores")
+	recordingPrefix = Flags.String("recording-prefix", "recordings/",
+		"prefix of the object names of recordings in the bucket")
+	recordingKMSKey = Flags.String("recording-kms-key", "",
+		"KMS key encrypting recordings in the bucket, an AWS KMS key id or a Cloud KMS key name")
+)
+
+// recordingStoreTimeout bounds a transfer of a recording
+const recordingStoreTimeout = 10 * time.Minute
+
+// jobKindUploadRecording moves a finished recording from -recording-dir to
+// the recording store
+const jobKindUploadRecording = "recording.upload"
+
+// RecordingStore keeps the asciicast files of finished recordings. Sessions
+// are recorded to -recording-dir first and moved to the store when they end
+type RecordingStore interface {
+	// Put stores the recording id of size bytes read from r
+	Put(ctx context.Context, id string, r io.Reader, size int64) error
+	// Get opens a recording, ErrRecordingNotFound if it doesn't exist
+	Get(ctx context.Context, id string) (io.ReadCloser, error)
+	// Delete removes a recording, deleting a missing one is no error
+	Delete(ctx context.Context, id string) error
+}
+
+var recordingStore RecordingStore = localRecordingStore{}
+
+func init() {
+	RegisterJobHandler(jobKindUploadRecording, func(payload json.RawMessage) error {
+		var id string
+		if err := json.Unmarshal(payload, &id); err != nil {
+			return err
+		}
+		return uploadRecording(id)
+	})
+}
+
+// setupRecordingStore selects the store of -recording-store
+func setupRecordingStore() error {
+	switch *recordingStoreKind {
+	case "local":
+		recordingStore = localRecordingStore{}
+		return nil
+	case "s3", "gcs":
+		if *recordingBucket == "" {
+			return fmt.Errorf("-recording-bucket is required with -recording-store %s", *recordingStoreKind)
+		}
+	default:
+		return fmt.Errorf("unknown recording store %q", *recordingStoreKind)
+	}
+	client, err := EgressClient(recordingStoreTimeout)
+	if err != nil {
+		return err
+	}
+	if *recordingStoreKind == "s3" {
+		recordingStore, err = newS3RecordingStore(client)
+		return err
+	}
+	recordingStore = newGCSRecordingStore(client)
+	return nil
+}
+
+func recordingObject(id string) string {
+	return *recordingPrefix + id + ".cast"
+}
+
+// storeRecording queues the upload of a finished recording, local recordings
+// stay where they are
+func storeRecording(id string) {
+	if _, ok := recordingStore.(localRecordingStore); ok {
+		return
+	}
+	if _, err := EnqueueJob(jobKindUploadRecording, id, time.Time{}); err != nil {
+		log.Println("storeRecording err", err)
+	}
+}
+
+// uploadRecording moves a recording to the store, it is done if the local
+// file is gone
+func uploadRecording(id string) error {
+	file, err := os.Open(recordingPath(id))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), recordingStoreTimeout)
+	defer cancel()
+	if err := recordingStore.Put(ctx, id, file, stat.Size()); err != nil {
+		return err
+	}
+	return os.Remove(recordingPath(id))
+}
+
+// OpenRecording returns the asciicast file of a recording. Recordings of
+// running sessions and ones not uploaded yet are read from -recording-dir
+func OpenRecording(ctx context.Context, id string) (io.ReadCloser, error) {
+	file, err := os.Open(recordingPath(id))
+	if err == nil {
+		return file, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return recordingStore.Get(ctx, id)
+}
+
+// localRecordingStore keeps the recordings in -recording-dir
+type localRecordingStore struct{}
+
+func (localRecordingStore) Put(ctx context.Context, id string, r io.Reader, size int64) error {
+	file, err := os.OpenFile(recordingPath(id), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (localRecordingStore) Get(ctx context.Context, id string) (io.ReadCloser, error) {
+	file, err := os.Open(recordingPath(id))
+	if os.IsNotExist(err) {
+		return nil, ErrRecordingNotFound
+	}
+	return file, err
+}
+
+func (localRecordingStore) Delete(ctx context.Context, id string) error {
+	if err := os.Remove(recordingPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
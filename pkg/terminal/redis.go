@@ -0,0 +1,28 @@
+package terminal
+
+import (
+	"sync"
+
+	"github.com/go-redis/redis/v7"
+)
+
+var (
+	redisAddr     = Flags.String("redis-addr", "localhost:6379", "address of the redis server")
+	redisPassword = Flags.String("redis-password", "", "password of the redis server")
+	redisDB       = Flags.Int("redis-db", 0, "redis database number")
+
+	redisOnce   sync.Once
+	redisClient *redis.Client
+)
+
+// getRedisClient returns the redis client shared by all redis backed subsystems
+func getRedisClient() *redis.Client {
+	redisOnce.Do(func() {
+		redisClient = redis.NewClient(&redis.Options{
+			Addr:     *redisAddr,
+			Password: *redisPassword,
+			DB:       *redisDB,
+		})
+	})
+	return redisClient
+}
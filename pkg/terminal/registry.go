@@ -0,0 +1,248 @@
+package terminal
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+var sessionRegistry = Flags.String("session-registry", "memory",
+	`where the session list is kept: "memory" or "redis" to share it between replicas`)
+
+const (
+	// registryPrefix is the key prefix of sessions in redis
+	registryPrefix = "terminal:session:"
+	// registryKillChannel is the pub/sub channel of kills of sessions that
+	// run on other replicas
+	registryKillChannel = "terminal:session-kill"
+	// approvalPrefix is the key prefix of pending approvals in redis
+	approvalPrefix = "terminal:approval:"
+	// registryAnswerChannel is the pub/sub channel of answers to approvals,
+	// the replica whose terminal waits for one hands it over
+	registryAnswerChannel = "terminal:approval-answer"
+	// registryRefresh is how often replicas renew their sessions, entries of
+	// a replica that died expire after registryTTL
+	registryRefresh = 30 * time.Second
+	registryTTL     = 3 * registryRefresh
+)
+
+// registryKill asks the replica running a session to end it
+type registryKill struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+// registryAnswer is the answer of an approval
+type registryAnswer struct {
+	ID       string `json:"id"`
+	Approver string `json:"approver"`
+	Approved bool   `json:"approved"`
+}
+
+// replicaName identifies this replica in the session list
+func replicaName() string {
+	if *advertiseURL != "" {
+		return *advertiseURL
+	}
+	name, _ := os.Hostname()
+	return name
+}
+
+func registryEnabled() bool {
+	return *sessionRegistry == "redis"
+}
+
+// StartRegistry keeps the sessions of this replica in the shared registry and
+// ends the ones other replicas kill, if -session-registry is redis. Pending
+// approvals are shared as well, so any replica lists and answers them
+func StartRegistry() {
+	if !registryEnabled() {
+		return
+	}
+	go func() {
+		for range time.Tick(registryRefresh) {
+			for _, info := range localSessions() {
+				registerSession(info)
+			}
+		}
+	}()
+	go func() {
+		for msg := range getRedisClient().Subscribe(registryKillChannel).Channel() {
+			var kill registryKill
+			if err := json.Unmarshal([]byte(msg.Payload), &kill); err != nil {
+				continue
+			}
+			if err := killLocalSession(kill.ID, kill.Reason); err != nil && err != ErrSessionNotFound {
+				log.Println("registry kill err", err)
+			}
+		}
+	}()
+	go func() {
+		for msg := range getRedisClient().Subscribe(registryAnswerChannel).Channel() {
+			var answer registryAnswer
+			if err := json.Unmarshal([]byte(msg.Payload), &answer); err != nil {
+				continue
+			}
+			// every replica gets the answer, only one has the terminal
+			answerLocalApproval(answer.ID, answer.Approver, answer.Approved)
+		}
+	}()
+}
+
+// registerSession stores the info of a local session in the registry
+func registerSession(info SessionInfo) {
+	if !registryEnabled() {
+		return
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return
+	}
+	if err := getRedisClient().Set(registryPrefix+info.ID, data, registryTTL).Err(); err != nil {
+		log.Println("registerSession err", err)
+	}
+}
+
+// unregisterSession removes an ended session from the registry
+func unregisterSession(id string) {
+	if !registryEnabled() {
+		return
+	}
+	if err := getRedisClient().Del(registryPrefix + id).Err(); err != nil {
+		log.Println("unregisterSession err", err)
+	}
+}
+
+// registryValues returns the values of the registry keys starting with prefix
+func registryValues(prefix string) ([]string, error) {
+	client := getRedisClient()
+	var keys []string
+	var cursor uint64
+	for {
+		batch, next, err := client.Scan(cursor, prefix+"*", 500).Result()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, batch...)
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	values, err := client.MGet(keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	data := make([]string, 0, len(values))
+	for _, value := range values {
+		// not a string if it expired between the scan and the read
+		if value, ok := value.(string); ok {
+			data = append(data, value)
+		}
+	}
+	return data, nil
+}
+
+// registeredSessions returns the sessions of all replicas
+func registeredSessions() ([]SessionInfo, error) {
+	values, err := registryValues(registryPrefix)
+	if err != nil {
+		return nil, err
+	}
+	sessions := make([]SessionInfo, 0, len(values))
+	for _, data := range values {
+		var info SessionInfo
+		if err := json.Unmarshal([]byte(data), &info); err == nil {
+			sessions = append(sessions, info)
+		}
+	}
+	return sessions, nil
+}
+
+// killRegisteredSession ends a session running on another replica
+func killRegisteredSession(id string, reason string) error {
+	client := getRedisClient()
+	exists, err := client.Exists(registryPrefix + id).Result()
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		return ErrSessionNotFound
+	}
+	data, _ := json.Marshal(registryKill{ID: id, Reason: reason})
+	return client.Publish(registryKillChannel, data).Err()
+}
+
+// registerApproval stores a pending approval of a local terminal in the
+// registry until it expires
+func registerApproval(a *Approval) {
+	if !registryEnabled() {
+		return
+	}
+	data, err := json.Marshal(a)
+	if err != nil {
+		return
+	}
+	if err := getRedisClient().Set(approvalPrefix+a.ID, data, time.Until(a.Expires)).Err(); err != nil {
+		log.Println("registerApproval err", err)
+	}
+}
+
+// unregisterApproval removes an approval that was answered or gave up
+func unregisterApproval(id string) {
+	if !registryEnabled() {
+		return
+	}
+	if err := getRedisClient().Del(approvalPrefix + id).Err(); err != nil {
+		log.Println("unregisterApproval err", err)
+	}
+}
+
+// registeredApprovals returns the pending approvals of all replicas
+func registeredApprovals() ([]Approval, error) {
+	values, err := registryValues(approvalPrefix)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Approval, 0, len(values))
+	for _, data := range values {
+		var a Approval
+		if err := json.Unmarshal([]byte(data), &a); err == nil {
+			list = append(list, a)
+		}
+	}
+	return list, nil
+}
+
+// answerRegisteredApproval answers an approval of any replica. The first
+// answer removes it from the registry, later ones don't find it
+func answerRegisteredApproval(id string, approver string, approved bool) error {
+	client := getRedisClient()
+	data, err := client.Get(approvalPrefix + id).Result()
+	if err == redis.Nil {
+		return ErrApprovalNotFound
+	} else if err != nil {
+		return err
+	}
+	var a Approval
+	if err := json.Unmarshal([]byte(data), &a); err != nil {
+		return ErrApprovalNotFound
+	}
+	if a.User == approver {
+		return ErrSelfApproval
+	}
+	deleted, err := client.Del(approvalPrefix + id).Result()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrApprovalNotFound
+	}
+	payload, _ := json.Marshal(registryAnswer{ID: id, Approver: approver, Approved: approved})
+	return client.Publish(registryAnswerChannel, payload).Err()
+}
@@ -0,0 +1,219 @@
+package terminal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// maxReplaySpeed bounds the speed of a replay, faster ones only flood the client
+const maxReplaySpeed = 16
+
+// errReplayClosed ends a replay whose client went away
+var errReplayClosed = errors.New("replay closed by the client")
+
+// ReplayMessage is a text frame of GET /api/v1/recordings/{id}/play. The
+// server starts with "start", sends the output in binary frames, "resize" when
+// the recorded terminal was resized and "end" once the recording was played.
+// Clients may send "pause", "resume" and "speed"
+type ReplayMessage struct {
+	Op string `json:"op"`
+	// Speed multiplies the pace of the recording, like 2 for twice as fast
+	Speed float64 `json:"speed,omitempty"`
+	Rows  uint16  `json:"rows,omitempty"`
+	Cols  uint16  `json:"cols,omitempty"`
+	// Time is the position in the recording in seconds
+	Time float64 `json:"time,omitempty"`
+}
+
+// replayer plays an asciicast recording to a websocket
+type replayer struct {
+	conn *websocket.Conn
+	// speed multiplies the pace, idleLimit caps the pauses between events in
+	// seconds of the recording if positive
+	speed     float64
+	idleLimit float64
+	paused    bool
+	controls  chan ReplayMessage
+	done      chan struct{}
+}
+
+// parseReplaySpeed validates the speed of a replay
+func parseReplaySpeed(s string) (float64, error) {
+	speed, err := strconv.ParseFloat(s, 64)
+	if err != nil || !validReplaySpeed(speed) {
+		return 0, fmt.Errorf("speed must be a number above 0 and up to %d", maxReplaySpeed)
+	}
+	return speed, nil
+}
+
+// validReplaySpeed reports whether speed is within 0 and maxReplaySpeed, NaN
+// compares false to both bounds so it is checked on its own
+func validReplaySpeed(speed float64) bool {
+	return !math.IsNaN(speed) && speed > 0 && speed <= maxReplaySpeed
+}
+
+// play sends recording, an asciicast v2 file, with the timing of its events
+func (p *replayer) play(recording io.Reader) error {
+	p.controls, p.done = make(chan ReplayMessage), make(chan struct{})
+	defer close(p.done)
+	go p.readControls()
+
+	reader := bufio.NewReader(recording)
+	header, err := reader.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	var size struct {
+		Width  uint16 `json:"width"`
+		Height uint16 `json:"height"`
+	}
+	if err := json.Unmarshal(header, &size); err != nil {
+		return fmt.Errorf("read asciicast header: %v", err)
+	}
+	if err := p.conn.WriteJSON(ReplayMessage{Op: "start", Speed: p.speed, Rows: size.Height, Cols: size.Width}); err != nil {
+		return err
+	}
+
+	var position float64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			at, kind, data, ok := parseReplayEvent(line)
+			if !ok {
+				continue
+			}
+			pause := at - position
+			if p.idleLimit > 0 && pause > p.idleLimit {
+				pause = p.idleLimit
+			}
+			if err := p.wait(pause); err == errReplayClosed {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			position = at
+			if err := p.send(kind, data); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	p.conn.WriteJSON(ReplayMessage{Op: "end", Time: position})
+	return p.conn.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
+
+// parseReplayEvent returns the time, code and data of an event line
+func parseReplayEvent(line []byte) (float64, string, string, bool) {
+	var event []json.RawMessage
+	if err := json.Unmarshal(line, &event); err != nil || len(event) < 3 {
+		return 0, "", "", false
+	}
+	var at float64
+	var kind, data string
+	if json.Unmarshal(event[0], &at) != nil || json.Unmarshal(event[1], &kind) != nil ||
+		json.Unmarshal(event[2], &data) != nil {
+		return 0, "", "", false
+	}
+	return at, kind, data, true
+}
+
+// send replays an event, only output and resizes are shown
+func (p *replayer) send(kind string, data string) error {
+	switch kind {
+	case "o":
+		return p.conn.WriteMessage(websocket.BinaryMessage, []byte(data))
+	case "r":
+		var cols, rows uint16
+		if _, err := fmt.Sscanf(data, "%dx%d", &cols, &rows); err != nil {
+			return nil
+		}
+		return p.conn.WriteJSON(ReplayMessage{Op: "resize", Rows: rows, Cols: cols})
+	}
+	return nil
+}
+
+// wait sleeps for d seconds of the recording at the current speed, applying
+// the controls the client sends meanwhile
+func (p *replayer) wait(d float64) error {
+	for d > 0 || p.paused {
+		if p.paused {
+			msg, ok := <-p.controls
+			if !ok {
+				return errReplayClosed
+			}
+			p.control(msg)
+			continue
+		}
+		started, speed := time.Now(), p.speed
+		timer := time.NewTimer(time.Duration(d / speed * float64(time.Second)))
+		select {
+		case <-timer.C:
+			return nil
+		case msg, ok := <-p.controls:
+			timer.Stop()
+			if !ok {
+				return errReplayClosed
+			}
+			d -= time.Since(started).Seconds() * speed
+			p.control(msg)
+		}
+	}
+	return nil
+}
+
+func (p *replayer) control(msg ReplayMessage) {
+	switch msg.Op {
+	case "pause":
+		p.paused = true
+	case "resume":
+		p.paused = false
+	case "speed":
+		if validReplaySpeed(msg.Speed) {
+			p.speed = msg.Speed
+		}
+	}
+}
+
+// readControls passes the messages of the client to wait until it closes the
+// websocket
+func (p *replayer) readControls() {
+	defer close(p.controls)
+	for {
+		messageType, data, err := p.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var msg ReplayMessage
+		if messageType != websocket.TextMessage || json.Unmarshal(data, &msg) != nil {
+			continue
+		}
+		select {
+		case p.controls <- msg:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// replayIdleLimit parses the cap of pauses in seconds, like asciinema's
+// idle_time_limit
+func replayIdleLimit(s string) (float64, error) {
+	limit, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(limit) || math.IsInf(limit, 0) || limit < 0 {
+		return 0, errors.New("idleLimit must be a number of seconds")
+	}
+	return limit, nil
+}
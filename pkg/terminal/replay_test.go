@@ -0,0 +1,25 @@
+package terminal
+
+import "testing"
+
+func TestParseReplaySpeed(t *testing.T) {
+	for s, valid := range map[string]bool{
+		"1": true, "0.5": true, "16": true,
+		"0": false, "-1": false, "17": false, "NaN": false, "Inf": false, "-Inf": false, "fast": false,
+	} {
+		if _, err := parseReplaySpeed(s); (err == nil) != valid {
+			t.Errorf("parseReplaySpeed(%q): %v, want valid %v", s, err, valid)
+		}
+	}
+}
+
+func TestReplayIdleLimit(t *testing.T) {
+	for s, valid := range map[string]bool{
+		"0": true, "2.5": true,
+		"-1": false, "NaN": false, "Inf": false, "+Inf": false, "": false,
+	} {
+		if _, err := replayIdleLimit(s); (err == nil) != valid {
+			t.Errorf("replayIdleLimit(%q): %v, want valid %v", s, err, valid)
+		}
+	}
+}
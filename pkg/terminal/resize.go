@@ -0,0 +1,33 @@
+package terminal
+
+import (
+	"time"
+
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// resizeDebounce coalesces the bursts of resize messages sent while a window is dragged
+const resizeDebounce = 50 * time.Millisecond
+
+// resize queues a new terminal size without blocking the client's reader
+// A size the shell didn't pick up yet is replaced, only the latest one matters
+func (t *TerminalSession) resize(rows uint16, cols uint16) {
+	if rows == 0 || cols == 0 || rows > maxTerminalSize || cols > maxTerminalSize {
+		return
+	}
+	size := remotecommand.TerminalSize{Width: cols, Height: rows}
+	t.sizeLock.Lock()
+	t.lastSize = size
+	t.sizeLock.Unlock()
+	for {
+		select {
+		case t.sizeChan <- size:
+			return
+		default:
+		}
+		select {
+		case <-t.sizeChan:
+		default:
+		}
+	}
+}
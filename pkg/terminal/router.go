@@ -0,0 +1,140 @@
+package terminal
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/urfave/negroni"
+)
+
+// Config configures the routes of NewRouter
+type Config struct {
+	// PathPrefix mounts the routes below a path of an existing service, like
+	// "/terminal". Empty serves them from the root
+	PathPrefix string
+	// Version, Commit and BuildDate are reported by /version
+	Version   string
+	Commit    string
+	BuildDate string
+}
+
+// Dependencies are what the handlers of NewRouter talk to
+type Dependencies struct {
+	// Kube is the cluster terminals are opened in, tests pass a fake
+	// clientset with NewKubeClientFor
+	Kube *KubeClient
+	// Executor runs the commands of sessions instead of -exec-backend if set,
+	// see SetExecutor
+	Executor Executor
+	// Auth identifies the users of requests, Authenticate running the chain of
+	// -auth if nil. Custom middlewares pass the user on with WithClaims
+	Auth negroni.Handler
+	// Metrics is served on /metrics if set
+	Metrics http.Handler
+}
+
+// NewRouter returns the HTTP and websocket API of the terminal server, with
+// its forwarded headers, access log, tracing, CORS, replica routing and auth
+// middlewares
+func NewRouter(cfg Config, deps Dependencies) http.Handler {
+	cfg.PathPrefix = strings.TrimRight(cfg.PathPrefix, "/")
+	if deps.Executor != nil {
+		SetExecutor(deps.Executor)
+	}
+	auth := deps.Auth
+	if auth == nil {
+		auth = negroni.HandlerFunc(Authenticate)
+	}
+	a := &api{cfg: cfg, kube: deps.Kube}
+
+	router := mux.NewRouter()
+	router.Use(RecordRoute)
+	router.HandleFunc("/", HomeHandler).Methods("GET")
+	if *uiEnabled {
+		router.HandleFunc("/ui", UIRedirectHandler).Methods("GET")
+		router.HandleFunc("/ui/config.js", a.UIConfigHandler).Methods("GET")
+		router.PathPrefix("/ui/").Handler(UIHandler()).Methods("GET", "HEAD")
+	}
+	if deps.Metrics != nil {
+		router.Handle("/metrics", deps.Metrics).Methods("GET")
+	}
+	router.HandleFunc("/.well-known/terminal-server.json", a.DiscoveryHandler).Methods("GET")
+	router.HandleFunc("/version", a.VersionHandler).Methods("GET")
+	router.HandleFunc("/auth/login", a.OIDCLoginHandler).Methods("GET")
+	router.HandleFunc("/auth/callback", a.OIDCCallbackHandler).Methods("GET")
+	router.HandleFunc("/auth/refresh", OIDCRefreshHandler).Methods("POST")
+	router.HandleFunc("/api/v1/namespaces", a.NamespacesHandler).Methods("GET")
+	router.HandleFunc("/api/v1/pods/{namespace}/{label}", a.GetPodHandler).Methods("GET")
+	router.HandleFunc("/api/v1/fs/{namespace}/{pod}/{container}", a.FSHandler).Methods("GET")
+	router.HandleFunc("/api/v1/watch/pods/{namespace}", a.WatchPodsHandler).Methods("GET")
+	router.HandleFunc("/api/v1/workloads/{namespace}", a.WorkloadsHandler).Methods("GET")
+	router.HandleFunc("/api/v1/workloads/{namespace}/{kind}/{name}/pods", a.WorkloadPodsHandler).Methods("GET")
+	router.HandleFunc("/api/v1/terminals/presign", a.PresignHandler).Methods("POST")
+	router.HandleFunc("/api/v1/terminals/{namespace}/by-label/{selector}", a.TerminalByLabelHandler)
+	router.HandleFunc("/api/v1/terminals/{namespace}/{pod}/{container}", a.TerminalHandler)
+	router.HandleFunc("/api/v1/terminals/{namespace}/{pod}", a.TerminalHandler)
+	router.HandleFunc("/api/v1/portforward/{namespace}/{pod}/{port}", a.PortForwardHandler)
+	router.HandleFunc("/api/v1/mux/{namespace}/{pod}", a.MuxHandler)
+	router.HandleFunc("/api/v1/jobs/{namespace}/{cronjob}/debug", a.DebugCronJobHandler).Methods("POST")
+	router.HandleFunc("/api/v1/debug-pods/{namespace}", a.CreateDebugPodHandler).Methods("POST")
+	router.HandleFunc("/api/v1/sessions/{sessionId}/join", JoinSessionHandler)
+	router.HandleFunc("/api/v1/sessions/{sessionId}/support", PairSessionHandler)
+	router.HandleFunc("/api/v1/sessions/{sessionId}/stats", SessionStatsHandler).Methods("GET")
+	router.HandleFunc("/api/v1/groups", CreateGroupHandler).Methods("POST")
+	router.HandleFunc("/api/v1/groups/{groupId}", GroupHandler).Methods("GET")
+	router.HandleFunc("/api/v1/groups/{groupId}", DeleteGroupHandler).Methods("DELETE")
+	router.HandleFunc("/api/v1/recordings", RecordingsHandler).Methods("GET")
+	router.HandleFunc("/api/v1/recordings/diff", RecordingDiffHandler).Methods("GET")
+	router.HandleFunc("/api/v1/recordings/{id}", RecordingHandler).Methods("GET")
+	router.HandleFunc("/api/v1/recordings/{id}", DeleteRecordingHandler).Methods("DELETE")
+	router.HandleFunc("/api/v1/recordings/{id}/restore", RestoreRecordingHandler).Methods("POST")
+	router.HandleFunc("/api/v1/recordings/{id}/play", PlayRecordingHandler).Methods("GET")
+	router.HandleFunc("/api/v1/uploads", a.CreateUploadHandler).Methods("POST")
+	router.HandleFunc("/api/v1/uploads/{id}", a.UploadHandler).Methods("HEAD", "GET", "PATCH")
+	router.HandleFunc("/api/v1/admin/sessions", AdminSessionsHandler).Methods("GET")
+	router.HandleFunc("/api/v1/admin/sessions/{sessionId}", AdminKillSessionHandler).Methods("DELETE")
+	router.HandleFunc("/api/v1/admin/sessions/{sessionId}/debug", AdminSessionDebugHandler).Methods("GET")
+	router.HandleFunc("/api/v1/admin/heatmap", AdminHeatmapHandler).Methods("GET")
+	router.HandleFunc("/api/v1/admin/jobs", AdminJobsHandler).Methods("GET")
+	router.HandleFunc("/api/v1/admin/approvals", AdminApprovalsHandler).Methods("GET")
+	router.HandleFunc("/api/v1/admin/approvals/{id}/{answer:approve|deny}", AdminAnswerApprovalHandler).Methods("POST")
+	router.HandleFunc("/api/v1/approvals/slack", SlackApprovalHandler).Methods("POST")
+	router.HandleFunc("/api/v1/internal/state", StateHandler).Methods("GET")
+
+	chain := negroni.New()
+	chain.Use(negroni.HandlerFunc(TraceRequests))
+	chain.Use(negroni.HandlerFunc(CORS))
+	chain.Use(negroni.HandlerFunc(RouteToReplica))
+	chain.Use(auth)
+	chain.UseHandler(router)
+
+	// the access log sees the paths with the prefix the client sent
+	n := negroni.New()
+	n.Use(negroni.HandlerFunc(Forwarded))
+	n.Use(negroni.HandlerFunc(AccessLog))
+	if cfg.PathPrefix == "" {
+		n.UseHandler(chain)
+	} else {
+		n.UseHandler(stripPrefix(cfg.PathPrefix, chain))
+	}
+	return n
+}
+
+// stripPrefix serves the requests below prefix with the paths the routes
+// expect, others are not found
+func stripPrefix(prefix string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, prefix)
+		if len(path) == len(r.URL.Path) || path != "" && path[0] != '/' {
+			http.NotFound(w, r)
+			return
+		}
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = "/" + strings.TrimPrefix(path, "/")
+		if r.URL.RawPath != "" {
+			r2.URL.RawPath = "/" + strings.TrimPrefix(strings.TrimPrefix(r.URL.RawPath, prefix), "/")
+		}
+		next.ServeHTTP(w, r2)
+	})
+}
@@ -0,0 +1,124 @@
+package terminal
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var (
+	routingKey = Flags.String("routing-key", "",
+		"secret shared by the replicas to sign the route tokens of sessions, routing is off if empty")
+	advertiseURL = Flags.String("advertise-url", "",
+		"URL other replicas reach this one at, like http://10.0.3.7:8000, required with -routing-key")
+)
+
+// RouteHeader carries the route token of a session, clients that can't set
+// headers, like browser websockets, use the route query parameter
+const RouteHeader = "X-Terminal-Route"
+
+// routedHeader marks requests proxied to another replica, they are never
+// proxied again
+const routedHeader = "X-Terminal-Routed"
+
+// ErrInvalidRoute is returned for route tokens that weren't signed by a replica
+var ErrInvalidRoute = errors.New("invalid route token")
+
+// sessionPath matches the endpoints of a running session
+var sessionPath = regexp.MustCompile(`^/api/v1/(?:admin/)?sessions/([^/]+)`)
+
+var replicaURL *url.URL
+
+// SetupRouting checks the routing configuration, it is called on startup
+func SetupRouting() error {
+	if *routingKey == "" {
+		return nil
+	}
+	if *advertiseURL == "" {
+		return errors.New("-advertise-url is required with -routing-key")
+	}
+	u, err := url.Parse(*advertiseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("-advertise-url must be an http or https URL")
+	}
+	replicaURL = u
+	return nil
+}
+
+func routeSignature(sessionId string, replica string) []byte {
+	mac := hmac.New(sha256.New, []byte(*routingKey))
+	mac.Write([]byte(sessionId + "\n" + replica))
+	return mac.Sum(nil)
+}
+
+// routeToken returns the token routing requests of a session to this replica,
+// "" if routing is off. It is bound to the session, so it can't send other
+// requests anywhere
+func routeToken(sessionId string) string {
+	if replicaURL == nil {
+		return ""
+	}
+	replica := replicaURL.String()
+	return base64.RawURLEncoding.EncodeToString([]byte(replica)) + "." +
+		base64.RawURLEncoding.EncodeToString(routeSignature(sessionId, replica))
+}
+
+// parseRouteToken returns the replica of a route token of sessionId
+func parseRouteToken(sessionId string, token string) (*url.URL, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return nil, ErrInvalidRoute
+	}
+	replica, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidRoute
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, routeSignature(sessionId, string(replica))) {
+		return nil, ErrInvalidRoute
+	}
+	return url.Parse(string(replica))
+}
+
+// RouteToReplica proxies the requests of a session owned by another replica,
+// like joins and admin kills, to it. Sessions are found by their route token,
+// which clients got in the capabilities message and admins in the session
+// list. Websocket upgrades are proxied as well
+func RouteToReplica(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	token := r.Header.Get(RouteHeader)
+	if token == "" {
+		token = r.URL.Query().Get("route")
+	}
+	match := sessionPath.FindStringSubmatch(r.URL.Path)
+	if replicaURL == nil || token == "" || match == nil || r.Header.Get(routedHeader) != "" {
+		next(w, r)
+		return
+	}
+	target, err := parseRouteToken(match[1], token)
+	if err != nil {
+		WriteError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if target.String() == replicaURL.String() || getSession(match[1]) != nil {
+		next(w, r)
+		return
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		req.Header.Set(routedHeader, replicaURL.String())
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Println("RouteToReplica err", err)
+		WriteError(w, "the replica of the session is not reachable", http.StatusBadGateway)
+	}
+	proxy.ServeHTTP(w, r)
+}
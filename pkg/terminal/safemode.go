@@ -0,0 +1,60 @@
+package terminal
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	safeModeRoles = Flags.String("safe-mode-roles", RoleRestricted,
+		"comma separated token roles whose terminals run in a restricted shell")
+	safeModeShell = Flags.String("safe-mode-shell", "rbash",
+		"restricted shell, or wrapper starting one, used for safe mode terminals")
+	safeModePath = Flags.String("safe-mode-path", "/opt/safe-mode/bin",
+		"PATH of safe mode terminals, directories in the containers holding only the approved commands and the shell")
+)
+
+// systemBinDirs hold shells and interpreters that leave the restricted shell,
+// like bash, env or python, so they must not be in -safe-mode-path
+var systemBinDirs = []string{"/bin", "/sbin", "/usr/bin", "/usr/sbin", "/usr/local/bin", "/usr/local/sbin"}
+
+// ValidateSafeMode refuses safe mode without a dedicated allowlist of commands
+func ValidateSafeMode() error {
+	if *safeModeRoles == "" {
+		return nil
+	}
+	if strings.TrimSpace(*safeModePath) == "" {
+		return errors.New("-safe-mode-path must name the directories of the approved commands, or -safe-mode-roles be empty")
+	}
+	for _, dir := range strings.Split(*safeModePath, ":") {
+		if !filepath.IsAbs(dir) {
+			return fmt.Errorf("-safe-mode-path entry %q must be an absolute path", dir)
+		}
+		if containsString(systemBinDirs, filepath.Clean(dir)) {
+			return fmt.Errorf("-safe-mode-path must not contain %s, its shells and interpreters leave the restricted shell", dir)
+		}
+	}
+	return nil
+}
+
+// IsSafeModeRole reports whether terminals opened with role run in safe mode
+func IsSafeModeRole(role string) bool {
+	return containsString(splitList(*safeModeRoles), role)
+}
+
+// safeModeCommand starts the restricted shell with the configured PATH. rbash
+// refuses to change PATH, run commands containing a slash and redirect output,
+// and skips the startup files that could loosen the environment before the
+// restrictions apply. The bootstrap script still runs unrestricted beforehand
+func safeModeCommand(shell string, script string) []string {
+	args := []string{shell}
+	if filepath.Base(shell) == "rbash" {
+		args = append(args, "--noprofile", "--norc")
+	}
+	if script == "" {
+		return append([]string{"env", "PATH=" + *safeModePath}, args...)
+	}
+	return append([]string{"sh", "-c", script + "\nexec env \"PATH=$0\" \"$@\"", *safeModePath}, args...)
+}
@@ -0,0 +1,215 @@
+package terminal
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	maxSessions = Flags.Int("max-sessions", 0,
+		"maximum number of running terminals, further terminals wait in a queue, 0 for no limit")
+	sessionQueueSize    = Flags.Int("session-queue-size", 50, "maximum number of terminals waiting for a slot")
+	sessionQueueTimeout = Flags.Duration("session-queue-timeout", 2*time.Minute,
+		"how long a terminal waits for a slot before it is refused")
+	sessionRoleWeights = Flags.String("session-role-weights", "admin=2",
+		"comma separated role=weight shares of the session slots, roles not listed weigh 1")
+)
+
+var (
+	ErrSessionQueueFull    = errors.New("too many terminals are waiting for a free slot")
+	ErrSessionQueueTimeout = errors.New("timed out waiting for a free terminal slot")
+)
+
+// slotWaiter is a terminal waiting for a session slot
+type slotWaiter struct {
+	user      string
+	namespace string
+	weight    float64
+	arrived   time.Time
+	granted   bool
+	ready     chan struct{}
+	// positions carries the latest queue position, older ones are dropped
+	positions chan int
+}
+
+// slotScheduler hands out session slots. While all slots are taken, waiting
+// terminals are ordered by the running sessions of their user, divided by
+// the weight of their role, then by those of their namespace, then by
+// arrival, so one busy user or namespace can't starve the others
+type slotScheduler struct {
+	lock        sync.Mutex
+	running     int
+	byUser      map[string]int
+	byNamespace map[string]int
+	waiting     []*slotWaiter
+}
+
+var scheduler = &slotScheduler{
+	byUser:      map[string]int{},
+	byNamespace: map[string]int{},
+}
+
+// roleWeight returns the share of a role from -session-role-weights
+func roleWeight(role string) float64 {
+	for _, pair := range strings.Split(*sessionRoleWeights, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 || parts[0] != role {
+			continue
+		}
+		if w, err := strconv.ParseFloat(parts[1], 64); err == nil && w > 0 {
+			return w
+		}
+	}
+	return 1
+}
+
+// SessionQueueFull reports whether a new terminal would be refused right away
+func SessionQueueFull() bool {
+	s := scheduler
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return *maxSessions > 0 && s.running >= *maxSessions && len(s.waiting) >= *sessionQueueSize
+}
+
+// acquireSlot waits until the terminal may start. notify is called with the
+// queue position while waiting. The returned func frees the slot
+func (s *slotScheduler) acquireSlot(ctx context.Context, user string, namespace string, role string,
+	notify func(position int)) (func(), error) {
+
+	w := &slotWaiter{
+		user:      user,
+		namespace: namespace,
+		weight:    roleWeight(role),
+		arrived:   time.Now(),
+		ready:     make(chan struct{}),
+		positions: make(chan int, 1),
+	}
+	release := func() { s.release(w) }
+
+	s.lock.Lock()
+	if *maxSessions <= 0 || (s.running < *maxSessions && len(s.waiting) == 0) {
+		s.take(w)
+		s.lock.Unlock()
+		return release, nil
+	}
+	if len(s.waiting) >= *sessionQueueSize {
+		s.lock.Unlock()
+		return nil, ErrSessionQueueFull
+	}
+	s.waiting = append(s.waiting, w)
+	queuedSessions.Set(float64(len(s.waiting)))
+	s.dispatch()
+	s.lock.Unlock()
+
+	timeout := time.NewTimer(*sessionQueueTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case <-w.ready:
+			return release, nil
+		case position := <-w.positions:
+			notify(position)
+		case <-timeout.C:
+			return nil, s.abandon(w, ErrSessionQueueTimeout)
+		case <-ctx.Done():
+			return nil, s.abandon(w, ctx.Err())
+		}
+	}
+}
+
+// abandon removes a waiter that gave up. A slot granted in the meantime is
+// handed on
+func (s *slotScheduler) abandon(w *slotWaiter, err error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if w.granted {
+		s.free(w)
+	} else {
+		s.remove(w)
+	}
+	s.dispatch()
+	return err
+}
+
+func (s *slotScheduler) release(w *slotWaiter) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.free(w)
+	s.dispatch()
+}
+
+func (s *slotScheduler) take(w *slotWaiter) {
+	w.granted = true
+	s.running++
+	s.byUser[w.user]++
+	s.byNamespace[w.namespace]++
+}
+
+func (s *slotScheduler) free(w *slotWaiter) {
+	s.running--
+	if s.byUser[w.user]--; s.byUser[w.user] <= 0 {
+		delete(s.byUser, w.user)
+	}
+	if s.byNamespace[w.namespace]--; s.byNamespace[w.namespace] <= 0 {
+		delete(s.byNamespace, w.namespace)
+	}
+}
+
+func (s *slotScheduler) remove(w *slotWaiter) {
+	for i, waiting := range s.waiting {
+		if waiting == w {
+			s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+			break
+		}
+	}
+	queuedSessions.Set(float64(len(s.waiting)))
+}
+
+// dispatch grants free slots in fair order and tells the remaining waiters
+// their position, the caller holds the lock
+func (s *slotScheduler) dispatch() {
+	for len(s.waiting) > 0 && (*maxSessions <= 0 || s.running < *maxSessions) {
+		// every grant changes the shares of the others
+		s.sortWaiting()
+		w := s.waiting[0]
+		s.remove(w)
+		s.take(w)
+		close(w.ready)
+	}
+	s.sortWaiting()
+	for i, w := range s.waiting {
+		select {
+		case <-w.positions:
+		default:
+		}
+		w.positions <- i + 1
+	}
+}
+
+func (s *slotScheduler) sortWaiting() {
+	sort.SliceStable(s.waiting, func(i, j int) bool {
+		a, b := s.waiting[i], s.waiting[j]
+		shareA := float64(s.byUser[a.user]) / a.weight
+		shareB := float64(s.byUser[b.user]) / b.weight
+		if shareA != shareB {
+			return shareA < shareB
+		}
+		if s.byNamespace[a.namespace] != s.byNamespace[b.namespace] {
+			return s.byNamespace[a.namespace] < s.byNamespace[b.namespace]
+		}
+		return a.arrived.Before(b.arrived)
+	})
+}
+
+// sendQueuePosition tells the clients where the terminal is in the queue
+func (t *TerminalSession) sendQueuePosition(position int) {
+	msg := TerminalMessage{Op: "queued", Position: position}
+	for _, c := range t.attachedClients() {
+		c.writeJSON(msg)
+	}
+}
@@ -0,0 +1,111 @@
+package terminal
+
+import (
+	"time"
+)
+
+// SessionMeta describes who opened a session against which container
+type SessionMeta struct {
+	User      string    `json:"user"`
+	Role      string    `json:"role,omitempty"`
+	Namespace string    `json:"namespace"`
+	Pod       string    `json:"pod"`
+	Container string    `json:"container"`
+	Started   time.Time `json:"started"`
+	// SafeMode sessions run in a restricted shell, see -safe-mode-roles
+	SafeMode bool `json:"safeMode,omitempty"`
+	// ReadOnly sessions discard the owner's input, so the output can be
+	// watched without typing into the shell
+	ReadOnly bool `json:"readOnly,omitempty"`
+	// Group is the SessionGroup the session belongs to, if any
+	Group string `json:"group,omitempty"`
+	// Encoding of the shell's output and input if it isn't UTF-8, see LookupEncoding
+	Encoding string `json:"encoding,omitempty"`
+	// Selector is the label selector of a session opened by label, its shell
+	// moves to another matching pod when its pod dies, see -failover-attempts
+	Selector string `json:"selector,omitempty"`
+	// NoTTY sessions run the shell without a terminal, stdin and stdout pass
+	// through as is and stderr is sent apart, see ParseTTY
+	NoTTY bool `json:"noTty,omitempty"`
+	// OS is "windows" for shells in Windows containers, see detectOS
+	OS string `json:"os,omitempty"`
+	// Env is exported into the shell, see ParseSessionEnv
+	Env map[string]string `json:"env,omitempty"`
+	// Reason and Tags tell why the session was opened, see ParseSessionPurpose
+	Reason string            `json:"reason,omitempty"`
+	Tags   map[string]string `json:"tags,omitempty"`
+	// TokenExpiresAt is the unix time the owner's token expires, the session
+	// ends then unless the owner refreshed it, see watchTokenExpiry
+	TokenExpiresAt int64 `json:"tokenExpiresAt,omitempty"`
+	// Remote is the IP address of the client that opened the session, see
+	// -trusted-proxies
+	Remote string `json:"remote,omitempty"`
+	// Claims of the token that opened the session, passed on to OPA
+	Claims *MyCustomClaims `json:"-"`
+	// Environment is captured at session start with -capture-environment
+	Environment *EnvironmentCapture `json:"environment,omitempty"`
+}
+
+// SessionInfo is the admin view of a running session
+type SessionInfo struct {
+	ID string `json:"id"`
+	// Route is the route token of the session, see RouteToReplica
+	Route string `json:"route,omitempty"`
+	// Replica runs the session, see -session-registry
+	Replica string `json:"replica,omitempty"`
+	SessionMeta
+	Clients []ClientInfo `json:"clients"`
+}
+
+// ClientInfo is the admin view of a client attached to a session
+type ClientInfo struct {
+	ReadOnly bool `json:"readOnly"`
+	// LatencyMs is the last heartbeat round-trip time, 0 until the client answered one
+	LatencyMs float64 `json:"latencyMs"`
+}
+
+func (t *TerminalSession) info() SessionInfo {
+	t.clientsLock.Lock()
+	meta := t.meta
+	t.clientsLock.Unlock()
+	info := SessionInfo{ID: t.id, Route: routeToken(t.id), Replica: replicaName(), SessionMeta: meta}
+	for _, c := range t.attachedClients() {
+		info.Clients = append(info.Clients, ClientInfo{
+			ReadOnly:  c.readOnly,
+			LatencyMs: c.latencyMillis(),
+		})
+	}
+	return info
+}
+
+// SessionManager controls the sessions of the server, for admin APIs and
+// services embedding the package
+type SessionManager interface {
+	// List describes the running sessions, see ListSessions
+	List() []SessionInfo
+	// Stats returns the stats of a live session of this replica
+	Stats(sessionId string) (*SessionStats, error)
+	// Kill ends a session, reason is shown to its clients
+	Kill(sessionId string, reason string) error
+	// Close ends all sessions of this replica and waits up to timeout
+	Close(reason string, timeout time.Duration)
+}
+
+// Sessions is the SessionManager of the sessions this process serves
+var Sessions SessionManager = processSessions{}
+
+type processSessions struct{}
+
+func (processSessions) List() []SessionInfo { return ListSessions() }
+
+func (processSessions) Stats(sessionId string) (*SessionStats, error) {
+	return GetSessionStats(sessionId)
+}
+
+func (processSessions) Kill(sessionId string, reason string) error {
+	return KillSession(sessionId, reason)
+}
+
+func (processSessions) Close(reason string, timeout time.Duration) {
+	CloseSessions(reason, timeout)
+}
@@ -0,0 +1,116 @@
+package terminal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+var detectShell = Flags.Bool("detect-shell", true,
+	"probe a container once per image for bash, instead of trying bash and then sh in every session")
+
+// shellProbeTimeout bounds the exec probing for the shell
+const shellProbeTimeout = 10 * time.Second
+
+// shellProbeCommand prints the best shell of a container
+const shellProbeCommand = `command -v bash >/dev/null 2>&1 && echo bash || echo sh`
+
+// maxShellCacheEntries bounds the images detected shells are remembered for
+const maxShellCacheEntries = 1000
+
+// ErrNoShell is returned for containers without a shell, like distroless images
+var ErrNoShell = errors.New("no shell found in the container")
+
+var (
+	shellCacheLock sync.Mutex
+	shellCache     = make(map[string]string)
+)
+
+// containerImage returns the image id of a container, which detected shells
+// are cached by, or "" if it isn't known
+func containerImage(p *v1.Pod, container string) string {
+	for _, status := range p.Status.ContainerStatuses {
+		if status.Name == container && status.ImageID != "" {
+			return status.ImageID
+		}
+	}
+	for _, c := range p.Spec.Containers {
+		if c.Name == container {
+			return c.Image
+		}
+	}
+	return ""
+}
+
+// detectShells returns the shells to try in order. A shell configured for
+// the pod or its namespace comes first, Windows containers then get
+// windowsShells. Else the container is probed once per image, so sessions
+// don't start with a failed exec of bash in images that only have sh. If the
+// probe fails for other reasons than a missing shell, bash and then sh are
+// tried like without detection
+func (t *TerminalSession) detectShells() ([]string, error) {
+	fallback := []string{"bash", "sh"}
+	image := ""
+	if !DockerBackend() {
+		configured := ""
+		p, err := t.kube.getPod(t.ctx, t.meta.Namespace, t.meta.Pod)
+		if err == nil {
+			configured = t.kube.terminalDefaults(t.ctx, p).Shell
+			image = containerImage(p, t.meta.Container)
+		}
+		if t.windows() {
+			// Windows containers have no sh to probe with
+			return windowsDefaultShells(configured), nil
+		}
+		if shells := defaultShells(configured); shells != nil {
+			return shells, nil
+		}
+	}
+	if !*detectShell {
+		return fallback, nil
+	}
+	shellCacheLock.Lock()
+	shell, ok := shellCache[image]
+	shellCacheLock.Unlock()
+	if ok && image != "" {
+		return shellsFrom(shell), nil
+	}
+
+	ctx, cancel := context.WithTimeout(t.ctx, shellProbeTimeout)
+	defer cancel()
+	var stdout bytes.Buffer
+	err := t.exec.ExecCommand(ctx, t.meta.Container, t.meta.Pod, t.meta.Namespace,
+		[]string{"sh", "-c", shellProbeCommand}, nil, &stdout, nil)
+	if err != nil {
+		if classifyExecError(err) == ExecErrNoShell {
+			return nil, ErrNoShell
+		}
+		log.Printf("session %s: shell probe err %v", t.id, err)
+		return fallback, nil
+	}
+	shell = strings.TrimSpace(stdout.String())
+	if image != "" {
+		shellCacheLock.Lock()
+		if len(shellCache) >= maxShellCacheEntries {
+			shellCache = make(map[string]string)
+		}
+		shellCache[image] = shell
+		shellCacheLock.Unlock()
+	}
+	return shellsFrom(shell), nil
+}
+
+// shellsFrom returns the shells to try for a detected one, sh stays the
+// fallback of bash for command policies that don't allow bash
+func shellsFrom(shell string) []string {
+	if shell == "bash" {
+		return []string{"bash", "sh"}
+	}
+	return []string{"sh"}
+}
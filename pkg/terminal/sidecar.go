@@ -0,0 +1,61 @@
+package terminal
+
+import (
+	"context"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+var (
+	sidecarNames = Flags.String("sidecar-containers",
+		"istio-proxy,istio-init,linkerd-proxy,envoy,vault-agent,cloud-sql-proxy,fluent-bit",
+		"comma separated container names never picked automatically")
+	sidecarImages = Flags.String("sidecar-images",
+		"istio/proxyv2,linkerd2-proxy,envoyproxy/envoy,hashicorp/vault,cloudsql-proxy,fluent-bit",
+		"comma separated image name fragments of containers never picked automatically")
+)
+
+// IsAutoContainer reports whether the container should be chosen by the server
+func IsAutoContainer(container string) bool {
+	return container == "" || container == "auto"
+}
+
+// ResolveContainer returns the default container of a pod, or its first
+// non-sidecar container
+func (k *KubeClient) ResolveContainer(ctx context.Context, namespace string, pod string) (string, error) {
+	p, err := k.getPod(ctx, namespace, pod)
+	if err != nil {
+		return "", err
+	}
+	return pickContainer(p, k.terminalDefaults(ctx, p).Container), nil
+}
+
+// pickContainer returns the preferred container if the pod has it, else the
+// first container that is not a known sidecar, or the first container if all
+// of them look like sidecars
+func pickContainer(pod *v1.Pod, preferred string) string {
+	for _, c := range pod.Spec.Containers {
+		if preferred != "" && c.Name == preferred {
+			return c.Name
+		}
+	}
+	names := splitList(*sidecarNames)
+	images := splitList(*sidecarImages)
+	for _, c := range pod.Spec.Containers {
+		if containsString(names, c.Name) {
+			continue
+		}
+		sidecar := false
+		for _, image := range images {
+			if strings.Contains(c.Image, image) {
+				sidecar = true
+				break
+			}
+		}
+		if !sidecar {
+			return c.Name
+		}
+	}
+	return pod.Spec.Containers[0].Name
+}
@@ -0,0 +1,529 @@
+package terminal
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	sshListenAddr = Flags.String("ssh-listen", "",
+		"address of the SSH gateway to pods like :2222, it is off if empty")
+	sshHostKeyFile = Flags.String("ssh-host-key", "ssh_host_ed25519_key",
+		"private host key of the SSH gateway, an ed25519 key is generated if the file doesn't exist")
+	sshAuthorizedKeys = Flags.String("ssh-authorized-keys", "",
+		`authorized_keys file of the SSH gateway, the comment of each key is "user role"`)
+)
+
+// sshClaimsExtension carries the claims of an authenticated SSH connection
+const sshClaimsExtension = "claims"
+
+// sshTarget is the container of an SSH session and the command to run in it,
+// an empty command opens an interactive shell
+type sshTarget struct {
+	namespace string
+	pod       string
+	container string
+	command   string
+}
+
+// parseSSHTarget reads "namespace/pod[/container] [command]" from the command
+// of an SSH session, or the target from the user name and the whole command
+// from the session, so scp and rsync work with "ssh namespace/pod@host"
+func parseSSHTarget(user string, command string) (*sshTarget, error) {
+	spec, rest := strings.TrimSpace(command), ""
+	if i := strings.IndexAny(spec, " \t"); i >= 0 {
+		spec, rest = spec[:i], strings.TrimSpace(spec[i:])
+	}
+	if !strings.Contains(spec, "/") {
+		spec, rest = user, strings.TrimSpace(command)
+	}
+	rest = strings.TrimSpace(strings.TrimPrefix(rest, "--"))
+	parts := strings.Split(spec, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return nil, errors.New("usage: ssh -p 2222 user@host namespace/pod[/container] [command]")
+	}
+	target := &sshTarget{namespace: parts[0], pod: parts[1], command: rest}
+	if len(parts) == 3 {
+		target.container = parts[2]
+	}
+	return target, nil
+}
+
+// StartSSH serves the SSH gateway on -ssh-listen. Users authenticate with a
+// token or API key as password, or a key of -ssh-authorized-keys
+func StartSSH(kube *KubeClient) (func(), error) {
+	if *sshListenAddr == "" {
+		return func() {}, nil
+	}
+	hostKey, err := loadSSHHostKey(*sshHostKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := loadSSHAuthorizedKeys(*sshAuthorizedKeys)
+	if err != nil {
+		return nil, err
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			return sshPermissions(authenticateSSHPassword(string(password)))
+		},
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			claims, ok := keys[string(key.Marshal())]
+			if !ok {
+				return nil, errors.New("unknown public key")
+			}
+			copied := *claims
+			return sshPermissions(&copied, nil)
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", *sshListenAddr)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Start SSH gateway on", *sshListenAddr)
+	gateway := &sshGateway{kube: kube, config: config}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Println("SSH gateway err", err)
+				return
+			}
+			go gateway.serve(conn)
+		}
+	}()
+	return func() { listener.Close() }, nil
+}
+
+func loadSSHHostKey(path string) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		block, err := ssh.MarshalPrivateKey(key, "k8s-terminal-server")
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(block)
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			return nil, err
+		}
+		log.Println("generated SSH host key", path)
+	} else if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(data)
+}
+
+func loadSSHAuthorizedKeys(path string) (map[string]*MyCustomClaims, error) {
+	keys := map[string]*MyCustomClaims{}
+	if path == "" {
+		return keys, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for len(data) > 0 {
+		key, comment, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			break
+		}
+		data = rest
+		fields := strings.Fields(comment)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("authorized key %s needs a user as comment", ssh.FingerprintSHA256(key))
+		}
+		claims := &MyCustomClaims{}
+		claims.Subject = fields[0]
+		if len(fields) > 1 {
+			claims.Role = fields[1]
+		}
+		keys[string(key.Marshal())] = claims
+	}
+	return keys, nil
+}
+
+// authenticateSSHPassword takes the password as JWT, then as API key
+func authenticateSSHPassword(password string) (*MyCustomClaims, error) {
+	claims, err := authenticateHeader(context.Background(), http.Header{"Authorization": {"Bearer " + password}})
+	if err == nil {
+		return claims, nil
+	}
+	return authenticateHeader(context.Background(), http.Header{"X-Api-Key": {password}})
+}
+
+func sshPermissions(claims *MyCustomClaims, err error) (*ssh.Permissions, error) {
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return nil, err
+	}
+	return &ssh.Permissions{Extensions: map[string]string{sshClaimsExtension: string(data)}}, nil
+}
+
+type sshGateway struct {
+	kube   *KubeClient
+	config *ssh.ServerConfig
+}
+
+func (g *sshGateway) serve(nc net.Conn) {
+	nc.SetDeadline(time.Now().Add(handshakeTimeout))
+	conn, channels, requests, err := ssh.NewServerConn(nc, g.config)
+	if err != nil {
+		nc.Close()
+		return
+	}
+	nc.SetDeadline(time.Time{})
+	defer conn.Close()
+	go ssh.DiscardRequests(requests)
+	// commands and terminals of the connection end with it
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var claims MyCustomClaims
+	if err := json.Unmarshal([]byte(conn.Permissions.Extensions[sshClaimsExtension]), &claims); err != nil {
+		return
+	}
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only session channels are supported")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go g.session(ctx, conn.User(), &claims, channel, channelRequests)
+	}
+}
+
+// session waits for the pty, shell and exec requests of a channel and runs
+// the terminal they ask for
+func (g *sshGateway) session(ctx context.Context, user string, claims *MyCustomClaims, channel ssh.Channel,
+	requests <-chan *ssh.Request) {
+
+	conn := &sshConn{channel: channel, frames: make(chan sshFrame, 16), closed: make(chan struct{})}
+	for req := range requests {
+		switch req.Type {
+		case "pty-req":
+			conn.rows, conn.cols = parsePtyRequest(req.Payload)
+			conn.pty = true
+			req.Reply(true, nil)
+		case "env":
+			// like AcceptEnv of sshd, variables beyond -allowed-env are refused
+			var payload struct{ Name, Value string }
+			ssh.Unmarshal(req.Payload, &payload)
+			env, err := ParseSessionEnv([]string{payload.Name + "=" + payload.Value})
+			if err == nil {
+				if conn.env == nil {
+					conn.env = make(map[string]string)
+				}
+				conn.env[payload.Name] = env[payload.Name]
+			}
+			req.Reply(err == nil, nil)
+		case "shell", "exec":
+			command := ""
+			if req.Type == "exec" {
+				var payload struct{ Command string }
+				ssh.Unmarshal(req.Payload, &payload)
+				command = payload.Command
+			}
+			req.Reply(true, nil)
+			ctx, cancel := context.WithCancel(ctx)
+			go func() {
+				// the requests end when the client closed the channel
+				defer cancel()
+				for req := range requests {
+					if req.Type == "window-change" {
+						rows, cols := parseWindowChange(req.Payload)
+						conn.pushResize(rows, cols)
+					}
+					if req.WantReply {
+						req.Reply(false, nil)
+					}
+				}
+			}()
+			g.run(ctx, user, claims, command, conn)
+			return
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+	channel.Close()
+}
+
+// run starts the terminal or command of a session and ends the channel with
+// its exit status
+func (g *sshGateway) run(ctx context.Context, user string, claims *MyCustomClaims, command string, conn *sshConn) {
+	target, err := parseSSHTarget(user, command)
+	if err != nil {
+		conn.exit(2, err.Error())
+		return
+	}
+	meta, err := admitTerminal(ctx, g.kube, claims, target.namespace, target.pod, target.container)
+	if err != nil {
+		conn.exit(1, err.Error())
+		return
+	}
+	meta.Env = conn.env
+	if target.command != "" {
+		conn.exit(g.runCommand(ctx, meta, target.command, conn), "")
+		return
+	}
+	if !conn.pty {
+		conn.exit(1, "an interactive shell needs a pty, use ssh -t")
+		return
+	}
+	go conn.readInput()
+	sessionId, err := startSession(ctx, conn, g.kube, meta)
+	if err != nil {
+		conn.exit(1, err.Error())
+		return
+	}
+	log.Printf("start SSH terminal: %s", sessionId)
+	ExecTerminal(meta.Container, target.pod, target.namespace, sessionId)
+	<-conn.closed
+	conn.exit(conn.status, "")
+}
+
+// runCommand runs a command without terminal, like scp and rsync do, after
+// the checks a shell of the session would get. It returns the exit status
+func (g *sshGateway) runCommand(ctx context.Context, meta SessionMeta, command string, conn *sshConn) uint32 {
+	if meta.SafeMode || meta.ReadOnly {
+		fmt.Fprintln(conn.channel.Stderr(), "viewers and safe mode users can only open a shell")
+		return 1
+	}
+	if err := admitWithoutTerminal(meta.Namespace); err != nil {
+		fmt.Fprintln(conn.channel.Stderr(), err)
+		return 1
+	}
+	words := strings.Fields(command)
+	if len(words) == 0 {
+		fmt.Fprintln(conn.channel.Stderr(), "empty command")
+		return 2
+	}
+	rule := commandRule(meta.Namespace, meta.Role)
+	// the policy checks words, so checked commands run without a shell
+	checked := rule != nil || *opaURL != ""
+	if checked && strings.ContainsAny(command, shellMetacharacters) {
+		fmt.Fprintln(conn.channel.Stderr(), ErrShellSyntax)
+		return 1
+	}
+	if !rule.allowsLine(command) {
+		fmt.Fprintln(conn.channel.Stderr(), ErrCommandDenied)
+		return 1
+	}
+	if *opaURL != "" {
+		input, err := g.kube.execPolicyInput(ctx, meta)
+		if err == nil {
+			input.Command = words[0]
+			err = authorizeOPA(ctx, input)
+		}
+		if err != nil {
+			fmt.Fprintln(conn.channel.Stderr(), err)
+			return 1
+		}
+	}
+	audit(AuditEvent{
+		Type:      "ssh.exec",
+		User:      meta.User,
+		Namespace: meta.Namespace,
+		Pod:       meta.Pod,
+		Container: meta.Container,
+		Details:   map[string]string{"command": string(maskStream([]byte(command)))},
+	})
+	cmd := []string{"sh", "-c", command}
+	if checked {
+		cmd = words
+	}
+	err := execBackendOf(g.kube).ExecCommand(ctx, meta.Container, meta.Pod, meta.Namespace,
+		envCommand(meta.Env, cmd), conn.channel, conn.channel, conn.channel.Stderr())
+	if exitErr, ok := err.(interface{ ExitStatus() int }); ok {
+		return uint32(exitErr.ExitStatus())
+	} else if err != nil {
+		fmt.Fprintln(conn.channel.Stderr(), err)
+		return 1
+	}
+	return 0
+}
+
+func parsePtyRequest(payload []byte) (uint16, uint16) {
+	var req struct {
+		Term   string
+		Cols   uint32
+		Rows   uint32
+		Width  uint32
+		Height uint32
+		Modes  string
+	}
+	if ssh.Unmarshal(payload, &req) != nil {
+		return 0, 0
+	}
+	return uint16(req.Rows), uint16(req.Cols)
+}
+
+func parseWindowChange(payload []byte) (uint16, uint16) {
+	if len(payload) < 8 {
+		return 0, 0
+	}
+	cols := binary.BigEndian.Uint32(payload)
+	rows := binary.BigEndian.Uint32(payload[4:])
+	return uint16(rows), uint16(cols)
+}
+
+type sshFrame struct {
+	messageType int
+	data        []byte
+	err         error
+}
+
+// sshConn adapts an SSH channel to the session stack like grpcConn does:
+// output and toasts go to the channel, errors to its stderr, and input and
+// window changes come in as frames
+type sshConn struct {
+	channel ssh.Channel
+	pty     bool
+	env     map[string]string
+	rows    uint16
+	cols    uint16
+	acked   bool
+	// status is the exit status of the shell, 1 if it didn't start
+	status uint32
+
+	frames    chan sshFrame
+	closeOnce sync.Once
+	closed    chan struct{}
+	exitOnce  sync.Once
+}
+
+func (s *sshConn) readInput() {
+	for {
+		buf := make([]byte, 4096)
+		n, err := s.channel.Read(buf)
+		frame := sshFrame{websocket.BinaryMessage, buf[:n], nil}
+		if err != nil {
+			frame = sshFrame{err: err}
+		} else if n == 0 {
+			continue
+		}
+		select {
+		case s.frames <- frame:
+		case <-s.closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *sshConn) pushResize(rows uint16, cols uint16) {
+	data, _ := json.Marshal(TerminalMessage{Op: "resize", Rows: rows, Cols: cols})
+	select {
+	case s.frames <- sshFrame{websocket.TextMessage, data, nil}:
+	case <-s.closed:
+	}
+}
+
+func (s *sshConn) WriteMessage(messageType int, data []byte) error {
+	if messageType == websocket.TextMessage {
+		var msg TerminalMessage
+		if err := json.Unmarshal(data, &msg); err == nil {
+			return s.WriteJSON(msg)
+		}
+	}
+	_, err := s.channel.Write(data)
+	return err
+}
+
+// WriteJSON shows errors and the queue position on stderr and drops the
+// other control messages
+func (s *sshConn) WriteJSON(v interface{}) error {
+	if exit, ok := v.(ExitMessage); ok {
+		s.status = uint32(exit.Code)
+		return nil
+	}
+	msg, ok := v.(TerminalMessage)
+	if !ok {
+		return nil
+	}
+	switch msg.Op {
+	case "error":
+		s.status = 1
+		_, err := fmt.Fprintf(s.channel.Stderr(), "\r\n%s %s\r\n", msg.Code, msg.Data)
+		return err
+	case "queued":
+		_, err := fmt.Fprintf(s.channel.Stderr(), "waiting for a free terminal slot, position %d\r\n", msg.Position)
+		return err
+	}
+	return nil
+}
+
+func (s *sshConn) ReadMessage() (int, []byte, error) {
+	select {
+	case frame := <-s.frames:
+		return frame.messageType, frame.data, frame.err
+	case <-s.closed:
+		return 0, nil, errors.New("SSH channel was closed")
+	}
+}
+
+// ReadJSON returns the ack of the handshake with the size of the pty
+func (s *sshConn) ReadJSON(v interface{}) error {
+	ack, ok := v.(*TerminalMessage)
+	if !ok || s.acked {
+		return errors.New("unexpected JSON read on an SSH channel")
+	}
+	s.acked = true
+	*ack = TerminalMessage{Op: "ack", Version: ProtocolVersion, Rows: s.rows, Cols: s.cols}
+	return nil
+}
+
+func (s *sshConn) SetReadDeadline(t time.Time) error   { return nil }
+func (s *sshConn) SetCompressionLevel(level int) error { return nil }
+func (s *sshConn) EnableWriteCompression(enable bool)  {}
+
+// Close is called once the session is done with the channel, exit sends the
+// exit status and closes it
+func (s *sshConn) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	return nil
+}
+
+// exit reports the exit status of the session and closes the channel
+func (s *sshConn) exit(status uint32, message string) {
+	s.exitOnce.Do(func() {
+		if message != "" {
+			fmt.Fprintf(s.channel.Stderr(), "%s\r\n", message)
+		}
+		s.channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+		s.channel.Close()
+		s.Close()
+	})
+}
@@ -0,0 +1,202 @@
+package terminal
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+var (
+	standbyOf = Flags.String("standby-of", "",
+		"URL of the active instance, runs this instance as its warm standby")
+	syncToken = Flags.String("sync-token", "",
+		"shared secret of the state sync between active and standby instance")
+	standbySyncInterval = Flags.Duration("standby-sync-interval", 2*time.Second,
+		"how often the standby copies the state of the active instance")
+	standbyLease = Flags.String("standby-lease", "",
+		"namespace/name of the coordination.k8s.io Lease of the active and standby instance, only its holder serves terminals")
+	standbyLeaseDuration = Flags.Duration("standby-lease-duration", 15*time.Second,
+		"how long the active instance may miss renewing the standby lease before the standby takes over")
+)
+
+// SyncTokenHeader carries the sync token on state sync requests
+const SyncTokenHeader = "X-Sync-Token"
+
+// StateSnapshot is the control-plane state mirrored by the standby instance
+// The sessions carry their route tokens, PresignUses the used presigned URLs
+// that must not open another terminal once the standby took over
+type StateSnapshot struct {
+	Taken       time.Time            `json:"taken"`
+	Sessions    []SessionInfo        `json:"sessions"`
+	Activity    []ActivityBucket     `json:"activity"`
+	PresignUses map[string]time.Time `json:"presignUses,omitempty"`
+}
+
+var standbyState struct {
+	lock    sync.Mutex
+	standby bool
+	mirror  *StateSnapshot
+}
+
+// GetStateSnapshot captures the state a standby needs to take over
+func GetStateSnapshot() StateSnapshot {
+	return StateSnapshot{
+		Taken:       time.Now(),
+		Sessions:    localSessions(),
+		Activity:    GetActivityHeatmap("", time.Time{}, false),
+		PresignUses: presignedUsesSnapshot(),
+	}
+}
+
+// CheckSyncToken validates the token of a state sync request
+func CheckSyncToken(token string) bool {
+	if *syncToken == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(*syncToken)) == 1
+}
+
+// IsStandby reports whether this instance is a standby that was not promoted yet
+func IsStandby() bool {
+	standbyState.lock.Lock()
+	defer standbyState.lock.Unlock()
+	return standbyState.standby
+}
+
+// mirroredSessions returns the sessions of the active instance while in standby
+func mirroredSessions() ([]SessionInfo, bool) {
+	standbyState.lock.Lock()
+	defer standbyState.lock.Unlock()
+	if !standbyState.standby || standbyState.mirror == nil {
+		return nil, false
+	}
+	return standbyState.mirror.Sessions, true
+}
+
+// StartStandby runs this instance as active or standby instance if
+// -standby-lease is set. Both hold the coordination.k8s.io Lease, the one
+// holding it serves terminals and the other one mirrors it with -standby-of.
+// The standby takes over once it acquired the lease, which the active
+// instance only loses when it missed renewing it, and an instance that lost
+// the lease exits so two never serve at once
+func StartStandby(kube *KubeClient) error {
+	if *standbyLease == "" {
+		if *standbyOf != "" {
+			return errors.New("-standby-of needs -standby-lease, set on both instances")
+		}
+		return nil
+	}
+	parts := strings.SplitN(*standbyLease, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return errors.New("-standby-lease must be namespace/name")
+	}
+	if DockerBackend() {
+		return errors.New("-standby-lease needs a cluster")
+	}
+	// nothing is served until the lease was acquired
+	standbyState.lock.Lock()
+	standbyState.standby = true
+	standbyState.lock.Unlock()
+	if *standbyOf != "" {
+		log.Println("running as standby of", *standbyOf)
+		go syncFromActive()
+	}
+	go holdStandbyLease(kube, parts[0], parts[1])
+	return nil
+}
+
+// holdStandbyLease competes for the lease once the cluster is available
+func holdStandbyLease(kube *KubeClient, namespace string, name string) {
+	backoff := minConnectBackoff
+	for {
+		clientset, err := kube.Clientset()
+		if err == nil {
+			lock := &resourcelock.LeaseLock{
+				LeaseMeta:  metav1.ObjectMeta{Namespace: namespace, Name: name},
+				Client:     clientset.CoordinationV1(),
+				LockConfig: resourcelock.ResourceLockConfig{Identity: replicaName()},
+			}
+			// runs as long as the lease is held
+			leaderelection.RunOrDie(context.Background(), leaderelection.LeaderElectionConfig{
+				Lock:          lock,
+				LeaseDuration: *standbyLeaseDuration,
+				RenewDeadline: *standbyLeaseDuration * 2 / 3,
+				RetryPeriod:   *standbyLeaseDuration / 6,
+				Callbacks: leaderelection.LeaderCallbacks{
+					OnStartedLeading: func(ctx context.Context) { promote() },
+					OnStoppedLeading: func() {
+						log.Fatalf("lost the standby lease %s/%s, the other instance serves now", namespace, name)
+					},
+				},
+			})
+			return
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxConnectBackoff {
+			backoff = maxConnectBackoff
+		}
+	}
+}
+
+// syncFromActive mirrors the active instance until this one is promoted
+func syncFromActive() {
+	url := strings.TrimRight(*standbyOf, "/") + "/api/v1/internal/state"
+	client := &http.Client{Timeout: *standbySyncInterval}
+	for range time.Tick(*standbySyncInterval) {
+		if !IsStandby() {
+			return
+		}
+		snapshot, err := fetchSnapshot(client, url)
+		if err != nil {
+			log.Printf("standby sync failed: %v", err)
+			continue
+		}
+		importActivity(snapshot.Activity)
+		importPresignedUses(snapshot.PresignUses)
+		standbyState.lock.Lock()
+		standbyState.mirror = snapshot
+		standbyState.lock.Unlock()
+	}
+}
+
+func fetchSnapshot(client *http.Client, url string) (*StateSnapshot, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(SyncTokenHeader, *syncToken)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("active instance answered %s", resp.Status)
+	}
+	var snapshot StateSnapshot
+	if err := json.NewDecoder(resp.Body).Decode(&snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// promote turns the standby into the active instance once it holds the lease
+// The sessions of the lost instance died with it and are dropped from the registry
+func promote() {
+	standbyState.lock.Lock()
+	defer standbyState.lock.Unlock()
+	standbyState.standby = false
+	standbyState.mirror = nil
+	log.Println("acquired the standby lease, serving terminals")
+}
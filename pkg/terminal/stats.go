@@ -0,0 +1,120 @@
+package terminal
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// States of the shell of a session, see ProcessStatus
+const (
+	ProcessPending  = "pending"
+	ProcessStarting = "starting"
+	ProcessRunning  = "running"
+	ProcessExited   = "exited"
+	ProcessClosed   = "closed"
+)
+
+// SessionStats is the traffic and state of a live session, for the status bar
+// of a UI and for admins looking for runaway sessions
+type SessionStats struct {
+	ID              string    `json:"id"`
+	User            string    `json:"user"`
+	Started         time.Time `json:"started"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	// BytesIn is the stdin passed to the shell, BytesOut its output
+	BytesIn  uint64 `json:"bytesIn"`
+	BytesOut uint64 `json:"bytesOut"`
+	// FramesIn and FramesOut are the websocket frames of all clients that
+	// were attached, after their handshakes
+	FramesIn  uint64 `json:"framesIn"`
+	FramesOut uint64 `json:"framesOut"`
+	// LastActivity is the last input or output, zero if there was none
+	LastActivity time.Time     `json:"lastActivity"`
+	Clients      int           `json:"clients"`
+	Process      ProcessStatus `json:"process"`
+}
+
+// ProcessStatus is the state of the shell of a session: pending while it
+// waits for an approval or a slot, starting, running, exited or closed when
+// the session ended without the shell's exit status
+type ProcessStatus struct {
+	State     string `json:"state"`
+	Pod       string `json:"pod"`
+	Container string `json:"container"`
+	Shell     string `json:"shell,omitempty"`
+	ExitCode  *int   `json:"exitCode,omitempty"`
+}
+
+// sessionCounters counts the traffic of a session, atomically
+type sessionCounters struct {
+	bytesIn    uint64
+	bytesOut   uint64
+	framesIn   uint64
+	framesOut  uint64
+	lastOutput int64
+}
+
+func (s *sessionCounters) countFrame(direction string) {
+	if direction == "in" {
+		atomic.AddUint64(&s.framesIn, 1)
+	} else {
+		atomic.AddUint64(&s.framesOut, 1)
+	}
+}
+
+func (s *sessionCounters) countInput(n int) {
+	atomic.AddUint64(&s.bytesIn, uint64(n))
+}
+
+func (s *sessionCounters) countOutput(n int) {
+	atomic.AddUint64(&s.bytesOut, uint64(n))
+	atomic.StoreInt64(&s.lastOutput, time.Now().UnixNano())
+}
+
+// setProcess records the state of the shell, shell is kept if empty
+func (t *TerminalSession) setProcess(state string, shell string) {
+	t.setupLock.Lock()
+	defer t.setupLock.Unlock()
+	t.process = state
+	if shell != "" {
+		t.processShell = shell
+	}
+}
+
+// GetSessionStats returns the stats of a live session of this replica
+func GetSessionStats(sessionId string) (*SessionStats, error) {
+	t := getSession(sessionId)
+	if t == nil {
+		return nil, ErrSessionNotFound
+	}
+	t.setupLock.Lock()
+	process := ProcessStatus{State: t.process, Shell: t.processShell}
+	t.setupLock.Unlock()
+	if exit := t.exitMessage(); exit != nil {
+		process.State = ProcessExited
+		process.ExitCode = &exit.Code
+	} else if t.ctx.Err() != nil {
+		process.State = ProcessClosed
+	}
+	process.Pod, process.Container = t.currentPod(), t.meta.Container
+
+	stats := &SessionStats{
+		ID:              t.id,
+		User:            t.meta.User,
+		Started:         t.meta.Started,
+		DurationSeconds: time.Since(t.meta.Started).Seconds(),
+		BytesIn:         atomic.LoadUint64(&t.counters.bytesIn),
+		BytesOut:        atomic.LoadUint64(&t.counters.bytesOut),
+		FramesIn:        atomic.LoadUint64(&t.counters.framesIn),
+		FramesOut:       atomic.LoadUint64(&t.counters.framesOut),
+		LastActivity:    t.lastInputTime(),
+		Clients:         len(t.attachedClients()),
+		Process:         process,
+	}
+	if nanos := atomic.LoadInt64(&t.counters.lastOutput); nanos != 0 {
+		if output := time.Unix(0, nanos); output.After(stats.LastActivity) {
+			stats.LastActivity = output
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,82 @@
+package terminal
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	statsdAddr   = Flags.String("statsd-addr", "localhost:8125", "UDP address of the StatsD server or Datadog agent")
+	statsdPrefix = Flags.String("statsd-prefix", "", "prefix of the metric names sent to StatsD")
+	statsdTags   = Flags.Bool("statsd-tags", true,
+		"send labels as DogStatsD tags, otherwise they are appended to the metric name")
+)
+
+// statsdBackend sends measurements to StatsD over UDP, losing some of them is
+// accepted rather than blocking the terminals
+type statsdBackend struct {
+	conn net.Conn
+}
+
+func newStatsdBackend() (*statsdBackend, error) {
+	conn, err := net.Dial("udp", *statsdAddr)
+	if err != nil {
+		return nil, fmt.Errorf("statsd: %v", err)
+	}
+	return &statsdBackend{conn: conn}, nil
+}
+
+func (s *statsdBackend) Register(m *Metric) error {
+	return nil
+}
+
+func (s *statsdBackend) Add(m *Metric, value float64, labels []string) {
+	s.send(m, value, "c", labels)
+}
+
+func (s *statsdBackend) Set(m *Metric, value float64, labels []string) {
+	s.send(m, value, "g", labels)
+}
+
+func (s *statsdBackend) Observe(m *Metric, value float64, labels []string) {
+	s.send(m, value, "h", labels)
+}
+
+// Delete is a no-op, StatsD forgets series that are no longer sent
+func (s *statsdBackend) Delete(m *Metric, labels []string) {}
+
+// send writes one line like name:1|c|#code:NO_SHELL
+func (s *statsdBackend) send(m *Metric, value float64, kind string, labels []string) {
+	var line strings.Builder
+	line.WriteString(*statsdPrefix)
+	line.WriteString(m.Name)
+	if !*statsdTags {
+		for _, label := range labels {
+			line.WriteString(".")
+			line.WriteString(statsdSanitize(label))
+		}
+	}
+	line.WriteString(":")
+	line.WriteString(strconv.FormatFloat(value, 'f', -1, 64))
+	line.WriteString("|")
+	line.WriteString(kind)
+	if *statsdTags && len(labels) > 0 {
+		line.WriteString("|#")
+		for i, label := range labels {
+			if i > 0 {
+				line.WriteString(",")
+			}
+			line.WriteString(m.Labels[i])
+			line.WriteString(":")
+			line.WriteString(statsdSanitize(label))
+		}
+	}
+	s.conn.Write([]byte(line.String()))
+}
+
+// statsdSanitize replaces the characters with a meaning in the line protocol
+func statsdSanitize(value string) string {
+	return strings.NewReplacer(":", "_", "|", "_", ",", "_", "#", "_", "@", "_", "\n", "_").Replace(value)
+}
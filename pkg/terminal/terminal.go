@@ -0,0 +1,1097 @@
+package terminal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+var (
+	sessionsLock     sync.Mutex
+	terminalSessions = make(map[string]*TerminalSession)
+)
+
+// ErrSessionNotFound is returned when joining a session that does not exist (anymore)
+var ErrSessionNotFound = errors.New("terminal session not found")
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	Subprotocols:    []string{WebSocketProtocol},
+	// only offered, frames are compressed as -websocket-compression says
+	EnableCompression: true,
+	// pages of other sites must not open terminals with the user's cookies or
+	// tokens, see -allowed-origins
+	CheckOrigin: OriginAllowed,
+	Error: func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+		WriteError(w, reason.Error(), status)
+	},
+}
+
+// PtyHandler is what remotecommand expects from a pty
+type PtyHandler interface {
+	io.Reader
+	io.Writer
+	io.Closer
+	remotecommand.TerminalSizeQueue
+}
+
+// clientConn is the connection of a terminal client, a websocket or a gRPC
+// stream adapted by grpcConn
+type clientConn interface {
+	WriteMessage(messageType int, data []byte) error
+	WriteJSON(v interface{}) error
+	ReadMessage() (int, []byte, error)
+	ReadJSON(v interface{}) error
+	SetReadDeadline(t time.Time) error
+	SetCompressionLevel(level int) error
+	EnableWriteCompression(enable bool)
+	Close() error
+}
+
+// terminalClient is a connection attached to a TerminalSession
+type terminalClient struct {
+	conn     clientConn
+	readOnly bool
+	output   *outputBuffer
+	done     chan struct{}
+	stopOnce sync.Once
+
+	// gorilla/websocket supports only one concurrent writer per connection
+	writeLock sync.Mutex
+
+	statsLock sync.Mutex
+	latency   time.Duration
+
+	// version is the protocol version acknowledged in the handshake and
+	// features what the client agreed on
+	version  int
+	features map[string]bool
+	// partial is the start of a character split across output chunks, see
+	// outputFrame
+	partial []byte
+	frames  frameLog
+
+	// stderr buffers the stderr of a NoTTY session like output, its writer
+	// closes stderrDone once it is drained. Both are nil with a TTY
+	stderr     *outputBuffer
+	stderrDone chan struct{}
+
+	// tokenUser and tokenExpires are of the token the client connected or
+	// refreshed with, see watchToken
+	tokenLock      sync.Mutex
+	tokenUser      string
+	tokenExpires   time.Time
+	tokenRefreshed chan struct{}
+}
+
+func newTerminalClient(conn clientConn, readOnly bool) *terminalClient {
+	setupCompression(conn)
+	return &terminalClient{
+		conn:     conn,
+		readOnly: readOnly,
+		output:   newOutputBuffer(),
+		done:     make(chan struct{}),
+
+		tokenRefreshed: make(chan struct{}, 1),
+	}
+}
+
+// stop ends the heartbeats and the output of the client
+func (c *terminalClient) stop() {
+	c.stopOnce.Do(func() {
+		close(c.done)
+		c.output.close()
+		if c.stderr != nil {
+			c.stderr.close()
+		}
+	})
+}
+
+func (c *terminalClient) writeMessage(messageType int, data []byte) error {
+	c.frames.record("out", "", len(data))
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.compressFrame(len(data))
+	return c.conn.WriteMessage(messageType, data)
+}
+
+func (c *terminalClient) writeJSON(v interface{}) error {
+	if msg, ok := v.(TerminalMessage); ok {
+		c.frames.record("out", msg.Op, 0)
+	}
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	// control messages are small
+	c.compressFrame(0)
+	return c.conn.WriteJSON(v)
+}
+
+// TerminalSession implements PtyHandler (using a SockJS connection)
+// Several clients may be attached to one session: output is broadcast to all
+// of them and stdin of the writable ones is serialized through receiver
+type TerminalSession struct {
+	id       string
+	meta     SessionMeta
+	sizeChan chan remotecommand.TerminalSize
+	// lastSize is the latest size a client asked for, see resendSize
+	sizeLock sync.Mutex
+	lastSize remotecommand.TerminalSize
+	bound    chan error
+
+	receiver chan []byte
+	sender   chan []byte
+	// eof is closed once the stdin of a NoTTY session ended
+	eof     chan struct{}
+	eofOnce sync.Once
+
+	clientsLock sync.Mutex
+	clients     map[*terminalClient]bool
+	closed      bool
+	// exit is the exit status of the shell, nil until it exited
+	exit *ExitMessage
+
+	// kube is the client of the cluster the shell runs in
+	kube *KubeClient
+	// exec runs the shell, kube unless -exec-backend says otherwise
+	exec Executor
+
+	// policy restricts the commands of the session, nil if unrestricted
+	policy      *CommandRule
+	policyLock  sync.Mutex
+	firstLine   []byte
+	lineChecked bool
+	inputEscape int
+
+	// previewing is 1 while a file is read for preview, see startPreview
+	previewing int32
+
+	// ctx carries the span of the request that opened the session, it is
+	// cancelled when the session ends to abort the exec stream
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	setupLock sync.Mutex
+	setupSpan trace.Span
+	// process is the state of the shell and processShell its name, see
+	// GetSessionStats
+	process      string
+	processShell string
+	counters     *sessionCounters
+
+	// decoder and encoder transcode output and input of sessions with a
+	// legacy encoding, nil for UTF-8
+	decoder *transcoder
+	encoder *transcoder
+
+	// outputLimiter caps the output rate, nil if unlimited
+	outputLimiter *rate.Limiter
+	// inputLimiter caps the stdin rate of all clients, nil if unlimited
+	inputLimiter *rate.Limiter
+
+	// lastInput is when a client typed last, see watchIdle
+	idleLock  sync.Mutex
+	lastInput time.Time
+
+	// dlpLine is the command line being typed and dlpPending a dangerous
+	// one waiting for its confirmation, see guardInput
+	dlpLock    sync.Mutex
+	dlpLine    []byte
+	dlpPending string
+
+	// owner is the client that opened the session, it answers support requests
+	owner       *terminalClient
+	pairLock    sync.Mutex
+	pairPending *pairRequest
+	pairs       map[*terminalClient]*pairGrant
+	// prompts are the masked prompts waiting for the owner, see promptSecret
+	promptLock sync.Mutex
+	prompts    map[string]chan string
+
+	// recorder records the output with -recording-dir, nil if not recorded
+	recorder *sessionRecorder
+	// detachedTimer ends a grouped session nobody reattached, see keepDetached
+	detachedTimer *time.Timer
+}
+
+// detached reports whether a grouped session runs without clients, its
+// output is then only recorded
+func (t *TerminalSession) detached() bool {
+	t.clientsLock.Lock()
+	defer t.clientsLock.Unlock()
+	return t.detachedTimer != nil
+}
+
+// TerminalSize handles pty->process resize events
+// Called in a loop from remotecommand as long as the process is running
+// Sizes arriving within resizeDebounce are coalesced to the latest one
+func (t *TerminalSession) Next() *remotecommand.TerminalSize {
+	var size remotecommand.TerminalSize
+	select {
+	case size = <-t.sizeChan:
+	case <-t.ctx.Done():
+		return nil
+	}
+	timer := time.NewTimer(resizeDebounce)
+	defer timer.Stop()
+	for {
+		select {
+		case size = <-t.sizeChan:
+		case <-timer.C:
+			return &size
+		case <-t.ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Read handles pty->process messages (stdin, resize)
+// Called in a loop from remotecommand as long as the process is running
+func (t *TerminalSession) Read(p []byte) (int, error) {
+	select {
+	case m := <-t.receiver:
+		if t.encoder != nil {
+			m = t.encoder.convert(m)
+		}
+		return copy(p, m), nil
+	case <-t.eof:
+		return 0, io.EOF
+	case <-t.ctx.Done():
+		return 0, io.EOF
+	}
+}
+
+// Write handles process->pty stdout
+// Called from remotecommand whenever there is any output
+// The output is queued in the buffer of every client, so one slow client
+// doesn't stall the others
+func (t *TerminalSession) Write(p []byte) (int, error) {
+	t.endSetup(nil)
+	if err := t.throttle(len(p)); err != nil {
+		return 0, err
+	}
+	output := p
+	if t.decoder != nil {
+		output = t.decoder.convert(p)
+	}
+	output = t.relayPromptRequests(output)
+	t.recorder.record(output)
+	t.counters.countOutput(len(p))
+	delivered := 0
+	for _, c := range t.attachedClients() {
+		if err := c.output.push(output); err == nil {
+			delivered++
+		}
+	}
+	if delivered == 0 && !t.detached() {
+		return 0, errors.New("no client is attached to the terminal")
+	}
+	return len(p), nil
+}
+
+// Toast can be used to send the user any OOB messages
+// hterm puts these in the center of the terminal
+func (t *TerminalSession) Toast(p string) error {
+	if t.broadcast([]byte(p)) == 0 {
+		return errors.New("no client is attached to the terminal")
+	}
+	return nil
+}
+
+// Close shuts down the SockJS connection and sends the status code and reason to the client
+// Can happen if the process exits or if there is an error starting up the process
+// For now the status code is unused and reason is shown to the user (unless "")
+func (t *TerminalSession) Close() error {
+	//log.Println("Terminal session was closed")
+	// the writers close the connections once the pending output was flushed
+	t.clientsLock.Lock()
+	defer t.clientsLock.Unlock()
+	t.cancel()
+	t.closed = true
+	for c := range t.clients {
+		c.stop()
+		delete(t.clients, c)
+	}
+	return nil
+}
+
+// attach adds a client to the session and starts its writer
+// It fails once the session was closed
+func (t *TerminalSession) attach(c *terminalClient) bool {
+	t.clientsLock.Lock()
+	defer t.clientsLock.Unlock()
+	if t.closed {
+		return false
+	}
+	if t.detachedTimer != nil {
+		t.detachedTimer.Stop()
+		t.detachedTimer = nil
+	}
+	t.clients[c] = true
+	c.frames.countInto(t.counters)
+	if t.meta.NoTTY {
+		c.stderr = newOutputBuffer()
+		c.stderrDone = make(chan struct{})
+		go t.writeStderr(c)
+	}
+	go t.writeOutput(c)
+	if c.has(FeatureHeartbeats) {
+		go t.sendHeartbeats(c)
+	}
+	go t.watchToken(c)
+	return true
+}
+
+// detach removes a client from the session, its connection is closed by the writer
+func (t *TerminalSession) detach(c *terminalClient) {
+	t.clientsLock.Lock()
+	defer t.clientsLock.Unlock()
+	if t.clients[c] {
+		delete(t.clients, c)
+		c.stop()
+	}
+	// nobody is left to use the shell, so end it
+	if len(t.clients) == 0 && !t.closed && !t.keepDetached() {
+		log.Printf("session %s: last client disconnected", t.id)
+		t.cancel()
+	}
+}
+
+// writeOutput sends the buffered output of a client until the buffer is closed
+func (t *TerminalSession) writeOutput(c *terminalClient) {
+	t.labelGoroutine("writeOutput")
+	defer c.conn.Close()
+	for {
+		data := c.output.pop(maxFrameSize)
+		if data == nil {
+			if c.stderrDone != nil {
+				<-c.stderrDone
+			}
+			if exit := t.exitMessage(); exit != nil && c.has(FeatureExit) {
+				c.writeJSON(*exit)
+			}
+			return
+		}
+		// binary output is sent as is, it may not be valid UTF-8 or end mid-character
+		messageType, frame := c.outputFrame(data)
+		if t.meta.NoTTY && c.has(FeatureStreams) {
+			frame = streamFrame(streamStdout, data)
+		}
+		if len(frame) == 0 {
+			continue
+		}
+		if err := c.writeMessage(messageType, frame); err != nil {
+			log.Printf("session %s: write to client failed: %v", t.id, err)
+			t.detach(c)
+			return
+		}
+	}
+}
+
+func (t *TerminalSession) attachedClients() []*terminalClient {
+	t.clientsLock.Lock()
+	defer t.clientsLock.Unlock()
+	clients := make([]*terminalClient, 0, len(t.clients))
+	for c := range t.clients {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+func (t *TerminalSession) isAttached(c *terminalClient) bool {
+	t.clientsLock.Lock()
+	defer t.clientsLock.Unlock()
+	return t.clients[c]
+}
+
+// broadcast sends a notice to every attached client, clients failing to
+// receive it are detached. It returns the number of clients reached
+func (t *TerminalSession) broadcast(data []byte) int {
+	delivered := 0
+	for _, c := range t.attachedClients() {
+		if err := t.writeNotice(c, data); err != nil {
+			log.Printf("session %s: write to client failed: %v", t.id, err)
+			t.detach(c)
+			continue
+		}
+		delivered++
+	}
+	return delivered
+}
+
+// writeNotice shows a notice to one client
+func (t *TerminalSession) writeNotice(c *terminalClient, data []byte) error {
+	if t.meta.NoTTY {
+		// notices must not end up in the output of a command
+		return c.writeJSON(TerminalMessage{Op: "notice", Data: string(data)})
+	}
+	return c.writeMessage(c.noticeFrame(data))
+}
+
+// readFromClient forwards the stdin of a client until its connection is closed
+// Input of read-only clients is discarded
+func (t *TerminalSession) readFromClient(c *terminalClient) {
+	t.labelGoroutine("readFromClient")
+	defer t.detach(c)
+	for {
+		messageType, message, err := c.conn.ReadMessage()
+		if err != nil {
+			log.Printf("error: %v", err)
+			break
+		}
+		// binary frames are always stdin, text frames may be control messages
+		if messageType == websocket.TextMessage && t.handleControl(c, message) {
+			continue
+		}
+		c.frames.record("in", "", len(message))
+		// read-only clients are active too, their keystrokes just don't reach the shell
+		t.touch()
+		if c.readOnly {
+			continue
+		}
+		if !t.inspectInput(message) {
+			log.Printf("session %s: first command denied by policy", t.id)
+			audit(t.auditEvent("policy.denied", nil))
+			t.sendExecError(ExecErrPolicyDenied, ErrCommandDenied)
+			t.cancel()
+			break
+		}
+		if err := t.limitInput(len(message)); err != nil {
+			break
+		}
+		if message = t.guardInput(message); len(message) == 0 {
+			continue
+		}
+		select {
+		case t.receiver <- message:
+			t.counters.countInput(len(message))
+		case <-t.eof:
+			// stdin was closed, see closeStdin
+		case <-t.ctx.Done():
+			// the session ended, nobody reads the input anymore
+			return
+		}
+	}
+	log.Println("readFromClient ReadMessage was closed")
+}
+
+func getSession(sessionId string) *TerminalSession {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	return terminalSessions[sessionId]
+}
+
+func removeSession(sessionId string) {
+	sessionsLock.Lock()
+	session := terminalSessions[sessionId]
+	delete(terminalSessions, sessionId)
+	sessionsLock.Unlock()
+	sessionLatency.Delete(sessionId)
+	unregisterSession(sessionId)
+	if session != nil {
+		leaveGroup(session.meta.Group)
+		releaseDebugPod(session.meta.Namespace, session.meta.Pod)
+	}
+}
+
+// ToastSession shows an out-of-band message in the terminal of a session
+func ToastSession(sessionId string, message string) error {
+	session := getSession(sessionId)
+	if session == nil {
+		return ErrSessionNotFound
+	}
+	return session.Toast(message)
+}
+
+// KillSession ends a session, reason is shown to its clients. Sessions of
+// other replicas are ended through the registry, see -session-registry
+func KillSession(sessionId string, reason string) error {
+	err := killLocalSession(sessionId, reason)
+	if err == ErrSessionNotFound && registryEnabled() {
+		return killRegisteredSession(sessionId, reason)
+	}
+	return err
+}
+
+func killLocalSession(sessionId string, reason string) error {
+	session := getSession(sessionId)
+	if session == nil {
+		return ErrSessionNotFound
+	}
+	log.Printf("session %s: killed: %s", sessionId, reason)
+	audit(session.auditEvent("session.kill", map[string]string{"reason": reason}))
+	session.Toast("\r\n" + reason + "\r\n")
+	session.cancel()
+	return nil
+}
+
+// CloseSessions cancels all sessions on shutdown and waits up to timeout for
+// their shells to end, so their activity is still recorded
+func CloseSessions(reason string, timeout time.Duration) {
+	sessionsLock.Lock()
+	sessions := make([]*TerminalSession, 0, len(terminalSessions))
+	for _, session := range terminalSessions {
+		sessions = append(sessions, session)
+	}
+	sessionsLock.Unlock()
+
+	for _, session := range sessions {
+		session.Toast("\r\n" + reason + "\r\n")
+		session.cancel()
+	}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		sessionsLock.Lock()
+		remaining := len(terminalSessions)
+		sessionsLock.Unlock()
+		if remaining == 0 {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// ListSessions describes all running sessions for the admin API
+// A standby instance reports the sessions of the active instance
+func ListSessions() []SessionInfo {
+	if sessions, ok := mirroredSessions(); ok {
+		return sessions
+	}
+	if registryEnabled() {
+		sessions, err := registeredSessions()
+		if err == nil {
+			return sessions
+		}
+		log.Println("ListSessions registry err", err)
+	}
+	return localSessions()
+}
+
+func localSessions() []SessionInfo {
+	sessionsLock.Lock()
+	sessions := make([]*TerminalSession, 0, len(terminalSessions))
+	for _, session := range terminalSessions {
+		sessions = append(sessions, session)
+	}
+	sessionsLock.Unlock()
+
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		infos = append(infos, session.info())
+	}
+	return infos
+}
+
+func (k *KubeClient) newExecutor(ctx context.Context, pod string, namespace string,
+	options *v1.PodExecOptions) (remotecommand.Executor, error) {
+
+	config, err := k.Config()
+	if err != nil {
+		return nil, err
+	}
+	clientset, err := k.Clientset()
+	if err != nil {
+		return nil, err
+	}
+	config = tracedConfig(ctx, config)
+
+	req := clientset.CoreV1().RESTClient().Post().Resource("pods").Name(pod).
+		Namespace(namespace).SubResource("exec")
+	req.VersionedParams(options, scheme.ParameterCodec)
+
+	return remotecommand.NewSPDYExecutor(config, "POST", req.URL())
+}
+
+func (k *KubeClient) ExecPod(ctx context.Context, container string, pod string, namespace string, cmd []string,
+	ptyHandler PtyHandler, stderr io.Writer) error {
+
+	tty := stderr == nil
+	exec, err := k.newExecutor(ctx, pod, namespace, &v1.PodExecOptions{
+		Container: container,
+		Command:   cmd,
+		Stdin:     true,
+		Stdout:    true,
+		Stderr:    true,
+		TTY:       tty,
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	watchdog := newSetupWatchdog(ptyHandler, cancel)
+	options := remotecommand.StreamOptions{
+		Stdin:  watchdog,
+		Stdout: watchdog,
+		Stderr: stderr,
+		Tty:    tty,
+	}
+	if tty {
+		// the pty merges stderr into stdout
+		options.Stderr = watchdog
+		options.TerminalSizeQueue = watchdog
+	}
+	err = exec.StreamWithContext(ctx, options)
+	if watchdog.expired() {
+		return fmt.Errorf("exec stream was not established within %v: timed out", *kubeTimeout)
+	}
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// setupWatchdog cancels an exec whose stream isn't established within
+// -kube-timeout. The executor starts using the handler once it is
+type setupWatchdog struct {
+	PtyHandler
+	timer   *time.Timer
+	once    sync.Once
+	timeout int32
+}
+
+func newSetupWatchdog(ptyHandler PtyHandler, cancel context.CancelFunc) *setupWatchdog {
+	w := &setupWatchdog{PtyHandler: ptyHandler}
+	if *kubeTimeout > 0 {
+		w.timer = time.AfterFunc(*kubeTimeout, func() {
+			atomic.StoreInt32(&w.timeout, 1)
+			cancel()
+		})
+	}
+	return w
+}
+
+func (w *setupWatchdog) established() {
+	w.once.Do(func() {
+		if w.timer != nil {
+			w.timer.Stop()
+		}
+	})
+}
+
+func (w *setupWatchdog) expired() bool {
+	w.established()
+	return atomic.LoadInt32(&w.timeout) == 1
+}
+
+func (w *setupWatchdog) Read(p []byte) (int, error) {
+	w.established()
+	return w.PtyHandler.Read(p)
+}
+
+func (w *setupWatchdog) Write(p []byte) (int, error) {
+	w.established()
+	return w.PtyHandler.Write(p)
+}
+
+func (w *setupWatchdog) Next() *remotecommand.TerminalSize {
+	w.established()
+	return w.PtyHandler.Next()
+}
+
+// ExecCommand runs a command without TTY, streams that are nil are not attached
+func (k *KubeClient) ExecCommand(ctx context.Context, container string, pod string,
+	namespace string, cmd []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+
+	exec, err := k.newExecutor(ctx, pod, namespace, &v1.PodExecOptions{
+		Container: container,
+		Command:   cmd,
+		Stdin:     stdin != nil,
+		Stdout:    stdout != nil,
+		Stderr:    stderr != nil,
+	})
+	if err != nil {
+		return err
+	}
+	return exec.StreamWithContext(ctx, remotecommand.StreamOptions{
+		Stdin:  stdin,
+		Stdout: stdout,
+		Stderr: stderr,
+	})
+}
+
+func GenTerminalSessionId() (string, error) {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	id := make([]byte, hex.EncodedLen(len(bytes)))
+	hex.Encode(id, bytes)
+	return string(id), nil
+}
+
+func CreateSession(w http.ResponseWriter, r *http.Request, kube *KubeClient,
+	meta SessionMeta) (string, error) {
+
+	_, span := StartSpan(r.Context(), "websocket.upgrade")
+	conn, err := upgrade(w, r)
+	if err != nil {
+		log.Print("upgrade:", err)
+		EndSpan(span, err)
+		return "", err
+	}
+	sessionId, err := startSession(r.Context(), conn, kube, meta)
+	EndSpan(span, err)
+	return sessionId, err
+}
+
+// startSession sets up the session of a connection that was just opened, the
+// shell is started by ExecTerminal
+func startSession(ctx context.Context, conn clientConn, kube *KubeClient, meta SessionMeta) (string, error) {
+	if meta.Reason == "" && ReasonRequired(meta.Namespace) {
+		conn.Close()
+		return "", ErrReasonRequired
+	}
+	sessionId, _ := GenTerminalSessionId()
+	owner := newTerminalClient(conn, meta.ReadOnly)
+	owner.setToken(meta.Claims)
+	ack, err := owner.handshake(sessionId)
+	if err != nil {
+		conn.Close()
+		return "", err
+	}
+	meta.Started = time.Now()
+	if meta.Claims != nil {
+		meta.TokenExpiresAt = meta.Claims.ExpiresAt
+	}
+	if *captureEnvironment {
+		capture, err := kube.captureContainerEnvironment(ctx, meta.Namespace, meta.Pod, meta.Container)
+		if err != nil {
+			log.Println("CreateSession capture environment err", err)
+		}
+		meta.Environment = capture
+	}
+	terminalSession := &TerminalSession{
+		id:       sessionId,
+		meta:     meta,
+		bound:    make(chan error),
+		sizeChan: make(chan remotecommand.TerminalSize, 1),
+
+		receiver: make(chan []byte),
+		sender:   make(chan []byte),
+		eof:      make(chan struct{}),
+
+		clients: make(map[*terminalClient]bool),
+		owner:   owner,
+		pairs:   make(map[*terminalClient]*pairGrant),
+
+		kube:   kube,
+		exec:   execBackendOf(kube),
+		policy: commandRule(meta.Namespace, meta.Role),
+
+		process:  ProcessPending,
+		counters: &sessionCounters{},
+	}
+	terminalSession.decoder, terminalSession.encoder = newSessionTranscoders(meta.Encoding)
+	terminalSession.outputLimiter = newOutputLimiter()
+	terminalSession.inputLimiter = newInputLimiter()
+	terminalSession.recorder = newSessionRecorder(sessionId, meta, ack.Rows, ack.Cols)
+	terminalSession.ctx, terminalSession.cancel = context.WithCancel(detachedTraceContext(ctx))
+	// queued before the shell starts, so full-screen programs render right away
+	terminalSession.resize(ack.Rows, ack.Cols)
+	terminalSession.attach(owner)
+	sessionsLock.Lock()
+	terminalSessions[sessionId] = terminalSession
+	sessionsLock.Unlock()
+	registerSession(terminalSession.info())
+	claimDebugPod(meta.Namespace, meta.Pod)
+	go terminalSession.watchTokenExpiry()
+
+	details := map[string]string{
+		"role":     meta.Role,
+		"readOnly": strconv.FormatBool(meta.ReadOnly),
+	}
+	if meta.Remote != "" {
+		details["remote"] = meta.Remote
+	}
+	audit(terminalSession.auditEvent("session.start", purposeDetails(meta, details)))
+	go terminalSession.readFromClient(owner)
+	return sessionId, nil
+}
+
+// JoinAccess decides how claims may join a session: the owner and admins
+// write if they ask for it, other users of its namespace only watch. Others
+// get write access with the owner's approval through PairSession
+func JoinAccess(sessionId string, claims *MyCustomClaims, write bool) (readOnly bool, err error) {
+	session := getSession(sessionId)
+	if session == nil {
+		return true, ErrSessionNotFound
+	}
+	if !claims.AllowsNamespace(session.meta.Namespace) {
+		return true, ErrNamespaceForbidden
+	}
+	owner := claims.Subject == session.meta.User || claims.Role == RoleAdmin
+	// safe mode users must not type into unrestricted shells of others
+	restricted := claims.Role == RoleViewer || IsSafeModeRole(claims.Role)
+	return !write || !owner || restricted, nil
+}
+
+// JoinSession attaches another websocket client to a running session, e.g. an
+// SRE shadowing a developer. It blocks until the client disconnects
+func JoinSession(w http.ResponseWriter, r *http.Request, sessionId string, readOnly bool) error {
+	session := getSession(sessionId)
+	if session == nil {
+		return ErrSessionNotFound
+	}
+
+	conn, err := upgrade(w, r)
+	if err != nil {
+		log.Print("upgrade:", err)
+		return err
+	}
+	c := newTerminalClient(conn, readOnly)
+	if claims, err := RequestClaims(r); err == nil {
+		c.setToken(claims)
+	}
+	if _, err := c.handshake(sessionId); err != nil {
+		conn.Close()
+		return err
+	}
+	if !session.attach(c) {
+		c.sendError("terminal session was closed")
+		conn.Close()
+		return errors.New("terminal session was closed while joining")
+	}
+	log.Printf("client joined session %s (readOnly=%v)", sessionId, readOnly)
+	audit(session.auditEvent("session.join", map[string]string{
+		"readOnly": strconv.FormatBool(readOnly),
+	}))
+	session.readFromClient(c)
+	return nil
+}
+
+// GetPodListByLable lists a page of the pods of namespace matching the label
+// selector and returns them with the continue token of the next page, "" on
+// the last one. Listing an unknown namespace yields no pods, so it is looked
+// up to report it as not found instead
+func (k *KubeClient) GetPodListByLable(ctx context.Context, namespace string, labels string,
+	opts PodListOptions) ([]PodInfo, string, error) {
+
+	if err := validatePodQuery(namespace, labels); err != nil {
+		return nil, "", err
+	}
+	if err := opts.validate(); err != nil {
+		return nil, "", err
+	}
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+	if podInfos, ok := k.cachedPodList(ctx, namespace, labels, opts); ok {
+		return podInfos, "", nil
+	}
+	clientset, err := k.Clientset()
+	if err != nil {
+		return nil, "", err
+	}
+	option := metav1.ListOptions{
+		LabelSelector: labels,
+		FieldSelector: opts.FieldSelector,
+		Limit:         opts.Limit,
+		Continue:      opts.Continue,
+	}
+	pods, err := clientset.CoreV1().Pods(namespace).List(ctx, option)
+	if err != nil {
+		return nil, "", err
+	}
+
+	count := len(pods.Items)
+	if count == 0 && opts.Continue == "" {
+		_, err := clientset.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil, "", err
+		}
+	}
+
+	podInfos := make([]PodInfo, count)
+	for i := 0; i < count; i++ {
+		podInfos[i] = newPodInfo(&pods.Items[i])
+	}
+	sortPods(podInfos, opts.Sort)
+	return podInfos, pods.Continue, nil
+}
+
+func ExecTerminal(container string, pod string, namespace string, sessionId string) {
+	session := getSession(sessionId)
+	if session == nil {
+		return
+	}
+	session.labelGoroutine("exec")
+	defer session.Close()
+	defer removeSession(sessionId)
+	defer func() {
+		session.recorder.close()
+		record := activityRecord{session.meta.Namespace, session.meta.Started, time.Now()}
+		if _, err := EnqueueJob(jobKindRecordActivity, record, time.Time{}); err != nil {
+			log.Println("ExecTerminal record activity err", err)
+		}
+		details := map[string]string{
+			"duration": time.Since(session.meta.Started).Round(time.Second).String(),
+		}
+		if exit := session.exitMessage(); exit != nil {
+			details["exitCode"] = strconv.Itoa(exit.Code)
+		}
+		audit(session.auditEvent("session.end", details))
+	}()
+
+	// approved before queueing, a pending terminal must not hold a slot
+	if err := session.awaitApproval(); err == context.Canceled {
+		log.Printf("session %s was cancelled while awaiting approval", sessionId)
+		return
+	} else if err != nil {
+		code := classifyExecError(err)
+		log.Printf("ExecTerminal err %s: %v", code, err)
+		session.sendExecError(code, err)
+		return
+	}
+	if err := session.verifyMFA(); err == context.Canceled {
+		return
+	} else if err != nil {
+		code := classifyExecError(err)
+		log.Printf("ExecTerminal err %s: %v", code, err)
+		session.sendExecError(code, err)
+		return
+	}
+	release, err := scheduler.acquireSlot(session.ctx, session.meta.User, namespace, session.meta.Role,
+		session.sendQueuePosition)
+	if err == context.Canceled {
+		log.Printf("session %s was cancelled while queued", sessionId)
+		return
+	} else if err != nil {
+		code := classifyExecError(err)
+		log.Printf("ExecTerminal err %s: %v", code, err)
+		session.sendExecError(code, err)
+		return
+	}
+	defer release()
+	session.setProcess(ProcessStarting, "")
+
+	session.showBanner()
+	go session.watchIdle()
+	session.detectOS()
+	script := bootstrapScript(namespace)
+	if script != "" && session.windows() {
+		// bootstrap scripts are written for sh
+		log.Printf("session %s: no bootstrap script in a Windows container", sessionId)
+		script = ""
+	} else if script != "" {
+		session.announceBootstrap(script)
+	}
+
+	var shells []string
+	if session.meta.SafeMode && session.windows() {
+		session.sendExecError(ExecErrNoShell, ErrSafeModeWindows)
+		audit(session.auditEvent("session.error", map[string]string{"code": string(ExecErrNoShell)}))
+		return
+	} else if session.meta.SafeMode {
+		// never fall back to an unrestricted shell
+		shells = []string{*safeModeShell}
+		session.Toast("Safe mode: restricted shell\r\n")
+	} else if shells, err = session.detectShells(); err != nil {
+		log.Printf("ExecTerminal err %s: %v", ExecErrNoShell, err)
+		session.sendExecError(ExecErrNoShell, err)
+		audit(session.auditEvent("session.error", map[string]string{"code": string(ExecErrNoShell)}))
+		return
+	}
+	started := time.Now()
+	err = session.runShell(container, pod, namespace, shells, script)
+	// a session opened by label moves on when its pod dies under the shell
+	for attempt := 0; attempt < *failoverAttempts && session.ctx.Err() == nil; attempt++ {
+		next, ok := session.failover(pod, started)
+		if !ok {
+			break
+		}
+		pod, started = next, time.Now()
+		err = session.runShell(container, pod, namespace, shells, script)
+	}
+
+	if err != nil {
+		code := classifyExecError(err)
+		log.Printf("ExecTerminal err %s: %v", code, err)
+		session.sendExecError(code, err)
+		kind := "session.error"
+		if code == ExecErrPolicyDenied {
+			kind = "policy.denied"
+		}
+		audit(session.auditEvent(kind, map[string]string{"code": string(code)}))
+		return
+	}
+	if session.ctx.Err() != nil {
+		log.Printf("session %s was cancelled", sessionId)
+		return
+	}
+	log.Println("terminal was closed")
+}
+
+// runShell starts the first of shells the policies allow in pod and returns
+// once it ended. The exit status of a shell that ran is recorded and nil
+// returned, like for a cancelled session
+func (t *TerminalSession) runShell(container string, pod string, namespace string, shells []string,
+	script string) error {
+
+	var err error
+	var input *ExecPolicyInput
+	if *opaURL != "" {
+		input, err = t.kube.execPolicyInput(t.ctx, t.meta)
+		if err != nil {
+			log.Println("ExecTerminal policy input err", err)
+			return err
+		}
+	}
+	for _, shell := range shells {
+		if !t.policy.allows(shell) {
+			err = fmt.Errorf("%w: %s", ErrCommandDenied, shell)
+			continue
+		}
+		if input != nil {
+			input.Command = shell
+			if err = authorizeOPA(t.ctx, input); errors.Is(err, ErrCommandDenied) {
+				continue
+			} else if err != nil {
+				break
+			}
+		}
+		cmd := bootstrapCommand(shell, script, t.loginShell())
+		if t.meta.SafeMode {
+			cmd = safeModeCommand(shell, script)
+		}
+		cmd = envCommand(t.shellEnv(), cmd)
+		if t.windows() {
+			cmd = windowsEnvCommand(t.meta.Env, shell)
+		}
+		t.setProcess(ProcessStarting, shell)
+		ctx := t.traceSetup(shell)
+		err = t.exec.ExecPod(ctx, container, pod, namespace, cmd, t, t.stderr())
+		t.endSetup(err)
+		if err == nil || isShellExit(err) || t.ctx.Err() != nil {
+			if t.ctx.Err() == nil {
+				t.setExit(exitCode(err))
+			}
+			err = nil
+			break
+		}
+		log.Println("ExecTerminal ExecPod err", err)
+		// only a missing shell is worth another try
+		if classifyExecError(err) != ExecErrNoShell {
+			break
+		}
+	}
+	return err
+}
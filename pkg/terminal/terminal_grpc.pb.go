@@ -0,0 +1,147 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: terminal.proto
+
+package terminal
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	TerminalService_Exec_FullMethodName = "/terminal.v1.TerminalService/Exec"
+)
+
+// TerminalServiceClient is the client API for TerminalService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type TerminalServiceClient interface {
+	// Exec opens a terminal. The first request must carry start, the later ones
+	// stdin or a resize. The first response carries the session id, the later
+	// ones stdout or an error ending the stream
+	Exec(ctx context.Context, opts ...grpc.CallOption) (TerminalService_ExecClient, error)
+}
+
+type terminalServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewTerminalServiceClient(cc grpc.ClientConnInterface) TerminalServiceClient {
+	return &terminalServiceClient{cc}
+}
+
+func (c *terminalServiceClient) Exec(ctx context.Context, opts ...grpc.CallOption) (TerminalService_ExecClient, error) {
+	stream, err := c.cc.NewStream(ctx, &TerminalService_ServiceDesc.Streams[0], TerminalService_Exec_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &terminalServiceExecClient{stream}
+	return x, nil
+}
+
+type TerminalService_ExecClient interface {
+	Send(*ExecRequest) error
+	Recv() (*ExecResponse, error)
+	grpc.ClientStream
+}
+
+type terminalServiceExecClient struct {
+	grpc.ClientStream
+}
+
+func (x *terminalServiceExecClient) Send(m *ExecRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *terminalServiceExecClient) Recv() (*ExecResponse, error) {
+	m := new(ExecResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// TerminalServiceServer is the server API for TerminalService service.
+// All implementations must embed UnimplementedTerminalServiceServer
+// for forward compatibility
+type TerminalServiceServer interface {
+	// Exec opens a terminal. The first request must carry start, the later ones
+	// stdin or a resize. The first response carries the session id, the later
+	// ones stdout or an error ending the stream
+	Exec(TerminalService_ExecServer) error
+	mustEmbedUnimplementedTerminalServiceServer()
+}
+
+// UnimplementedTerminalServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedTerminalServiceServer struct {
+}
+
+func (UnimplementedTerminalServiceServer) Exec(TerminalService_ExecServer) error {
+	return status.Errorf(codes.Unimplemented, "method Exec not implemented")
+}
+func (UnimplementedTerminalServiceServer) mustEmbedUnimplementedTerminalServiceServer() {}
+
+// UnsafeTerminalServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to TerminalServiceServer will
+// result in compilation errors.
+type UnsafeTerminalServiceServer interface {
+	mustEmbedUnimplementedTerminalServiceServer()
+}
+
+func RegisterTerminalServiceServer(s grpc.ServiceRegistrar, srv TerminalServiceServer) {
+	s.RegisterService(&TerminalService_ServiceDesc, srv)
+}
+
+func _TerminalService_Exec_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(TerminalServiceServer).Exec(&terminalServiceExecServer{stream})
+}
+
+type TerminalService_ExecServer interface {
+	Send(*ExecResponse) error
+	Recv() (*ExecRequest, error)
+	grpc.ServerStream
+}
+
+type terminalServiceExecServer struct {
+	grpc.ServerStream
+}
+
+func (x *terminalServiceExecServer) Send(m *ExecResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *terminalServiceExecServer) Recv() (*ExecRequest, error) {
+	m := new(ExecRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// TerminalService_ServiceDesc is the grpc.ServiceDesc for TerminalService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var TerminalService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "terminal.v1.TerminalService",
+	HandlerType: (*TerminalServiceServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Exec",
+			Handler:       _TerminalService_Exec_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "terminal.proto",
+}
@@ -0,0 +1,83 @@
+package terminaltest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+
+	".."
+)
+
+// newJWTServer starts a server authenticating with the -auth jwt chain
+// instead of UserHeader
+func newJWTServer(t *testing.T, objects ...runtime.Object) *Server {
+	t.Helper()
+	terminal.Flags.Set("auth", "jwt")
+	if err := terminal.SetupAuth(); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Clientset: fake.NewSimpleClientset(objects...), Executor: NewExecutor()}
+	s.Kube = terminal.NewKubeClientFor(s.Clientset, nil)
+	s.Server = httptest.NewServer(terminal.NewRouter(terminal.Config{Version: "test"}, terminal.Dependencies{
+		Kube:     s.Kube,
+		Executor: s.Executor,
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// bearer returns the header authenticating as claims
+func bearer(t *testing.T, claims *terminal.MyCustomClaims) http.Header {
+	t.Helper()
+	token, err := terminal.SignJwtToken(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return http.Header{"Authorization": {"Bearer " + token}}
+}
+
+func TestRequestsWithoutCredentialsAreRefused(t *testing.T) {
+	s := newJWTServer(t)
+	for _, header := range []http.Header{nil, {"Authorization": {"Bearer forged"}}} {
+		for _, path := range []string{"/api/v1/namespaces", "/api/v1/recordings", "/api/v1/admin/sessions"} {
+			if status, code := get(t, s, path, header); status != http.StatusUnauthorized ||
+				code != terminal.ErrCodeTokenInvalid {
+				t.Errorf("GET %s with %v: %d %s, want 401 %s", path, header, status, code, terminal.ErrCodeTokenInvalid)
+			}
+		}
+	}
+	expectRefused(t, s, "/api/v1/terminals/default/web/app", http.Header{"Authorization": {"Bearer forged"}},
+		terminal.ErrCodeTokenInvalid)
+}
+
+func TestPublicPathsNeedNoCredentials(t *testing.T) {
+	s := newJWTServer(t)
+	for _, path := range []string{"/", "/version", "/.well-known/terminal-server.json", "/ui/", "/ui/config.js"} {
+		if status, _ := get(t, s, path, nil); status != http.StatusOK {
+			t.Errorf("GET %s: %d, want 200", path, status)
+		}
+	}
+}
+
+func TestAuthMessage(t *testing.T) {
+	s := newJWTServer(t, Pod("default", "web"))
+	conn, _, err := s.Dial("/api/v1/terminals/default/web/app", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	token, err := terminal.SignJwtToken(Claims("alice", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteJSON(terminal.TerminalMessage{Op: "auth", Token: token}); err != nil {
+		t.Fatal(err)
+	}
+	readControl(t, conn, "capabilities")
+
+	// other websockets are refused at once instead of waiting for one
+	expectRefused(t, s, "/api/v1/recordings/x/play", nil, terminal.ErrCodeTokenInvalid)
+}
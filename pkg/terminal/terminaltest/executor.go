@@ -0,0 +1,247 @@
+// Package terminaltest runs the terminal server against a fake cluster with
+// simulated shells, so clients and the websocket protocol can be tested
+// without a Kubernetes API or containers
+package terminaltest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/client-go/util/exec"
+
+	".."
+)
+
+// Step is one exchange of a Script: the shell waits until its input contains
+// Expect, none if empty, then writes Output after Delay
+type Step struct {
+	Expect string
+	Output string
+	Delay  time.Duration
+}
+
+// Script simulates an interactive shell
+type Script struct {
+	// Echo writes the input back like a terminal in cooked mode
+	Echo  bool
+	Steps []Step
+	// Replies answers the lines entered after the steps, by their text
+	// without the "\r". A shell that echoes or replies reads lines until
+	// "exit" or "exit N", which ends it with code N, and answers "stty size"
+	// with the size of its terminal
+	Replies  map[string]string
+	ExitCode int
+}
+
+// EchoShell echoes its input until "exit" is entered
+var EchoShell = Script{Echo: true}
+
+// Result answers a non-interactive command
+type Result struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+}
+
+// Call is a command the Executor ran
+type Call struct {
+	Namespace string
+	Pod       string
+	Container string
+	Cmd       []string
+	TTY       bool
+	// Stdin is the input of non-interactive commands
+	Stdin string
+}
+
+// Executor implements terminal.Executor with simulated shells
+type Executor struct {
+	// Shell is run by every terminal, the zero Script exits at once
+	Shell Script
+	// Commands answers non-interactive commands by their arguments joined
+	// with spaces, others succeed without output
+	Commands map[string]Result
+
+	lock  sync.Mutex
+	calls []Call
+	sizes []remotecommand.TerminalSize
+}
+
+// NewExecutor returns an Executor running EchoShell
+func NewExecutor() *Executor {
+	return &Executor{Shell: EchoShell, Commands: make(map[string]Result)}
+}
+
+// Calls returns the commands run so far
+func (e *Executor) Calls() []Call {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return append([]Call(nil), e.calls...)
+}
+
+// Sizes returns the terminal sizes the shells were resized to
+func (e *Executor) Sizes() []remotecommand.TerminalSize {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return append([]remotecommand.TerminalSize(nil), e.sizes...)
+}
+
+func (e *Executor) record(c Call) {
+	e.lock.Lock()
+	e.calls = append(e.calls, c)
+	e.lock.Unlock()
+}
+
+// ExecPod runs e.Shell on the PTY of a terminal
+func (e *Executor) ExecPod(ctx context.Context, container string, pod string, namespace string, cmd []string,
+	ptyHandler terminal.PtyHandler, stderr io.Writer) error {
+	e.record(Call{Namespace: namespace, Pod: pod, Container: container, Cmd: cmd, TTY: stderr == nil})
+	var sizeLock sync.Mutex
+	var current remotecommand.TerminalSize
+	go func() {
+		for {
+			size := ptyHandler.Next()
+			if size == nil {
+				return
+			}
+			e.lock.Lock()
+			e.sizes = append(e.sizes, *size)
+			e.lock.Unlock()
+			sizeLock.Lock()
+			current = *size
+			sizeLock.Unlock()
+		}
+	}()
+
+	input := make(chan []byte)
+	go func() {
+		defer close(input)
+		buf := make([]byte, 1024)
+		for {
+			n, err := ptyHandler.Read(buf)
+			if n > 0 {
+				select {
+				case input <- append([]byte(nil), buf[:n]...):
+				case <-ctx.Done():
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	script := e.Shell
+	var typed bytes.Buffer
+	// waitFor reads input until it contains s and returns the input before
+	// it, false if the input ended first
+	waitFor := func(s string) (string, bool) {
+		for !strings.Contains(typed.String(), s) {
+			select {
+			case p, ok := <-input:
+				if !ok {
+					return "", false
+				}
+				typed.Write(p)
+				if script.Echo {
+					ptyHandler.Write(p)
+				}
+			case <-ctx.Done():
+				return "", false
+			}
+		}
+		before := typed.Next(strings.Index(typed.String(), s))
+		typed.Next(len(s))
+		return string(before), true
+	}
+	for _, step := range script.Steps {
+		if step.Expect != "" {
+			if _, ok := waitFor(step.Expect); !ok {
+				return ctx.Err()
+			}
+		}
+		if step.Delay > 0 {
+			select {
+			case <-time.After(step.Delay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if _, err := ptyHandler.Write([]byte(step.Output)); err != nil {
+			return err
+		}
+	}
+	for script.Echo || script.Replies != nil {
+		line, ok := waitFor("\r")
+		if !ok {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			break
+		}
+		line = strings.TrimSpace(line)
+		if line == "exit" {
+			break
+		}
+		if code, err := strconv.Atoi(strings.TrimPrefix(line, "exit ")); err == nil && strings.HasPrefix(line, "exit ") {
+			return exitError(code)
+		}
+		reply, ok := script.Replies[line]
+		if line == "stty size" && !ok {
+			sizeLock.Lock()
+			reply, ok = fmt.Sprintf("%d %d", current.Height, current.Width), true
+			sizeLock.Unlock()
+		}
+		if script.Echo {
+			ptyHandler.Write([]byte("\n"))
+		}
+		if ok {
+			if _, err := ptyHandler.Write([]byte(reply + "\r\n")); err != nil {
+				return err
+			}
+		}
+	}
+	return exitError(script.ExitCode)
+}
+
+// ExecCommand answers cmd from e.Commands
+func (e *Executor) ExecCommand(ctx context.Context, container string, pod string, namespace string, cmd []string,
+	stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	call := Call{Namespace: namespace, Pod: pod, Container: container, Cmd: cmd}
+	if stdin != nil {
+		in, err := ioutil.ReadAll(stdin)
+		if err != nil {
+			return err
+		}
+		call.Stdin = string(in)
+	}
+	e.record(call)
+
+	e.lock.Lock()
+	result := e.Commands[strings.Join(cmd, " ")]
+	e.lock.Unlock()
+	if stdout != nil {
+		io.WriteString(stdout, result.Stdout)
+	}
+	if stderr != nil {
+		io.WriteString(stderr, result.Stderr)
+	}
+	return exitError(result.ExitCode)
+}
+
+// exitError reports code like the exec streams of the Kubernetes API
+func exitError(code int) error {
+	if code == 0 {
+		return nil
+	}
+	return exec.CodeExitError{Err: fmt.Errorf("command terminated with exit code %d", code), Code: code}
+}
@@ -0,0 +1,103 @@
+package terminaltest
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"k8s.io/client-go/util/exec"
+
+	".."
+)
+
+// readExit reads until the exit message of the session
+func readExit(t *testing.T, conn *websocket.Conn) terminal.ExitMessage {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for the exit message: %v", err)
+		}
+		var exit terminal.ExitMessage
+		if messageType == websocket.TextMessage && json.Unmarshal(data, &exit) == nil && exit.Op == "exit" {
+			return exit
+		}
+	}
+}
+
+func TestScriptedShell(t *testing.T) {
+	s := NewServer(Pod("default", "web"))
+	defer s.Close()
+	s.Executor.Shell = Script{
+		Steps: []Step{
+			{Output: "$ "},
+			{Expect: "hostname\r", Output: "web\r\n$ "},
+			{Expect: "exit 3\r"},
+		},
+		ExitCode: 3,
+	}
+	conn, _ := open(t, s, "/api/v1/terminals/default/web/app", nil)
+	readOutput(t, conn, "$ ")
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("hostname\r")); err != nil {
+		t.Fatal(err)
+	}
+	readOutput(t, conn, "web")
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("exit 3\r")); err != nil {
+		t.Fatal(err)
+	}
+	if exit := readExit(t, conn); exit.Code != 3 {
+		t.Errorf("exit code %d, want 3", exit.Code)
+	}
+
+	var shell *Call
+	for _, c := range s.Executor.Calls() {
+		if c.TTY {
+			c := c
+			shell = &c
+		}
+	}
+	if shell == nil || shell.Namespace != "default" || shell.Pod != "web" || shell.Container != "app" {
+		t.Errorf("shell ran as %+v, want default/web/app", shell)
+	}
+}
+
+func TestEchoShell(t *testing.T) {
+	s := NewServer(Pod("default", "web"))
+	defer s.Close()
+	conn, _ := open(t, s, "/api/v1/terminals/default/web/app", nil)
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("hello\r")); err != nil {
+		t.Fatal(err)
+	}
+	readOutput(t, conn, "hello")
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("exit\r")); err != nil {
+		t.Fatal(err)
+	}
+	if exit := readExit(t, conn); exit.Code != 0 {
+		t.Errorf("exit code %d, want 0", exit.Code)
+	}
+}
+
+func TestExecutorCommands(t *testing.T) {
+	e := NewExecutor()
+	e.Commands["cat /etc/hostname"] = Result{Stdout: "web\n"}
+	e.Commands["false"] = Result{ExitCode: 1}
+
+	var stdout strings.Builder
+	err := e.ExecCommand(context.Background(), "app", "web", "default", []string{"cat", "/etc/hostname"},
+		strings.NewReader("input"), &stdout, nil)
+	if err != nil || stdout.String() != "web\n" {
+		t.Errorf("cat /etc/hostname: %q, %v", stdout.String(), err)
+	}
+	err = e.ExecCommand(context.Background(), "app", "web", "default", []string{"false"}, nil, nil, nil)
+	if exitErr, ok := err.(exec.CodeExitError); !ok || exitErr.Code != 1 {
+		t.Errorf("false: %v, want exit code 1", err)
+	}
+	calls := e.Calls()
+	if len(calls) != 2 || calls[0].Stdin != "input" || calls[1].Cmd[0] != "false" {
+		t.Errorf("calls %+v", calls)
+	}
+}
@@ -0,0 +1,133 @@
+package terminaltest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	".."
+)
+
+// readTimeout bounds the wait for a message of the server
+const readTimeout = 5 * time.Second
+
+// as returns the header making requests as user
+func as(user string) http.Header {
+	return http.Header{UserHeader: {user}}
+}
+
+// open dials the websocket of path and acknowledges its capabilities
+func open(t *testing.T, s *Server, path string, header http.Header) (*websocket.Conn, terminal.TerminalMessage) {
+	t.Helper()
+	conn, resp, err := s.Dial(path, header)
+	if err != nil {
+		if resp != nil {
+			t.Fatalf("dial %s: %v: %s", path, err, resp.Status)
+		}
+		t.Fatalf("dial %s: %v", path, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	caps := readControl(t, conn, "capabilities")
+	ack := terminal.TerminalMessage{
+		Op:       "ack",
+		Version:  terminal.ProtocolVersion,
+		Features: []string{terminal.FeatureBinary, terminal.FeatureResize, terminal.FeatureExit},
+		Rows:     24,
+		Cols:     80,
+	}
+	if err := conn.WriteJSON(ack); err != nil {
+		t.Fatal(err)
+	}
+	return conn, caps
+}
+
+// readControl skips the output until a control message with op arrives,
+// error messages fail t unless op is "error"
+func readControl(t *testing.T, conn *websocket.Conn, op string) terminal.TerminalMessage {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for %q: %v", op, err)
+		}
+		var msg terminal.TerminalMessage
+		if messageType != websocket.TextMessage || json.Unmarshal(data, &msg) != nil {
+			continue
+		}
+		if msg.Op == op {
+			return msg
+		} else if msg.Op == "error" {
+			t.Fatalf("waiting for %q: server error %s: %s", op, msg.Code, msg.Data)
+		}
+	}
+}
+
+// readOutput reads the output until it contains want
+func readOutput(t *testing.T, conn *websocket.Conn, want string) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
+	var output bytes.Buffer
+	for !strings.Contains(output.String(), want) {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for %q, got %q: %v", want, output.String(), err)
+		}
+		if messageType == websocket.BinaryMessage {
+			output.Write(data)
+		}
+	}
+}
+
+// expectRefused dials path and expects the server to refuse it with code,
+// in the upgrade response or in an error message on the websocket
+func expectRefused(t *testing.T, s *Server, path string, header http.Header, code string) {
+	t.Helper()
+	conn, resp, err := s.Dial(path, header)
+	if err != nil {
+		if resp == nil {
+			t.Fatalf("dial %s: %v", path, err)
+		}
+		if got := errorCode(resp); got != code {
+			t.Fatalf("dial %s: refused with %s %s, want %s", path, resp.Status, got, code)
+		}
+		return
+	}
+	defer conn.Close()
+	if msg := readControl(t, conn, "error"); msg.Code != code {
+		t.Fatalf("dial %s: error %s: %s, want %s", path, msg.Code, msg.Data, code)
+	}
+}
+
+// get requests path and returns the status and error code of the response
+func get(t *testing.T, s *Server, path string, header http.Header) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest("GET", s.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode, errorCode(resp)
+}
+
+// errorCode returns the code of the error envelope of resp, empty if it has none
+func errorCode(resp *http.Response) string {
+	var envelope terminal.APIError
+	if json.NewDecoder(io.LimitReader(resp.Body, 4<<10)).Decode(&envelope) != nil {
+		return ""
+	}
+	return envelope.Error.Code
+}
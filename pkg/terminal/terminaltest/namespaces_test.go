@@ -0,0 +1,49 @@
+package terminaltest
+
+import (
+	"net/http"
+	"testing"
+
+	".."
+)
+
+func TestNamespacesClaim(t *testing.T) {
+	s := NewServer(Pod("team-a", "web"), Pod("team-b", "web"))
+	defer s.Close()
+	alice := Claims("alice", "")
+	alice.Namespaces = []string{"team-a"}
+	s.Users["alice"] = alice
+
+	open(t, s, "/api/v1/terminals/team-a/web/app", as("alice"))
+	expectRefused(t, s, "/api/v1/terminals/team-b/web/app", as("alice"), terminal.ErrCodeNamespaceForbidden)
+	expectRefused(t, s, "/api/v1/terminals/team-b/by-label/app=web", as("alice"), terminal.ErrCodeNamespaceForbidden)
+
+	if status, _ := get(t, s, "/api/v1/pods/team-a/app=web", as("alice")); status != http.StatusOK {
+		t.Errorf("list pods of team-a: %d, want 200", status)
+	}
+	for _, path := range []string{
+		"/api/v1/pods/team-b/app=web",
+		"/api/v1/watch/pods/team-b",
+		"/api/v1/workloads/team-b",
+		"/api/v1/workloads/team-b/deployment/web/pods",
+		"/api/v1/fs/team-b/web/app",
+	} {
+		if status, code := get(t, s, path, as("alice")); status != http.StatusForbidden ||
+			code != terminal.ErrCodeNamespaceForbidden {
+			t.Errorf("GET %s: %d %s, want 403 %s", path, status, code, terminal.ErrCodeNamespaceForbidden)
+		}
+	}
+}
+
+func TestApprovalNamespacesNeedATerminal(t *testing.T) {
+	terminal.Flags.Set("approval-namespaces", "prod")
+	defer terminal.Flags.Set("approval-namespaces", "")
+	s := NewServer(Pod("prod", "web"))
+	defer s.Close()
+
+	for _, path := range []string{"/api/v1/fs/prod/web/app", "/api/v1/portforward/prod/web/8080"} {
+		if status, _ := get(t, s, path, nil); status != http.StatusForbidden {
+			t.Errorf("GET %s: %d, want 403", path, status)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package terminaltest
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	".."
+)
+
+// presign asks for a presigned URL of req as the user of header and returns
+// its path and query
+func presign(t *testing.T, s *Server, header http.Header, req terminal.PresignRequest) string {
+	t.Helper()
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := http.NewRequest("POST", s.URL+"/api/v1/terminals/presign", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header = header
+	resp, err := s.Client().Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("presign: %s", resp.Status)
+	}
+	var presigned terminal.PresignedURL
+	if err := json.NewDecoder(resp.Body).Decode(&presigned); err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(presigned.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.RequestURI()
+}
+
+func TestPresignedURLs(t *testing.T) {
+	terminal.Flags.Set("presign", "true")
+	defer terminal.Flags.Set("presign", "false")
+	s := newJWTServer(t, Pod("default", "web"))
+	alice := bearer(t, Claims("alice", ""))
+	req := terminal.PresignRequest{Namespace: "default", Pod: "web", Container: "app",
+		Params: map[string]string{"readonly": "true"}}
+
+	path := presign(t, s, alice, req)
+	_, caps := open(t, s, path, nil)
+	if !caps.ReadOnly {
+		t.Error("terminal of a presigned readonly URL is writable")
+	}
+	// URLs work once
+	expectRefused(t, s, path, nil, terminal.ErrCodeTokenInvalid)
+
+	u, _ := url.Parse(presign(t, s, alice, req))
+	query := u.Query()
+	query.Set("readonly", "false")
+	u.RawQuery = query.Encode()
+	expectRefused(t, s, u.RequestURI(), nil, terminal.ErrCodeTokenInvalid)
+	u.Path = "/api/v1/terminals/default/web/sidecar"
+	expectRefused(t, s, u.RequestURI(), nil, terminal.ErrCodeTokenInvalid)
+}
@@ -0,0 +1,106 @@
+package terminaltest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/websocket"
+	"github.com/urfave/negroni"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+
+	".."
+)
+
+// UserHeader selects the user of a request to a Server, requests without it
+// are made by Server.User
+const UserHeader = "X-Test-User"
+
+// Server is a terminal server on a local port, its cluster is a fake
+// clientset and its shells are simulated by an Executor. The executor is set
+// for the whole process, so tests using Servers don't run in parallel
+type Server struct {
+	*httptest.Server
+	Clientset *fake.Clientset
+	Kube      *terminal.KubeClient
+	Executor  *Executor
+	// User is the user of requests without UserHeader, an admin of every
+	// namespace. Users named by the header get the claims of Users, or none
+	User  *terminal.MyCustomClaims
+	Users map[string]*terminal.MyCustomClaims
+}
+
+// NewServer starts a server whose cluster holds objects, like the pods of
+// Pod. Close it when done
+func NewServer(objects ...runtime.Object) *Server {
+	s := &Server{
+		Clientset: fake.NewSimpleClientset(objects...),
+		Executor:  NewExecutor(),
+		User:      Claims("test", terminal.RoleAdmin),
+		Users:     make(map[string]*terminal.MyCustomClaims),
+	}
+	s.Kube = terminal.NewKubeClientFor(s.Clientset, nil)
+	s.Server = httptest.NewServer(terminal.NewRouter(terminal.Config{Version: "test"}, terminal.Dependencies{
+		Kube:     s.Kube,
+		Executor: s.Executor,
+		Auth:     negroni.HandlerFunc(s.authenticate),
+	}))
+	return s
+}
+
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	user := r.Header.Get(UserHeader)
+	if user == "" {
+		next(w, terminal.WithClaims(r, s.User, nil))
+		return
+	}
+	claims, ok := s.Users[user]
+	if !ok {
+		next(w, terminal.WithClaims(r, nil, terminal.ErrNoCredentials))
+		return
+	}
+	next(w, terminal.WithClaims(r, claims, nil))
+}
+
+// Dial opens a websocket to path, like "/api/v1/terminals/default/web/app"
+func (s *Server) Dial(path string, header http.Header) (*websocket.Conn, *http.Response, error) {
+	url := "ws" + strings.TrimPrefix(s.URL, "http") + path
+	return websocket.DefaultDialer.Dial(url, header)
+}
+
+// Claims returns the claims of user with role, valid for an hour in every
+// namespace
+func Claims(user string, role string) *terminal.MyCustomClaims {
+	return &terminal.MyCustomClaims{
+		Role: role,
+		StandardClaims: jwt.StandardClaims{
+			Subject:   user,
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		},
+	}
+}
+
+// Pod returns a running pod with containers, "app" if none are given
+func Pod(namespace string, name string, containers ...string) *v1.Pod {
+	if len(containers) == 0 {
+		containers = []string{"app"}
+	}
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Labels: map[string]string{"app": name}},
+		Status:     v1.PodStatus{Phase: v1.PodRunning},
+	}
+	for _, c := range containers {
+		pod.Spec.Containers = append(pod.Spec.Containers, v1.Container{Name: c, Image: "busybox"})
+		pod.Status.ContainerStatuses = append(pod.Status.ContainerStatuses, v1.ContainerStatus{
+			Name:  c,
+			Ready: true,
+			State: v1.ContainerState{Running: &v1.ContainerStateRunning{StartedAt: metav1.Now()}},
+		})
+	}
+	return pod
+}
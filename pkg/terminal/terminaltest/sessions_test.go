@@ -0,0 +1,73 @@
+package terminaltest
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/websocket"
+
+	".."
+)
+
+// newSessionServer starts a server whose user olivia owns a terminal of
+// default/web, it returns the websocket and id of her session
+func newSessionServer(t *testing.T) (*Server, *websocket.Conn, string) {
+	t.Helper()
+	s := NewServer(Pod("default", "web"))
+	t.Cleanup(s.Close)
+	s.Users["olivia"] = Claims("olivia", "")
+	conn, caps := open(t, s, "/api/v1/terminals/default/web/app", as("olivia"))
+	// the session is registered once the shell echoes
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("ready")); err != nil {
+		t.Fatal(err)
+	}
+	readOutput(t, conn, "ready")
+	return s, conn, caps.SessionID
+}
+
+func TestJoinWithWriteAccess(t *testing.T) {
+	s, _, id := newSessionServer(t)
+	s.Users["bob"] = Claims("bob", "")
+	carol := Claims("carol", "")
+	carol.Namespaces = []string{"other"}
+	s.Users["carol"] = carol
+
+	for _, tc := range []struct {
+		header   http.Header
+		readOnly bool
+	}{
+		{as("olivia"), false},
+		// the default user is an admin
+		{nil, false},
+		{as("bob"), true},
+	} {
+		_, caps := open(t, s, "/api/v1/sessions/"+id+"/join?write=true", tc.header)
+		if caps.ReadOnly != tc.readOnly {
+			t.Errorf("join as %v: readOnly %v, want %v", tc.header, caps.ReadOnly, tc.readOnly)
+		}
+	}
+	expectRefused(t, s, "/api/v1/sessions/"+id+"/join", as("carol"), terminal.ErrCodeNamespaceForbidden)
+}
+
+func TestKeystrokesDontAnswerSupportRequests(t *testing.T) {
+	s, owner, id := newSessionServer(t)
+	s.Users["sam"] = Claims("sam", "")
+
+	engineer, _ := open(t, s, "/api/v1/sessions/"+id+"/support?minutes=5", as("sam"))
+	request := readControl(t, owner, "pair_request")
+	if request.User != "sam" || request.Minutes != 5 {
+		t.Fatalf("pair_request of %s for %d minutes, want sam for 5", request.User, request.Minutes)
+	}
+	// the shell gets the keystroke, the request stays pending
+	if err := owner.WriteMessage(websocket.TextMessage, []byte("y")); err != nil {
+		t.Fatal(err)
+	}
+	readOutput(t, owner, "y")
+	answer := terminal.TerminalMessage{Op: "pair_answer", RequestID: request.RequestID, Approved: false}
+	if err := owner.WriteJSON(answer); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readControl(t, engineer, "error"); msg.Data != terminal.ErrPairDenied.Error() {
+		t.Fatalf("support request answered with %q, want %q", msg.Data, terminal.ErrPairDenied)
+	}
+}
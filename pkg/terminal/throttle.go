@@ -0,0 +1,60 @@
+package terminal
+
+import (
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+var (
+	outputRateLimit = Flags.Int("output-rate-limit", 0,
+		"bytes per second of output a session may send, 0 for no limit")
+	outputBurst = Flags.Int("output-burst", 256<<10,
+		"bytes of output a session may send at once before -output-rate-limit applies")
+)
+
+// newOutputLimiter returns the token bucket of a session's output, nil if
+// output is not limited
+func newOutputLimiter() *rate.Limiter {
+	if *outputRateLimit <= 0 {
+		return nil
+	}
+	burst := *outputBurst
+	if burst < 1 {
+		burst = *outputRateLimit
+	}
+	return rate.NewLimiter(rate.Limit(*outputRateLimit), burst)
+}
+
+// throttle blocks until the session may send n bytes of output. Blocking the
+// exec stream's writer holds back the process in the container, like a slow
+// terminal would, instead of buffering or dropping its output
+func (t *TerminalSession) throttle(n int) error {
+	if t.outputLimiter == nil {
+		return nil
+	}
+	started := time.Now()
+	defer func() {
+		if waited := time.Since(started); waited > time.Millisecond {
+			outputThrottled.Add(waited.Seconds())
+		}
+	}()
+	return waitLimiter(t, t.outputLimiter, n)
+}
+
+// waitLimiter takes n tokens of limiter in chunks of its burst, so a write
+// larger than the burst waits instead of failing
+func waitLimiter(t *TerminalSession, limiter *rate.Limiter, n int) error {
+	burst := limiter.Burst()
+	for n > 0 {
+		chunk := n
+		if chunk > burst {
+			chunk = burst
+		}
+		if err := limiter.WaitN(t.ctx, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
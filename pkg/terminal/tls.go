@@ -0,0 +1,116 @@
+package terminal
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLSOptions configures the certificates served by the terminal server
+type TLSOptions struct {
+	// CertFile and KeyFile are served to clients whose server name has no own certificate
+	CertFile string
+	KeyFile  string
+	// SNICerts is a comma separated list of "hostname:certFile:keyFile" entries,
+	// hostname may be a wildcard like "*.company.com"
+	SNICerts string
+	// ACMEHosts is a comma separated list of hostnames whose certificates are
+	// obtained automatically from Let's Encrypt (tls-alpn-01 challenge)
+	ACMEHosts    string
+	ACMECacheDir string
+}
+
+// Enabled reports whether any certificate source was configured
+func (o TLSOptions) Enabled() bool {
+	return o.CertFile != "" || o.SNICerts != "" || o.ACMEHosts != ""
+}
+
+// NewTLSConfig builds a tls.Config that selects the certificate by the SNI hostname
+func NewTLSConfig(o TLSOptions) (*tls.Config, error) {
+	var fallback *tls.Certificate
+	if o.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load default certificate: %v", err)
+		}
+		fallback = &cert
+	}
+
+	certs := make(map[string]*tls.Certificate)
+	for _, entry := range splitList(o.SNICerts) {
+		parts := strings.Split(entry, ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid SNI certificate %q, want hostname:certFile:keyFile", entry)
+		}
+		cert, err := tls.LoadX509KeyPair(parts[1], parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("load certificate for %s: %v", parts[0], err)
+		}
+		certs[strings.ToLower(parts[0])] = &cert
+	}
+
+	acmeHosts := splitList(o.ACMEHosts)
+	var manager *autocert.Manager
+	if len(acmeHosts) > 0 {
+		manager = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(acmeHosts...),
+		}
+		if o.ACMECacheDir != "" {
+			manager.Cache = autocert.DirCache(o.ACMECacheDir)
+		}
+		client, err := EgressClient(0)
+		if err != nil {
+			return nil, err
+		}
+		manager.Client = &acme.Client{HTTPClient: client}
+	}
+
+	getCertificate := func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		name := strings.ToLower(hello.ServerName)
+		if cert, ok := certs[name]; ok {
+			return cert, nil
+		}
+		if i := strings.Index(name, "."); i > 0 {
+			if cert, ok := certs["*"+name[i:]]; ok {
+				return cert, nil
+			}
+		}
+		if manager != nil && containsString(acmeHosts, name) {
+			return manager.GetCertificate(hello)
+		}
+		if fallback != nil {
+			return fallback, nil
+		}
+		return nil, fmt.Errorf("no certificate for server name %q", hello.ServerName)
+	}
+
+	return &tls.Config{
+		GetCertificate: getCertificate,
+		// websockets need HTTP/1.1, so h2 is deliberately not offered
+		NextProtos: []string{"http/1.1", acme.ALPNProto},
+		MinVersion: tls.VersionTLS12,
+	}, nil
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+package terminal
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var tokenExpiryWarnings = Flags.String("token-expiry-warnings", "5m,1m",
+	"comma separated times before the owner's token expires at which the terminal asks to refresh it")
+
+// closeTokenExpired is the websocket close code of clients whose token
+// expired without being refreshed, in the range of private codes
+const closeTokenExpired = 4001
+
+// setToken records the user and the expiry of the token a client connected
+// or refreshed with, tokens without expiry, like API keys, never expire
+func (c *terminalClient) setToken(claims *MyCustomClaims) {
+	if claims == nil {
+		return
+	}
+	c.tokenLock.Lock()
+	defer c.tokenLock.Unlock()
+	c.tokenUser = claims.Subject
+	c.tokenExpires = time.Time{}
+	if claims.ExpiresAt > 0 {
+		c.tokenExpires = time.Unix(claims.ExpiresAt, 0)
+	}
+}
+
+func (c *terminalClient) tokenExpiry() (string, time.Time) {
+	c.tokenLock.Lock()
+	defer c.tokenLock.Unlock()
+	return c.tokenUser, c.tokenExpires
+}
+
+// refreshToken replaces the token of a client by the one of a
+// {"op":"refresh_token","token":"..."} message, which must be of the same user
+// and still grant the namespace. The client gets
+// {"op":"token_refreshed","expiresAt":..} or an error and keeps the old token
+func (t *TerminalSession) refreshToken(c *terminalClient, token string) {
+	claims, err := ParseJwtToken(token)
+	if err == nil {
+		user, _ := c.tokenExpiry()
+		switch {
+		case user != "" && claims.Subject != user:
+			err = fmt.Errorf("the token is of %s, not of %s", claims.Subject, user)
+		case !claims.AllowsNamespace(t.meta.Namespace):
+			err = fmt.Errorf("the token does not grant namespace %s", t.meta.Namespace)
+		}
+	}
+	if err != nil {
+		log.Printf("session %s: token refresh err %v", t.id, err)
+		c.writeJSON(TerminalMessage{Op: "error", Code: ErrCodeTokenInvalid, Data: "token refresh failed: " + err.Error()})
+		return
+	}
+	c.setToken(claims)
+	if c == t.owner {
+		t.clientsLock.Lock()
+		t.meta.TokenExpiresAt = claims.ExpiresAt
+		t.clientsLock.Unlock()
+		registerSession(t.info())
+	}
+	select {
+	case c.tokenRefreshed <- struct{}{}:
+	default:
+	}
+	audit(t.auditEvent("session.token_refresh", map[string]string{"user": claims.Subject}))
+	c.writeJSON(TerminalMessage{Op: "token_refreshed", ExpiresAt: claims.ExpiresAt})
+}
+
+// watchToken detaches a client once its token expired without a refresh, the
+// owner's token is watched by watchTokenExpiry
+func (t *TerminalSession) watchToken(c *terminalClient) {
+	if c == t.owner {
+		return
+	}
+	t.labelGoroutine("watchToken")
+	for {
+		_, expires := c.tokenExpiry()
+		if expires.IsZero() {
+			return
+		}
+		timer := time.NewTimer(time.Until(expires))
+		select {
+		case <-timer.C:
+			t.expireClient(c)
+			return
+		case <-c.tokenRefreshed:
+			timer.Stop()
+		case <-c.done:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// expireClient tells a client its token expired and closes its connection
+// with closeTokenExpired
+func (t *TerminalSession) expireClient(c *terminalClient) {
+	user, _ := c.tokenExpiry()
+	log.Printf("session %s: token of %s expired", t.id, user)
+	audit(t.auditEvent("session.token_expired", map[string]string{"user": user}))
+	t.writeNotice(c, []byte("\r\nYour token expired, reconnect to continue\r\n"))
+	c.writeJSON(TerminalMessage{Op: "error", Code: ErrCodeTokenExpired, Data: "token expired"})
+	if conn, ok := c.conn.(*websocket.Conn); ok {
+		c.writeMessage(websocket.CloseMessage, websocket.FormatCloseMessage(closeTokenExpired, "token expired"))
+		conn.Close()
+	}
+	t.detach(c)
+}
+
+func (t *TerminalSession) tokenExpiresAt() int64 {
+	t.clientsLock.Lock()
+	defer t.clientsLock.Unlock()
+	return t.meta.TokenExpiresAt
+}
+
+// watchTokenExpiry ends the session once the owner's token expired, whether
+// or not the owner is attached, so a short-lived token can't keep a shell
+// open. Before it asks the owner to refresh the token at the
+// -token-expiry-warnings, a refresh starts over
+func (t *TerminalSession) watchTokenExpiry() {
+	if t.tokenExpiresAt() == 0 {
+		return
+	}
+	t.labelGoroutine("watchTokenExpiry")
+	warnings := warningTimes(*tokenExpiryWarnings, 0)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var expiresAt int64
+	warned := 0
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if current := t.tokenExpiresAt(); current != expiresAt {
+			expiresAt, warned = current, 0
+		}
+		if expiresAt == 0 {
+			// refreshed with a token that doesn't expire
+			return
+		}
+		remaining := time.Until(time.Unix(expiresAt, 0))
+		if remaining <= 0 {
+			if t.isAttached(t.owner) {
+				t.expireClient(t.owner)
+			}
+			killLocalSession(t.id, fmt.Sprintf("session closed, the token of %s expired", t.meta.User))
+			return
+		}
+		if warned < len(warnings) && remaining <= warnings[warned] {
+			for warned < len(warnings) && remaining <= warnings[warned] {
+				warned++
+			}
+			if t.isAttached(t.owner) {
+				t.writeNotice(t.owner, []byte(fmt.Sprintf("\r\nYour token expires in %s, refresh it to keep the session\r\n",
+					remaining.Round(time.Second))))
+			}
+		}
+	}
+}
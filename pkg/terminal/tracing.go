@@ -0,0 +1,160 @@
+package terminal
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/client-go/rest"
+)
+
+var (
+	otlpEndpoint = Flags.String("otlp-endpoint", "",
+		"host:port of the OTLP/HTTP collector spans and OTLP metrics are exported to, tracing is off if empty")
+	otlpInsecure = Flags.Bool("otlp-insecure", false, "export spans over plain HTTP")
+)
+
+var tracer = otel.Tracer("k8s-terminal-server")
+
+// StartTracing installs the OTLP exporter if an endpoint is configured
+// The returned function flushes the pending spans
+func StartTracing() (func(), error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+	if *otlpEndpoint == "" {
+		return func() {}, nil
+	}
+
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(*otlpEndpoint)}
+	if *otlpInsecure {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceName("k8s-terminal-server"))),
+	)
+	otel.SetTracerProvider(provider)
+	return func() { provider.Shutdown(context.Background()) }, nil
+}
+
+// TraceRequests is a middleware starting a server span per request, continuing
+// the trace propagated by the caller
+func TraceRequests(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, "HTTP "+r.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.target", r.URL.Path),
+		))
+	defer span.End()
+
+	next(w, r.WithContext(ctx))
+	if rw, ok := w.(interface{ Status() int }); ok {
+		span.SetAttributes(attribute.Int("http.status_code", rw.Status()))
+	}
+}
+
+// StartSpan starts a span as child of the span in ctx
+func StartSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// EndSpan records err on the span, if any, and ends it
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// startClientSpan starts the span of a clientset call
+func startClientSpan(ctx context.Context, verb string, resource string, namespace string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "k8s."+resource+"."+verb,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("k8s.namespace.name", namespace)))
+}
+
+// detachedTraceContext keeps the span of ctx without its cancellation, for
+// sessions outliving the request that started them
+func detachedTraceContext(ctx context.Context) context.Context {
+	return trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(ctx))
+}
+
+// tracedConfig returns a copy of config whose requests are traced as children
+// of the span in ctx and carry its trace context to the API server
+func tracedConfig(ctx context.Context, config *rest.Config) *rest.Config {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return config
+	}
+	config = rest.CopyConfig(config)
+	config.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+		return &tracingTransport{parent: ctx, next: rt}
+	})
+	return config
+}
+
+type tracingTransport struct {
+	parent context.Context
+	next   http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := tracer.Start(t.parent, "k8s.api "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("http.target", req.URL.Path)))
+	req = req.Clone(req.Context())
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := t.next.RoundTrip(req)
+	if resp != nil {
+		span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	}
+	EndSpan(span, err)
+	return resp, err
+}
+
+// traceSetup starts the span of an exec attempt, it ends with the first output
+// of the shell or when the attempt failed
+func (t *TerminalSession) traceSetup(shell string) context.Context {
+	ctx, span := StartSpan(t.ctx, "exec.setup",
+		attribute.String("k8s.namespace.name", t.meta.Namespace),
+		attribute.String("k8s.pod.name", t.meta.Pod),
+		attribute.String("k8s.container.name", t.meta.Container),
+		attribute.String("shell", shell),
+	)
+	t.setupLock.Lock()
+	t.setupSpan = span
+	t.setupLock.Unlock()
+	return ctx
+}
+
+func (t *TerminalSession) endSetup(err error) {
+	t.setupLock.Lock()
+	span := t.setupSpan
+	t.setupSpan = nil
+	if span != nil && err == nil {
+		t.process = ProcessRunning
+	}
+	t.setupLock.Unlock()
+	if span != nil {
+		EndSpan(span, err)
+		if err == nil && t.windows() {
+			t.resendSize()
+		}
+	}
+}
@@ -0,0 +1,320 @@
+// Minimal front-end of the terminal server: pick a container of a workload or
+// of a label selector and open a terminal in it through a presigned URL, so
+// the token never reaches the websocket
+(function () {
+  'use strict';
+
+  // window.terminalConfig comes from config.js, rendered by the server
+  var config = window.terminalConfig || { basePath: '', auth: {}, features: {} };
+  var base = new URL(config.basePath + '/', location.origin);
+  var el = function (id) { return document.getElementById(id); };
+
+  // tokens of an OIDC login arrive in the fragment, see -oidc-post-login-url
+  var fragment = new URLSearchParams(location.hash.slice(1));
+  if (fragment.get('token')) {
+    sessionStorage.setItem('terminal-token', fragment.get('token'));
+    history.replaceState(null, '', location.pathname + location.search);
+  }
+
+  function token() {
+    return sessionStorage.getItem('terminal-token') || '';
+  }
+
+  function status(text) {
+    el('status').textContent = text;
+  }
+
+  function api(method, path, body) {
+    var headers = {};
+    if (token()) {
+      headers.Authorization = 'Bearer ' + token();
+    }
+    if (body !== undefined) {
+      headers['Content-Type'] = 'application/json';
+      body = JSON.stringify(body);
+    }
+    return fetch(new URL(path, base), { method: method, headers: headers, body: body }).then(function (resp) {
+      return resp.json().catch(function () { return {}; }).then(function (data) {
+        if (!resp.ok) {
+          var message = data.error ? data.error.message : resp.statusText;
+          throw new Error(resp.status + ' ' + message);
+        }
+        return data;
+      });
+    });
+  }
+
+  function item(list, className, text, onclick) {
+    var li = document.createElement('li');
+    li.className = className;
+    li.textContent = text;
+    if (onclick) {
+      li.addEventListener('click', function (event) {
+        event.stopPropagation();
+        onclick(li);
+      });
+    }
+    list.appendChild(li);
+    return li;
+  }
+
+  function showPods(parent, namespace, pods) {
+    var list = document.createElement('ul');
+    if (pods.length === 0) {
+      item(list, 'error', 'no pods');
+    }
+    pods.forEach(function (pod) {
+      var li = item(list, 'pod', pod.name + ' (' + pod.phase + ')');
+      var containers = document.createElement('ul');
+      (pod.containers || []).forEach(function (c) {
+        item(containers, 'container', c.name, function () {
+          openTerminal(namespace, pod.name, c.name);
+        });
+      });
+      li.appendChild(containers);
+    });
+    parent.appendChild(list);
+  }
+
+  function loadWorkloads() {
+    var namespace = el('namespaces').value;
+    var list = el('workloads');
+    list.textContent = '';
+    if (!namespace) {
+      return;
+    }
+    api('GET', 'api/v1/workloads/' + encodeURIComponent(namespace)).then(function (workloads) {
+      if (workloads.length === 0) {
+        item(list, 'error', 'no workloads, find pods by label');
+      }
+      workloads.forEach(function (w) {
+        item(list, 'workload', w.kind + '/' + w.name + ' ' + w.ready + '/' + w.replicas, function (li) {
+          if (li.querySelector('ul')) {
+            li.removeChild(li.querySelector('ul'));
+            return;
+          }
+          var path = 'api/v1/workloads/' + encodeURIComponent(namespace) + '/' +
+            encodeURIComponent(w.kind.toLowerCase()) + '/' + encodeURIComponent(w.name) + '/pods';
+          api('GET', path).then(function (pods) {
+            showPods(li, namespace, pods);
+          }, function (err) {
+            item(li, 'error', err.message);
+          });
+        });
+      });
+    }, function (err) {
+      item(list, 'error', err.message);
+    });
+  }
+
+  function loadNamespaces() {
+    var select = el('namespaces');
+    select.textContent = '';
+    api('GET', 'api/v1/namespaces').then(function (namespaces) {
+      namespaces.forEach(function (ns) {
+        var option = document.createElement('option');
+        option.value = option.textContent = ns;
+        select.appendChild(option);
+      });
+      status('');
+      loadWorkloads();
+    }, function (err) {
+      status(err.message);
+    });
+  }
+
+  var term = new Terminal({ cursorBlink: true, convertEol: false });
+  var fit = new FitAddon.FitAddon();
+  term.loadAddon(fit);
+  term.open(el('terminal'));
+  fit.fit();
+  window.addEventListener('resize', function () { fit.fit(); });
+
+  var socket = null;
+
+  function send(message) {
+    if (socket && socket.readyState === WebSocket.OPEN) {
+      socket.send(typeof message === 'string' ? message : JSON.stringify(message));
+    }
+  }
+
+  term.onData(function (data) { send(data); });
+  term.onResize(function (size) { send({ op: 'resize', rows: size.rows, cols: size.cols }); });
+
+  function handleControl(msg) {
+    switch (msg.op) {
+      case 'capabilities':
+        send({
+          op: 'ack',
+          version: msg.version,
+          features: ['binary', 'resize', 'exit', 'heartbeats'],
+          rows: term.rows,
+          cols: term.cols
+        });
+        break;
+      case 'heartbeat':
+        send({ op: 'heartbeat', timestamp: msg.timestamp });
+        break;
+      case 'exit':
+        term.write('\r\n[process exited with code ' + msg.code + ']\r\n');
+        break;
+      case 'error':
+        term.write('\r\n[' + (msg.code || 'error') + ': ' + msg.data + ']\r\n');
+        break;
+      case 'pair_request':
+        send({
+          op: 'pair_answer',
+          requestId: msg.requestId,
+          approved: window.confirm(msg.user + ' asks for write access for ' + msg.minutes + ' minutes. Allow?')
+        });
+        break;
+    }
+  }
+
+  function openTerminal(namespace, pod, container) {
+    if (socket) {
+      socket.close();
+    }
+    term.reset();
+    el('title').textContent = namespace + '/' + pod + '/' + container;
+    api('POST', 'api/v1/terminals/presign', { namespace: namespace, pod: pod, container: container }).then(function (presigned) {
+      socket = new WebSocket(presigned.url);
+      socket.binaryType = 'arraybuffer';
+      socket.onmessage = function (event) {
+        if (event.data instanceof ArrayBuffer) {
+          term.write(new Uint8Array(event.data));
+          return;
+        }
+        var msg = null;
+        try {
+          msg = JSON.parse(event.data);
+        } catch (e) {
+          // plain output of clients without the binary feature
+        }
+        if (msg && msg.op) {
+          handleControl(msg);
+        } else {
+          term.write(event.data);
+        }
+      };
+      socket.onclose = function () {
+        el('title').textContent += ' (closed)';
+      };
+      term.focus();
+    }, function (err) {
+      term.write('[' + err.message + ']\r\n');
+    });
+  }
+
+  function websocketURL(path) {
+    var u = new URL(path, base);
+    u.protocol = u.protocol === 'https:' ? 'wss:' : 'ws:';
+    return u.href;
+  }
+
+  // websockets can't carry headers, the token goes in a subprotocol instead
+  function websocketProtocols() {
+    var protocols = ['terminal.k8s.io'];
+    if (token()) {
+      var encoded = btoa(token()).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+      protocols.push('base64url.bearer.authorization.k8s.io.' + encoded);
+    }
+    return protocols;
+  }
+
+  function loadRecordings() {
+    var list = el('recordings');
+    list.textContent = '';
+    api('GET', 'api/v1/recordings').then(function (recordings) {
+      if (!recordings || recordings.length === 0) {
+        item(list, 'error', 'no recordings');
+        return;
+      }
+      // newest first
+      recordings.slice().reverse().forEach(function (rec) {
+        var started = new Date(rec.started).toLocaleString();
+        item(list, 'recording', rec.namespace + '/' + rec.pod + ' ' + started, function () {
+          playRecording(rec);
+        });
+      });
+    }, function (err) {
+      item(list, 'error', err.message);
+    });
+  }
+
+  function playRecording(rec) {
+    if (socket) {
+      socket.close();
+    }
+    term.reset();
+    el('pause').textContent = 'Pause';
+    el('title').textContent = 'recording of ' + rec.user + ' in ' + rec.namespace + '/' + rec.pod + '/' + rec.container;
+    var path = 'api/v1/recordings/' + encodeURIComponent(rec.id) + '/play?idleLimit=2&speed=' + el('speed').value;
+    socket = new WebSocket(websocketURL(path), websocketProtocols());
+    socket.binaryType = 'arraybuffer';
+    socket.onmessage = function (event) {
+      if (event.data instanceof ArrayBuffer) {
+        term.write(new Uint8Array(event.data));
+        return;
+      }
+      var msg = JSON.parse(event.data);
+      switch (msg.op) {
+        case 'start':
+        case 'resize':
+          term.resize(msg.cols, msg.rows);
+          break;
+        case 'end':
+          term.write('\r\n[end of recording]\r\n');
+          break;
+        case 'error':
+          term.write('\r\n[' + (msg.code || 'error') + ': ' + msg.data + ']\r\n');
+          break;
+      }
+    };
+  }
+
+  el('speed').addEventListener('change', function () {
+    send({ op: 'speed', speed: Number(el('speed').value) });
+  });
+  el('pause').addEventListener('click', function () {
+    var paused = el('pause').textContent === 'Pause';
+    send({ op: paused ? 'pause' : 'resume' });
+    el('pause').textContent = paused ? 'Resume' : 'Pause';
+  });
+  el('namespaces').addEventListener('change', loadWorkloads);
+  el('selector-form').addEventListener('submit', function (event) {
+    event.preventDefault();
+    var namespace = el('namespaces').value;
+    var selector = el('selector').value.trim();
+    var list = el('workloads');
+    list.textContent = '';
+    if (!namespace || !selector) {
+      loadWorkloads();
+      return;
+    }
+    api('GET', 'api/v1/pods/' + encodeURIComponent(namespace) + '/' + encodeURIComponent(selector)).then(function (pods) {
+      showPods(list, namespace, pods);
+    }, function (err) {
+      item(list, 'error', err.message);
+    });
+  });
+  el('token-form').addEventListener('submit', function (event) {
+    event.preventDefault();
+    sessionStorage.setItem('terminal-token', el('token').value.trim());
+    el('token').value = '';
+    loadNamespaces();
+    if (config.features.recordings) {
+      loadRecordings();
+    }
+  });
+
+  if (config.auth.loginUrl) {
+    el('login').href = config.auth.loginUrl;
+    el('login').hidden = false;
+  }
+  loadNamespaces();
+  if (config.features.recordings) {
+    el('recordings-panel').hidden = false;
+    loadRecordings();
+  }
+})();
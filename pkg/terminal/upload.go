@@ -0,0 +1,286 @@
+package terminal
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	uploadDir = Flags.String("upload-dir", filepath.Join(os.TempDir(), "terminal-uploads"),
+		"directory staging uploaded files before they are copied into containers")
+	uploadMaxSize = Flags.Int64("upload-max-size", 1<<30, "maximum size of an uploaded file in bytes")
+	uploadTTL     = Flags.Duration("upload-ttl", 24*time.Hour,
+		"how long unfinished uploads and staged content are kept")
+)
+
+const jobKindExpireUpload = "upload.expire"
+
+var (
+	ErrUploadNotFound    = errors.New("upload not found")
+	ErrUploadOffset      = errors.New("upload offset does not match")
+	ErrUploadTooLarge    = errors.New("upload exceeds the maximum size")
+	ErrUploadChecksum    = errors.New("uploaded content does not match its sha256")
+	ErrUploadInvalidHash = errors.New("sha256 must be 64 hex characters")
+)
+
+var (
+	sha256Pattern   = regexp.MustCompile(`^[0-9a-f]{64}$`)
+	uploadIdPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+)
+
+// Upload is a file being uploaded in chunks and then copied into a container
+// Partial content is staged per upload, verified content is stored by its
+// sha256 so the same file is only transferred once per user
+type Upload struct {
+	ID        string    `json:"id"`
+	User      string    `json:"user"`
+	Namespace string    `json:"namespace"`
+	Pod       string    `json:"pod"`
+	Container string    `json:"container"`
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+	Offset    int64     `json:"offset"`
+	Complete  bool      `json:"complete"`
+	Created   time.Time `json:"created"`
+}
+
+var uploadLocks sync.Map
+
+// lockUpload serializes the chunks of one upload
+func lockUpload(id string) func() {
+	l, _ := uploadLocks.LoadOrStore(id, &sync.Mutex{})
+	lock := l.(*sync.Mutex)
+	lock.Lock()
+	return lock.Unlock
+}
+
+func init() {
+	RegisterJobHandler(jobKindExpireUpload, func(payload json.RawMessage) error {
+		var id string
+		if err := json.Unmarshal(payload, &id); err != nil {
+			return err
+		}
+		expireUpload(id)
+		return nil
+	})
+}
+
+func uploadFile(name string) string {
+	return filepath.Join(*uploadDir, name)
+}
+
+// contentName names the verified content of an upload. It is kept per user,
+// otherwise knowing the sha256 of a file would copy another user's content
+func contentName(u *Upload) string {
+	h := sha256.Sum256([]byte(u.User + "\n" + u.SHA256))
+	return hex.EncodeToString(h[:])
+}
+
+// CreateUpload starts an upload. If the content is already staged it is copied
+// into the container right away and the upload is returned complete
+func CreateUpload(ctx context.Context, kube *KubeClient, u Upload) (*Upload, error) {
+	if u.Size < 0 || u.Size > *uploadMaxSize {
+		return nil, ErrUploadTooLarge
+	}
+	if !sha256Pattern.MatchString(u.SHA256) {
+		return nil, ErrUploadInvalidHash
+	}
+	if err := os.MkdirAll(*uploadDir, 0700); err != nil {
+		return nil, err
+	}
+	id, err := GenTerminalSessionId()
+	if err != nil {
+		return nil, err
+	}
+	u.ID = id
+	u.Offset = 0
+	u.Complete = false
+	u.Created = time.Now()
+	if _, err := EnqueueJob(jobKindExpireUpload, id, time.Now().Add(*uploadTTL)); err != nil {
+		log.Println("CreateUpload schedule expiry err", err)
+	}
+
+	if _, err := os.Stat(uploadFile(contentName(&u))); err == nil {
+		u.Offset = u.Size
+		if err := finishUpload(ctx, kube, &u); err != nil {
+			return nil, err
+		}
+		return &u, nil
+	}
+
+	if err := ioutil.WriteFile(uploadFile(id+".part"), nil, 0600); err != nil {
+		return nil, err
+	}
+	if err := saveUpload(&u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// GetUpload returns an upload of user
+func GetUpload(id string, user string) (*Upload, error) {
+	u, err := loadUpload(id)
+	if err != nil {
+		return nil, err
+	}
+	if u.User != user {
+		return nil, ErrUploadNotFound
+	}
+	return u, nil
+}
+
+// AppendUpload adds a chunk at offset, the upload is verified and copied into
+// the container once all bytes arrived
+func AppendUpload(ctx context.Context, kube *KubeClient, id string, user string, offset int64, chunk io.Reader) (*Upload, error) {
+	unlock := lockUpload(id)
+	defer unlock()
+
+	u, err := GetUpload(id, user)
+	if err != nil {
+		return nil, err
+	}
+	if u.Complete {
+		return u, nil
+	}
+	if offset != u.Offset {
+		return u, ErrUploadOffset
+	}
+
+	f, err := os.OpenFile(uploadFile(id+".part"), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	n, err := io.Copy(f, io.LimitReader(chunk, u.Size-u.Offset))
+	f.Close()
+	u.Offset += n
+	if serr := saveUpload(u); serr != nil {
+		return nil, serr
+	}
+	if err != nil {
+		// the client resumes from the offset that was stored
+		return u, err
+	}
+	if u.Offset < u.Size {
+		return u, nil
+	}
+
+	// a previous attempt may have verified the content but failed to copy it
+	if _, err := os.Stat(uploadFile(contentName(u))); os.IsNotExist(err) {
+		if err := verifyUpload(u); err != nil {
+			return u, err
+		}
+	}
+	return u, finishUpload(ctx, kube, u)
+}
+
+// verifyUpload checks the sha256 of the staged content and moves it to the
+// content addressed store. On mismatch the upload starts over
+func verifyUpload(u *Upload) error {
+	part := uploadFile(u.ID + ".part")
+	f, err := os.Open(part)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != u.SHA256 {
+		u.Offset = 0
+		ioutil.WriteFile(part, nil, 0600)
+		saveUpload(u)
+		return ErrUploadChecksum
+	}
+	if err := os.Rename(part, uploadFile(contentName(u))); err != nil {
+		return err
+	}
+	// keep the content around for further uploads of the same file
+	_, err = EnqueueJob(jobKindExpireUpload, contentName(u), time.Now().Add(*uploadTTL))
+	return err
+}
+
+// finishUpload copies verified content into the container
+func finishUpload(ctx context.Context, kube *KubeClient, u *Upload) error {
+	// checked again, the flags may have changed since the upload started
+	if err := admitWithoutTerminal(u.Namespace); err != nil {
+		return err
+	}
+	content, err := os.Open(uploadFile(contentName(u)))
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	var stderr bytes.Buffer
+	cmd := []string{"sh", "-c", `cat > "$0"`, u.Path}
+	err = execBackendOf(kube).ExecCommand(ctx, u.Container, u.Pod, u.Namespace, cmd, content, nil, &stderr)
+	if err == ErrClusterUnavailable {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("copy into container: %v %s", err, stderr.String())
+	}
+	log.Printf("upload %s: copied %d bytes to %s/%s:%s", u.ID, u.Size, u.Namespace, u.Pod, u.Path)
+	audit(AuditEvent{
+		Type:      "file.upload",
+		User:      u.User,
+		Namespace: u.Namespace,
+		Pod:       u.Pod,
+		Container: u.Container,
+		Details:   map[string]string{"path": u.Path, "sha256": u.SHA256, "size": strconv.FormatInt(u.Size, 10)},
+	})
+
+	u.Complete = true
+	return saveUpload(u)
+}
+
+// expireUpload removes the staged data of an upload or a content hash
+func expireUpload(name string) {
+	os.Remove(uploadFile(name + ".part"))
+	os.Remove(uploadFile(name + ".json"))
+	if sha256Pattern.MatchString(name) {
+		os.Remove(uploadFile(name))
+	}
+	uploadLocks.Delete(name)
+}
+
+func saveUpload(u *Upload) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(uploadFile(u.ID+".json"), data, 0600)
+}
+
+func loadUpload(id string) (*Upload, error) {
+	if !uploadIdPattern.MatchString(id) {
+		return nil, ErrUploadNotFound
+	}
+	data, err := ioutil.ReadFile(uploadFile(id + ".json"))
+	if os.IsNotExist(err) {
+		return nil, ErrUploadNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var u Upload
+	if err := json.Unmarshal(data, &u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
@@ -0,0 +1,48 @@
+package terminal
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// VersionInfo is served at /version, so UIs and operators can tell which
+// server they talk to and gate functionality on its features
+type VersionInfo struct {
+	Version          string          `json:"version"`
+	Commit           string          `json:"commit"`
+	BuildDate        string          `json:"buildDate,omitempty"`
+	GoVersion        string          `json:"goVersion"`
+	Platform         string          `json:"platform"`
+	ProtocolVersions []int           `json:"protocolVersions"`
+	Features         map[string]bool `json:"features"`
+}
+
+// GetVersion describes the build of the server. version, commit and
+// buildDate come from the linker flags of the build, the commit falls back to
+// the VCS revision Go stamped into the binary
+func GetVersion(version string, commit string, buildDate string) VersionInfo {
+	if version == "" {
+		version = "dev"
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && commit == "" {
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				commit = setting.Value
+			case "vcs.modified":
+				if setting.Value == "true" {
+					commit += "-dirty"
+				}
+			}
+		}
+	}
+	return VersionInfo{
+		Version:          version,
+		Commit:           commit,
+		BuildDate:        buildDate,
+		GoVersion:        runtime.Version(),
+		Platform:         runtime.GOOS + "/" + runtime.GOARCH,
+		ProtocolVersions: []int{ProtocolVersion},
+		Features:         serverFeatures(),
+	}
+}
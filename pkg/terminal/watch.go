@@ -0,0 +1,93 @@
+package terminal
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// PodEvent is a change of a pod pushed to the pod picker
+type PodEvent struct {
+	Type  string `json:"type"`
+	Pod   string `json:"pod"`
+	Phase string `json:"phase"`
+	Ready bool   `json:"ready"`
+}
+
+// WatchPods sends the events of the pods in namespace matching the label
+// selector until ctx is done. Existing pods are reported as ADDED first
+func (k *KubeClient) WatchPods(ctx context.Context, namespace string, labels string,
+	events chan<- PodEvent) error {
+
+	if err := validatePodQuery(namespace, labels); err != nil {
+		return err
+	}
+	clientset, err := k.Clientset()
+	if err != nil {
+		return err
+	}
+	resourceVersion := ""
+	for {
+		w, err := clientset.CoreV1().Pods(namespace).Watch(ctx, metav1.ListOptions{
+			LabelSelector:   labels,
+			ResourceVersion: resourceVersion,
+		})
+		if err != nil {
+			return err
+		}
+
+		restart, err := forwardPodEvents(w, ctx.Done(), events, &resourceVersion)
+		w.Stop()
+		if !restart {
+			return err
+		}
+		// the API server closes watches after a timeout, resume where we left off
+		log.Printf("WatchPods %s restarting watch at %s", namespace, resourceVersion)
+	}
+}
+
+func forwardPodEvents(w watch.Interface, stop <-chan struct{}, events chan<- PodEvent,
+	resourceVersion *string) (bool, error) {
+
+	for {
+		select {
+		case <-stop:
+			return false, nil
+		case ev, ok := <-w.ResultChan():
+			if !ok {
+				return true, nil
+			}
+			if ev.Type == watch.Error {
+				return false, fmt.Errorf("watch failed: %v", ev.Object)
+			}
+			pod, ok := ev.Object.(*v1.Pod)
+			if !ok {
+				continue
+			}
+			*resourceVersion = pod.ResourceVersion
+			select {
+			case events <- PodEvent{
+				Type:  string(ev.Type),
+				Pod:   pod.Name,
+				Phase: string(pod.Status.Phase),
+				Ready: isPodReady(pod),
+			}:
+			case <-stop:
+				return false, nil
+			}
+		}
+	}
+}
+
+func isPodReady(pod *v1.Pod) bool {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == v1.PodReady {
+			return cond.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package terminal
+
+import (
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"text/template"
+)
+
+var uiEnabled = Flags.Bool("ui", true, "serve the web UI on /ui")
+
+// uiFiles is the web UI, it loads xterm.js from its CDN and talks to the API
+// of the server it was served by
+//
+//go:embed ui
+var uiFiles embed.FS
+
+// uiPolicy lets the UI load xterm.js and open websockets to any host, the
+// presigned URLs name the host the browser reached
+const uiPolicy = "default-src 'self'; script-src 'self' https://cdn.jsdelivr.net; " +
+	"style-src 'self' https://cdn.jsdelivr.net; connect-src 'self' ws: wss:; frame-ancestors 'none'"
+
+// UIConfig is the runtime configuration of the web UI, served as
+// /ui/config.js so the same assets run behind any base path and auth setup
+type UIConfig struct {
+	// BasePath is -base-path, the API is below it
+	BasePath string       `json:"basePath"`
+	Auth     UIAuthConfig `json:"auth"`
+	// Features are the optional features of discovery, like recordings
+	Features map[string]bool `json:"features"`
+	Version  string          `json:"version"`
+}
+
+// UIAuthConfig tells the UI how users get a token
+type UIAuthConfig struct {
+	// Methods are the enabled authenticators, see -auth
+	Methods []string `json:"methods"`
+	// LoginURL starts the OIDC login, empty if it is disabled
+	LoginURL string `json:"loginUrl,omitempty"`
+}
+
+// uiConfigTemplate renders UIConfig as script, the JSON is escaped for it
+var uiConfigTemplate = template.Must(template.New("config.js").Parse(
+	"// runtime configuration of the terminal server\nwindow.terminalConfig = {{.}};\n"))
+
+// GetUIConfig returns the configuration of the UI served below basePath
+func GetUIConfig(basePath string, version string) UIConfig {
+	config := UIConfig{
+		BasePath: basePath,
+		Auth:     UIAuthConfig{Methods: splitList(*authChain)},
+		Features: serverFeatures(),
+		Version:  version,
+	}
+	if OIDCEnabled() {
+		config.Auth.LoginURL = basePath + "/auth/login"
+	}
+	return config
+}
+
+// renderUIConfig writes config as the script /ui/config.js
+func renderUIConfig(w http.ResponseWriter, config UIConfig) error {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Security-Policy", uiPolicy)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	return uiConfigTemplate.Execute(w, string(data))
+}
+
+// UIHandler serves the web UI below /ui/
+func UIHandler() http.Handler {
+	files, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		panic(err)
+	}
+	server := http.StripPrefix("/ui/", http.FileServer(http.FS(files)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", uiPolicy)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		server.ServeHTTP(w, r)
+	})
+}
+
+// UIRedirectHandler sends /ui to /ui/, relative to keep the base path
+func UIRedirectHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Location", "ui/")
+	w.WriteHeader(http.StatusMovedPermanently)
+}
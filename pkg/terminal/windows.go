@@ -0,0 +1,124 @@
+package terminal
+
+import (
+	"errors"
+	"log"
+	"path"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// OSWindows is the SessionMeta.OS of shells in Windows containers
+const OSWindows = "windows"
+
+// osLabel is the node label pods select their OS with
+const osLabel = "kubernetes.io/os"
+
+// windowsShells are tried in Windows containers, nanoserver images only
+// have cmd.exe
+var windowsShells = []string{"powershell.exe", "cmd.exe"}
+
+// ErrSafeModeWindows is returned for safe mode sessions in Windows
+// containers, which have no restricted shell
+var ErrSafeModeWindows = errors.New("safe mode is not available in Windows containers")
+
+// podOS returns the OS of a pod from spec.os or else its node selector, ""
+// if it doesn't tell, which is linux
+func podOS(p *v1.Pod) string {
+	if p.Spec.OS != nil && p.Spec.OS.Name != "" {
+		return string(p.Spec.OS.Name)
+	}
+	return p.Spec.NodeSelector[osLabel]
+}
+
+// detectOS records the OS of the session's pod and tells clients that agreed
+// on FeaturePlatform with {"op":"platform","data":"windows"}, so terminals
+// like xterm.js can handle the reflow of the Windows console
+func (t *TerminalSession) detectOS() {
+	if DockerBackend() {
+		return
+	}
+	p, err := t.kube.getPod(t.ctx, t.meta.Namespace, t.currentPod())
+	if err != nil {
+		log.Printf("session %s: OS detection err %v", t.id, err)
+		return
+	}
+	os := podOS(p)
+	if os != OSWindows {
+		return
+	}
+	t.clientsLock.Lock()
+	t.meta.OS = os
+	t.clientsLock.Unlock()
+	registerSession(t.info())
+	for _, c := range t.attachedClients() {
+		if c.has(FeaturePlatform) {
+			c.writeJSON(TerminalMessage{Op: "platform", Data: os})
+		}
+	}
+}
+
+func (t *TerminalSession) windows() bool {
+	return t.meta.OS == OSWindows
+}
+
+// windowsDefaultShells returns the shells to try in a Windows container, a
+// configured shell first
+func windowsDefaultShells(shell string) []string {
+	if shell == "" || len(strings.Fields(shell)) != 1 {
+		return windowsShells
+	}
+	shells := []string{shell}
+	for _, fallback := range windowsShells {
+		if !strings.EqualFold(fallback, shell) {
+			shells = append(shells, fallback)
+		}
+	}
+	return shells
+}
+
+// windowsEnvCommand sets env for a Windows shell, which has no env(1).
+// PowerShell gets them as $env: assignments, cmd.exe as set commands, which
+// can't quote " and %, so such values are dropped
+func windowsEnvCommand(env map[string]string, shell string) []string {
+	if len(env) == 0 {
+		return []string{shell}
+	}
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var commands []string
+	if strings.EqualFold(path.Base(strings.ReplaceAll(shell, `\`, "/")), "cmd.exe") {
+		for _, name := range names {
+			if strings.ContainsAny(env[name], `"%`) {
+				log.Printf("dropping env %s, cmd.exe can't quote its value", name)
+				continue
+			}
+			commands = append(commands, `set "`+name+"="+env[name]+`"`)
+		}
+		if len(commands) == 0 {
+			return []string{shell}
+		}
+		return []string{shell, "/k", strings.Join(commands, "&")}
+	}
+	for _, name := range names {
+		commands = append(commands, "$env:"+name+"='"+strings.ReplaceAll(env[name], "'", "''")+"'")
+	}
+	return []string{shell, "-NoLogo", "-NoExit", "-Command", strings.Join(commands, "; ")}
+}
+
+// resendSize queues the last terminal size again once the shell of a Windows
+// container started, its console ignores the size set before
+func (t *TerminalSession) resendSize() {
+	t.sizeLock.Lock()
+	size := t.lastSize
+	t.sizeLock.Unlock()
+	if size != (remotecommand.TerminalSize{}) {
+		t.resize(size.Height, size.Width)
+	}
+}
@@ -0,0 +1,164 @@
+package terminal
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// WorkloadInfo is a controller whose pods users may open terminals into
+type WorkloadInfo struct {
+	Kind     string `json:"kind"`
+	Name     string `json:"name"`
+	Replicas int32  `json:"replicas"`
+	Ready    int32  `json:"ready"`
+}
+
+// ErrUnknownWorkloadKind is returned for kinds other than deployment,
+// statefulset, daemonset and job
+var ErrUnknownWorkloadKind = errors.New("kind must be one of deployment, statefulset, daemonset or job")
+
+// ListWorkloads returns the deployments, statefulsets, daemonsets and jobs of a namespace
+func (k *KubeClient) ListWorkloads(ctx context.Context, namespace string) ([]WorkloadInfo, error) {
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+	clientset, err := k.Clientset()
+	if err != nil {
+		return nil, err
+	}
+	var workloads []WorkloadInfo
+
+	deployments, err := clientset.AppsV1().Deployments(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range deployments.Items {
+		workloads = append(workloads, WorkloadInfo{"deployment", d.Name, d.Status.Replicas, d.Status.ReadyReplicas})
+	}
+
+	statefulSets, err := clientset.AppsV1().StatefulSets(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range statefulSets.Items {
+		workloads = append(workloads, WorkloadInfo{"statefulset", s.Name, s.Status.Replicas, s.Status.ReadyReplicas})
+	}
+
+	daemonSets, err := clientset.AppsV1().DaemonSets(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range daemonSets.Items {
+		workloads = append(workloads, WorkloadInfo{"daemonset", d.Name, d.Status.DesiredNumberScheduled, d.Status.NumberReady})
+	}
+
+	jobs, err := clientset.BatchV1().Jobs(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, j := range jobs.Items {
+		workloads = append(workloads, WorkloadInfo{"job", j.Name, j.Status.Active, j.Status.Active})
+	}
+
+	sort.Slice(workloads, func(i, j int) bool {
+		if workloads[i].Kind != workloads[j].Kind {
+			return workloads[i].Kind < workloads[j].Kind
+		}
+		return workloads[i].Name < workloads[j].Name
+	})
+	return workloads, nil
+}
+
+// GetWorkloadPods resolves a workload to its pods by following owner references
+// Deployments own their pods through replicasets
+func (k *KubeClient) GetWorkloadPods(ctx context.Context, namespace string, kind string, name string) ([]PodInfo, error) {
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+	clientset, err := k.Clientset()
+	if err != nil {
+		return nil, err
+	}
+	owners := make(map[types.UID]bool)
+	var selector *metav1.LabelSelector
+
+	switch strings.TrimSuffix(strings.ToLower(kind), "s") {
+	case "deployment":
+		d, err := clientset.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		selector = d.Spec.Selector
+		replicaSets, err := clientset.AppsV1().ReplicaSets(namespace).List(ctx, listOptionsFor(selector))
+		if err != nil {
+			return nil, err
+		}
+		for _, rs := range replicaSets.Items {
+			if isOwnedBy(rs.OwnerReferences, d.UID) {
+				owners[rs.UID] = true
+			}
+		}
+	case "statefulset":
+		s, err := clientset.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		selector = s.Spec.Selector
+		owners[s.UID] = true
+	case "daemonset":
+		d, err := clientset.AppsV1().DaemonSets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		selector = d.Spec.Selector
+		owners[d.UID] = true
+	case "job":
+		j, err := clientset.BatchV1().Jobs(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		selector = j.Spec.Selector
+		owners[j.UID] = true
+	default:
+		return nil, ErrUnknownWorkloadKind
+	}
+
+	pods, err := k.listPods(ctx, namespace, listOptionsFor(selector).LabelSelector)
+	if err != nil {
+		return nil, err
+	}
+	podInfos := []PodInfo{}
+	for _, pod := range pods {
+		for _, ref := range pod.OwnerReferences {
+			if owners[ref.UID] {
+				podInfos = append(podInfos, newPodInfo(pod))
+				break
+			}
+		}
+	}
+	return podInfos, nil
+}
+
+// listOptionsFor narrows a list to the objects matched by a workload selector
+func listOptionsFor(selector *metav1.LabelSelector) metav1.ListOptions {
+	if selector == nil {
+		return metav1.ListOptions{}
+	}
+	s, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return metav1.ListOptions{}
+	}
+	return metav1.ListOptions{LabelSelector: s.String()}
+}
+
+func isOwnedBy(refs []metav1.OwnerReference, uid types.UID) bool {
+	for _, ref := range refs {
+		if ref.UID == uid {
+			return true
+		}
+	}
+	return false
+}
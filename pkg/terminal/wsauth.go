@@ -0,0 +1,107 @@
+package terminal
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	allowQueryToken = Flags.Bool("allow-query-token", true,
+		"accept the jwtToken query parameter, tokens in URLs end up in proxy logs and browser history")
+	authMessage = Flags.Bool("websocket-auth-message", true,
+		`let websockets without credentials send {"op":"auth","token":"..."} as first message`)
+)
+
+// authMessageTimeout bounds how long a websocket without credentials is held
+// open until its auth message arrives
+const authMessageTimeout = 5 * time.Second
+
+// authMessageRoute matches the websockets that may send an auth message, the
+// terminal, join, support and mux websockets whose handlers reuse the upgraded
+// connection
+var authMessageRoute = regexp.MustCompile(`^/api/v1/(terminals/[^/]+/[^/]+(/[^/]+)?|sessions/[^/]+/(join|support)|mux/[^/]+/[^/]+)$`)
+
+// ErrQueryTokenDisabled is returned for tokens in the URL with -allow-query-token=false
+var ErrQueryTokenDisabled = errors.New("tokens in the URL are not accepted, " +
+	"use the Authorization header, the websocket subprotocol or an auth message")
+
+// authenticateMessage upgrades a websocket that came without credentials and
+// authenticates the token of its first message. Handlers then get a writer
+// that sends their HTTP errors as error messages over the websocket, and
+// CreateSession and JoinSession reuse the connection
+func authenticateMessage(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *MyCustomClaims, error) {
+	conn, err := upgradeWebsocket(w, r)
+	if err != nil {
+		// the upgrader answered the request already
+		return nil, nil, err
+	}
+	aw := &authMessageWriter{conn: conn, header: http.Header{}}
+
+	conn.SetReadDeadline(time.Now().Add(authMessageTimeout))
+	var msg TerminalMessage
+	err = conn.ReadJSON(&msg)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil || msg.Op != "auth" || msg.Token == "" {
+		return aw, nil, ErrNoCredentials
+	}
+	_, span := StartSpan(r.Context(), "jwt.validate")
+	claims, err := ParseJwtToken(msg.Token)
+	EndSpan(span, err)
+	return aw, claims, err
+}
+
+// authMessageWriter stands in for the ResponseWriter of a request whose
+// websocket was upgraded to read an auth message
+type authMessageWriter struct {
+	conn   *websocket.Conn
+	header http.Header
+	status int
+	closed bool
+}
+
+func (aw *authMessageWriter) Header() http.Header {
+	return aw.header
+}
+
+func (aw *authMessageWriter) WriteHeader(status int) {
+	if aw.status == 0 {
+		aw.status = status
+	}
+}
+
+// Write sends the body of an error as error message and closes the websocket,
+// the code and message of an error envelope are passed on
+func (aw *authMessageWriter) Write(body []byte) (int, error) {
+	if aw.closed {
+		return len(body), nil
+	}
+	aw.closed = true
+	if aw.status == 0 {
+		aw.status = http.StatusOK
+	}
+	code, message := StatusErrorCode(aw.status), strings.TrimSpace(string(body))
+	var envelope APIError
+	if json.Unmarshal(body, &envelope) == nil && envelope.Error.Code != "" {
+		code, message = envelope.Error.Code, envelope.Error.Message
+	}
+	closeWithError(aw.conn, code, message)
+	return len(body), nil
+}
+
+// upgrade returns the websocket of r, which may have been upgraded already
+// to read an auth message
+func upgrade(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
+	if aw, ok := w.(*authMessageWriter); ok {
+		if aw.closed {
+			return nil, errors.New("websocket was closed")
+		}
+		return aw.conn, nil
+	}
+	return upgradeWebsocket(w, r)
+}
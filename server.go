@@ -1,77 +1,191 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
 
-	"github.com/gorilla/mux"
-	"github.com/gorilla/websocket"
-	"github.com/urfave/negroni"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
-	"./lib"
+	"./pkg/terminal"
 )
 
-func AuthMiddleware(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-	fmt.Println("auth middleware")
-	next(rw, r)
-}
+var (
+	listenAddr = flag.String("addr", ":8000", "address the server listens on")
+	basePath   = flag.String("base-path", "",
+		"path prefix all routes are served under, like /terminal behind ingress path routing")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second,
+		"how long sessions and requests may take to finish on SIGTERM")
+	kubeconfig = kubeconfigFlag()
 
-func HomeHandler(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintln(w, "Hello! This is terminal server.")
-}
+	tlsOptions terminal.TLSOptions
 
-func GetPodHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	label := vars["label"]
-	namespace := vars["namespace"]
-	pods, _ := lib.GetPodListByLable(namespace, label)
+	// set with -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=..."
+	version   string
+	commit    string
+	buildDate string
+)
+
+func init() {
+	flag.StringVar(&tlsOptions.CertFile, "tls-cert", "", "default TLS certificate file")
+	flag.StringVar(&tlsOptions.KeyFile, "tls-key", "", "default TLS private key file")
+	flag.StringVar(&tlsOptions.SNICerts, "tls-sni-certs", "",
+		"comma separated hostname:certFile:keyFile entries selected by SNI")
+	flag.StringVar(&tlsOptions.ACMEHosts, "acme-hosts", "",
+		"comma separated hostnames served with automatic Let's Encrypt certificates")
+	flag.StringVar(&tlsOptions.ACMECacheDir, "acme-cache-dir", "", "directory caching ACME certificates")
+}
 
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintln(w, pods)
+func homeDir() string {
+	if h := os.Getenv("HOME"); h != "" {
+		return h
+	}
+	return os.Getenv("USERPROFILE") // windows
 }
 
-func checkJwtToken(token string) bool {
-	return lib.IsVaildJwtToken(token)
+func kubeconfigFlag() *string {
+	if home := homeDir(); home != "" {
+		return flag.String("kubeconfig", filepath.Join(home, ".kube", "config"),
+			"(optional) absolute path to the kubeconfig file")
+	}
+	return flag.String("kubeconfig", "", "absolute path to the kubeconfig file")
 }
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	}}
-
-func TerminalHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	pod := vars["pod"]
-	container := vars["container"]
-	namespace := vars["namespace"]
-	jwtToken := vars["jwtToken"]
-	log.Printf("TerminalHandler namespace=%s, pod=%s, container=%s", namespace, pod, container)
-
-	if checkJwtToken(jwtToken) {
-		sessionId, err := lib.CreateSession(w, r)
-		log.Printf("start terminal: %s\n", sessionId)
-		if err == nil {
-			go lib.ExecTerminal(container, pod, namespace, sessionId)
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "connect" {
+		status, err := terminal.RunClient(os.Args[2:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
+		os.Exit(status)
+	}
+	terminal.AddFlags(flag.CommandLine)
+	flag.Parse()
+
+	kube := terminal.NewKubeClient(*kubeconfig)
+	handler := terminal.NewRouter(terminal.Config{
+		PathPrefix: *basePath,
+		Version:    version,
+		Commit:     commit,
+		BuildDate:  buildDate,
+	}, terminal.Dependencies{Kube: kube, Metrics: promhttp.Handler()})
+
+	shutdownTracing, err := terminal.StartTracing()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer shutdownTracing()
+	stopMetrics, err := terminal.StartMetrics()
+	if err != nil {
+		log.Fatal("metrics: ", err)
+	}
+	defer stopMetrics()
+
+	if err := terminal.SetupAuth(); err != nil {
+		log.Fatal("auth: ", err)
+	}
+	if err := terminal.SetupProxies(); err != nil {
+		log.Fatal("trusted proxies: ", err)
+	}
+	if err := terminal.SetupRouting(); err != nil {
+		log.Fatal("routing: ", err)
+	}
+	if err := terminal.SetupExecBackend(); err != nil {
+		log.Fatal("exec backend: ", err)
+	}
+	// docker containers don't need a cluster
+	if !terminal.DockerBackend() {
+		kube.Start()
+		terminal.StartPinSweep(kube)
+	}
+	if err := terminal.StartJWTKeys(kube); err != nil {
+		log.Fatal("JWT keys: ", err)
+	}
+	if err := terminal.LoadCommandPolicy(); err != nil {
+		log.Fatal("command policy: ", err)
+	}
+	if err := terminal.LoadDLPConfig(); err != nil {
+		log.Fatal("DLP config: ", err)
+	}
+	if err := terminal.ValidateAccessLog(); err != nil {
+		log.Fatal(err)
+	}
+	if err := terminal.ValidateSafeMode(); err != nil {
+		log.Fatal("safe mode: ", err)
+	}
+	if err := terminal.StartNotifications(); err != nil {
+		log.Fatal("notifications: ", err)
+	}
+	if err := terminal.StartAudit(); err != nil {
+		log.Fatal("audit: ", err)
+	}
+	if err := terminal.StartRecordings(); err != nil {
+		log.Fatal("recordings: ", err)
+	}
+	terminal.StartJobQueue()
+	if err := terminal.StartStandby(kube); err != nil {
+		log.Fatal("standby: ", err)
+	}
+	terminal.StartRegistry()
+
+	server := &http.Server{Addr: *listenAddr, Handler: handler}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		shutdownOnSignal(server)
+	}()
+
+	if tlsOptions.Enabled() {
+		server.TLSConfig, err = terminal.NewTLSConfig(tlsOptions)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	stopGRPC, err := terminal.StartGRPC(kube, server.TLSConfig)
+	if err != nil {
+		log.Fatal("grpc: ", err)
+	}
+	defer stopGRPC()
+	stopSSH, err := terminal.StartSSH(kube)
+	if err != nil {
+		log.Fatal("ssh: ", err)
+	}
+	defer stopSSH()
+
+	if tlsOptions.Enabled() {
+		log.Println("Start TLS server on", *listenAddr)
+		err = server.ListenAndServeTLS("", "")
 	} else {
-		log.Println("token is invaild or expired")
+		log.Println("Start server on", *listenAddr)
+		err = server.ListenAndServe()
 	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
 }
 
-func main() {
-	router := mux.NewRouter()
-	router.HandleFunc("/", HomeHandler).Methods("GET")
-	router.HandleFunc("/api/v1/pods/{namespace}/{label}", GetPodHandler).Methods("GET")
-	router.HandleFunc("/api/v1/terminals/{namespace}/{pod}/{container}", TerminalHandler).
-		Queries("jwtToken", "{jwtToken}")
-
-	//n := negroni.Classic()
-	n := negroni.New()
-	n.Use(negroni.HandlerFunc(AuthMiddleware))
-	n.UseHandler(router)
-
-	log.Println("Start server on 8000")
-	log.Fatal(http.ListenAndServe(":8000", n))
+// shutdownOnSignal ends the terminal sessions and stops the server on SIGINT or SIGTERM
+// Websockets are hijacked connections the http.Server doesn't track, so the
+// sessions are cancelled explicitly
+func shutdownOnSignal(server *http.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	log.Println("shutting down")
+
+	terminal.Sessions.Close("The terminal server is shutting down", *shutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("shutdown err", err)
+	}
 }